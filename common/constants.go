@@ -84,6 +84,28 @@ var PreConsumedQuota = 500
 var ApproximateTokenEnabled = false
 var RetryTimes = 0
 
+var StreamHeartbeatInterval = 0 // unit is second, 0 means no heartbeat
+var StreamFirstTokenTimeout = 0 // unit is second, 0 means no timeout
+
+// ChannelHealthRedisEnabled shares the health of the channels between the
+// nodes through Redis
+var ChannelHealthRedisEnabled = false
+var ChannelHealthSyncFrequency = GetOrDefault("CHANNEL_HEALTH_SYNC_FREQUENCY", 5) // unit is second
+
+var CircuitBreakerThreshold = 0     // consecutive failures that open the circuit of a channel, 0 means no circuit breaker
+var CircuitBreakerCooldown = 60     // unit is second
+var CircuitBreakerProbeRequests = 1 // requests let through at a time once the cooldown is over
+
+var ChannelRateLimitCooldown = 30 // unit is second, for upstreams that do not say when a 429 ends
+
+var ResponseCacheEnabled = false
+var ResponseCacheTTL = 3600 // unit is second
+var ResponseCacheHitRatio = 0.0
+var ResponseCacheMemoryLimit = GetOrDefault("RESPONSE_CACHE_MEMORY_LIMIT", 64) // unit is MB, for the response cache without Redis
+
+var TranscriptMaxSize = 64 * 1024 // unit is byte, for each of the request and the response
+var TranscriptRetentionDays = 7
+
 var RootUserEmail = ""
 
 var IsMasterNode = os.Getenv("NODE_TYPE") != "slave"
@@ -96,13 +118,16 @@ var SyncFrequency = GetOrDefault("SYNC_FREQUENCY", 10*60) // unit is second
 var BatchUpdateEnabled = false
 var BatchUpdateInterval = GetOrDefault("BATCH_UPDATE_INTERVAL", 5)
 
-var RelayTimeout = GetOrDefault("RELAY_TIMEOUT", 0) // unit is second
+var RelayTimeout = GetOrDefault("RELAY_TIMEOUT", 0) // unit is second, for the response header to arrive
+
+var GeminiSafetySetting = GetOrDefaultString("GEMINI_SAFETY_SETTING", "BLOCK_NONE")
 
 var AsyncWriteConsumeLogEnable = os.Getenv("ASYNC_WRITE_CONSUME_LOG_ENABLE") == "true"
 var AsyncWriteConsumeLogFrequency = GetOrDefault("ASYNC_WRITE_CONSUME_LOG_FREQUENCY", 1)
 
 const (
-	RequestIdKey = "X-Oneapi-Request-Id"
+	RequestIdKey   = "X-Oneapi-Request-Id"
+	KeyRequestBody = "key_request_body"
 )
 
 const (
@@ -165,6 +190,14 @@ const (
 	ChannelStatusAutoDisabled     = 3
 )
 
+// strategies choosing among the keys of a channel with several keys, the
+// channel has a single key if it has no strategy
+const (
+	ChannelKeyStrategyRoundRobin           = "round_robin"
+	ChannelKeyStrategyRandom               = "random"
+	ChannelKeyStrategyLeastRecentlyErrored = "least_recently_errored"
+)
+
 const (
 	ChannelTypeUnknown        = 0
 	ChannelTypeOpenAI         = 1
@@ -190,6 +223,8 @@ const (
 	ChannelTypeAIProxyLibrary = 21
 	ChannelTypeFastGPT        = 22
 	ChannelTypeTencent        = 23
+	ChannelTypeGemini         = 24
+	ChannelTypeOllama         = 25
 )
 
 var ChannelBaseURLs = []string{
@@ -217,4 +252,6 @@ var ChannelBaseURLs = []string{
 	"https://api.aiproxy.io",            // 21
 	"https://fastgpt.run/api/openapi",   // 22
 	"https://hunyuan.cloud.tencent.com", //23
+	"https://generativelanguage.googleapis.com", //24
+	"http://localhost:11434",                    //25
 }
@@ -3,26 +3,56 @@ package common
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"github.com/gin-gonic/gin"
 	"io"
 	"strings"
 )
 
-func UnmarshalBodyReusable(c *gin.Context, v any) error {
+// GetRequestBody reads the request body once and keeps it in the context,
+// so that it can be replayed when the request is relayed again.
+func GetRequestBody(c *gin.Context) ([]byte, error) {
+	if requestBody, ok := c.Get(KeyRequestBody); ok {
+		return requestBody.([]byte), nil
+	}
 	requestBody, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		return nil, err
+	}
+	_ = c.Request.Body.Close()
+	c.Set(KeyRequestBody, requestBody)
+	return requestBody, nil
+}
+
+// unmarshalMultipartFields decodes the text fields of a form into v, form values
+// are strings, so fields of other types are left for the caller to parse.
+func unmarshalMultipartFields(body []byte, contentType string, v any) error {
+	fields, err := ParseMultipartFormFields(body, contentType)
 	if err != nil {
 		return err
 	}
-	err = c.Request.Body.Close()
+	jsonFields, err := json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+	err = json.Unmarshal(jsonFields, v)
+	var typeError *json.UnmarshalTypeError
+	if errors.As(err, &typeError) {
+		return nil
+	}
+	return err
+}
+
+func UnmarshalBodyReusable(c *gin.Context, v any) error {
+	requestBody, err := GetRequestBody(c)
 	if err != nil {
 		return err
 	}
 	contentType := c.Request.Header.Get("Content-Type")
 	if strings.HasPrefix(contentType, "application/json") {
 		err = json.Unmarshal(requestBody, &v)
-	} else {
-		// skip for now
-		// TODO: someday non json request have variant model, we will need to implementation this
+	} else if strings.HasPrefix(contentType, "multipart/form-data") {
+		err = unmarshalMultipartFields(requestBody, contentType, v)
 	}
 	if err != nil {
 		return err
@@ -0,0 +1,49 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+const (
+	RoutingStrategyPriority = "priority" // the channels of the top priority, chosen by weight
+	RoutingStrategyHealth   = "health"   // all channels, chosen by weight and health score
+	// the channels of the top priority, the same one for a session as long as it
+	// is available, so that the upstream caches the prompts of the session
+	RoutingStrategySticky = "sticky"
+)
+
+// GroupRoutingStrategy maps a group to the strategy its channels are chosen by,
+// groups not listed use RoutingStrategyPriority
+var GroupRoutingStrategy = map[string]string{}
+
+func GroupRoutingStrategy2JSONString() string {
+	jsonBytes, err := json.Marshal(GroupRoutingStrategy)
+	if err != nil {
+		SysError("error marshalling group routing strategy: " + err.Error())
+	}
+	return string(jsonBytes)
+}
+
+func UpdateGroupRoutingStrategyByJSONString(jsonStr string) error {
+	strategies := make(map[string]string)
+	err := json.Unmarshal([]byte(jsonStr), &strategies)
+	if err != nil {
+		return err
+	}
+	for group, strategy := range strategies {
+		if strategy != RoutingStrategyPriority && strategy != RoutingStrategyHealth && strategy != RoutingStrategySticky {
+			return fmt.Errorf("unknown routing strategy of group %s: %s", group, strategy)
+		}
+	}
+	GroupRoutingStrategy = strategies
+	return nil
+}
+
+func GetGroupRoutingStrategy(group string) string {
+	strategy, ok := GroupRoutingStrategy[group]
+	if !ok {
+		return RoutingStrategyPriority
+	}
+	return strategy
+}
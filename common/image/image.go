@@ -1,13 +1,19 @@
 package image
 
 import (
+	"encoding/base64"
+	"errors"
 	"image"
 	_ "image/gif"
 	_ "image/jpeg"
 	_ "image/png"
+	"io"
+	"net"
 	"net/http"
 	"regexp"
 	"strings"
+	"syscall"
+	"time"
 
 	_ "golang.org/x/image/webp"
 )
@@ -45,3 +51,65 @@ func GetImageSize(image string) (width int, height int, err error) {
 	}
 	return GetImageSizeFromUrl(image)
 }
+
+var (
+	dataURLReg = regexp.MustCompile(`^data:(image/[^;]+);base64,(.*)$`)
+)
+
+// the largest image that is downloaded, the upstreams accept no larger ones
+const maxImageSize = 20 * 1024 * 1024
+
+// imageClient downloads the images of the requests. The URLs are given by the
+// users, so it does not connect to the loopback, private and link-local
+// addresses of the network the gateway runs in, redirects included.
+var imageClient = &http.Client{
+	Timeout: 30 * time.Second,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: 10 * time.Second,
+			Control: func(network, address string, _ syscall.RawConn) error {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				ip := net.ParseIP(host)
+				if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+					ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() {
+					return errors.New("image address is not allowed: " + host)
+				}
+				return nil
+			},
+		}).DialContext,
+	},
+}
+
+// GetImageFromUrl returns the mime type and base64 encoded data of the image,
+// the image is downloaded unless it is already a data URL.
+func GetImageFromUrl(url string) (mimeType string, data string, err error) {
+	if matches := dataURLReg.FindStringSubmatch(url); len(matches) == 3 {
+		return matches[1], matches[2], nil
+	}
+	resp, err := imageClient.Get(url)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", "", errors.New("failed to download image: " + resp.Status)
+	}
+	imageData, err := io.ReadAll(io.LimitReader(resp.Body, maxImageSize+1))
+	if err != nil {
+		return
+	}
+	if len(imageData) > maxImageSize {
+		return "", "", errors.New("image is larger than 20 MB")
+	}
+	mimeType = resp.Header.Get("Content-Type")
+	if !strings.HasPrefix(mimeType, "image/") {
+		mimeType = http.DetectContentType(imageData)
+	}
+	if i := strings.Index(mimeType, ";"); i >= 0 {
+		mimeType = mimeType[:i]
+	}
+	return mimeType, base64.StdEncoding.EncodeToString(imageData), nil
+}
@@ -8,6 +8,7 @@ import (
 	_ "image/png"
 	"io"
 	"net/http"
+	"net/http/httptest"
 	"strconv"
 	"strings"
 	"testing"
@@ -152,3 +153,35 @@ func TestGetImageSize(t *testing.T) {
 		})
 	}
 }
+
+func TestGetImageFromUrl(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		_, _ = w.Write([]byte("\x89PNG"))
+	}))
+	defer server.Close()
+	cases := []struct {
+		name     string
+		url      string
+		mimeType string
+		data     string
+		wantErr  bool
+	}{
+		{name: "data url", url: "data:image/png;base64,iVBORw0K", mimeType: "image/png", data: "iVBORw0K"},
+		{name: "loopback", url: server.URL, wantErr: true},
+		{name: "private", url: "http://10.0.0.1/image.png", wantErr: true},
+		{name: "link local", url: "http://169.254.169.254/latest/meta-data/", wantErr: true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			mimeType, data, err := img.GetImageFromUrl(c.url)
+			if c.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, c.mimeType, mimeType)
+			assert.Equal(t, c.data, data)
+		})
+	}
+}
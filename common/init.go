@@ -22,7 +22,10 @@ func printHelp() {
 	fmt.Println("Usage: one-api [--port <port>] [--log-dir <log directory>] [--version] [--help]")
 }
 
-func init() {
+// Init parses the command line flags and the settings of the environment that
+// are needed early. It is called by main rather than at package init, so that
+// the flags of test binaries are left alone.
+func Init() {
 	flag.Parse()
 
 	if *PrintVersion {
@@ -83,6 +83,10 @@ var ModelRatio = map[string]float64{
 	"ERNIE-Bot-4":               8.572,  // ￥0.12 / 1k tokens
 	"Embedding-V1":              0.1429, // ￥0.002 / 1k tokens
 	"PaLM-2":                    1,
+	"gemini-pro":                0.25,   // $0.5 / 1M tokens
+	"gemini-pro-vision":         0.25,   // $0.5 / 1M tokens
+	"gemini-1.5-pro":            1.75,   // $3.5 / 1M tokens
+	"gemini-1.5-flash":          0.175,  // $0.35 / 1M tokens
 	"chatglm_turbo":             0.3572, // ￥0.005 / 1k tokens
 	"chatglm_pro":               0.7143, // ￥0.01 / 1k tokens
 	"chatglm_std":               0.3572, // ￥0.005 / 1k tokens
@@ -113,6 +117,9 @@ func UpdateModelRatioByJSONString(jsonStr string) error {
 
 func GetModelRatio(name string) float64 {
 	ratio, ok := ModelRatio[name]
+	if base, isFineTuned := GetFineTunedBaseModel(name); !ok && isFineTuned {
+		return GetModelRatio(base) * GetFineTunedRatio(base)
+	}
 	if !ok {
 		SysError("model ratio not found: " + name)
 		return 30
@@ -120,7 +127,122 @@ func GetModelRatio(name string) float64 {
 	return ratio
 }
 
+// BatchRatio is the discount applied to the model ratio for requests made
+// through the batch API, models not listed here get DefaultBatchRatio.
+// https://platform.openai.com/docs/guides/batch
+var BatchRatio = map[string]float64{}
+
+const DefaultBatchRatio = 0.5
+
+func BatchRatio2JSONString() string {
+	jsonBytes, err := json.Marshal(BatchRatio)
+	if err != nil {
+		SysError("error marshalling batch ratio: " + err.Error())
+	}
+	return string(jsonBytes)
+}
+
+func UpdateBatchRatioByJSONString(jsonStr string) error {
+	BatchRatio = make(map[string]float64)
+	return json.Unmarshal([]byte(jsonStr), &BatchRatio)
+}
+
+func GetBatchRatio(name string) float64 {
+	ratio, ok := BatchRatio[name]
+	if !ok {
+		return DefaultBatchRatio
+	}
+	return ratio
+}
+
+// FineTunedRatio is the ratio of the price of a model fine-tuned from a base
+// model to the price of the base model, fine-tuned models not listed in
+// ModelRatio are priced with it. Base models not listed here get
+// DefaultFineTunedRatio. https://openai.com/pricing#fine-tuning-models
+var FineTunedRatio = map[string]float64{
+	"gpt-3.5-turbo-0613": 2, // $0.003 / 1K tokens
+	"gpt-3.5-turbo-1106": 3, // $0.003 / 1K tokens
+}
+
+const DefaultFineTunedRatio = 1
+
+func FineTunedRatio2JSONString() string {
+	jsonBytes, err := json.Marshal(FineTunedRatio)
+	if err != nil {
+		SysError("error marshalling fine-tuned ratio: " + err.Error())
+	}
+	return string(jsonBytes)
+}
+
+func UpdateFineTunedRatioByJSONString(jsonStr string) error {
+	FineTunedRatio = make(map[string]float64)
+	return json.Unmarshal([]byte(jsonStr), &FineTunedRatio)
+}
+
+func GetFineTunedRatio(name string) float64 {
+	ratio, ok := FineTunedRatio[name]
+	if !ok {
+		return DefaultFineTunedRatio
+	}
+	return ratio
+}
+
+// TrainingRatio is the price of the tokens trained by a fine-tuning job by
+// base model, in the unit of ModelRatio. A base model not listed here gets
+// the ratio of the longest listed model its name starts with, so that dated
+// versions are covered. https://openai.com/pricing#fine-tuning-models
+var TrainingRatio = map[string]float64{
+	"gpt-3.5-turbo":     4,    // $0.008 / 1K tokens
+	"gpt-4o-mini":       1.5,  // $0.003 / 1K tokens
+	"gpt-4o-2024-08-06": 12.5, // $0.025 / 1K tokens
+	"davinci-002":       3,    // $0.006 / 1K tokens
+	"babbage-002":       0.2,  // $0.0004 / 1K tokens
+}
+
+func TrainingRatio2JSONString() string {
+	jsonBytes, err := json.Marshal(TrainingRatio)
+	if err != nil {
+		SysError("error marshalling training ratio: " + err.Error())
+	}
+	return string(jsonBytes)
+}
+
+func UpdateTrainingRatioByJSONString(jsonStr string) error {
+	TrainingRatio = make(map[string]float64)
+	return json.Unmarshal([]byte(jsonStr), &TrainingRatio)
+}
+
+func GetTrainingRatio(name string) float64 {
+	if ratio, ok := TrainingRatio[name]; ok {
+		return ratio
+	}
+	prefix := ""
+	for model := range TrainingRatio {
+		if strings.HasPrefix(name, model) && len(model) > len(prefix) {
+			prefix = model
+		}
+	}
+	if prefix == "" {
+		SysError("training ratio not found: " + name)
+		return GetModelRatio(name)
+	}
+	return TrainingRatio[prefix]
+}
+
+// GetFineTunedBaseModel returns the base model of a fine-tuned model, whose
+// name looks like ft:gpt-3.5-turbo-0613:org:suffix:id
+func GetFineTunedBaseModel(name string) (string, bool) {
+	parts := strings.Split(name, ":")
+	if len(parts) < 2 || parts[0] != "ft" || parts[1] == "" {
+		return "", false
+	}
+	return parts[1], true
+}
+
 func GetCompletionRatio(name string) float64 {
+	if base, ok := GetFineTunedBaseModel(name); ok {
+		name = base
+	}
 	if strings.HasPrefix(name, "gpt-3.5") {
 		if strings.HasSuffix(name, "1106") {
 			return 2
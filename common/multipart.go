@@ -0,0 +1,111 @@
+package common
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+)
+
+func multipartBoundary(contentType string) (string, error) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "", err
+	}
+	if mediaType != "multipart/form-data" || params["boundary"] == "" {
+		return "", errors.New("not a multipart/form-data request")
+	}
+	return params["boundary"], nil
+}
+
+// ParseMultipartFormFields returns the text fields of a multipart/form-data body,
+// file parts are skipped without being copied.
+func ParseMultipartFormFields(body []byte, contentType string) (map[string]string, error) {
+	boundary, err := multipartBoundary(contentType)
+	if err != nil {
+		return nil, err
+	}
+	fields := make(map[string]string)
+	reader := multipart.NewReader(bytes.NewReader(body), boundary)
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if part.FileName() != "" || part.FormName() == "" {
+			continue
+		}
+		value, err := io.ReadAll(part)
+		if err != nil {
+			return nil, err
+		}
+		fields[part.FormName()] = string(value)
+	}
+	return fields, nil
+}
+
+// RewriteMultipartForm streams a multipart/form-data body with the given text
+// fields replaced and the removed fields left out, fields missing from the body
+// are appended. The parts are copied as they are read, so files are not
+// buffered a second time. The body is written by a goroutine until it is read
+// to the end or closed, a caller that does not send it must close it.
+func RewriteMultipartForm(body []byte, contentType string, fields map[string]string, removedFields ...string) (io.ReadCloser, string, error) {
+	boundary, err := multipartBoundary(contentType)
+	if err != nil {
+		return nil, "", err
+	}
+	pipeReader, pipeWriter := io.Pipe()
+	writer := multipart.NewWriter(pipeWriter)
+	go func() {
+		pipeWriter.CloseWithError(copyMultipartForm(multipart.NewReader(bytes.NewReader(body), boundary), writer, fields, removedFields))
+	}()
+	return pipeReader, writer.FormDataContentType(), nil
+}
+
+func copyMultipartForm(reader *multipart.Reader, writer *multipart.Writer, fields map[string]string, removedFields []string) error {
+	// fields that are written or removed, later parts of the same name are dropped
+	written := make(map[string]bool)
+	for _, name := range removedFields {
+		written[name] = true
+	}
+	for {
+		part, err := reader.NextRawPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		name := part.FormName()
+		if written[name] && part.FileName() == "" {
+			continue
+		}
+		if value, ok := fields[name]; ok && part.FileName() == "" {
+			written[name] = true
+			if err := writer.WriteField(name, value); err != nil {
+				return err
+			}
+			continue
+		}
+		partWriter, err := writer.CreatePart(part.Header)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(partWriter, part); err != nil {
+			return err
+		}
+	}
+	for name, value := range fields {
+		if written[name] {
+			continue
+		}
+		if err := writer.WriteField(name, value); err != nil {
+			return err
+		}
+	}
+	return writer.Close()
+}
@@ -0,0 +1,146 @@
+package common_test
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"mime/multipart"
+	"testing"
+
+	"one-api/common"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type formPart struct {
+	name     string
+	fileName string
+	value    string
+}
+
+func writeForm(t *testing.T, parts []formPart) ([]byte, string) {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	for _, part := range parts {
+		var partWriter io.Writer
+		var err error
+		if part.fileName != "" {
+			partWriter, err = writer.CreateFormFile(part.name, part.fileName)
+		} else {
+			partWriter, err = writer.CreateFormField(part.name)
+		}
+		require.NoError(t, err)
+		_, err = partWriter.Write([]byte(part.value))
+		require.NoError(t, err)
+	}
+	require.NoError(t, writer.Close())
+	return body.Bytes(), writer.FormDataContentType()
+}
+
+func readForm(t *testing.T, reader io.Reader, contentType string) []formPart {
+	_, params, err := mime.ParseMediaType(contentType)
+	require.NoError(t, err)
+	multipartReader := multipart.NewReader(reader, params["boundary"])
+	var parts []formPart
+	for {
+		part, err := multipartReader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		value, err := io.ReadAll(part)
+		require.NoError(t, err)
+		parts = append(parts, formPart{name: part.FormName(), fileName: part.FileName(), value: string(value)})
+	}
+	return parts
+}
+
+func TestRewriteMultipartForm(t *testing.T) {
+	file := formPart{name: "file", fileName: "audio.mp3", value: "ID3\x00\x01binary"}
+	cases := []struct {
+		name          string
+		parts         []formPart
+		fields        map[string]string
+		removedFields []string
+		want          []formPart
+	}{
+		{
+			name:   "unchanged",
+			parts:  []formPart{file, {name: "model", value: "whisper-1"}},
+			fields: map[string]string{},
+			want:   []formPart{file, {name: "model", value: "whisper-1"}},
+		},
+		{
+			name:   "replaced in place",
+			parts:  []formPart{{name: "model", value: "whisper-1"}, file, {name: "language", value: "en"}},
+			fields: map[string]string{"model": "whisper-large"},
+			want:   []formPart{{name: "model", value: "whisper-large"}, file, {name: "language", value: "en"}},
+		},
+		{
+			name:   "missing fields are appended",
+			parts:  []formPart{file, {name: "model", value: "whisper-1"}},
+			fields: map[string]string{"language": "en"},
+			want:   []formPart{file, {name: "model", value: "whisper-1"}, {name: "language", value: "en"}},
+		},
+		{
+			name:          "removed",
+			parts:         []formPart{file, {name: "model", value: "whisper-1"}, {name: "prompt", value: "p"}},
+			fields:        map[string]string{},
+			removedFields: []string{"prompt"},
+			want:          []formPart{file, {name: "model", value: "whisper-1"}},
+		},
+		{
+			name:   "repeated fields are replaced once",
+			parts:  []formPart{{name: "timestamp_granularities[]", value: "word"}, {name: "timestamp_granularities[]", value: "segment"}, file},
+			fields: map[string]string{"timestamp_granularities[]": "word"},
+			want:   []formPart{{name: "timestamp_granularities[]", value: "word"}, file},
+		},
+		{
+			name:   "files are not replaced",
+			parts:  []formPart{file},
+			fields: map[string]string{"file": "text"},
+			want:   []formPart{file, {name: "file", value: "text"}},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			body, contentType := writeForm(t, c.parts)
+			reader, newContentType, err := common.RewriteMultipartForm(body, contentType, c.fields, c.removedFields...)
+			require.NoError(t, err)
+			assert.Equal(t, c.want, readForm(t, reader, newContentType))
+		})
+	}
+}
+
+func TestRewriteMultipartFormErrors(t *testing.T) {
+	_, _, err := common.RewriteMultipartForm([]byte(`{}`), "application/json", nil)
+	assert.Error(t, err)
+
+	// the body ends within the file
+	body, contentType := writeForm(t, []formPart{{name: "file", fileName: "audio.mp3", value: string(bytes.Repeat([]byte("x"), 1000))}})
+	reader, newContentType, err := common.RewriteMultipartForm(body[:500], contentType, nil)
+	require.NoError(t, err)
+	_, params, err := mime.ParseMediaType(newContentType)
+	require.NoError(t, err)
+	multipartReader := multipart.NewReader(reader, params["boundary"])
+	for err == nil {
+		var part *multipart.Part
+		part, err = multipartReader.NextPart()
+		if err == nil {
+			_, err = io.ReadAll(part)
+		}
+	}
+	assert.NotEqual(t, io.EOF, err, "a truncated body is reported to the reader")
+}
+
+func TestParseMultipartFormFields(t *testing.T) {
+	body, contentType := writeForm(t, []formPart{
+		{name: "file", fileName: "audio.mp3", value: "binary"},
+		{name: "model", value: "whisper-1"},
+		{name: "temperature", value: "0.5"},
+	})
+	fields, err := common.ParseMultipartFormFields(body, contentType)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"model": "whisper-1", "temperature": "0.5"}, fields)
+}
@@ -4,6 +4,7 @@ import (
 	"github.com/gin-gonic/gin"
 	"one-api/common"
 	"one-api/model"
+	relaymodel "one-api/relay/model"
 )
 
 func GetSubscription(c *gin.Context) {
@@ -28,7 +29,7 @@ func GetSubscription(c *gin.Context) {
 		expiredTime = 0
 	}
 	if err != nil {
-		openAIError := OpenAIError{
+		openAIError := relaymodel.OpenAIError{
 			Message: err.Error(),
 			Type:    "upstream_error",
 		}
@@ -71,7 +72,7 @@ func GetUsage(c *gin.Context) {
 		quota, err = model.GetUserUsedQuota(ctx, userId)
 	}
 	if err != nil {
-		openAIError := OpenAIError{
+		openAIError := relaymodel.OpenAIError{
 			Message: err.Error(),
 			Type:    "one_api_error",
 		}
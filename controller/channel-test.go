@@ -10,14 +10,17 @@ import (
 	"net/http"
 	"one-api/common"
 	"one-api/model"
+	relaymodel "one-api/relay/model"
+	"one-api/relay/util"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
-func testChannel(channel *model.Channel, request ChatRequest) (err error, openaiErr *OpenAIError) {
+func testChannel(channel *model.Channel, request relaymodel.ChatRequest) (err error, openaiErr *relaymodel.OpenAIError) {
 	switch channel.Type {
 	case common.ChannelTypePaLM:
 		fallthrough
@@ -32,47 +35,69 @@ func testChannel(channel *model.Channel, request ChatRequest) (err error, openai
 	case common.ChannelType360:
 		fallthrough
 	case common.ChannelTypeXunfei:
+		fallthrough
+	case common.ChannelTypeGemini:
+		fallthrough
+	case common.ChannelTypeOllama:
 		return errors.New("该渠道类型当前版本不支持测试，请手动测试"), nil
 	case common.ChannelTypeAzure:
-		request.Model = "gpt-35-turbo"
+		request.Model = "gpt-3.5-turbo"
 		defer func() {
 			if err != nil {
-				err = errors.New("请确保已在 Azure 上创建了 gpt-35-turbo 模型，并且 apiVersion 已正确填写！")
+				err = fmt.Errorf("请确保已在 Azure 上创建了 gpt-3.5-turbo 模型对应的部署，并且 apiVersion 已正确填写！（%s）", err.Error())
 			}
 		}()
 	default:
 		request.Model = "gpt-3.5-turbo"
 	}
 	requestURL := common.ChannelBaseURLs[channel.Type]
+	config := channel.GetConfig()
 	if channel.Type == common.ChannelTypeAzure {
-		requestURL = getFullRequestURL(channel.GetBaseURL(), fmt.Sprintf("/openai/deployments/%s/chat/completions?api-version=2023-03-15-preview", request.Model), channel.Type)
+		deployment := config.Azure.GetDeployment(request.Model)
+		apiVersion := config.Azure.GetAPIVersion(common.AzureEndpointChat, channel.Other)
+		if apiVersion == "" {
+			apiVersion = "2023-03-15-preview"
+		}
+		requestURL = util.GetFullRequestURL(channel.GetBaseURL(), fmt.Sprintf("/openai/deployments/%s/chat/completions?api-version=%s", deployment, apiVersion), channel.Type)
 	} else {
 		if baseURL := channel.GetBaseURL(); len(baseURL) > 0 {
 			requestURL = baseURL
 		}
 
-		requestURL = getFullRequestURL(requestURL, "/v1/chat/completions", channel.Type)
+		requestURL = util.GetFullRequestURL(requestURL, "/v1/chat/completions", channel.Type)
 	}
 	jsonData, err := json.Marshal(request)
 	if err != nil {
 		return err, nil
 	}
+	jsonData, err = util.ApplyBodyOverrides(jsonData, config)
+	if err != nil {
+		return err, nil
+	}
 	req, err := http.NewRequest("POST", requestURL, bytes.NewBuffer(jsonData))
 	if err != nil {
 		return err, nil
 	}
 	if channel.Type == common.ChannelTypeAzure {
-		req.Header.Set("api-key", channel.Key)
+		err = util.SetupAzureAuthorization(req.Context(), req, channel.Id, config, channel.Key)
+		if err != nil {
+			return err, nil
+		}
 	} else {
 		req.Header.Set("Authorization", "Bearer "+channel.Key)
 	}
 	req.Header.Set("Content-Type", "application/json")
-	resp, err := httpClient.Do(req)
+	util.SetupHeaderOverrides(req, channel.Type, config)
+	client, err := util.GetChannelHTTPClient(channel.Id, config)
+	if err != nil {
+		return err, nil
+	}
+	resp, err := client.Do(req)
 	if err != nil {
 		return err, nil
 	}
 	defer resp.Body.Close()
-	var response TextResponse
+	var response relaymodel.TextResponse
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
 		return err, nil
@@ -90,12 +115,12 @@ func testChannel(channel *model.Channel, request ChatRequest) (err error, openai
 	return nil, nil
 }
 
-func buildTestRequest() *ChatRequest {
-	testRequest := &ChatRequest{
+func buildTestRequest() *relaymodel.ChatRequest {
+	testRequest := &relaymodel.ChatRequest{
 		Model:     "", // this will be set later
 		MaxTokens: 1,
 	}
-	testMessage := Message{
+	testMessage := relaymodel.Message{
 		Role:    "user",
 		Content: "hi",
 	}
@@ -122,6 +147,10 @@ func TestChannel(c *gin.Context) {
 		return
 	}
 	testRequest := buildTestRequest()
+	if channel.GetKeyStrategy() != "" {
+		testChannelKeysOnce(c, channel, *testRequest)
+		return
+	}
 	tik := time.Now()
 	err, _ = testChannel(channel, *testRequest)
 	tok := time.Now()
@@ -144,6 +173,51 @@ func TestChannel(c *gin.Context) {
 	return
 }
 
+// testChannelKeysOnce responds with the errors of the keys that failed, and
+// with the average time of the keys
+func testChannelKeysOnce(c *gin.Context, channel *model.Channel, request relaymodel.ChatRequest) {
+	ctx := c.Request.Context()
+	results, err := testChannelKeys(ctx, channel, request)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	if len(results) == 0 {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": "该渠道没有可测试的密钥",
+		})
+		return
+	}
+	var totalMilliseconds int64
+	var messages []string
+	for _, result := range results {
+		totalMilliseconds += result.milliseconds
+		if result.err != nil {
+			messages = append(messages, fmt.Sprintf("密钥 #%d：%s", result.key.Id, result.err.Error()))
+		}
+	}
+	milliseconds := totalMilliseconds / int64(len(results))
+	go channel.UpdateResponseTime(ctx, milliseconds)
+	consumedTime := float64(milliseconds) / 1000.0
+	if len(messages) > 0 {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": strings.Join(messages, "\n"),
+			"time":    consumedTime,
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "",
+		"time":    consumedTime,
+	})
+}
+
 var testAllChannelsLock sync.Mutex
 var testAllChannelsRunning bool = false
 
@@ -173,6 +247,74 @@ func enableChannel(ctx context.Context, channelId int, channelName string) {
 	notifyRootUser(ctx, subject, content)
 }
 
+// disableChannelKey disables a key of a channel with several keys, the channel
+// itself is disabled once none of its keys is enabled
+func disableChannelKey(ctx context.Context, channelId int, keyId int, channelName string, reason string) {
+	model.UpdateChannelKeyStatus(ctx, channelId, keyId, common.ChannelStatusAutoDisabled)
+	subject := fmt.Sprintf("通道「%s」（#%d）的密钥 #%d 已被禁用", channelName, channelId, keyId)
+	content := fmt.Sprintf("通道「%s」（#%d）的密钥 #%d 已被禁用，原因：%s", channelName, channelId, keyId, reason)
+	notifyRootUser(ctx, subject, content)
+	keys, err := model.GetChannelKeys(ctx, channelId)
+	if err != nil {
+		common.SysError(fmt.Sprintf("failed to get keys of channel #%d: %s", channelId, err.Error()))
+		return
+	}
+	for _, key := range keys {
+		if key.Status == common.ChannelStatusEnabled {
+			return
+		}
+	}
+	disableChannel(ctx, channelId, channelName, "所有密钥均已被禁用")
+}
+
+// enableChannelKey enables a key of a channel with several keys, along with
+// the channel if it was disabled automatically
+func enableChannelKey(ctx context.Context, channel *model.Channel, keyId int) {
+	model.UpdateChannelKeyStatus(ctx, channel.Id, keyId, common.ChannelStatusEnabled)
+	subject := fmt.Sprintf("通道「%s」（#%d）的密钥 #%d 已被启用", channel.Name, channel.Id, keyId)
+	notifyRootUser(ctx, subject, subject)
+	if channel.Status == common.ChannelStatusAutoDisabled {
+		enableChannel(ctx, channel.Id, channel.Name)
+		channel.Status = common.ChannelStatusEnabled
+	}
+}
+
+type channelKeyTestResult struct {
+	key          *model.ChannelKey
+	err          error
+	openaiErr    *relaymodel.OpenAIError
+	milliseconds int64
+}
+
+// testChannelKeys tests the keys of a channel with several keys one by one,
+// the keys disabled by hand are skipped
+func testChannelKeys(ctx context.Context, channel *model.Channel, request relaymodel.ChatRequest) ([]channelKeyTestResult, error) {
+	keys, err := model.GetChannelKeys(ctx, channel.Id)
+	if err != nil {
+		return nil, err
+	}
+	var results []channelKeyTestResult
+	for _, key := range keys {
+		if key.Status == common.ChannelStatusManuallyDisabled {
+			continue
+		}
+		keyChannel := *channel
+		keyChannel.Key = key.Key
+		tik := time.Now()
+		err, openaiErr := testChannel(&keyChannel, request)
+		tok := time.Now()
+		milliseconds := tok.Sub(tik).Milliseconds()
+		key.UpdateResponseTime(ctx, milliseconds)
+		results = append(results, channelKeyTestResult{
+			key:          key,
+			err:          err,
+			openaiErr:    openaiErr,
+			milliseconds: milliseconds,
+		})
+	}
+	return results, nil
+}
+
 func testAllChannels(ctx context.Context, notify bool) error {
 	if common.RootUserEmail == "" {
 		common.RootUserEmail = model.GetRootUserEmail(ctx)
@@ -195,6 +337,11 @@ func testAllChannels(ctx context.Context, notify bool) error {
 	}
 	go func() {
 		for _, channel := range channels {
+			if channel.GetKeyStrategy() != "" {
+				testAllChannelKeys(ctx, channel, *testRequest, disableThreshold)
+				time.Sleep(common.RequestInterval)
+				continue
+			}
 			isChannelEnabled := channel.Status == common.ChannelStatusEnabled
 			tik := time.Now()
 			err, openaiErr := testChannel(channel, *testRequest)
@@ -226,6 +373,40 @@ func testAllChannels(ctx context.Context, notify bool) error {
 	return nil
 }
 
+// testAllChannelKeys disables and enables the keys of a channel by their own
+// results, the channel follows its keys
+func testAllChannelKeys(ctx context.Context, channel *model.Channel, request relaymodel.ChatRequest, disableThreshold int64) {
+	if channel.Status == common.ChannelStatusManuallyDisabled {
+		return
+	}
+	results, err := testChannelKeys(ctx, channel, request)
+	if err != nil {
+		common.SysError(fmt.Sprintf("failed to test keys of channel #%d: %s", channel.Id, err.Error()))
+		return
+	}
+	var totalMilliseconds int64
+	for _, result := range results {
+		totalMilliseconds += result.milliseconds
+		isKeyEnabled := result.key.Status == common.ChannelStatusEnabled
+		err := result.err
+		if isKeyEnabled && result.milliseconds > disableThreshold {
+			err = errors.New(fmt.Sprintf("响应时间 %.2fs 超过阈值 %.2fs", float64(result.milliseconds)/1000.0, float64(disableThreshold)/1000.0))
+			disableChannelKey(ctx, channel.Id, result.key.Id, channel.Name, err.Error())
+			continue
+		}
+		if isKeyEnabled && shouldDisableChannel(result.openaiErr, -1) {
+			disableChannelKey(ctx, channel.Id, result.key.Id, channel.Name, err.Error())
+			continue
+		}
+		if !isKeyEnabled && shouldEnableChannel(err, result.openaiErr) {
+			enableChannelKey(ctx, channel, result.key.Id)
+		}
+	}
+	if len(results) > 0 {
+		channel.UpdateResponseTime(ctx, totalMilliseconds/int64(len(results)))
+	}
+}
+
 func TestAllChannels(c *gin.Context) {
 	ctx := c.Request.Context()
 	err := testAllChannels(ctx, true)
@@ -1,10 +1,15 @@
 package controller
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"github.com/gin-gonic/gin"
 	"net/http"
 	"one-api/common"
 	"one-api/model"
+	"one-api/relay/channel/ollama"
+	"one-api/relay/util"
 	"strconv"
 	"strings"
 )
@@ -88,7 +93,43 @@ func AddChannel(c *gin.Context) {
 		})
 		return
 	}
+	err = validateChannel(&channel)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
 	channel.CreatedTime = common.GetTimestamp()
+	if channel.GetKeyStrategy() != "" {
+		// the keys are those of a single channel
+		keys := splitChannelKeys(channel.Key)
+		if len(keys) == 0 {
+			c.JSON(http.StatusOK, gin.H{
+				"success": false,
+				"message": "密钥不能为空",
+			})
+			return
+		}
+		channel.Key = keys[0]
+		err = channel.Insert(ctx)
+		if err == nil {
+			err = model.SetChannelKeys(ctx, channel.Id, keys)
+		}
+		if err != nil {
+			c.JSON(http.StatusOK, gin.H{
+				"success": false,
+				"message": err.Error(),
+			})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"success": true,
+			"message": "",
+		})
+		return
+	}
 	keys := strings.Split(channel.Key, "\n")
 	channels := make([]model.Channel, 0, len(keys))
 	for _, key := range keys {
@@ -114,6 +155,34 @@ func AddChannel(c *gin.Context) {
 	return
 }
 
+func validateChannel(channel *model.Channel) error {
+	switch channel.GetKeyStrategy() {
+	case "", common.ChannelKeyStrategyRoundRobin, common.ChannelKeyStrategyRandom, common.ChannelKeyStrategyLeastRecentlyErrored:
+	default:
+		return fmt.Errorf("无效的密钥选择策略：%s", channel.GetKeyStrategy())
+	}
+	if channel.Config == nil {
+		return nil
+	}
+	_, err := common.ParseChannelConfig(*channel.Config)
+	if err != nil {
+		return fmt.Errorf("渠道配置无效：%s", err.Error())
+	}
+	return nil
+}
+
+// splitChannelKeys returns the keys of a channel with several keys, one per line
+func splitChannelKeys(key string) []string {
+	var keys []string
+	for _, line := range strings.Split(key, "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" {
+			keys = append(keys, line)
+		}
+	}
+	return keys
+}
+
 func DeleteChannel(c *gin.Context) {
 	ctx := c.Request.Context()
 	id, _ := strconv.Atoi(c.Param("id"))
@@ -126,6 +195,9 @@ func DeleteChannel(c *gin.Context) {
 		})
 		return
 	}
+	util.ResetChannelHTTPClient(id)
+	model.ResetChannelHealth(ctx, id)
+	model.ResetChannelCircuits(id, "")
 	c.JSON(http.StatusOK, gin.H{
 		"success": true,
 		"message": "",
@@ -162,7 +234,25 @@ func UpdateChannel(c *gin.Context) {
 		})
 		return
 	}
+	err = validateChannel(&channel)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	var keys []string
+	if channel.GetKeyStrategy() != "" {
+		keys = splitChannelKeys(channel.Key)
+		if len(keys) > 0 {
+			channel.Key = keys[0]
+		}
+	}
 	err = channel.Update(ctx)
+	if err == nil {
+		err = updateChannelKeys(ctx, &channel, keys)
+	}
 	if err != nil {
 		c.JSON(http.StatusOK, gin.H{
 			"success": false,
@@ -170,6 +260,8 @@ func UpdateChannel(c *gin.Context) {
 		})
 		return
 	}
+	util.ResetChannelHTTPClient(channel.Id)
+	model.ResetChannelCircuits(channel.Id, "")
 	c.JSON(http.StatusOK, gin.H{
 		"success": true,
 		"message": "",
@@ -177,3 +269,247 @@ func UpdateChannel(c *gin.Context) {
 	})
 	return
 }
+
+// GetChannelDistribution previews the share of the requests for a model in a
+// group that each channel receives
+func GetChannelDistribution(c *gin.Context) {
+	ctx := c.Request.Context()
+	group := c.DefaultQuery("group", "default")
+	modelName := c.Query("model")
+	if modelName == "" {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": "模型不能为空",
+		})
+		return
+	}
+	shares, err := model.GetChannelDistribution(ctx, group, modelName)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "",
+		"data":    shares,
+	})
+	return
+}
+
+// GetChannelHealth lists the latencies and error rates, by model, the channels
+// are routed by in groups routed by health
+func GetChannelHealth(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "",
+		"data":    model.GetAllChannelHealth(),
+	})
+	return
+}
+
+// GetChannelCircuits lists the circuit breakers of the channels that are open,
+// half open or closed with recent failures
+func GetChannelCircuits(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "",
+		"data":    model.GetChannelCircuits(),
+	})
+	return
+}
+
+// GetChannelCooldowns lists the channels and the keys that are rate limited
+// and left out of the selection until then
+func GetChannelCooldowns(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "",
+		"data":    model.GetChannelCooldowns(c.Request.Context()),
+	})
+	return
+}
+
+// ResetChannelCircuits closes the circuits of a channel by hand, only that of
+// a model if the model is given
+func ResetChannelCircuits(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	model.ResetChannelCircuits(id, c.Query("model"))
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "",
+	})
+	return
+}
+
+// updateChannelKeys saves the keys given to a channel that is saved with several
+// keys, an empty list keeps the keys of the channel
+func updateChannelKeys(ctx context.Context, channel *model.Channel, keys []string) error {
+	if channel.GetKeyStrategy() == "" {
+		return model.DeleteChannelKeys(ctx, channel.Id)
+	}
+	if len(keys) > 0 {
+		return model.SetChannelKeys(ctx, channel.Id, keys)
+	}
+	existingKeys, err := model.GetChannelKeys(ctx, channel.Id)
+	if err != nil {
+		return err
+	}
+	if len(existingKeys) == 0 {
+		// the channel had a single key until now
+		return model.SetChannelKeys(ctx, channel.Id, []string{channel.Key})
+	}
+	return nil
+}
+
+// GetChannelKeys lists the keys of a channel with several keys, along with
+// their status, used quota and test results
+func GetChannelKeys(c *gin.Context) {
+	ctx := c.Request.Context()
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	keys, err := model.GetChannelKeys(ctx, id)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	for _, key := range keys {
+		key.Key = maskChannelKey(key.Key)
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "",
+		"data":    keys,
+	})
+	return
+}
+
+// UpdateChannelKeyStatus enables or disables a key of a channel by hand
+func UpdateChannelKeyStatus(c *gin.Context) {
+	ctx := c.Request.Context()
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	request := model.ChannelKey{}
+	err = c.ShouldBindJSON(&request)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	if request.Status != common.ChannelStatusEnabled && request.Status != common.ChannelStatusManuallyDisabled {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": "无效的状态",
+		})
+		return
+	}
+	key, err := model.GetChannelKeyById(ctx, id, request.Id)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	model.UpdateChannelKeyStatus(ctx, id, key.Id, request.Status)
+	if request.Status == common.ChannelStatusEnabled {
+		channel, err := model.GetChannelById(ctx, id, false)
+		if err == nil && channel.Status == common.ChannelStatusAutoDisabled {
+			// the channel was disabled along with its last key
+			model.UpdateChannelStatusById(ctx, id, common.ChannelStatusEnabled)
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "",
+	})
+	return
+}
+
+func maskChannelKey(key string) string {
+	if len(key) <= 8 {
+		return strings.Repeat("*", len(key))
+	}
+	return key[:3] + "..." + key[len(key)-4:]
+}
+
+// FetchChannelModels lists the models served by the upstream of a channel,
+// the channel may be one that has not been saved yet.
+func FetchChannelModels(c *gin.Context) {
+	ctx := c.Request.Context()
+	channel := model.Channel{}
+	err := c.ShouldBindJSON(&channel)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	if channel.Key == "" && channel.Id != 0 {
+		savedChannel, err := model.GetChannelById(ctx, channel.Id, true)
+		if err == nil {
+			channel.Key = savedChannel.Key
+		}
+	}
+	baseURL := channel.GetBaseURL()
+	if baseURL == "" && channel.Type >= 0 && channel.Type < len(common.ChannelBaseURLs) {
+		baseURL = common.ChannelBaseURLs[channel.Type]
+	}
+	// the config in the form may not be saved yet, so the client is not cached
+	// by the id of the channel
+	client, err := util.GetChannelHTTPClient(0, channel.GetConfig())
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	var models []string
+	switch channel.Type {
+	case common.ChannelTypeOllama:
+		models, err = ollama.ListModels(client, baseURL, channel.Key)
+	default:
+		err = errors.New("该渠道类型不支持获取模型列表")
+	}
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "",
+		"data":    models,
+	})
+	return
+}
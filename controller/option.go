@@ -5,6 +5,7 @@ import (
 	"net/http"
 	"one-api/common"
 	"one-api/model"
+	"strconv"
 	"strings"
 
 	"github.com/gin-gonic/gin"
@@ -75,6 +76,14 @@ func UpdateOption(c *gin.Context) {
 			})
 			return
 		}
+	case "TranscriptMaxSize":
+		if size, err := strconv.Atoi(option.Value); err != nil || size <= 0 {
+			c.JSON(http.StatusOK, gin.H{
+				"success": false,
+				"message": "对话记录大小上限必须为正整数！",
+			})
+			return
+		}
 	}
 	err = model.UpdateOption(ctx, option.Key, option.Value)
 	if err != nil {
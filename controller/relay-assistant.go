@@ -0,0 +1,431 @@
+package controller
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"one-api/common"
+	"one-api/middleware"
+	"one-api/model"
+	relaymodel "one-api/relay/model"
+	"one-api/relay/util"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func newAssistantRequest(c *gin.Context, method string, requestBody io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(c.Request.Context(), method, getUpstreamRequestURL(c), requestBody)
+	if err != nil {
+		return nil, err
+	}
+	err = setupUpstreamAuthorization(c, req)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", c.Request.Header.Get("Content-Type"))
+	req.Header.Set("Accept", c.Request.Header.Get("Accept"))
+	if beta := c.Request.Header.Get("OpenAI-Beta"); beta != "" {
+		req.Header.Set("OpenAI-Beta", beta)
+	}
+	return req, nil
+}
+
+func relayAssistantHelper(c *gin.Context) *relaymodel.OpenAIErrorWithStatusCode {
+	if c.Request.Method == http.MethodPost && strings.HasSuffix(c.Request.URL.Path, "/runs") {
+		// the cost of a run is only known once it completes
+		if relayErr := checkUserQuota(c); relayErr != nil {
+			return relayErr
+		}
+	}
+	var requestBody io.Reader
+	if c.Request.Method == http.MethodPost {
+		originRequestBody, err := common.GetRequestBody(c)
+		if err != nil {
+			return util.ErrorWrapper(err, "read_request_body_failed", http.StatusInternalServerError)
+		}
+		requestBody = bytes.NewReader(originRequestBody)
+	}
+	req, err := newAssistantRequest(c, c.Request.Method, requestBody)
+	if err != nil {
+		return util.ErrorWrapper(err, "new_request_failed", http.StatusInternalServerError)
+	}
+	client, err := util.GetHTTPClient(c)
+	if err != nil {
+		return util.ErrorWrapper(err, "get_http_client_failed", http.StatusInternalServerError)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return util.UpstreamErrorWrapper(err, "do_request_failed", http.StatusInternalServerError)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return util.RelayErrorHandler(resp)
+	}
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
+		return relayAssistantStream(c, resp)
+	}
+	responseBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return util.UpstreamErrorWrapper(err, "read_response_body_failed", http.StatusInternalServerError)
+	}
+	err = resp.Body.Close()
+	if err != nil {
+		return util.ErrorWrapper(err, "close_response_body_failed", http.StatusInternalServerError)
+	}
+	trackAssistantObject(c, responseBody)
+	c.Writer.Header().Set("Content-Type", "application/json")
+	c.Writer.WriteHeader(resp.StatusCode)
+	_, err = c.Writer.Write(responseBody)
+	if err != nil {
+		return util.ErrorWrapper(err, "write_response_body_failed", http.StatusInternalServerError)
+	}
+	return nil
+}
+
+// relayAssistantStream relays the events of a streamed run, the objects they
+// carry are tracked as well.
+func relayAssistantStream(c *gin.Context, resp *http.Response) *relaymodel.OpenAIErrorWithStatusCode {
+	for k, v := range resp.Header {
+		c.Writer.Header().Set(k, v[0])
+	}
+	c.Writer.WriteHeader(resp.StatusCode)
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "data: {") {
+			trackAssistantObject(c, []byte(strings.TrimPrefix(line, "data: ")))
+		}
+		_, err := c.Writer.WriteString(line + "\n")
+		if err != nil {
+			break
+		}
+		c.Writer.Flush()
+	}
+	err := resp.Body.Close()
+	if err != nil {
+		return util.ErrorWrapper(err, "close_response_body_failed", http.StatusInternalServerError)
+	}
+	return nil
+}
+
+// trackAssistantObject records the objects created through the gateway, forgets
+// the deleted ones and bills the runs that have finished. The runs that are not
+// fetched again are billed by AutomaticallyUpdateRuns.
+func trackAssistantObject(c *gin.Context, data []byte) {
+	ctx := c.Request.Context()
+	var object relaymodel.AssistantObject
+	if err := json.Unmarshal(data, &object); err != nil {
+		return
+	}
+	switch object.Object {
+	case "list":
+		for _, item := range object.Data {
+			trackAssistantObject(c, item)
+		}
+	case model.ObjectTypeAssistant, model.ObjectTypeThread, model.ObjectTypeRun:
+		if c.Request.Method == http.MethodPost {
+			threadId := ""
+			if object.Object == model.ObjectTypeRun {
+				threadId = object.ThreadId
+			}
+			recordAssistantObject(c, object.Id, object.Object, threadId)
+			if threadId != "" {
+				// the thread may have been created along with the run
+				recordAssistantObject(c, threadId, model.ObjectTypeThread, "")
+			}
+		}
+		if object.IsTerminalRun() {
+			billRun(ctx, &object)
+		}
+	case "assistant.deleted", "thread.deleted":
+		if !object.Deleted {
+			return
+		}
+		err := model.DeleteObjectByObjectId(ctx, object.Id)
+		if err != nil {
+			common.LogError(ctx, "failed to delete object record: "+err.Error())
+		}
+	}
+}
+
+func recordAssistantObject(c *gin.Context, objectId string, objectType string, threadId string) {
+	object := model.UpstreamObject{
+		ObjectId:     objectId,
+		Type:         objectType,
+		UserId:       c.GetInt("id"),
+		TokenId:      c.GetInt("token_id"),
+		ChannelId:    c.GetInt("channel_id"),
+		ChannelKeyId: c.GetInt("channel_key_id"),
+		ThreadId:     threadId,
+		CreatedTime:  common.GetTimestamp(),
+	}
+	err := object.Record(c.Request.Context())
+	if err != nil {
+		common.LogError(c.Request.Context(), "failed to record object: "+err.Error())
+	}
+}
+
+// billRun bills the usage of a finished run to the token that created it, a run
+// that ended without usage is only marked as billed
+func billRun(ctx context.Context, run *relaymodel.AssistantObject) {
+	record, err := model.GetObjectByObjectId(ctx, run.Id)
+	if err != nil {
+		// not created through the gateway
+		return
+	}
+	billed, err := model.MarkObjectBilled(ctx, run.Id)
+	if err != nil {
+		common.LogError(ctx, "failed to mark run as billed: "+err.Error())
+		return
+	}
+	if !billed || run.Usage == nil {
+		return
+	}
+	meta, group := getBillingMeta(ctx, record.UserId, record.TokenId, record.ChannelId)
+	modelRatio := common.GetModelRatio(run.Model)
+	groupRatio := common.GetGroupRatio(group)
+	postConsumeTextQuota(ctx, run.Usage, meta, run.Model, modelRatio*groupRatio, 0, modelRatio, groupRatio)
+}
+
+// runs expire upstream after ten minutes, a run that could not be fetched for
+// this long is given up
+const maxUnbilledRunAge = 24 * 60 * 60
+
+// AutomaticallyUpdateRuns polls the runs created through the gateway and bills
+// the ones that have finished, whether or not their clients fetched them
+func AutomaticallyUpdateRuns(ctx context.Context, frequency int) {
+	for {
+		time.Sleep(time.Duration(frequency) * time.Minute)
+		runs, err := model.GetUnbilledRuns(ctx)
+		if err != nil {
+			common.SysError("failed to get unbilled runs: " + err.Error())
+			continue
+		}
+		for _, run := range runs {
+			err = updateRun(ctx, run)
+			if err == nil {
+				continue
+			}
+			common.SysError(fmt.Sprintf("failed to update run %s: %s", run.ObjectId, err.Error()))
+			if common.GetTimestamp()-run.CreatedTime > maxUnbilledRunAge {
+				_, err = model.MarkObjectBilled(ctx, run.ObjectId)
+				if err != nil {
+					common.SysError("failed to mark run as billed: " + err.Error())
+				}
+			}
+		}
+	}
+}
+
+func updateRun(ctx context.Context, run *model.UpstreamObject) error {
+	channel, err := model.GetChannelById(ctx, run.ChannelId, true)
+	if err != nil {
+		return err
+	}
+	resp, err := doChannelRequest(ctx, channel, run.ChannelKeyId, "/v1/threads/"+run.ThreadId+"/runs/"+run.ObjectId)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var object relaymodel.AssistantObject
+	err = json.NewDecoder(resp.Body).Decode(&object)
+	if err != nil {
+		return err
+	}
+	if object.IsTerminalRun() {
+		billRun(ctx, &object)
+	}
+	return nil
+}
+
+// checkUserQuota rejects users out of quota, for requests billed once they
+// finish upstream, when nothing can be pre-consumed
+func checkUserQuota(c *gin.Context) *relaymodel.OpenAIErrorWithStatusCode {
+	userQuota, err := model.CacheGetUserQuota(c.Request.Context(), c.GetInt("id"))
+	if err != nil {
+		return util.ErrorWrapper(err, "get_user_quota_failed", http.StatusInternalServerError)
+	}
+	if userQuota <= 0 {
+		return util.ErrorWrapper(errors.New("user quota is not enough"), "insufficient_user_quota", http.StatusForbidden)
+	}
+	return nil
+}
+
+// getBillingMeta describes a request billed after it was relayed, from the
+// token that made it
+func getBillingMeta(ctx context.Context, userId int, tokenId int, channelId int) (*util.RelayMeta, string) {
+	group, err := model.CacheGetUserGroup(ctx, userId)
+	if err != nil {
+		common.LogError(ctx, "failed to get user group: "+err.Error())
+	}
+	meta := &util.RelayMeta{
+		UserId:    userId,
+		TokenId:   tokenId,
+		ChannelId: channelId,
+	}
+	if token, err := model.GetTokenById(ctx, tokenId); err == nil {
+		meta.TokenName = token.Name
+	}
+	return meta, group
+}
+
+type assistantListItem struct {
+	Id        string `json:"id"`
+	CreatedAt int64  `json:"created_at"`
+	data      json.RawMessage
+}
+
+// ListAssistants lists the assistants of the user, which may be spread over
+// several channels, each of which is asked for its assistants.
+func ListAssistants(c *gin.Context) {
+	ctx := c.Request.Context()
+	objects, err := model.GetUserObjects(ctx, c.GetInt("id"), model.ObjectTypeAssistant)
+	if err != nil {
+		listAssistantsError(c, err)
+		return
+	}
+	owned := make(map[string]bool)
+	// the number of assistants of the user on each channel and key
+	type channelKey struct {
+		channelId int
+		keyId     int
+	}
+	channelKeys := make(map[channelKey]int)
+	for _, object := range objects {
+		owned[object.ObjectId] = true
+		channelKeys[channelKey{object.ChannelId, object.ChannelKeyId}]++
+	}
+	limit, _ := strconv.Atoi(c.Query("limit"))
+	if limit <= 0 || limit > 100 {
+		limit = 20
+	}
+	order := c.Query("order")
+	if order != "asc" {
+		order = "desc"
+	}
+	after, before := c.Query("after"), c.Query("before")
+	// cursors belong to a single channel, they are applied after merging
+	var items []assistantListItem
+	for key, count := range channelKeys {
+		channel, err := model.GetChannelById(ctx, key.channelId, true)
+		if err != nil {
+			continue
+		}
+		err = middleware.SetupContextForPinnedChannel(c, channel, key.keyId)
+		if err != nil {
+			common.LogError(ctx, fmt.Sprintf("failed to list assistants of channel #%d: %s", key.channelId, err.Error()))
+			continue
+		}
+		channelItems, err := fetchChannelAssistants(c, order, owned, count)
+		if err != nil {
+			common.LogError(ctx, fmt.Sprintf("failed to list assistants of channel #%d: %s", key.channelId, err.Error()))
+		}
+		items = append(items, channelItems...)
+	}
+	sort.SliceStable(items, func(i, j int) bool {
+		if order == "asc" {
+			return items[i].CreatedAt < items[j].CreatedAt
+		}
+		return items[i].CreatedAt > items[j].CreatedAt
+	})
+	page := make([]json.RawMessage, 0, limit)
+	var firstId, lastId any
+	started := after == ""
+	hasMore := false
+	for _, item := range items {
+		if !started {
+			started = item.Id == after
+			continue
+		}
+		if item.Id == before {
+			break
+		}
+		if len(page) == limit {
+			hasMore = true
+			break
+		}
+		if firstId == nil {
+			firstId = item.Id
+		}
+		lastId = item.Id
+		page = append(page, item.data)
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"object":   "list",
+		"data":     page,
+		"first_id": firstId,
+		"last_id":  lastId,
+		"has_more": hasMore,
+	})
+}
+
+// fetchChannelAssistants pages through the assistants of the selected channel
+// until the count assistants of the user were found or there are no more
+func fetchChannelAssistants(c *gin.Context, order string, owned map[string]bool, count int) ([]assistantListItem, error) {
+	var items []assistantListItem
+	after := ""
+	for {
+		query := "limit=100&order=" + order
+		if after != "" {
+			query += "&after=" + url.QueryEscape(after)
+		}
+		c.Request.URL.RawQuery = query
+		list, err := fetchAssistantList(c)
+		if err != nil {
+			return items, err
+		}
+		for _, data := range list.Data {
+			item := assistantListItem{data: data}
+			if json.Unmarshal(data, &item) != nil || !owned[item.Id] {
+				continue
+			}
+			items = append(items, item)
+		}
+		if len(items) >= count || !list.HasMore || list.LastId == "" || list.LastId == after {
+			return items, nil
+		}
+		after = list.LastId
+	}
+}
+
+func fetchAssistantList(c *gin.Context) (*relaymodel.AssistantObject, error) {
+	req, err := newAssistantRequest(c, http.MethodGet, nil)
+	if err != nil {
+		return nil, err
+	}
+	client, err := util.GetHTTPClient(c)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(util.RelayErrorHandler(resp).Message)
+	}
+	defer resp.Body.Close()
+	var list relaymodel.AssistantObject
+	err = json.NewDecoder(resp.Body).Decode(&list)
+	return &list, err
+}
+
+func listAssistantsError(c *gin.Context, err error) {
+	c.JSON(http.StatusInternalServerError, gin.H{
+		"error": relaymodel.OpenAIError{
+			Message: common.MessageWithRequestId(err.Error(), c.GetString(common.RequestIdKey)),
+			Type:    "one_api_error",
+			Code:    "list_assistants_failed",
+		},
+	})
+}
@@ -12,32 +12,36 @@ import (
 	"net/http"
 	"one-api/common"
 	"one-api/model"
+	"one-api/relay/constant"
+	relaymodel "one-api/relay/model"
+	"one-api/relay/util"
 	"strings"
 )
 
-func relayAudioHelper(c *gin.Context, relayMode int) *OpenAIErrorWithStatusCode {
+func relayAudioHelper(c *gin.Context, relayMode int) *relaymodel.OpenAIErrorWithStatusCode {
 	ctx := c.Request.Context()
 	audioModel := "whisper-1"
 
 	tokenId := c.GetInt("token_id")
 	channelType := c.GetInt("channel")
 	channelId := c.GetInt("channel_id")
+	channelKeyId := c.GetInt("channel_key_id")
 	userId := c.GetInt("id")
 	group := c.GetString("group")
 	tokenName := c.GetString("token_name")
 
 	var ttsRequest TextToSpeechRequest
-	if relayMode == RelayModeAudioSpeech {
+	if relayMode == constant.RelayModeAudioSpeech {
 		// Read JSON
 		err := common.UnmarshalBodyReusable(c, &ttsRequest)
 		// Check if JSON is valid
 		if err != nil {
-			return errorWrapper(err, "invalid_json", http.StatusBadRequest)
+			return util.ErrorWrapper(err, "invalid_json", http.StatusBadRequest)
 		}
 		audioModel = ttsRequest.Model
 		// Check if text is too long 4096
 		if len(ttsRequest.Input) > 4096 {
-			return errorWrapper(errors.New("input is too long (over 4096 characters)"), "text_too_long", http.StatusBadRequest)
+			return util.ErrorWrapper(errors.New("input is too long (over 4096 characters)"), "text_too_long", http.StatusBadRequest)
 		}
 	}
 
@@ -47,7 +51,7 @@ func relayAudioHelper(c *gin.Context, relayMode int) *OpenAIErrorWithStatusCode
 	var quota int
 	var preConsumedQuota int
 	switch relayMode {
-	case RelayModeAudioSpeech:
+	case constant.RelayModeAudioSpeech:
 		preConsumedQuota = int(float64(len(ttsRequest.Input)) * ratio)
 		quota = preConsumedQuota
 	default:
@@ -55,16 +59,16 @@ func relayAudioHelper(c *gin.Context, relayMode int) *OpenAIErrorWithStatusCode
 	}
 	userQuota, err := model.CacheGetUserQuota(ctx, userId)
 	if err != nil {
-		return errorWrapper(err, "get_user_quota_failed", http.StatusInternalServerError)
+		return util.ErrorWrapper(err, "get_user_quota_failed", http.StatusInternalServerError)
 	}
 
 	// Check if user quota is enough
 	if userQuota-preConsumedQuota < 0 {
-		return errorWrapper(errors.New("user quota is not enough"), "insufficient_user_quota", http.StatusForbidden)
+		return util.ErrorWrapper(errors.New("user quota is not enough"), "insufficient_user_quota", http.StatusForbidden)
 	}
 	err = model.CacheDecreaseUserQuota(ctx, userId, preConsumedQuota)
 	if err != nil {
-		return errorWrapper(err, "decrease_user_quota_failed", http.StatusInternalServerError)
+		return util.ErrorWrapper(err, "decrease_user_quota_failed", http.StatusInternalServerError)
 	}
 	if userQuota > 100*preConsumedQuota {
 		// in this case, we do not pre-consume quota
@@ -74,7 +78,7 @@ func relayAudioHelper(c *gin.Context, relayMode int) *OpenAIErrorWithStatusCode
 	if preConsumedQuota > 0 {
 		err := model.PreConsumeTokenQuota(ctx, tokenId, preConsumedQuota)
 		if err != nil {
-			return errorWrapper(err, "pre_consume_token_quota_failed", http.StatusForbidden)
+			return util.ErrorWrapper(err, "pre_consume_token_quota_failed", http.StatusForbidden)
 		}
 	}
 
@@ -84,7 +88,7 @@ func relayAudioHelper(c *gin.Context, relayMode int) *OpenAIErrorWithStatusCode
 		modelMap := make(map[string]string)
 		err := json.Unmarshal([]byte(modelMapping), &modelMap)
 		if err != nil {
-			return errorWrapper(err, "unmarshal_model_mapping_failed", http.StatusInternalServerError)
+			return util.ErrorWrapper(err, "unmarshal_model_mapping_failed", http.StatusInternalServerError)
 		}
 		if modelMap[audioModel] != "" {
 			audioModel = modelMap[audioModel]
@@ -97,66 +101,96 @@ func relayAudioHelper(c *gin.Context, relayMode int) *OpenAIErrorWithStatusCode
 		baseURL = c.GetString("base_url")
 	}
 
-	fullRequestURL := getFullRequestURL(baseURL, requestURL, channelType)
-	if relayMode == RelayModeAudioTranscription && channelType == common.ChannelTypeAzure {
+	fullRequestURL := util.GetFullRequestURL(baseURL, requestURL, channelType)
+	if channelType == common.ChannelTypeAzure {
 		// https://learn.microsoft.com/en-us/azure/ai-services/openai/whisper-quickstart?tabs=command-line#rest-api
-		apiVersion := GetAPIVersion(c)
-		fullRequestURL = fmt.Sprintf("%s/openai/deployments/%s/audio/transcriptions?api-version=%s", baseURL, audioModel, apiVersion)
+		apiVersion := util.GetAzureAPIVersion(c, common.AzureEndpointAudio)
+		deployment := util.GetChannelConfig(c).Azure.GetDeployment(audioModel)
+		task := strings.TrimPrefix(strings.Split(requestURL, "?")[0], "/v1/")
+		fullRequestURL = fmt.Sprintf("%s/openai/deployments/%s/%s?api-version=%s", baseURL, deployment, task, apiVersion)
 	}
 
 	requestBody := &bytes.Buffer{}
 	_, err = io.Copy(requestBody, c.Request.Body)
 	if err != nil {
-		return errorWrapper(err, "new_request_body_failed", http.StatusInternalServerError)
+		return util.ErrorWrapper(err, "new_request_body_failed", http.StatusInternalServerError)
 	}
 	c.Request.Body = io.NopCloser(bytes.NewBuffer(requestBody.Bytes()))
 	responseFormat := c.DefaultPostForm("response_format", "json")
 
-	req, err := http.NewRequest(c.Request.Method, fullRequestURL, requestBody)
+	var upstreamRequestBody io.Reader = requestBody
+	contentType := c.Request.Header.Get("Content-Type")
+	channelConfig := util.GetChannelConfig(c)
+	if channelConfig.HasBodyOverrides() {
+		if relayMode == constant.RelayModeAudioSpeech {
+			jsonData, err := util.ApplyBodyOverrides(requestBody.Bytes(), channelConfig)
+			if err != nil {
+				return util.ErrorWrapper(err, "override_request_body_failed", http.StatusInternalServerError)
+			}
+			upstreamRequestBody = bytes.NewReader(jsonData)
+		} else {
+			form, formContentType, err := rewriteMultipartRequest(requestBody.Bytes(), contentType, audioModel, false, channelConfig)
+			if err != nil {
+				return util.ErrorWrapper(err, "rewrite_request_body_failed", http.StatusInternalServerError)
+			}
+			// ends the goroutine writing the form if the request is not sent
+			defer form.Close()
+			upstreamRequestBody, contentType = form, formContentType
+		}
+	}
+
+	req, err := http.NewRequestWithContext(c.Request.Context(), c.Request.Method, fullRequestURL, upstreamRequestBody)
 	if err != nil {
-		return errorWrapper(err, "new_request_failed", http.StatusInternalServerError)
+		return util.ErrorWrapper(err, "new_request_failed", http.StatusInternalServerError)
 	}
 
-	if relayMode == RelayModeAudioTranscription && channelType == common.ChannelTypeAzure {
+	if channelType == common.ChannelTypeAzure {
 		// https://learn.microsoft.com/en-us/azure/ai-services/openai/whisper-quickstart?tabs=command-line#rest-api
 		apiKey := c.Request.Header.Get("Authorization")
 		apiKey = strings.TrimPrefix(apiKey, "Bearer ")
-		req.Header.Set("api-key", apiKey)
-		req.ContentLength = c.Request.ContentLength
+		err = util.SetupAzureAuthorization(ctx, req, c.GetInt("channel_id"), channelConfig, apiKey)
+		if err != nil {
+			return util.ErrorWrapper(err, "setup_azure_authorization_failed", http.StatusInternalServerError)
+		}
 	} else {
 		req.Header.Set("Authorization", c.Request.Header.Get("Authorization"))
 	}
-	req.Header.Set("Content-Type", c.Request.Header.Get("Content-Type"))
+	req.Header.Set("Content-Type", contentType)
 	req.Header.Set("Accept", c.Request.Header.Get("Accept"))
+	util.SetupHeaderOverrides(req, channelType, channelConfig)
 
-	resp, err := httpClient.Do(req)
+	client, err := util.GetHTTPClient(c)
+	if err != nil {
+		return util.ErrorWrapper(err, "get_http_client_failed", http.StatusInternalServerError)
+	}
+	resp, err := client.Do(req)
 	if err != nil {
-		return errorWrapper(err, "do_request_failed", http.StatusInternalServerError)
+		return util.UpstreamErrorWrapper(err, "do_request_failed", http.StatusInternalServerError)
 	}
 
 	err = req.Body.Close()
 	if err != nil {
-		return errorWrapper(err, "close_request_body_failed", http.StatusInternalServerError)
+		return util.ErrorWrapper(err, "close_request_body_failed", http.StatusInternalServerError)
 	}
 	err = c.Request.Body.Close()
 	if err != nil {
-		return errorWrapper(err, "close_request_body_failed", http.StatusInternalServerError)
+		return util.ErrorWrapper(err, "close_request_body_failed", http.StatusInternalServerError)
 	}
 
-	if relayMode != RelayModeAudioSpeech {
+	if relayMode != constant.RelayModeAudioSpeech {
 		responseBody, err := io.ReadAll(resp.Body)
 		if err != nil {
-			return errorWrapper(err, "read_response_body_failed", http.StatusInternalServerError)
+			return util.UpstreamErrorWrapper(err, "read_response_body_failed", http.StatusInternalServerError)
 		}
 		err = resp.Body.Close()
 		if err != nil {
-			return errorWrapper(err, "close_response_body_failed", http.StatusInternalServerError)
+			return util.ErrorWrapper(err, "close_response_body_failed", http.StatusInternalServerError)
 		}
 
-		var openAIErr TextResponse
+		var openAIErr relaymodel.TextResponse
 		if err = json.Unmarshal(responseBody, &openAIErr); err == nil {
 			if openAIErr.Error.Message != "" {
-				return errorWrapper(fmt.Errorf("type %s, code %v, message %s", openAIErr.Error.Type, openAIErr.Error.Code, openAIErr.Error.Message), "request_error", http.StatusInternalServerError)
+				return util.UpstreamErrorWrapper(fmt.Errorf("type %s, code %v, message %s", openAIErr.Error.Type, openAIErr.Error.Code, openAIErr.Error.Message), "request_error", http.StatusInternalServerError)
 			}
 		}
 
@@ -173,12 +207,12 @@ func relayAudioHelper(c *gin.Context, relayMode int) *OpenAIErrorWithStatusCode
 		case "vtt":
 			text, err = getTextFromVTT(responseBody)
 		default:
-			return errorWrapper(errors.New("unexpected_response_format"), "unexpected_response_format", http.StatusInternalServerError)
+			return util.ErrorWrapper(errors.New("unexpected_response_format"), "unexpected_response_format", http.StatusInternalServerError)
 		}
 		if err != nil {
-			return errorWrapper(err, "get_text_from_body_err", http.StatusInternalServerError)
+			return util.ErrorWrapper(err, "get_text_from_body_err", http.StatusInternalServerError)
 		}
-		quota = countTokenText(text, audioModel)
+		quota = util.CountTokenText(text, audioModel)
 		resp.Body = io.NopCloser(bytes.NewBuffer(responseBody))
 	}
 	if resp.StatusCode != http.StatusOK {
@@ -194,11 +228,11 @@ func relayAudioHelper(c *gin.Context, relayMode int) *OpenAIErrorWithStatusCode
 				}()
 			}(c.Request.Context())
 		}
-		return relayErrorHandler(resp)
+		return util.RelayErrorHandler(resp)
 	}
 	quotaDelta := quota - preConsumedQuota
 	defer func(ctx context.Context) {
-		go postConsumeQuota(ctx, tokenId, quotaDelta, quota, userId, channelId, modelRatio, groupRatio, audioModel, tokenName)
+		go postConsumeQuota(ctx, tokenId, quotaDelta, quota, userId, channelId, channelKeyId, modelRatio, groupRatio, audioModel, tokenName)
 	}(c.Request.Context())
 
 	for k, v := range resp.Header {
@@ -208,11 +242,11 @@ func relayAudioHelper(c *gin.Context, relayMode int) *OpenAIErrorWithStatusCode
 
 	_, err = io.Copy(c.Writer, resp.Body)
 	if err != nil {
-		return errorWrapper(err, "copy_response_body_failed", http.StatusInternalServerError)
+		return util.ErrorWrapper(err, "copy_response_body_failed", http.StatusInternalServerError)
 	}
 	err = resp.Body.Close()
 	if err != nil {
-		return errorWrapper(err, "close_response_body_failed", http.StatusInternalServerError)
+		return util.ErrorWrapper(err, "close_response_body_failed", http.StatusInternalServerError)
 	}
 	return nil
 }
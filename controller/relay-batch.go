@@ -0,0 +1,417 @@
+package controller
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"one-api/common"
+	"one-api/model"
+	relaymodel "one-api/relay/model"
+	"one-api/relay/util"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func relayBatchHelper(c *gin.Context) *relaymodel.OpenAIErrorWithStatusCode {
+	ctx := c.Request.Context()
+	isCreation := c.Request.Method == http.MethodPost && c.Param("id") == ""
+	if isCreation {
+		// the cost of a batch is only known once it completes
+		if relayErr := checkUserQuota(c); relayErr != nil {
+			return relayErr
+		}
+		if relayErr := checkBatchModels(c); relayErr != nil {
+			return relayErr
+		}
+	}
+	responseBody, relayErr := doUpstreamJSONRequest(c)
+	if relayErr != nil {
+		return relayErr
+	}
+	var batchResponse relaymodel.Batch
+	err := json.Unmarshal(responseBody, &batchResponse)
+	if err == nil && batchResponse.Id == "" {
+		err = errors.New("upstream returned no batch id")
+	}
+	if err != nil {
+		return util.ErrorWrapper(err, "unmarshal_response_body_failed", http.StatusInternalServerError)
+	}
+	if isCreation {
+		batch := model.Batch{
+			BatchId:      batchResponse.Id,
+			UserId:       c.GetInt("id"),
+			TokenId:      c.GetInt("token_id"),
+			ChannelId:    c.GetInt("channel_id"),
+			ChannelKeyId: c.GetInt("channel_key_id"),
+			Endpoint:     batchResponse.Endpoint,
+			InputFileId:  batchResponse.InputFileId,
+			Status:       batchResponse.Status,
+			Data:         string(responseBody),
+			CreatedTime:  common.GetTimestamp(),
+			UpdatedTime:  common.GetTimestamp(),
+		}
+		err = batch.Insert(ctx)
+		if err != nil {
+			return util.ErrorWrapper(err, "insert_batch_failed", http.StatusInternalServerError)
+		}
+	} else if batch, ok := c.Get("batch"); ok {
+		err = updateBatchRecord(ctx, batch.(*model.Batch), &batchResponse, responseBody)
+		if err != nil {
+			common.LogError(ctx, "failed to update batch record: "+err.Error())
+		}
+	}
+	return writeUpstreamJSONResponse(c, responseBody)
+}
+
+// checkBatchModels rejects a batch whose input file has a request for a model
+// the group of the user may not use on the channel running the batch
+func checkBatchModels(c *gin.Context) *relaymodel.OpenAIErrorWithStatusCode {
+	ctx := c.Request.Context()
+	var request relaymodel.Batch
+	err := common.UnmarshalBodyReusable(c, &request)
+	if err != nil {
+		relayErr := util.ErrorWrapper(err, "invalid_batch_request", http.StatusBadRequest)
+		relayErr.Type = "invalid_request_error"
+		return relayErr
+	}
+	channel, err := model.GetChannelById(ctx, c.GetInt("channel_id"), true)
+	if err != nil {
+		return util.ErrorWrapper(err, "get_channel_failed", http.StatusInternalServerError)
+	}
+	requestModels, err := getBatchRequestModels(ctx, channel, c.GetInt("channel_key_id"), request.InputFileId)
+	if err != nil {
+		return util.ErrorWrapper(err, "read_batch_input_failed", http.StatusInternalServerError)
+	}
+	group := c.GetString("group")
+	checked := make(map[string]bool)
+	for customId, modelName := range requestModels {
+		if checked[modelName] {
+			continue
+		}
+		ok, err := model.HasChannelAbility(ctx, group, modelName, channel.Id)
+		if err != nil {
+			return util.ErrorWrapper(err, "check_ability_failed", http.StatusInternalServerError)
+		}
+		if !ok {
+			err = fmt.Errorf("model %s of request %s is not available in group %s", modelName, customId, group)
+			relayErr := util.ErrorWrapper(err, "model_not_available", http.StatusBadRequest)
+			relayErr.Type = "invalid_request_error"
+			return relayErr
+		}
+		checked[modelName] = true
+	}
+	return nil
+}
+
+// doUpstreamJSONRequest relays the request as it is to the upstream of the
+// selected channel and returns the body of the successful response
+func doUpstreamJSONRequest(c *gin.Context) ([]byte, *relaymodel.OpenAIErrorWithStatusCode) {
+	var requestBody io.Reader
+	if c.Request.Method == http.MethodPost {
+		originRequestBody, err := common.GetRequestBody(c)
+		if err != nil {
+			return nil, util.ErrorWrapper(err, "read_request_body_failed", http.StatusInternalServerError)
+		}
+		requestBody = bytes.NewReader(originRequestBody)
+	}
+	req, err := http.NewRequestWithContext(c.Request.Context(), c.Request.Method, getUpstreamRequestURL(c), requestBody)
+	if err != nil {
+		return nil, util.ErrorWrapper(err, "new_request_failed", http.StatusInternalServerError)
+	}
+	err = setupUpstreamAuthorization(c, req)
+	if err != nil {
+		return nil, util.ErrorWrapper(err, "setup_upstream_authorization_failed", http.StatusInternalServerError)
+	}
+	req.Header.Set("Content-Type", c.Request.Header.Get("Content-Type"))
+	req.Header.Set("Accept", c.Request.Header.Get("Accept"))
+	client, err := util.GetHTTPClient(c)
+	if err != nil {
+		return nil, util.ErrorWrapper(err, "get_http_client_failed", http.StatusInternalServerError)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, util.UpstreamErrorWrapper(err, "do_request_failed", http.StatusInternalServerError)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, util.RelayErrorHandler(resp)
+	}
+	responseBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, util.UpstreamErrorWrapper(err, "read_response_body_failed", http.StatusInternalServerError)
+	}
+	err = resp.Body.Close()
+	if err != nil {
+		return nil, util.ErrorWrapper(err, "close_response_body_failed", http.StatusInternalServerError)
+	}
+	return responseBody, nil
+}
+
+func writeUpstreamJSONResponse(c *gin.Context, responseBody []byte) *relaymodel.OpenAIErrorWithStatusCode {
+	c.Writer.Header().Set("Content-Type", "application/json")
+	c.Writer.WriteHeader(http.StatusOK)
+	_, err := c.Writer.Write(responseBody)
+	if err != nil {
+		return util.ErrorWrapper(err, "write_response_body_failed", http.StatusInternalServerError)
+	}
+	return nil
+}
+
+// updateBatchRecord stores the batch as last seen upstream, its output files
+// are recorded for the user so that they can be downloaded through the gateway.
+func updateBatchRecord(ctx context.Context, batch *model.Batch, object *relaymodel.Batch, data []byte) error {
+	batch.OutputFileId = object.OutputFileId
+	batch.ErrorFileId = object.ErrorFileId
+	batch.Status = object.Status
+	batch.Data = string(data)
+	batch.UpdatedTime = common.GetTimestamp()
+	for _, fileId := range []string{object.OutputFileId, object.ErrorFileId} {
+		if fileId == "" {
+			continue
+		}
+		file := model.File{
+			FileId:       fileId,
+			UserId:       batch.UserId,
+			TokenId:      batch.TokenId,
+			ChannelId:    batch.ChannelId,
+			ChannelKeyId: batch.ChannelKeyId,
+			Purpose:      "batch_output",
+			CreatedTime:  common.GetTimestamp(),
+		}
+		err := file.Record(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	return batch.Update(ctx)
+}
+
+// ListBatches lists the batches of the user as they were last seen upstream
+func ListBatches(c *gin.Context) {
+	limit, _ := strconv.Atoi(c.Query("limit"))
+	if limit <= 0 || limit > 100 {
+		limit = 20
+	}
+	batches, err := model.GetUserBatches(c.Request.Context(), c.GetInt("id"), c.Query("after"), limit+1)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": relaymodel.OpenAIError{
+				Message: common.MessageWithRequestId(err.Error(), c.GetString(common.RequestIdKey)),
+				Type:    "one_api_error",
+				Code:    "list_batches_failed",
+			},
+		})
+		return
+	}
+	batchList := relaymodel.BatchList{
+		Object: "list",
+		Data:   make([]json.RawMessage, 0, limit),
+	}
+	if len(batches) > limit {
+		batches = batches[:limit]
+		batchList.HasMore = true
+	}
+	for _, batch := range batches {
+		if batchList.FirstId == nil {
+			batchList.FirstId = batch.BatchId
+		}
+		batchList.LastId = batch.BatchId
+		batchList.Data = append(batchList.Data, json.RawMessage(batch.Data))
+	}
+	c.JSON(http.StatusOK, batchList)
+}
+
+// AutomaticallyUpdateBatches polls the unfinished batches and bills the ones
+// that have finished
+func AutomaticallyUpdateBatches(ctx context.Context, frequency int) {
+	for {
+		time.Sleep(time.Duration(frequency) * time.Minute)
+		batches, err := model.GetUnsettledBatches(ctx)
+		if err != nil {
+			common.SysError("failed to get unsettled batches: " + err.Error())
+			continue
+		}
+		for _, batch := range batches {
+			err = updateBatch(ctx, batch)
+			if err != nil {
+				common.SysError(fmt.Sprintf("failed to update batch %s: %s", batch.BatchId, err.Error()))
+			}
+		}
+	}
+}
+
+func updateBatch(ctx context.Context, batch *model.Batch) error {
+	channel, err := model.GetChannelById(ctx, batch.ChannelId, true)
+	if err != nil {
+		return err
+	}
+	resp, err := doChannelRequest(ctx, channel, batch.ChannelKeyId, "/v1/batches/"+batch.BatchId)
+	if err != nil {
+		return err
+	}
+	data, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	var object relaymodel.Batch
+	err = json.Unmarshal(data, &object)
+	if err != nil {
+		return err
+	}
+	err = updateBatchRecord(ctx, batch, &object, data)
+	if err != nil {
+		return err
+	}
+	if !object.IsTerminal() {
+		return nil
+	}
+	// failed, cancelled and expired batches are billed for the requests that
+	// completed before they stopped
+	usages := make(map[string]*relaymodel.Usage)
+	if object.OutputFileId != "" {
+		usages, err = getBatchUsages(ctx, channel, batch.ChannelKeyId, batch.InputFileId, object.OutputFileId)
+		if err != nil {
+			return err
+		}
+	}
+	settled, err := model.MarkBatchSettled(ctx, batch.BatchId)
+	if err != nil || !settled {
+		return err
+	}
+	meta, group := getBillingMeta(ctx, batch.UserId, batch.TokenId, batch.ChannelId)
+	groupRatio := common.GetGroupRatio(group)
+	for modelName, usage := range usages {
+		modelRatio := common.GetModelRatio(modelName) * common.GetBatchRatio(modelName)
+		postConsumeTextQuota(ctx, usage, meta, modelName, modelRatio*groupRatio, 0, modelRatio, groupRatio)
+	}
+	return nil
+}
+
+// getBatchRequestModels returns the model requested by each request of the
+// input file of a batch, by custom id
+func getBatchRequestModels(ctx context.Context, channel *model.Channel, keyId int, inputFileId string) (map[string]string, error) {
+	modelMap := make(map[string]string)
+	if modelMapping := channel.GetModelMapping(); modelMapping != "" {
+		err := json.Unmarshal([]byte(modelMapping), &modelMap)
+		if err != nil {
+			return nil, err
+		}
+	}
+	resp, err := doChannelRequest(ctx, channel, keyId, "/v1/files/"+inputFileId+"/content")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	requestModels := make(map[string]string)
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var line relaymodel.BatchInputLine
+		if json.Unmarshal(scanner.Bytes(), &line) != nil {
+			continue
+		}
+		requestModels[line.CustomId] = getRequestedModel(modelMap, line.Body.Model)
+	}
+	return requestModels, scanner.Err()
+}
+
+// getRequestedModel undoes the model mapping of the channel, the requests of a
+// batch reach the upstream as they are in the input file, so they may name
+// the model the mapping leads to
+func getRequestedModel(modelMap map[string]string, modelName string) string {
+	requestedModel := ""
+	for from, to := range modelMap {
+		if to == modelName && (requestedModel == "" || from < requestedModel) {
+			requestedModel = from
+		}
+	}
+	if requestedModel == "" {
+		return modelName
+	}
+	return requestedModel
+}
+
+// getBatchUsages sums the usage of the successful requests in the output file
+// of a batch by the model they requested, rather than the model the upstream
+// reports, which may be a dated version that has no ratio of its own
+func getBatchUsages(ctx context.Context, channel *model.Channel, keyId int, inputFileId string, outputFileId string) (map[string]*relaymodel.Usage, error) {
+	requestModels, err := getBatchRequestModels(ctx, channel, keyId, inputFileId)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := doChannelRequest(ctx, channel, keyId, "/v1/files/"+outputFileId+"/content")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	usages := make(map[string]*relaymodel.Usage)
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var line relaymodel.BatchOutputLine
+		if json.Unmarshal(scanner.Bytes(), &line) != nil {
+			continue
+		}
+		if line.Response == nil || line.Response.StatusCode != http.StatusOK || line.Response.Body.Usage == nil {
+			continue
+		}
+		modelName, ok := requestModels[line.CustomId]
+		if !ok {
+			modelName = line.Response.Body.Model
+		}
+		usage, ok := usages[modelName]
+		if !ok {
+			usage = &relaymodel.Usage{}
+			usages[modelName] = usage
+		}
+		usage.PromptTokens += line.Response.Body.Usage.PromptTokens
+		usage.CompletionTokens += line.Response.Body.Usage.CompletionTokens
+		usage.TotalTokens += line.Response.Body.Usage.TotalTokens
+	}
+	return usages, scanner.Err()
+}
+
+// doChannelRequest gets a path of the OpenAI API from the upstream of the
+// channel with one of its keys, outside of any relayed request
+func doChannelRequest(ctx context.Context, channel *model.Channel, keyId int, path string) (*http.Response, error) {
+	key, err := channel.GetKeyById(ctx, keyId)
+	if err != nil {
+		return nil, err
+	}
+	config := channel.GetConfig()
+	apiVersion := config.Azure.GetAPIVersion(common.AzureEndpointDefault, channel.Other)
+	requestURL := getUpstreamURL(channel.Type, channel.GetBaseURL(), apiVersion, &url.URL{Path: path})
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, requestURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	err = setupUpstreamKey(req, channel.Id, channel.Type, config, key)
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(path, "/v1/threads/") {
+		// the assistants API is only served with its beta header
+		req.Header.Set("OpenAI-Beta", "assistants=v2")
+	}
+	client, err := util.GetChannelHTTPClient(channel.Id, config)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(util.RelayErrorHandler(resp).Message)
+	}
+	return resp, nil
+}
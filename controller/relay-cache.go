@@ -0,0 +1,168 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"one-api/common"
+	"one-api/model"
+	"one-api/relay/constant"
+	relaymodel "one-api/relay/model"
+	"one-api/relay/util"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// responses larger than this are not cached
+const maxCachedResponseSize = 1024 * 1024
+
+// getResponseCacheKey returns the key of the request in the response cache, or
+// an empty string if the request is not to be cached. Only the deterministic
+// requests of the tokens that opted in are cached: embeddings, and chat
+// completions at temperature 0.
+func getResponseCacheKey(c *gin.Context, relayMode int, textRequest *relaymodel.GeneralOpenAIRequest) string {
+	if !common.ResponseCacheEnabled || !c.GetBool("token_response_cache") {
+		return ""
+	}
+	switch relayMode {
+	case constant.RelayModeEmbeddings:
+	case constant.RelayModeChatCompletions:
+		// an omitted temperature defaults to 1
+		var request struct {
+			Temperature *float64 `json:"temperature"`
+		}
+		err := common.UnmarshalBodyReusable(c, &request)
+		if err != nil || request.Temperature == nil || *request.Temperature != 0 || textRequest.N > 1 {
+			return ""
+		}
+	default:
+		return ""
+	}
+	// the raw body is hashed, so that every field counts, even the ones the
+	// gateway does not know. It is decoded and encoded again to ignore the
+	// order of the fields and the spacing, and the end-user is left out since
+	// it does not change the response.
+	requestBody, err := common.GetRequestBody(c)
+	if err != nil {
+		return ""
+	}
+	var fields map[string]any
+	decoder := json.NewDecoder(bytes.NewReader(requestBody))
+	decoder.UseNumber()
+	if decoder.Decode(&fields) != nil {
+		return ""
+	}
+	delete(fields, "user")
+	jsonData, err := json.Marshal(fields)
+	if err != nil {
+		return ""
+	}
+	hash := sha256.New()
+	// the model may come from the path rather than the body
+	hash.Write([]byte(fmt.Sprintf("%d\n%s\n%s\n", relayMode, c.GetString("group"), textRequest.Model)))
+	hash.Write(jsonData)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// responseCaptureWriter keeps a copy of the response written by an adaptor, up
+// to limit bytes
+type responseCaptureWriter struct {
+	gin.ResponseWriter
+	body     bytes.Buffer
+	limit    int
+	overflow bool
+}
+
+func (w *responseCaptureWriter) capture(data []byte) {
+	if w.overflow {
+		return
+	}
+	if w.body.Len()+len(data) > w.limit {
+		if room := w.limit - w.body.Len(); room > 0 {
+			w.body.Write(data[:room])
+		}
+		w.overflow = true
+		return
+	}
+	w.body.Write(data)
+}
+
+func (w *responseCaptureWriter) Write(data []byte) (int, error) {
+	w.capture(data)
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *responseCaptureWriter) WriteString(s string) (int, error) {
+	w.capture([]byte(s))
+	return w.ResponseWriter.WriteString(s)
+}
+
+func cacheResponse(ctx context.Context, key string, w *responseCaptureWriter, usage *relaymodel.Usage) {
+	if w.overflow || w.body.Len() > maxCachedResponseSize || w.Status() != http.StatusOK || usage == nil {
+		return
+	}
+	entry := &model.ResponseCacheEntry{
+		Body:             w.body.Bytes(),
+		PromptTokens:     usage.PromptTokens,
+		CompletionTokens: usage.CompletionTokens,
+	}
+	err := model.CacheSetResponse(ctx, key, entry, time.Duration(common.ResponseCacheTTL)*time.Second)
+	if err != nil {
+		common.LogError(ctx, "failed to cache response: "+err.Error())
+	}
+}
+
+// relayCachedResponse answers the request from the response cache, streamed
+// responses are replayed event by event
+func relayCachedResponse(c *gin.Context, entry *model.ResponseCacheEntry, meta *util.RelayMeta, modelName string, preConsumedQuota int, modelRatio float64, groupRatio float64) *relaymodel.OpenAIErrorWithStatusCode {
+	ctx := c.Request.Context()
+	c.Set("response_cached", true)
+	c.Header("X-Cache", "HIT")
+	if meta.IsStream {
+		util.SetEventStreamHeaders(c)
+		c.Writer.WriteHeader(http.StatusOK)
+		for _, event := range bytes.SplitAfter(entry.Body, []byte("\n\n")) {
+			if len(event) == 0 {
+				continue
+			}
+			_, err := c.Writer.Write(event)
+			if err != nil {
+				break
+			}
+			c.Writer.Flush()
+		}
+	} else {
+		c.Writer.Header().Set("Content-Type", "application/json")
+		c.Writer.WriteHeader(http.StatusOK)
+		_, err := c.Writer.Write(entry.Body)
+		if err != nil {
+			returnPreConsumedQuota(ctx, preConsumedQuota, meta.TokenId)
+			return util.ErrorWrapper(err, "write_response_body_failed", http.StatusInternalServerError)
+		}
+	}
+	ctx = common.Detach(ctx)
+	completionRatio := common.GetCompletionRatio(modelName)
+	ratio := modelRatio * groupRatio * common.ResponseCacheHitRatio
+	quota := int(math.Ceil((float64(entry.PromptTokens) + float64(entry.CompletionTokens)*completionRatio) * ratio))
+	err := model.PostConsumeTokenQuota(ctx, meta.TokenId, quota-preConsumedQuota)
+	if err != nil {
+		common.LogError(ctx, "error consuming token remain quota: "+err.Error())
+	}
+	err = model.CacheUpdateUserQuota(ctx, meta.UserId)
+	if err != nil {
+		common.LogError(ctx, "error update user quota cache: "+err.Error())
+	}
+	if c.GetBool("token_transcript") {
+		recordTranscript(c, meta, entry.Body)
+	}
+	logContent := fmt.Sprintf("模型倍率 %.2f，分组倍率 %.2f，缓存命中倍率 %.2f", modelRatio, groupRatio, common.ResponseCacheHitRatio)
+	model.RecordCacheHitLog(ctx, meta.UserId, entry.PromptTokens, entry.CompletionTokens, modelName, meta.TokenName, quota, logContent)
+	model.UpdateUserUsedQuotaAndRequestCount(ctx, meta.UserId, quota)
+	return nil
+}
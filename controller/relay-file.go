@@ -0,0 +1,188 @@
+package controller
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"one-api/common"
+	"one-api/model"
+	relaymodel "one-api/relay/model"
+	"one-api/relay/util"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// getUpstreamRequestURL returns the upstream URL of an OpenAI API without a
+// model in its path, such as files, which Azure serves under /openai.
+func getUpstreamRequestURL(c *gin.Context) string {
+	return getUpstreamURL(c.GetInt("channel"), c.GetString("base_url"), util.GetAzureAPIVersion(c, common.AzureEndpointDefault), c.Request.URL)
+}
+
+func getUpstreamURL(channelType int, baseURL string, apiVersion string, requestURL *url.URL) string {
+	if baseURL == "" {
+		baseURL = common.ChannelBaseURLs[channelType]
+	}
+	if channelType == common.ChannelTypeAzure {
+		path := strings.TrimPrefix(requestURL.Path, "/v1")
+		query := requestURL.Query()
+		query.Set("api-version", apiVersion)
+		return fmt.Sprintf("%s/openai%s?%s", baseURL, path, query.Encode())
+	}
+	return util.GetFullRequestURL(baseURL, requestURL.String(), channelType)
+}
+
+func setupUpstreamAuthorization(c *gin.Context, req *http.Request) error {
+	key := strings.TrimPrefix(c.Request.Header.Get("Authorization"), "Bearer ")
+	return setupUpstreamKey(req, c.GetInt("channel_id"), c.GetInt("channel"), util.GetChannelConfig(c), key)
+}
+
+func setupUpstreamKey(req *http.Request, channelId int, channelType int, config *common.ChannelConfig, key string) error {
+	if channelType == common.ChannelTypeAzure {
+		return util.SetupAzureAuthorization(req.Context(), req, channelId, config, key)
+	}
+	req.Header.Set("Authorization", "Bearer "+key)
+	return nil
+}
+
+func relayFileHelper(c *gin.Context) *relaymodel.OpenAIErrorWithStatusCode {
+	ctx := c.Request.Context()
+	var requestBody io.Reader
+	contentType := c.Request.Header.Get("Content-Type")
+	isUpload := c.Request.Method == http.MethodPost
+	if isUpload {
+		originRequestBody, err := common.GetRequestBody(c)
+		if err != nil {
+			return util.ErrorWrapper(err, "read_request_body_failed", http.StatusInternalServerError)
+		}
+		// the model field only chooses the channel, it is not sent upstream
+		form, formContentType, err := common.RewriteMultipartForm(originRequestBody, contentType, nil, "model")
+		if err != nil {
+			return util.ErrorWrapper(err, "rewrite_request_body_failed", http.StatusBadRequest)
+		}
+		// ends the goroutine writing the form if the request is not sent
+		defer form.Close()
+		requestBody, contentType = form, formContentType
+	}
+	req, err := http.NewRequestWithContext(ctx, c.Request.Method, getUpstreamRequestURL(c), requestBody)
+	if err != nil {
+		return util.ErrorWrapper(err, "new_request_failed", http.StatusInternalServerError)
+	}
+	err = setupUpstreamAuthorization(c, req)
+	if err != nil {
+		return util.ErrorWrapper(err, "setup_upstream_authorization_failed", http.StatusInternalServerError)
+	}
+	if isUpload {
+		req.Header.Set("Content-Type", contentType)
+	}
+	req.Header.Set("Accept", c.Request.Header.Get("Accept"))
+	client, err := util.GetHTTPClient(c)
+	if err != nil {
+		return util.ErrorWrapper(err, "get_http_client_failed", http.StatusInternalServerError)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return util.UpstreamErrorWrapper(err, "do_request_failed", http.StatusInternalServerError)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return util.RelayErrorHandler(resp)
+	}
+	if c.Request.Method == http.MethodGet && strings.HasSuffix(c.Request.URL.Path, "/content") {
+		// file content may be large, stream it as it is
+		for k, v := range resp.Header {
+			c.Writer.Header().Set(k, v[0])
+		}
+		c.Writer.WriteHeader(resp.StatusCode)
+		_, err = io.Copy(c.Writer, resp.Body)
+		if err != nil {
+			return util.ErrorWrapper(err, "copy_response_body_failed", http.StatusInternalServerError)
+		}
+		err = resp.Body.Close()
+		if err != nil {
+			return util.ErrorWrapper(err, "close_response_body_failed", http.StatusInternalServerError)
+		}
+		return nil
+	}
+	responseBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return util.UpstreamErrorWrapper(err, "read_response_body_failed", http.StatusInternalServerError)
+	}
+	err = resp.Body.Close()
+	if err != nil {
+		return util.ErrorWrapper(err, "close_response_body_failed", http.StatusInternalServerError)
+	}
+	switch c.Request.Method {
+	case http.MethodPost:
+		var fileResponse relaymodel.File
+		err = json.Unmarshal(responseBody, &fileResponse)
+		if err == nil && fileResponse.Id == "" {
+			err = errors.New("upstream returned no file id")
+		}
+		if err != nil {
+			return util.ErrorWrapper(err, "unmarshal_response_body_failed", http.StatusInternalServerError)
+		}
+		file := model.File{
+			FileId:       fileResponse.Id,
+			UserId:       c.GetInt("id"),
+			TokenId:      c.GetInt("token_id"),
+			ChannelId:    c.GetInt("channel_id"),
+			ChannelKeyId: c.GetInt("channel_key_id"),
+			Filename:     fileResponse.Filename,
+			Purpose:      fileResponse.Purpose,
+			Bytes:        fileResponse.Bytes,
+			CreatedTime:  common.GetTimestamp(),
+		}
+		err = file.Insert(ctx)
+		if err != nil {
+			return util.ErrorWrapper(err, "insert_file_failed", http.StatusInternalServerError)
+		}
+	case http.MethodDelete:
+		if file, ok := c.Get("file"); ok {
+			err = file.(*model.File).Delete(ctx)
+			if err != nil {
+				common.LogError(ctx, "failed to delete file record: "+err.Error())
+			}
+		}
+	}
+	c.Writer.Header().Set("Content-Type", "application/json")
+	c.Writer.WriteHeader(resp.StatusCode)
+	_, err = c.Writer.Write(responseBody)
+	if err != nil {
+		return util.ErrorWrapper(err, "write_response_body_failed", http.StatusInternalServerError)
+	}
+	return nil
+}
+
+// ListFiles lists the files uploaded by the user, no upstream is involved
+// since the files may be spread over several channels.
+func ListFiles(c *gin.Context) {
+	files, err := model.GetUserFiles(c.Request.Context(), c.GetInt("id"), c.Query("purpose"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": relaymodel.OpenAIError{
+				Message: common.MessageWithRequestId(err.Error(), c.GetString(common.RequestIdKey)),
+				Type:    "one_api_error",
+				Code:    "list_files_failed",
+			},
+		})
+		return
+	}
+	fileList := relaymodel.FileList{
+		Object: "list",
+		Data:   make([]relaymodel.File, 0, len(files)),
+	}
+	for _, file := range files {
+		fileList.Data = append(fileList.Data, relaymodel.File{
+			Id:        file.FileId,
+			Object:    "file",
+			Bytes:     file.Bytes,
+			CreatedAt: file.CreatedTime,
+			Filename:  file.Filename,
+			Purpose:   file.Purpose,
+		})
+	}
+	c.JSON(http.StatusOK, fileList)
+}
@@ -0,0 +1,183 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"one-api/common"
+	"one-api/model"
+	relaymodel "one-api/relay/model"
+	"one-api/relay/util"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func relayFineTuningHelper(c *gin.Context) *relaymodel.OpenAIErrorWithStatusCode {
+	ctx := c.Request.Context()
+	isCreation := c.Request.Method == http.MethodPost && c.Param("id") == ""
+	if isCreation {
+		// the cost of the training is only known once the job succeeds
+		if relayErr := checkUserQuota(c); relayErr != nil {
+			return relayErr
+		}
+	}
+	responseBody, relayErr := doUpstreamJSONRequest(c)
+	if relayErr != nil {
+		return relayErr
+	}
+	if strings.HasSuffix(c.Request.URL.Path, "/events") || strings.HasSuffix(c.Request.URL.Path, "/checkpoints") {
+		return writeUpstreamJSONResponse(c, responseBody)
+	}
+	var jobResponse relaymodel.FineTuningJob
+	err := json.Unmarshal(responseBody, &jobResponse)
+	if err == nil && jobResponse.Id == "" {
+		err = errors.New("upstream returned no job id")
+	}
+	if err != nil {
+		return util.ErrorWrapper(err, "unmarshal_response_body_failed", http.StatusInternalServerError)
+	}
+	if isCreation {
+		job := model.FineTuningJob{
+			JobId:        jobResponse.Id,
+			UserId:       c.GetInt("id"),
+			TokenId:      c.GetInt("token_id"),
+			ChannelId:    c.GetInt("channel_id"),
+			ChannelKeyId: c.GetInt("channel_key_id"),
+			Group:        c.GetString("group"),
+			Model:        jobResponse.Model,
+			Status:       jobResponse.Status,
+			Data:         string(responseBody),
+			CreatedTime:  common.GetTimestamp(),
+			UpdatedTime:  common.GetTimestamp(),
+		}
+		err = job.Insert(ctx)
+		if err != nil {
+			return util.ErrorWrapper(err, "insert_fine_tuning_job_failed", http.StatusInternalServerError)
+		}
+	} else if job, ok := c.Get("fine_tuning_job"); ok {
+		err = updateFineTuningJobRecord(ctx, job.(*model.FineTuningJob), &jobResponse, responseBody)
+		if err != nil {
+			common.LogError(ctx, "failed to update fine-tuning job record: "+err.Error())
+		}
+	}
+	return writeUpstreamJSONResponse(c, responseBody)
+}
+
+// updateFineTuningJobRecord stores the job as last seen upstream. Once the job
+// succeeds, the fine-tuned model is added to the channel and the training is
+// billed to the token that created the job. The model is added before the job
+// is settled, so that a failure leaves the job to be settled again, adding it
+// twice does no harm, while billing twice would.
+func updateFineTuningJobRecord(ctx context.Context, job *model.FineTuningJob, object *relaymodel.FineTuningJob, data []byte) error {
+	job.FineTunedModel = object.FineTunedModel
+	job.Status = object.Status
+	job.Data = string(data)
+	job.UpdatedTime = common.GetTimestamp()
+	err := job.Update(ctx)
+	if err != nil {
+		return err
+	}
+	if !object.IsTerminal() {
+		return nil
+	}
+	succeeded := object.Status == "succeeded" && object.FineTunedModel != ""
+	if succeeded {
+		err = job.AddAbility(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	settled, err := model.MarkFineTuningJobSettled(ctx, job.JobId)
+	if err != nil || !settled || !succeeded {
+		return err
+	}
+	common.LogInfo(ctx, fmt.Sprintf("fine-tuned model %s added to channel #%d for group %s", job.FineTunedModel, job.ChannelId, job.Group))
+	meta, group := getBillingMeta(ctx, job.UserId, job.TokenId, job.ChannelId)
+	modelRatio := common.GetTrainingRatio(job.Model)
+	groupRatio := common.GetGroupRatio(group)
+	usage := &relaymodel.Usage{
+		PromptTokens: object.TrainedTokens,
+		TotalTokens:  object.TrainedTokens,
+	}
+	postConsumeTextQuota(ctx, usage, meta, job.FineTunedModel, modelRatio*groupRatio, 0, modelRatio, groupRatio)
+	return nil
+}
+
+// ListFineTuningJobs lists the fine-tuning jobs of the user as they were last
+// seen upstream
+func ListFineTuningJobs(c *gin.Context) {
+	limit, _ := strconv.Atoi(c.Query("limit"))
+	if limit <= 0 || limit > 100 {
+		limit = 20
+	}
+	jobs, err := model.GetUserFineTuningJobs(c.Request.Context(), c.GetInt("id"), c.Query("after"), limit+1)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": relaymodel.OpenAIError{
+				Message: common.MessageWithRequestId(err.Error(), c.GetString(common.RequestIdKey)),
+				Type:    "one_api_error",
+				Code:    "list_fine_tuning_jobs_failed",
+			},
+		})
+		return
+	}
+	jobList := relaymodel.FineTuningJobList{
+		Object: "list",
+		Data:   make([]json.RawMessage, 0, limit),
+	}
+	if len(jobs) > limit {
+		jobs = jobs[:limit]
+		jobList.HasMore = true
+	}
+	for _, job := range jobs {
+		jobList.Data = append(jobList.Data, json.RawMessage(job.Data))
+	}
+	c.JSON(http.StatusOK, jobList)
+}
+
+// AutomaticallyUpdateFineTuningJobs polls the unfinished fine-tuning jobs, so
+// that fine-tuned models become available without the user asking for them
+func AutomaticallyUpdateFineTuningJobs(ctx context.Context, frequency int) {
+	for {
+		time.Sleep(time.Duration(frequency) * time.Minute)
+		jobs, err := model.GetUnsettledFineTuningJobs(ctx)
+		if err != nil {
+			common.SysError("failed to get unsettled fine-tuning jobs: " + err.Error())
+			continue
+		}
+		for _, job := range jobs {
+			err = updateFineTuningJob(ctx, job)
+			if err != nil {
+				common.SysError(fmt.Sprintf("failed to update fine-tuning job %s: %s", job.JobId, err.Error()))
+			}
+		}
+	}
+}
+
+func updateFineTuningJob(ctx context.Context, job *model.FineTuningJob) error {
+	channel, err := model.GetChannelById(ctx, job.ChannelId, true)
+	if err != nil {
+		return err
+	}
+	resp, err := doChannelRequest(ctx, channel, job.ChannelKeyId, "/v1/fine_tuning/jobs/"+job.JobId)
+	if err != nil {
+		return err
+	}
+	data, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	var object relaymodel.FineTuningJob
+	err = json.Unmarshal(data, &object)
+	if err != nil {
+		return err
+	}
+	return updateFineTuningJobRecord(ctx, job, &object, data)
+}
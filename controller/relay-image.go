@@ -10,6 +10,10 @@ import (
 	"net/http"
 	"one-api/common"
 	"one-api/model"
+	"one-api/relay/constant"
+	relaymodel "one-api/relay/model"
+	"one-api/relay/util"
+	"strconv"
 	"strings"
 
 	"github.com/gin-gonic/gin"
@@ -26,7 +30,53 @@ func isWithinRange(element string, value int) bool {
 	return value >= min && value <= max
 }
 
-func relayImageHelper(c *gin.Context, relayMode int) *OpenAIErrorWithStatusCode {
+// getImageRequest reads the request, edits and variations are sent as multipart forms
+func getImageRequest(c *gin.Context, relayMode int) (*ImageRequest, error) {
+	imageRequest := &ImageRequest{}
+	if relayMode == constant.RelayModeImagesGenerations {
+		err := common.UnmarshalBodyReusable(c, imageRequest)
+		return imageRequest, err
+	}
+	requestBody, err := common.GetRequestBody(c)
+	if err != nil {
+		return nil, err
+	}
+	fields, err := common.ParseMultipartFormFields(requestBody, c.Request.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, err
+	}
+	imageRequest.Model = fields["model"]
+	imageRequest.Prompt = fields["prompt"]
+	imageRequest.Size = fields["size"]
+	imageRequest.ResponseFormat = fields["response_format"]
+	imageRequest.User = fields["user"]
+	if fields["n"] != "" {
+		imageRequest.N, err = strconv.Atoi(fields["n"])
+		if err != nil {
+			return nil, fmt.Errorf("invalid value of n: %s", fields["n"])
+		}
+	}
+	return imageRequest, nil
+}
+
+// rewriteMultipartRequest sends the mapped model and the fields patched by the
+// body operations of the channel in place of the ones of the client
+func rewriteMultipartRequest(body []byte, contentType string, modelName string, isModelMapped bool, config *common.ChannelConfig) (io.ReadCloser, string, error) {
+	fields, err := common.ParseMultipartFormFields(body, contentType)
+	if err != nil {
+		return nil, "", err
+	}
+	if isModelMapped {
+		fields["model"] = modelName
+	}
+	fields, removedFields, err := util.ApplyFormOverrides(fields, config)
+	if err != nil {
+		return nil, "", err
+	}
+	return common.RewriteMultipartForm(body, contentType, fields, removedFields...)
+}
+
+func relayImageHelper(c *gin.Context, relayMode int) *relaymodel.OpenAIErrorWithStatusCode {
 	ctx := c.Request.Context()
 	imageModel := "dall-e-2"
 	imageSize := "1024x1024"
@@ -37,10 +87,9 @@ func relayImageHelper(c *gin.Context, relayMode int) *OpenAIErrorWithStatusCode
 	userId := c.GetInt("id")
 	group := c.GetString("group")
 
-	var imageRequest ImageRequest
-	err := common.UnmarshalBodyReusable(c, &imageRequest)
+	imageRequest, err := getImageRequest(c, relayMode)
 	if err != nil {
-		return errorWrapper(err, "bind_request_body_failed", http.StatusBadRequest)
+		return util.ErrorWrapper(err, "bind_request_body_failed", http.StatusBadRequest)
 	}
 
 	// Size validation
@@ -65,22 +114,25 @@ func relayImageHelper(c *gin.Context, relayMode int) *OpenAIErrorWithStatusCode
 			}
 		}
 	} else {
-		return errorWrapper(errors.New("size not supported for this image model"), "size_not_supported", http.StatusBadRequest)
+		return util.ErrorWrapper(errors.New("size not supported for this image model"), "size_not_supported", http.StatusBadRequest)
 	}
 
-	// Prompt validation
-	if imageRequest.Prompt == "" {
-		return errorWrapper(errors.New("prompt is required"), "prompt_missing", http.StatusBadRequest)
+	// Prompt validation, variations take no prompt
+	if imageRequest.Prompt == "" && relayMode != constant.RelayModeImagesVariations {
+		return util.ErrorWrapper(errors.New("prompt is required"), "prompt_missing", http.StatusBadRequest)
 	}
 
 	// Check prompt length
 	if len(imageRequest.Prompt) > common.DalleImagePromptLengthLimitations[imageModel] {
-		return errorWrapper(errors.New("prompt is too long"), "prompt_too_long", http.StatusBadRequest)
+		return util.ErrorWrapper(errors.New("prompt is too long"), "prompt_too_long", http.StatusBadRequest)
 	}
 
 	// Number of generated images validation
+	if imageRequest.N == 0 {
+		imageRequest.N = 1
+	}
 	if isWithinRange(imageModel, imageRequest.N) == false {
-		return errorWrapper(errors.New("invalid value of n"), "n_not_within_range", http.StatusBadRequest)
+		return util.ErrorWrapper(errors.New("invalid value of n"), "n_not_within_range", http.StatusBadRequest)
 	}
 
 	// map model name
@@ -90,10 +142,11 @@ func relayImageHelper(c *gin.Context, relayMode int) *OpenAIErrorWithStatusCode
 		modelMap := make(map[string]string)
 		err := json.Unmarshal([]byte(modelMapping), &modelMap)
 		if err != nil {
-			return errorWrapper(err, "unmarshal_model_mapping_failed", http.StatusInternalServerError)
+			return util.ErrorWrapper(err, "unmarshal_model_mapping_failed", http.StatusInternalServerError)
 		}
 		if modelMap[imageModel] != "" {
 			imageModel = modelMap[imageModel]
+			imageRequest.Model = imageModel
 			isModelMapped = true
 		}
 	}
@@ -102,19 +155,43 @@ func relayImageHelper(c *gin.Context, relayMode int) *OpenAIErrorWithStatusCode
 	if c.GetString("base_url") != "" {
 		baseURL = c.GetString("base_url")
 	}
-	fullRequestURL := getFullRequestURL(baseURL, requestURL, channelType)
-	if channelType == common.ChannelTypeAzure && relayMode == RelayModeImagesGenerations {
+	fullRequestURL := util.GetFullRequestURL(baseURL, requestURL, channelType)
+	if channelType == common.ChannelTypeAzure {
 		// https://learn.microsoft.com/en-us/azure/ai-services/openai/dall-e-quickstart?tabs=dalle3%2Ccommand-line&pivots=rest-api
-		apiVersion := GetAPIVersion(c)
+		apiVersion := util.GetAzureAPIVersion(c, common.AzureEndpointImages)
+		deployment := util.GetChannelConfig(c).Azure.GetDeployment(imageModel)
+		task := strings.TrimPrefix(strings.Split(requestURL, "?")[0], "/v1/")
 		// https://{resource_name}.openai.azure.com/openai/deployments/dall-e-3/images/generations?api-version=2023-06-01-preview
-		fullRequestURL = fmt.Sprintf("%s/openai/deployments/%s/images/generations?api-version=%s", baseURL, imageModel, apiVersion)
+		fullRequestURL = fmt.Sprintf("%s/openai/deployments/%s/%s?api-version=%s", baseURL, deployment, task, apiVersion)
 	}
 
 	var requestBody io.Reader
-	if isModelMapped || channelType == common.ChannelTypeAzure { // make Azure channel request body
+	contentType := c.Request.Header.Get("Content-Type")
+	channelConfig := util.GetChannelConfig(c)
+	if relayMode != constant.RelayModeImagesGenerations {
+		originRequestBody, err := common.GetRequestBody(c)
+		if err != nil {
+			return util.ErrorWrapper(err, "read_request_body_failed", http.StatusInternalServerError)
+		}
+		if isModelMapped || channelConfig.HasBodyOverrides() {
+			form, formContentType, err := rewriteMultipartRequest(originRequestBody, contentType, imageModel, isModelMapped, channelConfig)
+			if err != nil {
+				return util.ErrorWrapper(err, "rewrite_request_body_failed", http.StatusInternalServerError)
+			}
+			// ends the goroutine writing the form if the request is not sent
+			defer form.Close()
+			requestBody, contentType = form, formContentType
+		} else {
+			requestBody = bytes.NewReader(originRequestBody)
+		}
+	} else if isModelMapped || channelType == common.ChannelTypeAzure || channelConfig.HasBodyOverrides() { // make Azure channel request body
 		jsonStr, err := json.Marshal(imageRequest)
 		if err != nil {
-			return errorWrapper(err, "marshal_text_request_failed", http.StatusInternalServerError)
+			return util.ErrorWrapper(err, "marshal_text_request_failed", http.StatusInternalServerError)
+		}
+		jsonStr, err = util.ApplyBodyOverrides(jsonStr, channelConfig)
+		if err != nil {
+			return util.ErrorWrapper(err, "override_request_body_failed", http.StatusInternalServerError)
 		}
 		requestBody = bytes.NewBuffer(jsonStr)
 	} else {
@@ -129,36 +206,47 @@ func relayImageHelper(c *gin.Context, relayMode int) *OpenAIErrorWithStatusCode
 	quota := int(ratio*imageCostRatio*1000) * imageRequest.N
 
 	if userQuota-quota < 0 {
-		return errorWrapper(errors.New("user quota is not enough"), "insufficient_user_quota", http.StatusForbidden)
+		return util.ErrorWrapper(errors.New("user quota is not enough"), "insufficient_user_quota", http.StatusForbidden)
 	}
 
-	req, err := http.NewRequest(c.Request.Method, fullRequestURL, requestBody)
+	req, err := http.NewRequestWithContext(c.Request.Context(), c.Request.Method, fullRequestURL, requestBody)
 	if err != nil {
-		return errorWrapper(err, "new_request_failed", http.StatusInternalServerError)
+		return util.ErrorWrapper(err, "new_request_failed", http.StatusInternalServerError)
 	}
 	token := c.Request.Header.Get("Authorization")
 	if channelType == common.ChannelTypeAzure { // Azure authentication
 		token = strings.TrimPrefix(token, "Bearer ")
-		req.Header.Set("api-key", token)
+		err = util.SetupAzureAuthorization(ctx, req, c.GetInt("channel_id"), channelConfig, token)
+		if err != nil {
+			return util.ErrorWrapper(err, "setup_azure_authorization_failed", http.StatusInternalServerError)
+		}
 	} else {
 		req.Header.Set("Authorization", token)
 	}
 
-	req.Header.Set("Content-Type", c.Request.Header.Get("Content-Type"))
+	req.Header.Set("Content-Type", contentType)
 	req.Header.Set("Accept", c.Request.Header.Get("Accept"))
+	util.SetupHeaderOverrides(req, channelType, channelConfig)
 
-	resp, err := httpClient.Do(req)
+	client, err := util.GetHTTPClient(c)
 	if err != nil {
-		return errorWrapper(err, "do_request_failed", http.StatusInternalServerError)
+		return util.ErrorWrapper(err, "get_http_client_failed", http.StatusInternalServerError)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return util.UpstreamErrorWrapper(err, "do_request_failed", http.StatusInternalServerError)
 	}
 
 	err = req.Body.Close()
 	if err != nil {
-		return errorWrapper(err, "close_request_body_failed", http.StatusInternalServerError)
+		return util.ErrorWrapper(err, "close_request_body_failed", http.StatusInternalServerError)
 	}
 	err = c.Request.Body.Close()
 	if err != nil {
-		return errorWrapper(err, "close_request_body_failed", http.StatusInternalServerError)
+		return util.ErrorWrapper(err, "close_request_body_failed", http.StatusInternalServerError)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return util.RelayErrorHandler(resp)
 	}
 	var textResponse ImageResponse
 
@@ -177,22 +265,22 @@ func relayImageHelper(c *gin.Context, relayMode int) *OpenAIErrorWithStatusCode
 			model.RecordConsumeLog(ctx, userId, channelId, 0, 0, imageModel, tokenName, quota, logContent)
 			model.UpdateUserUsedQuotaAndRequestCount(ctx, userId, quota)
 			channelId := c.GetInt("channel_id")
-			model.UpdateChannelUsedQuota(ctx, channelId, quota)
+			model.UpdateChannelUsedQuota(ctx, channelId, c.GetInt("channel_key_id"), quota)
 		}
 	}(c.Request.Context())
 
 	responseBody, err := io.ReadAll(resp.Body)
 
 	if err != nil {
-		return errorWrapper(err, "read_response_body_failed", http.StatusInternalServerError)
+		return util.UpstreamErrorWrapper(err, "read_response_body_failed", http.StatusInternalServerError)
 	}
 	err = resp.Body.Close()
 	if err != nil {
-		return errorWrapper(err, "close_response_body_failed", http.StatusInternalServerError)
+		return util.ErrorWrapper(err, "close_response_body_failed", http.StatusInternalServerError)
 	}
 	err = json.Unmarshal(responseBody, &textResponse)
 	if err != nil {
-		return errorWrapper(err, "unmarshal_response_body_failed", http.StatusInternalServerError)
+		return util.ErrorWrapper(err, "unmarshal_response_body_failed", http.StatusInternalServerError)
 	}
 
 	resp.Body = io.NopCloser(bytes.NewBuffer(responseBody))
@@ -204,11 +292,11 @@ func relayImageHelper(c *gin.Context, relayMode int) *OpenAIErrorWithStatusCode
 
 	_, err = io.Copy(c.Writer, resp.Body)
 	if err != nil {
-		return errorWrapper(err, "copy_response_body_failed", http.StatusInternalServerError)
+		return util.ErrorWrapper(err, "copy_response_body_failed", http.StatusInternalServerError)
 	}
 	err = resp.Body.Close()
 	if err != nil {
-		return errorWrapper(err, "close_response_body_failed", http.StatusInternalServerError)
+		return util.ErrorWrapper(err, "close_response_body_failed", http.StatusInternalServerError)
 	}
 	return nil
 }
@@ -0,0 +1,176 @@
+package controller
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"one-api/common"
+	"one-api/relay/channel/anthropic"
+	"one-api/relay/constant"
+	relaymodel "one-api/relay/model"
+	"one-api/relay/util"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// claudeMessagesWriter converts what the text relay writes in OpenAI's format
+// into the format of Anthropic's Messages API.
+type claudeMessagesWriter struct {
+	gin.ResponseWriter
+	c         *gin.Context
+	modelName string
+	buffer    []byte
+	converter anthropic.StreamConverter
+}
+
+func (w *claudeMessagesWriter) isStream() bool {
+	return strings.HasPrefix(w.Header().Get("Content-Type"), "text/event-stream")
+}
+
+func (w *claudeMessagesWriter) Write(data []byte) (int, error) {
+	if w.Status() != http.StatusOK {
+		return w.ResponseWriter.Write(data)
+	}
+	w.buffer = append(w.buffer, data...)
+	if !w.isStream() {
+		// converted once the whole response is received
+		return len(data), nil
+	}
+	for {
+		i := bytes.IndexByte(w.buffer, '\n')
+		if i < 0 {
+			break
+		}
+		line := strings.TrimSuffix(string(w.buffer[:i]), "\r")
+		w.buffer = w.buffer[i+1:]
+		if events := w.convertStreamLine(line); events != "" {
+			if _, err := w.ResponseWriter.WriteString(events); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return len(data), nil
+}
+
+func (w *claudeMessagesWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+func (w *claudeMessagesWriter) convertStreamLine(line string) string {
+	if strings.HasPrefix(line, ":") {
+		// comments such as heartbeats mean the same in both formats
+		return line + "\n\n"
+	}
+	if !strings.HasPrefix(line, "data: ") {
+		return ""
+	}
+	data := strings.TrimPrefix(line, "data: ")
+	if strings.HasPrefix(data, "[DONE]") {
+		return w.finishStream()
+	}
+	var streamResponse relaymodel.ChatCompletionsStreamResponse
+	err := json.Unmarshal([]byte(data), &streamResponse)
+	if err != nil {
+		common.SysError("error unmarshalling stream response: " + err.Error())
+		return ""
+	}
+	if streamResponse.Usage != nil {
+		w.converter.OutputTokens = streamResponse.Usage.CompletionTokens
+	}
+	w.converter.InputTokens = w.c.GetInt("prompt_tokens")
+	return w.converter.Convert(&streamResponse)
+}
+
+func (w *claudeMessagesWriter) finishStream() string {
+	w.converter.InputTokens = w.c.GetInt("prompt_tokens")
+	if w.converter.OutputTokens == 0 {
+		w.converter.OutputTokens = util.CountTokenText(w.converter.ResponseText, w.modelName)
+	}
+	return w.converter.Finish()
+}
+
+// finish writes out what is left once the relay has succeeded
+func (w *claudeMessagesWriter) finish() {
+	if w.Status() != http.StatusOK || len(w.buffer) == 0 && !w.isStream() {
+		return
+	}
+	if w.isStream() {
+		if events := w.finishStream(); events != "" {
+			_, _ = w.ResponseWriter.WriteString(events)
+			w.Flush()
+		}
+		return
+	}
+	var textResponse relaymodel.OpenAITextResponse
+	err := json.Unmarshal(w.buffer, &textResponse)
+	if err != nil {
+		common.SysError("error unmarshalling response: " + err.Error())
+		return
+	}
+	claudeResponse := anthropic.ResponseOpenAI2Claude(&textResponse)
+	claudeResponse.Model = w.modelName
+	jsonResponse, err := json.Marshal(claudeResponse)
+	if err != nil {
+		common.SysError("error marshalling response: " + err.Error())
+		return
+	}
+	w.Header().Del("Content-Length")
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.ResponseWriter.Write(jsonResponse)
+}
+
+// setupClaudeMessagesRelay rewrites a Messages API request into a chat completion
+// request, the returned writer takes over c.Writer to convert the response.
+func setupClaudeMessagesRelay(c *gin.Context) (*claudeMessagesWriter, *relaymodel.OpenAIErrorWithStatusCode) {
+	var claudeRequest anthropic.Request
+	err := common.UnmarshalBodyReusable(c, &claudeRequest)
+	if err != nil {
+		return nil, util.ErrorWrapper(err, "bind_request_body_failed", http.StatusBadRequest)
+	}
+	if claudeRequest.MaxTokens == 0 {
+		return nil, util.ErrorWrapper(errors.New("field max_tokens is required"), "required_field_missing", http.StatusBadRequest)
+	}
+	jsonData, err := json.Marshal(anthropic.RequestClaude2OpenAI(&claudeRequest))
+	if err != nil {
+		return nil, util.ErrorWrapper(err, "marshal_text_request_failed", http.StatusInternalServerError)
+	}
+	c.Set(common.KeyRequestBody, jsonData)
+	c.Request.Body = io.NopCloser(bytes.NewBuffer(jsonData))
+	c.Request.ContentLength = int64(len(jsonData))
+	c.Request.Header.Set("Content-Type", "application/json")
+	// adaptors build the upstream URL from the request path
+	c.Request.URL.Path = "/v1/chat/completions"
+	writer := &claudeMessagesWriter{
+		ResponseWriter: c.Writer,
+		c:              c,
+		modelName:      claudeRequest.Model,
+	}
+	writer.converter.Model = claudeRequest.Model
+	c.Writer = writer
+	return writer, nil
+}
+
+func relayClaudeMessagesHelper(c *gin.Context) *relaymodel.OpenAIErrorWithStatusCode {
+	err := relayTextHelper(c, constant.RelayModeChatCompletions)
+	if err == nil {
+		c.Writer.(*claudeMessagesWriter).finish()
+	}
+	return err
+}
+
+func claudeMessagesError(c *gin.Context, err *relaymodel.OpenAIErrorWithStatusCode) {
+	errorType, _ := err.Code.(string)
+	if errorType == "" {
+		errorType = err.Type
+	}
+	c.JSON(err.StatusCode, gin.H{
+		"type": "error",
+		"error": gin.H{
+			"type":    errorType,
+			"message": err.Message,
+		},
+	})
+}
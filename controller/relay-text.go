@@ -6,680 +6,335 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 	"go.opentelemetry.io/otel"
 	"io"
 	"math"
-	"net"
 	"net/http"
 	"one-api/common"
 	"one-api/model"
-	"os"
-	"runtime"
-	"strconv"
+	"one-api/relay/channel"
+	"one-api/relay/constant"
+	relaymodel "one-api/relay/model"
+	"one-api/relay/util"
 	"strings"
-	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
-const (
-	APITypeOpenAI = iota
-	APITypeClaude
-	APITypePaLM
-	APITypeBaidu
-	APITypeZhipu
-	APITypeAli
-	APITypeXunfei
-	APITypeAIProxyLibrary
-	APITypeTencent
-)
-
-var httpClient *http.Client
-var impatientHTTPClient *http.Client
-
-func defaultTransportDialContext(dialer *net.Dialer) func(context.Context, string, string) (net.Conn, error) {
-	return dialer.DialContext
-}
-
-func init() {
-	maxIdleConnsPerHost := runtime.NumCPU() * 100
-
-	if os.Getenv("MaxIdleConnsPerHostPerCpu") != "" {
-		maxIdleConnsPerHostPercpuFromEnv, err := strconv.Atoi(os.Getenv("MaxIdleConnsPerHostPerCpu"))
-		if err == nil {
-			if maxIdleConnsPerHostPercpuFromEnv > 0 {
-				fmt.Printf("maxIdleConnsPerHostPercpuFromEnv = %d\n", maxIdleConnsPerHostPercpuFromEnv)
-				maxIdleConnsPerHost = runtime.NumCPU() * maxIdleConnsPerHostPercpuFromEnv
-			}
-		}
-	}
-
-	transport := &http.Transport{
-		Proxy: http.ProxyFromEnvironment,
-		DialContext: defaultTransportDialContext(&net.Dialer{
-			Timeout:   30 * time.Second,
-			KeepAlive: 30 * time.Second,
-		}),
-		ForceAttemptHTTP2:     true,
-		IdleConnTimeout:       90 * time.Second,
-		TLSHandshakeTimeout:   10 * time.Second,
-		ExpectContinueTimeout: 1 * time.Second,
-		MaxIdleConnsPerHost:   maxIdleConnsPerHost,
-	}
-
-	if common.RelayTimeout == 0 {
-		httpClient = &http.Client{
-			Transport: otelhttp.NewTransport(transport),
-		}
-	} else {
-		httpClient = &http.Client{
-			Timeout:   time.Duration(common.RelayTimeout) * time.Second,
-			Transport: otelhttp.NewTransport(transport),
-		}
-	}
-
-	impatientHTTPClient = &http.Client{
-		Timeout:   5 * time.Second,
-		Transport: otelhttp.NewTransport(http.DefaultTransport),
-	}
-}
-
-func relayTextHelper(c *gin.Context, relayMode int) *OpenAIErrorWithStatusCode {
+func relayTextHelper(c *gin.Context, relayMode int) *relaymodel.OpenAIErrorWithStatusCode {
 	ctx := c.Request.Context()
 	tracer := otel.Tracer("one-api/controller/relay-text")
 	ctx, span := tracer.Start(ctx, "relayTextHelper")
 	defer span.End()
+	c.Request = c.Request.WithContext(ctx)
 
-	channelType := c.GetInt("channel")
-	channelId := c.GetInt("channel_id")
-	tokenId := c.GetInt("token_id")
-	userId := c.GetInt("id")
-	group := c.GetString("group")
-	var textRequest GeneralOpenAIRequest
+	meta := util.GetRelayMeta(c)
+	meta.Mode = relayMode
+	var textRequest relaymodel.GeneralOpenAIRequest
 	err := common.UnmarshalBodyReusable(c, &textRequest)
 	if err != nil {
-		return errorWrapper(err, "bind_request_body_failed", http.StatusBadRequest)
+		return util.ErrorWrapper(err, "bind_request_body_failed", http.StatusBadRequest)
 	}
-	if relayMode == RelayModeModerations && textRequest.Model == "" {
+	if relayMode == constant.RelayModeModerations && textRequest.Model == "" {
 		textRequest.Model = "text-moderation-latest"
 	}
-	if relayMode == RelayModeEmbeddings && textRequest.Model == "" {
+	if relayMode == constant.RelayModeEmbeddings && textRequest.Model == "" {
 		textRequest.Model = c.Param("model")
 	}
-	// request validation
-	if textRequest.Model == "" {
-		return errorWrapper(errors.New("model is required"), "required_field_missing", http.StatusBadRequest)
-	}
-	switch relayMode {
-	case RelayModeCompletions:
-		if textRequest.Prompt == "" {
-			return errorWrapper(errors.New("field prompt is required"), "required_field_missing", http.StatusBadRequest)
-		}
-	case RelayModeChatCompletions:
-		if textRequest.Messages == nil || len(textRequest.Messages) == 0 {
-			return errorWrapper(errors.New("field messages is required"), "required_field_missing", http.StatusBadRequest)
-		}
-	case RelayModeEmbeddings:
-	case RelayModeModerations:
-		if textRequest.Input == "" {
-			return errorWrapper(errors.New("field input is required"), "required_field_missing", http.StatusBadRequest)
-		}
-	case RelayModeEdits:
-		if textRequest.Instruction == "" {
-			return errorWrapper(errors.New("field instruction is required"), "required_field_missing", http.StatusBadRequest)
-		}
+	err = validateTextRequest(&textRequest, relayMode)
+	if err != nil {
+		return util.ErrorWrapper(err, "required_field_missing", http.StatusBadRequest)
 	}
+	meta.IsStream = textRequest.Stream
+	cacheKey := getResponseCacheKey(c, relayMode, &textRequest)
 	// map model name
-	modelMapping := c.GetString("model_mapping")
+	meta.OriginModelName = textRequest.Model
 	isModelMapped := false
-	if modelMapping != "" && modelMapping != "{}" {
-		modelMap := make(map[string]string)
-		err := json.Unmarshal([]byte(modelMapping), &modelMap)
-		if err != nil {
-			return errorWrapper(err, "unmarshal_model_mapping_failed", http.StatusInternalServerError)
-		}
-		if modelMap[textRequest.Model] != "" {
-			textRequest.Model = modelMap[textRequest.Model]
-			isModelMapped = true
-		}
+	textRequest.Model, isModelMapped, err = getMappedModelName(textRequest.Model, meta.ModelMapping)
+	if err != nil {
+		return util.ErrorWrapper(err, "unmarshal_model_mapping_failed", http.StatusInternalServerError)
 	}
-	apiType := APITypeOpenAI
-	switch channelType {
-	case common.ChannelTypeAnthropic:
-		apiType = APITypeClaude
-	case common.ChannelTypeBaidu:
-		apiType = APITypeBaidu
-	case common.ChannelTypePaLM:
-		apiType = APITypePaLM
-	case common.ChannelTypeZhipu:
-		apiType = APITypeZhipu
-	case common.ChannelTypeAli:
-		apiType = APITypeAli
-	case common.ChannelTypeXunfei:
-		apiType = APITypeXunfei
-	case common.ChannelTypeAIProxyLibrary:
-		apiType = APITypeAIProxyLibrary
-	case common.ChannelTypeTencent:
-		apiType = APITypeTencent
-	}
-	baseURL := common.ChannelBaseURLs[channelType]
-	requestURL := c.Request.URL.String()
-	if c.GetString("base_url") != "" {
-		baseURL = c.GetString("base_url")
-	}
-	fullRequestURL := getFullRequestURL(baseURL, requestURL, channelType)
-	switch apiType {
-	case APITypeOpenAI:
-		if channelType == common.ChannelTypeAzure {
-			// https://learn.microsoft.com/en-us/azure/cognitive-services/openai/chatgpt-quickstart?pivots=rest-api&tabs=command-line#rest-api
-			apiVersion := GetAPIVersion(c)
-			requestURL := strings.Split(requestURL, "?")[0]
-			requestURL = fmt.Sprintf("%s?api-version=%s", requestURL, apiVersion)
-			baseURL = c.GetString("base_url")
-			task := strings.TrimPrefix(requestURL, "/v1/")
-			model_ := textRequest.Model
-			model_ = strings.Replace(model_, ".", "", -1)
-			// https://github.com/songquanpeng/one-api/issues/67
-			model_ = strings.TrimSuffix(model_, "-0301")
-			model_ = strings.TrimSuffix(model_, "-0314")
-			model_ = strings.TrimSuffix(model_, "-0613")
-
-			requestURL = fmt.Sprintf("/openai/deployments/%s/%s", model_, task)
-			fullRequestURL = getFullRequestURL(baseURL, requestURL, channelType)
-		}
-	case APITypeClaude:
-		fullRequestURL = "https://api.anthropic.com/v1/complete"
-		if baseURL != "" {
-			fullRequestURL = fmt.Sprintf("%s/v1/complete", baseURL)
-		}
-	case APITypeBaidu:
-		switch textRequest.Model {
-		case "ERNIE-Bot":
-			fullRequestURL = "https://aip.baidubce.com/rpc/2.0/ai_custom/v1/wenxinworkshop/chat/completions"
-		case "ERNIE-Bot-turbo":
-			fullRequestURL = "https://aip.baidubce.com/rpc/2.0/ai_custom/v1/wenxinworkshop/chat/eb-instant"
-		case "ERNIE-Bot-4":
-			fullRequestURL = "https://aip.baidubce.com/rpc/2.0/ai_custom/v1/wenxinworkshop/chat/completions_pro"
-		case "BLOOMZ-7B":
-			fullRequestURL = "https://aip.baidubce.com/rpc/2.0/ai_custom/v1/wenxinworkshop/chat/bloomz_7b1"
-		case "Embedding-V1":
-			fullRequestURL = "https://aip.baidubce.com/rpc/2.0/ai_custom/v1/wenxinworkshop/embeddings/embedding-v1"
-		}
-		apiKey := c.Request.Header.Get("Authorization")
-		apiKey = strings.TrimPrefix(apiKey, "Bearer ")
-		var err error
-		if apiKey, err = getBaiduAccessToken(apiKey); err != nil {
-			return errorWrapper(err, "invalid_baidu_config", http.StatusInternalServerError)
-		}
-		fullRequestURL += "?access_token=" + apiKey
-	case APITypePaLM:
-		fullRequestURL = "https://generativelanguage.googleapis.com/v1beta2/models/chat-bison-001:generateMessage"
-		if baseURL != "" {
-			fullRequestURL = fmt.Sprintf("%s/v1beta2/models/chat-bison-001:generateMessage", baseURL)
-		}
-		apiKey := c.Request.Header.Get("Authorization")
-		apiKey = strings.TrimPrefix(apiKey, "Bearer ")
-		fullRequestURL += "?key=" + apiKey
-	case APITypeZhipu:
-		method := "invoke"
-		if textRequest.Stream {
-			method = "sse-invoke"
-		}
-		fullRequestURL = fmt.Sprintf("https://open.bigmodel.cn/api/paas/v3/model-api/%s/%s", textRequest.Model, method)
-	case APITypeAli:
-		fullRequestURL = "https://dashscope.aliyuncs.com/api/v1/services/aigc/text-generation/generation"
-		if relayMode == RelayModeEmbeddings {
-			fullRequestURL = "https://dashscope.aliyuncs.com/api/v1/services/embeddings/text-embedding/text-embedding"
-		}
-	case APITypeTencent:
-		fullRequestURL = "https://hunyuan.cloud.tencent.com/hyllm/v1/chat/completions"
-	case APITypeAIProxyLibrary:
-		fullRequestURL = fmt.Sprintf("%s/api/library/ask", baseURL)
+	meta.ActualModelName = textRequest.Model
+	adaptor := channel.GetAdaptor(meta.ChannelType)
+	if adaptor == nil {
+		return util.ErrorWrapper(fmt.Errorf("invalid channel type: %d", meta.ChannelType), "invalid_channel_type", http.StatusBadRequest)
 	}
+	adaptor.Init(meta)
+
 	var promptTokens int
-	var completionTokens int
 	switch relayMode {
-	case RelayModeChatCompletions:
-		promptTokens = countTokenMessages(textRequest.Messages, textRequest.Model)
-	case RelayModeCompletions:
-		promptTokens = countTokenInput(textRequest.Prompt, textRequest.Model)
-	case RelayModeModerations:
-		promptTokens = countTokenInput(textRequest.Input, textRequest.Model)
+	case constant.RelayModeChatCompletions:
+		promptTokens = util.CountTokenMessages(textRequest.Messages, textRequest.Model)
+	case constant.RelayModeCompletions:
+		promptTokens = util.CountTokenInput(textRequest.Prompt, textRequest.Model)
+	case constant.RelayModeModerations:
+		promptTokens = util.CountTokenInput(textRequest.Input, textRequest.Model)
 	}
+	meta.PromptTokens = promptTokens
+	c.Set("prompt_tokens", promptTokens)
 	preConsumedTokens := common.PreConsumedQuota
 	if textRequest.MaxTokens != 0 {
 		preConsumedTokens = promptTokens + textRequest.MaxTokens
 	}
 	modelRatio := common.GetModelRatio(textRequest.Model)
-	groupRatio := common.GetGroupRatio(group)
+	groupRatio := common.GetGroupRatio(meta.Group)
 	ratio := modelRatio * groupRatio
 	preConsumedQuota := int(float64(preConsumedTokens) * ratio)
-	userQuota, err := model.CacheGetUserQuota(ctx, userId)
+	userQuota, err := model.CacheGetUserQuota(ctx, meta.UserId)
 	if err != nil {
-		return errorWrapper(err, "get_user_quota_failed", http.StatusInternalServerError)
+		return util.ErrorWrapper(err, "get_user_quota_failed", http.StatusInternalServerError)
 	}
 	if userQuota-preConsumedQuota < 0 {
-		return errorWrapper(errors.New("user quota is not enough"), "insufficient_user_quota", http.StatusForbidden)
+		return util.ErrorWrapper(errors.New("user quota is not enough"), "insufficient_user_quota", http.StatusForbidden)
 	}
-	err = model.CacheDecreaseUserQuota(ctx, userId, preConsumedQuota)
+	err = model.CacheDecreaseUserQuota(ctx, meta.UserId, preConsumedQuota)
 	if err != nil {
-		return errorWrapper(err, "decrease_user_quota_failed", http.StatusInternalServerError)
+		return util.ErrorWrapper(err, "decrease_user_quota_failed", http.StatusInternalServerError)
 	}
 	if userQuota > 100*preConsumedQuota {
 		// in this case, we do not pre-consume quota
 		// because the user has enough quota
 		preConsumedQuota = 0
-		common.LogInfo(c.Request.Context(), fmt.Sprintf("user %d has enough quota %d, trusted and no need to pre-consume", userId, userQuota))
+		common.LogInfo(c.Request.Context(), fmt.Sprintf("user %d has enough quota %d, trusted and no need to pre-consume", meta.UserId, userQuota))
 	}
 	if preConsumedQuota > 0 {
-		err := model.PreConsumeTokenQuota(ctx, tokenId, preConsumedQuota)
+		err := model.PreConsumeTokenQuota(ctx, meta.TokenId, preConsumedQuota)
 		if err != nil {
-			return errorWrapper(err, "pre_consume_token_quota_failed", http.StatusForbidden)
+			return util.ErrorWrapper(err, "pre_consume_token_quota_failed", http.StatusForbidden)
 		}
 	}
-	var requestBody io.Reader
-	if isModelMapped {
-		jsonStr, err := json.Marshal(textRequest)
-		if err != nil {
-			return errorWrapper(err, "marshal_text_request_failed", http.StatusInternalServerError)
+
+	if cacheKey != "" {
+		if entry, err := model.CacheGetResponse(ctx, cacheKey); err == nil {
+			return relayCachedResponse(c, entry, meta, textRequest.Model, preConsumedQuota, modelRatio, groupRatio)
 		}
-		requestBody = bytes.NewBuffer(jsonStr)
-	} else {
-		requestBody = c.Request.Body
 	}
-	switch apiType {
-	case APITypeClaude:
-		claudeRequest := requestOpenAI2Claude(textRequest)
-		jsonStr, err := json.Marshal(claudeRequest)
-		if err != nil {
-			return errorWrapper(err, "marshal_text_request_failed", http.StatusInternalServerError)
-		}
-		requestBody = bytes.NewBuffer(jsonStr)
-	case APITypeBaidu:
+
+	// get request body
+	var requestBody io.Reader
+	convertedRequest, err := adaptor.ConvertRequest(c, relayMode, &textRequest)
+	if err != nil {
+		returnPreConsumedQuota(ctx, preConsumedQuota, meta.TokenId)
+		var unsupportedErr *channel.UnsupportedParameterError
+		if errors.As(err, &unsupportedErr) {
+			openaiErr := util.ErrorWrapper(err, "unsupported_parameter", http.StatusBadRequest)
+			openaiErr.Type = "invalid_request_error"
+			openaiErr.Param = unsupportedErr.Param
+			return openaiErr
+		}
+		var unsupportedModeErr *channel.UnsupportedRelayModeError
+		if errors.As(err, &unsupportedModeErr) {
+			openaiErr := util.ErrorWrapper(err, "unsupported_endpoint", http.StatusBadRequest)
+			openaiErr.Type = "invalid_request_error"
+			return openaiErr
+		}
+		return util.ErrorWrapper(err, "convert_request_failed", http.StatusInternalServerError)
+	}
+	if convertedRequest == any(&textRequest) && !isModelMapped && !meta.Config.HasBodyOverrides() {
+		// the adaptor speaks OpenAI's protocol, forward the original body so that
+		// fields unknown to GeneralOpenAIRequest are kept
+		requestBody = c.Request.Body
+	} else {
 		var jsonData []byte
-		var err error
-		switch relayMode {
-		case RelayModeEmbeddings:
-			baiduEmbeddingRequest := embeddingRequestOpenAI2Baidu(textRequest)
-			jsonData, err = json.Marshal(baiduEmbeddingRequest)
-		default:
-			baiduRequest := requestOpenAI2Baidu(textRequest)
-			jsonData, err = json.Marshal(baiduRequest)
-		}
-		if err != nil {
-			return errorWrapper(err, "marshal_text_request_failed", http.StatusInternalServerError)
-		}
-		requestBody = bytes.NewBuffer(jsonData)
-	case APITypePaLM:
-		palmRequest := requestOpenAI2PaLM(textRequest)
-		jsonStr, err := json.Marshal(palmRequest)
-		if err != nil {
-			return errorWrapper(err, "marshal_text_request_failed", http.StatusInternalServerError)
-		}
-		requestBody = bytes.NewBuffer(jsonStr)
-	case APITypeZhipu:
-		zhipuRequest := requestOpenAI2Zhipu(textRequest)
-		jsonStr, err := json.Marshal(zhipuRequest)
-		if err != nil {
-			return errorWrapper(err, "marshal_text_request_failed", http.StatusInternalServerError)
-		}
-		requestBody = bytes.NewBuffer(jsonStr)
-	case APITypeAli:
-		var jsonStr []byte
-		var err error
-		switch relayMode {
-		case RelayModeEmbeddings:
-			aliEmbeddingRequest := embeddingRequestOpenAI2Ali(textRequest)
-			jsonStr, err = json.Marshal(aliEmbeddingRequest)
-		default:
-			aliRequest := requestOpenAI2Ali(textRequest)
-			jsonStr, err = json.Marshal(aliRequest)
-		}
-		if err != nil {
-			return errorWrapper(err, "marshal_text_request_failed", http.StatusInternalServerError)
-		}
-		requestBody = bytes.NewBuffer(jsonStr)
-	case APITypeTencent:
-		apiKey := c.Request.Header.Get("Authorization")
-		apiKey = strings.TrimPrefix(apiKey, "Bearer ")
-		appId, secretId, secretKey, err := parseTencentConfig(apiKey)
-		if err != nil {
-			return errorWrapper(err, "invalid_tencent_config", http.StatusInternalServerError)
+		if convertedRequest == any(&textRequest) && !isModelMapped {
+			jsonData, err = common.GetRequestBody(c)
+		} else {
+			jsonData, err = json.Marshal(convertedRequest)
 		}
-		tencentRequest := requestOpenAI2Tencent(textRequest)
-		tencentRequest.AppId = appId
-		tencentRequest.SecretId = secretId
-		jsonStr, err := json.Marshal(tencentRequest)
 		if err != nil {
-			return errorWrapper(err, "marshal_text_request_failed", http.StatusInternalServerError)
+			return util.ErrorWrapper(err, "marshal_text_request_failed", http.StatusInternalServerError)
 		}
-		sign := getTencentSign(*tencentRequest, secretKey)
-		c.Request.Header.Set("Authorization", sign)
-		requestBody = bytes.NewBuffer(jsonStr)
-	case APITypeAIProxyLibrary:
-		aiProxyLibraryRequest := requestOpenAI2AIProxyLibrary(textRequest)
-		aiProxyLibraryRequest.LibraryId = c.GetString("library_id")
-		jsonStr, err := json.Marshal(aiProxyLibraryRequest)
+		jsonData, err = util.ApplyBodyOverrides(jsonData, meta.Config)
 		if err != nil {
-			return errorWrapper(err, "marshal_text_request_failed", http.StatusInternalServerError)
+			returnPreConsumedQuota(ctx, preConsumedQuota, meta.TokenId)
+			return util.ErrorWrapper(err, "override_request_body_failed", http.StatusInternalServerError)
 		}
-		requestBody = bytes.NewBuffer(jsonStr)
+		requestBody = bytes.NewBuffer(jsonData)
 	}
 
-	var req *http.Request
-	var resp *http.Response
-	isStream := textRequest.Stream
+	// do request
+	firstTokenTimer := &util.FirstTokenTimer{}
+	if meta.IsStream {
+		var upstreamCtx context.Context
+		upstreamCtx, firstTokenTimer = util.StartFirstTokenTimer(ctx)
+		c.Request = c.Request.WithContext(upstreamCtx)
+		defer func() {
+			// the request may be retried on another channel
+			c.Request = c.Request.WithContext(ctx)
+		}()
+		defer firstTokenTimer.Release()
+	}
+	firstByteClock := util.StartFirstByteClock()
+	resp, err := adaptor.DoRequest(c, meta, requestBody)
+	if err != nil {
+		returnPreConsumedQuota(ctx, preConsumedQuota, meta.TokenId)
+		if firstTokenTimer.Stop() {
+			return firstTokenTimeoutError()
+		}
+		return util.UpstreamErrorWrapper(err, "do_request_failed", http.StatusInternalServerError)
+	}
+	meta.IsStream = meta.IsStream || strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream")
+	if resp.StatusCode != http.StatusOK {
+		returnPreConsumedQuota(ctx, preConsumedQuota, meta.TokenId)
+		return util.RelayErrorHandler(resp)
+	}
+	firstByteClock.Watch(resp)
+	if firstTokenTimer.Enabled() && meta.IsStream {
+		util.WaitFirstByte(resp)
+	}
+	if firstTokenTimer.Stop() {
+		_ = resp.Body.Close()
+		returnPreConsumedQuota(ctx, preConsumedQuota, meta.TokenId)
+		return firstTokenTimeoutError()
+	}
 
-	if apiType != APITypeXunfei { // cause xunfei use websocket
-		req, err = http.NewRequestWithContext(ctx, c.Request.Method, fullRequestURL, requestBody)
-		if err != nil {
-			return errorWrapper(err, "new_request_failed", http.StatusInternalServerError)
+	// do response
+	isTranscribed := c.GetBool("token_transcript")
+	var captureWriter *responseCaptureWriter
+	if cacheKey != "" || isTranscribed {
+		captureWriter = &responseCaptureWriter{ResponseWriter: c.Writer, limit: common.TranscriptMaxSize}
+		if cacheKey != "" && captureWriter.limit < maxCachedResponseSize {
+			captureWriter.limit = maxCachedResponseSize
+		}
+		c.Writer = captureWriter
+	}
+	usage, respErr := adaptor.DoResponse(c, resp, meta)
+	if meta.IsStream {
+		c.Set("first_token_latency", firstByteClock.Elapsed())
+	}
+	if meta.IsStream && util.IsClientGone(c) {
+		meta.ClientAborted = true
+		usage = getAbortedStreamUsage(usage, meta)
+	}
+	if respErr != nil && !meta.ClientAborted {
+		// the adaptors convert the responses and the errors of the upstream
+		respErr.Upstream = true
+	}
+	if captureWriter != nil {
+		c.Writer = captureWriter.ResponseWriter
+		if cacheKey != "" && respErr == nil && !meta.ClientAborted {
+			cacheResponse(common.Detach(c.Request.Context()), cacheKey, captureWriter, usage)
 		}
-		apiKey := c.Request.Header.Get("Authorization")
-		apiKey = strings.TrimPrefix(apiKey, "Bearer ")
-		switch apiType {
-		case APITypeOpenAI:
-			if channelType == common.ChannelTypeAzure {
-				req.Header.Set("api-key", apiKey)
-			} else {
-				req.Header.Set("Authorization", c.Request.Header.Get("Authorization"))
-				if channelType == common.ChannelTypeOpenRouter {
-					req.Header.Set("HTTP-Referer", "https://github.com/songquanpeng/one-api")
-					req.Header.Set("X-Title", "One API")
-				}
-			}
-		case APITypeClaude:
-			req.Header.Set("x-api-key", apiKey)
-			anthropicVersion := c.Request.Header.Get("anthropic-version")
-			if anthropicVersion == "" {
-				anthropicVersion = "2023-06-01"
+		if isTranscribed {
+			response := captureWriter.body.Bytes()
+			if meta.ResponseText != "" {
+				// the text assembled from the stream reads better than its events
+				response = []byte(meta.ResponseText)
 			}
-			req.Header.Set("anthropic-version", anthropicVersion)
-		case APITypeZhipu:
-			token := getZhipuToken(apiKey)
-			req.Header.Set("Authorization", token)
-		case APITypeAli:
-			req.Header.Set("Authorization", "Bearer "+apiKey)
-			if textRequest.Stream {
-				req.Header.Set("X-DashScope-SSE", "enable")
-			}
-			if c.GetString("plugin") != "" {
-				req.Header.Set("X-DashScope-Plugin", c.GetString("plugin"))
-			}
-		case APITypeTencent:
-			req.Header.Set("Authorization", apiKey)
-		case APITypePaLM:
-			// do not set Authorization header
-		default:
-			req.Header.Set("Authorization", "Bearer "+apiKey)
+			recordTranscript(c, meta, response)
 		}
-		req.Header.Set("Content-Type", c.Request.Header.Get("Content-Type"))
-		req.Header.Set("Accept", c.Request.Header.Get("Accept"))
-		if isStream && c.Request.Header.Get("Accept") == "" {
-			req.Header.Set("Accept", "text/event-stream")
+	}
+	postConsumeTextQuota(common.Detach(c.Request.Context()), usage, meta, textRequest.Model, ratio, preConsumedQuota, modelRatio, groupRatio)
+	return respErr
+}
+
+func validateTextRequest(textRequest *relaymodel.GeneralOpenAIRequest, relayMode int) error {
+	if textRequest.Model == "" {
+		return errors.New("model is required")
+	}
+	switch relayMode {
+	case constant.RelayModeCompletions:
+		if textRequest.Prompt == "" {
+			return errors.New("field prompt is required")
 		}
-		//req.Header.Set("Connection", c.Request.Header.Get("Connection"))
-		resp, err = httpClient.Do(req)
-		if err != nil {
-			return errorWrapper(err, "do_request_failed", http.StatusInternalServerError)
+	case constant.RelayModeChatCompletions:
+		if textRequest.Messages == nil || len(textRequest.Messages) == 0 {
+			return errors.New("field messages is required")
 		}
-		err = req.Body.Close()
-		if err != nil {
-			return errorWrapper(err, "close_request_body_failed", http.StatusInternalServerError)
+	case constant.RelayModeEmbeddings:
+	case constant.RelayModeModerations:
+		if textRequest.Input == "" {
+			return errors.New("field input is required")
 		}
-		err = c.Request.Body.Close()
-		if err != nil {
-			return errorWrapper(err, "close_request_body_failed", http.StatusInternalServerError)
+	case constant.RelayModeEdits:
+		if textRequest.Instruction == "" {
+			return errors.New("field instruction is required")
 		}
-		isStream = isStream || strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream")
+	}
+	return nil
+}
 
-		if resp.StatusCode != http.StatusOK {
-			if preConsumedQuota != 0 {
-				// return pre-consumed quota
-				err := model.PostConsumeTokenQuota(ctx, tokenId, -preConsumedQuota)
-				if err != nil {
-					common.LogError(ctx, "error return pre-consumed quota: "+err.Error())
-				}
-			}
-			return relayErrorHandler(resp)
-		}
+func getMappedModelName(modelName string, mapping string) (string, bool, error) {
+	if mapping == "" || mapping == "{}" {
+		return modelName, false, nil
+	}
+	modelMap := make(map[string]string)
+	err := json.Unmarshal([]byte(mapping), &modelMap)
+	if err != nil {
+		return "", false, err
+	}
+	if modelMap[modelName] != "" {
+		return modelMap[modelName], true, nil
 	}
+	return modelName, false, nil
+}
 
-	var textResponse TextResponse
-	tokenName := c.GetString("token_name")
+func firstTokenTimeoutError() *relaymodel.OpenAIErrorWithStatusCode {
+	err := fmt.Errorf("upstream did not start streaming within %d seconds", common.StreamFirstTokenTimeout)
+	return util.UpstreamErrorWrapper(err, "first_token_timeout", http.StatusGatewayTimeout)
+}
 
-	defer func(ctx context.Context) {
-		// c.Writer.Flush()
+// getAbortedStreamUsage bills a stream the client left early for the text
+// generated until then, most upstreams only report usage once they are done
+func getAbortedStreamUsage(usage *relaymodel.Usage, meta *util.RelayMeta) *relaymodel.Usage {
+	partialUsage := util.ResponseText2Usage(meta.ResponseText, meta.ActualModelName, meta.PromptTokens)
+	if usage == nil {
+		return partialUsage
+	}
+	if usage.PromptTokens > 0 {
+		partialUsage.PromptTokens = usage.PromptTokens
+	}
+	if usage.CompletionTokens > partialUsage.CompletionTokens {
+		partialUsage.CompletionTokens = usage.CompletionTokens
+	}
+	partialUsage.TotalTokens = partialUsage.PromptTokens + partialUsage.CompletionTokens
+	return partialUsage
+}
 
-		quota := 0
-		completionRatio := common.GetCompletionRatio(textRequest.Model)
-		promptTokens = textResponse.Usage.PromptTokens
-		completionTokens = textResponse.Usage.CompletionTokens
-		quota = int(math.Ceil((float64(promptTokens) + float64(completionTokens)*completionRatio) * ratio))
-		if ratio != 0 && quota <= 0 {
-			quota = 1
-		}
-		totalTokens := promptTokens + completionTokens
-		if totalTokens == 0 {
-			// in this case, must be some error happened
-			// we cannot just return, because we may have to return the pre-consumed quota
-			quota = 0
-		}
-		quotaDelta := quota - preConsumedQuota
-		err := model.PostConsumeTokenQuota(ctx, tokenId, quotaDelta)
-		if err != nil {
-			common.LogError(ctx, "error consuming token remain quota: "+err.Error())
-		}
-		err = model.CacheUpdateUserQuota(ctx, userId)
+func returnPreConsumedQuota(ctx context.Context, preConsumedQuota int, tokenId int) {
+	if preConsumedQuota != 0 {
+		// return pre-consumed quota
+		err := model.PostConsumeTokenQuota(ctx, tokenId, -preConsumedQuota)
 		if err != nil {
-			common.LogError(ctx, "error update user quota cache: "+err.Error())
-		}
-		if quota != 0 {
-			logContent := fmt.Sprintf("模型倍率 %.2f，分组倍率 %.2f", modelRatio, groupRatio)
-			model.RecordConsumeLog(ctx, userId, channelId, promptTokens, completionTokens, textRequest.Model, tokenName, quota, logContent)
-			model.UpdateUserUsedQuotaAndRequestCount(ctx, userId, quota)
-			model.UpdateChannelUsedQuota(ctx, channelId, quota)
+			common.LogError(ctx, "error return pre-consumed quota: "+err.Error())
 		}
+	}
+}
 
-	}(common.Detach(c.Request.Context()))
-	switch apiType {
-	case APITypeOpenAI:
-		if isStream {
-			err, responseText := openaiStreamHandler(c, resp, relayMode)
-			if err != nil {
-				return err
-			}
-			textResponse.Usage.PromptTokens = promptTokens
-			textResponse.Usage.CompletionTokens = countTokenText(responseText, textRequest.Model)
-			return nil
-		} else {
-			err, usage := openaiHandler(c, resp, promptTokens, textRequest.Model)
-			if err != nil {
-				return err
-			}
-			if usage != nil {
-				textResponse.Usage = *usage
-			}
-			return nil
-		}
-	case APITypeClaude:
-		if isStream {
-			err, responseText := claudeStreamHandler(c, resp)
-			if err != nil {
-				return err
-			}
-			textResponse.Usage.PromptTokens = promptTokens
-			textResponse.Usage.CompletionTokens = countTokenText(responseText, textRequest.Model)
-			return nil
-		} else {
-			err, usage := claudeHandler(c, resp, promptTokens, textRequest.Model)
-			if err != nil {
-				return err
-			}
-			if usage != nil {
-				textResponse.Usage = *usage
-			}
-			return nil
-		}
-	case APITypeBaidu:
-		if isStream {
-			err, usage := baiduStreamHandler(c, resp)
-			if err != nil {
-				return err
-			}
-			if usage != nil {
-				textResponse.Usage = *usage
-			}
-			return nil
-		} else {
-			var err *OpenAIErrorWithStatusCode
-			var usage *Usage
-			switch relayMode {
-			case RelayModeEmbeddings:
-				err, usage = baiduEmbeddingHandler(c, resp)
-			default:
-				err, usage = baiduHandler(c, resp)
-			}
-			if err != nil {
-				return err
-			}
-			if usage != nil {
-				textResponse.Usage = *usage
-			}
-			return nil
-		}
-	case APITypePaLM:
-		if textRequest.Stream { // PaLM2 API does not support stream
-			err, responseText := palmStreamHandler(c, resp)
-			if err != nil {
-				return err
-			}
-			textResponse.Usage.PromptTokens = promptTokens
-			textResponse.Usage.CompletionTokens = countTokenText(responseText, textRequest.Model)
-			return nil
-		} else {
-			err, usage := palmHandler(c, resp, promptTokens, textRequest.Model)
-			if err != nil {
-				return err
-			}
-			if usage != nil {
-				textResponse.Usage = *usage
-			}
-			return nil
-		}
-	case APITypeZhipu:
-		if isStream {
-			err, usage := zhipuStreamHandler(c, resp)
-			if err != nil {
-				return err
-			}
-			if usage != nil {
-				textResponse.Usage = *usage
-			}
-			// zhipu's API does not return prompt tokens & completion tokens
-			textResponse.Usage.PromptTokens = textResponse.Usage.TotalTokens
-			return nil
-		} else {
-			err, usage := zhipuHandler(c, resp)
-			if err != nil {
-				return err
-			}
-			if usage != nil {
-				textResponse.Usage = *usage
-			}
-			// zhipu's API does not return prompt tokens & completion tokens
-			textResponse.Usage.PromptTokens = textResponse.Usage.TotalTokens
-			return nil
-		}
-	case APITypeAli:
-		if isStream {
-			err, usage := aliStreamHandler(c, resp)
-			if err != nil {
-				return err
-			}
-			if usage != nil {
-				textResponse.Usage = *usage
-			}
-			return nil
-		} else {
-			var err *OpenAIErrorWithStatusCode
-			var usage *Usage
-			switch relayMode {
-			case RelayModeEmbeddings:
-				err, usage = aliEmbeddingHandler(c, resp)
-			default:
-				err, usage = aliHandler(c, resp)
-			}
-			if err != nil {
-				return err
-			}
-			if usage != nil {
-				textResponse.Usage = *usage
-			}
-			return nil
-		}
-	case APITypeXunfei:
-		auth := c.Request.Header.Get("Authorization")
-		auth = strings.TrimPrefix(auth, "Bearer ")
-		splits := strings.Split(auth, "|")
-		if len(splits) != 3 {
-			return errorWrapper(errors.New("invalid auth"), "invalid_auth", http.StatusBadRequest)
-		}
-		var err *OpenAIErrorWithStatusCode
-		var usage *Usage
-		if isStream {
-			err, usage = xunfeiStreamHandler(c, textRequest, splits[0], splits[1], splits[2])
-		} else {
-			err, usage = xunfeiHandler(c, textRequest, splits[0], splits[1], splits[2])
-		}
-		if err != nil {
-			return err
-		}
-		if usage != nil {
-			textResponse.Usage = *usage
-		}
-		return nil
-	case APITypeAIProxyLibrary:
-		if isStream {
-			err, usage := aiProxyLibraryStreamHandler(c, resp)
-			if err != nil {
-				return err
-			}
-			if usage != nil {
-				textResponse.Usage = *usage
-			}
-			return nil
-		} else {
-			err, usage := aiProxyLibraryHandler(c, resp)
-			if err != nil {
-				return err
-			}
-			if usage != nil {
-				textResponse.Usage = *usage
-			}
-			return nil
-		}
-	case APITypeTencent:
-		if isStream {
-			err, responseText := tencentStreamHandler(c, resp)
-			if err != nil {
-				return err
-			}
-			textResponse.Usage.PromptTokens = promptTokens
-			textResponse.Usage.CompletionTokens = countTokenText(responseText, textRequest.Model)
-			return nil
-		} else {
-			err, usage := tencentHandler(c, resp)
-			if err != nil {
-				return err
-			}
-			if usage != nil {
-				textResponse.Usage = *usage
-			}
-			return nil
-		}
-	default:
-		return errorWrapper(errors.New("unknown api type"), "unknown_api_type", http.StatusInternalServerError)
+func postConsumeTextQuota(ctx context.Context, usage *relaymodel.Usage, meta *util.RelayMeta, modelName string, ratio float64, preConsumedQuota int, modelRatio float64, groupRatio float64) {
+	var promptTokens, completionTokens int
+	if usage != nil {
+		promptTokens = usage.PromptTokens
+		completionTokens = usage.CompletionTokens
+	}
+	quota := 0
+	completionRatio := common.GetCompletionRatio(modelName)
+	quota = int(math.Ceil((float64(promptTokens) + float64(completionTokens)*completionRatio) * ratio))
+	if ratio != 0 && quota <= 0 {
+		quota = 1
+	}
+	totalTokens := promptTokens + completionTokens
+	if totalTokens == 0 {
+		// in this case, must be some error happened
+		// we cannot just return, because we may have to return the pre-consumed quota
+		quota = 0
+	}
+	quotaDelta := quota - preConsumedQuota
+	err := model.PostConsumeTokenQuota(ctx, meta.TokenId, quotaDelta)
+	if err != nil {
+		common.LogError(ctx, "error consuming token remain quota: "+err.Error())
+	}
+	err = model.CacheUpdateUserQuota(ctx, meta.UserId)
+	if err != nil {
+		common.LogError(ctx, "error update user quota cache: "+err.Error())
+	}
+	if quota != 0 {
+		logContent := fmt.Sprintf("模型倍率 %.2f，分组倍率 %.2f", modelRatio, groupRatio)
+		if meta.ClientAborted {
+			logContent += "，客户端已中断，按已生成内容计费"
+		}
+		model.RecordConsumeLog(ctx, meta.UserId, meta.ChannelId, promptTokens, completionTokens, modelName, meta.TokenName, quota, logContent)
+		model.UpdateUserUsedQuotaAndRequestCount(ctx, meta.UserId, quota)
+		model.UpdateChannelUsedQuota(ctx, meta.ChannelId, meta.ChannelKeyId, quota)
 	}
 }
@@ -1,135 +1,26 @@
 package controller
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"io"
+	"math"
 	"net/http"
 	"one-api/common"
+	"one-api/middleware"
+	"one-api/model"
+	"one-api/relay/constant"
+	relaymodel "one-api/relay/model"
 	"strconv"
-	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
-type Message struct {
-	Role    string  `json:"role"`
-	Content any     `json:"content"`
-	Name    *string `json:"name,omitempty"`
-}
-
-type ImageURL struct {
-	Url    string `json:"url,omitempty"`
-	Detail string `json:"detail,omitempty"`
-}
-
-type TextContent struct {
-	Type string `json:"type,omitempty"`
-	Text string `json:"text,omitempty"`
-}
-
-type ImageContent struct {
-	Type     string    `json:"type,omitempty"`
-	ImageURL *ImageURL `json:"image_url,omitempty"`
-}
-
-func (m Message) StringContent() string {
-	content, ok := m.Content.(string)
-	if ok {
-		return content
-	}
-	contentList, ok := m.Content.([]any)
-	if ok {
-		var contentStr string
-		for _, contentItem := range contentList {
-			contentMap, ok := contentItem.(map[string]any)
-			if !ok {
-				continue
-			}
-			if contentMap["type"] == "text" {
-				if subStr, ok := contentMap["text"].(string); ok {
-					contentStr += subStr
-				}
-			}
-		}
-		return contentStr
-	}
-	return ""
-}
-
-const (
-	RelayModeUnknown = iota
-	RelayModeChatCompletions
-	RelayModeCompletions
-	RelayModeEmbeddings
-	RelayModeModerations
-	RelayModeImagesGenerations
-	RelayModeEdits
-	RelayModeAudioSpeech
-	RelayModeAudioTranscription
-	RelayModeAudioTranslation
-)
-
-// https://platform.openai.com/docs/api-reference/chat
-
-type ResponseFormat struct {
-	Type string `json:"type,omitempty"`
-}
-
-type GeneralOpenAIRequest struct {
-	Model            string          `json:"model,omitempty"`
-	Messages         []Message       `json:"messages,omitempty"`
-	Prompt           any             `json:"prompt,omitempty"`
-	Stream           bool            `json:"stream,omitempty"`
-	MaxTokens        int             `json:"max_tokens,omitempty"`
-	Temperature      float64         `json:"temperature,omitempty"`
-	TopP             float64         `json:"top_p,omitempty"`
-	N                int             `json:"n,omitempty"`
-	Input            any             `json:"input,omitempty"`
-	Instruction      string          `json:"instruction,omitempty"`
-	Size             string          `json:"size,omitempty"`
-	Functions        any             `json:"functions,omitempty"`
-	FrequencyPenalty float64         `json:"frequency_penalty,omitempty"`
-	PresencePenalty  float64         `json:"presence_penalty,omitempty"`
-	ResponseFormat   *ResponseFormat `json:"response_format,omitempty"`
-	Seed             float64         `json:"seed,omitempty"`
-	Tools            any             `json:"tools,omitempty"`
-	ToolChoice       any             `json:"tool_choice,omitempty"`
-	User             string          `json:"user,omitempty"`
-}
-
-func (r GeneralOpenAIRequest) ParseInput() []string {
-	if r.Input == nil {
-		return nil
-	}
-	var input []string
-	switch r.Input.(type) {
-	case string:
-		input = []string{r.Input.(string)}
-	case []any:
-		input = make([]string, 0, len(r.Input.([]any)))
-		for _, item := range r.Input.([]any) {
-			if str, ok := item.(string); ok {
-				input = append(input, str)
-			}
-		}
-	}
-	return input
-}
-
-type ChatRequest struct {
-	Model     string    `json:"model"`
-	Messages  []Message `json:"messages"`
-	MaxTokens int       `json:"max_tokens"`
-}
-
-type TextRequest struct {
-	Model     string    `json:"model"`
-	Messages  []Message `json:"messages"`
-	Prompt    string    `json:"prompt"`
-	MaxTokens int       `json:"max_tokens"`
-	//Stream   bool      `json:"stream"`
-}
-
 // ImageRequest docs: https://platform.openai.com/docs/api-reference/images/create
 type ImageRequest struct {
 	Model          string `json:"model"`
@@ -175,57 +66,6 @@ type TextToSpeechRequest struct {
 	ResponseFormat string  `json:"response_format"`
 }
 
-type Usage struct {
-	PromptTokens     int `json:"prompt_tokens"`
-	CompletionTokens int `json:"completion_tokens"`
-	TotalTokens      int `json:"total_tokens"`
-}
-
-type OpenAIError struct {
-	Message string `json:"message"`
-	Type    string `json:"type"`
-	Param   string `json:"param"`
-	Code    any    `json:"code"`
-}
-
-type OpenAIErrorWithStatusCode struct {
-	OpenAIError
-	StatusCode int `json:"status_code"`
-}
-
-type TextResponse struct {
-	Choices []OpenAITextResponseChoice `json:"choices"`
-	Usage   `json:"usage"`
-	Error   OpenAIError `json:"error"`
-}
-
-type OpenAITextResponseChoice struct {
-	Index        int `json:"index"`
-	Message      `json:"message"`
-	FinishReason string `json:"finish_reason"`
-}
-
-type OpenAITextResponse struct {
-	Id      string                     `json:"id"`
-	Object  string                     `json:"object"`
-	Created int64                      `json:"created"`
-	Choices []OpenAITextResponseChoice `json:"choices"`
-	Usage   `json:"usage"`
-}
-
-type OpenAIEmbeddingResponseItem struct {
-	Object    string    `json:"object"`
-	Index     int       `json:"index"`
-	Embedding []float64 `json:"embedding"`
-}
-
-type OpenAIEmbeddingResponse struct {
-	Object string                        `json:"object"`
-	Data   []OpenAIEmbeddingResponseItem `json:"data"`
-	Model  string                        `json:"model"`
-	Usage  `json:"usage"`
-}
-
 type ImageResponse struct {
 	Created int `json:"created"`
 	Data    []struct {
@@ -233,26 +73,31 @@ type ImageResponse struct {
 	}
 }
 
-type ChatCompletionsStreamResponseChoice struct {
-	Delta struct {
-		Content string `json:"content"`
-	} `json:"delta"`
-	FinishReason *string `json:"finish_reason"`
-}
-
-type ChatCompletionsStreamResponse struct {
-	Id      string                                `json:"id"`
-	Object  string                                `json:"object"`
-	Created int64                                 `json:"created"`
-	Model   string                                `json:"model"`
-	Choices []ChatCompletionsStreamResponseChoice `json:"choices"`
-}
-
-type CompletionsStreamResponse struct {
-	Choices []struct {
-		Text         string `json:"text"`
-		FinishReason string `json:"finish_reason"`
-	} `json:"choices"`
+func relayHelper(c *gin.Context, relayMode int) *relaymodel.OpenAIErrorWithStatusCode {
+	var err *relaymodel.OpenAIErrorWithStatusCode
+	switch relayMode {
+	case constant.RelayModeImagesGenerations, constant.RelayModeImagesEdits, constant.RelayModeImagesVariations:
+		err = relayImageHelper(c, relayMode)
+	case constant.RelayModeAudioSpeech:
+		fallthrough
+	case constant.RelayModeAudioTranslation:
+		fallthrough
+	case constant.RelayModeAudioTranscription:
+		err = relayAudioHelper(c, relayMode)
+	case constant.RelayModeFiles:
+		err = relayFileHelper(c)
+	case constant.RelayModeAssistants:
+		err = relayAssistantHelper(c)
+	case constant.RelayModeBatches:
+		err = relayBatchHelper(c)
+	case constant.RelayModeFineTuning:
+		err = relayFineTuningHelper(c)
+	case constant.RelayModeClaudeMessages:
+		err = relayClaudeMessagesHelper(c)
+	default:
+		err = relayTextHelper(c, relayMode)
+	}
+	return err
 }
 
 func Relay(c *gin.Context) {
@@ -260,75 +105,234 @@ func Relay(c *gin.Context) {
 	tracer := otel.Tracer("one-api/controller/relay")
 	ctx, span := tracer.Start(ctx, "Relay")
 	defer span.End()
-
-	relayMode := RelayModeUnknown
-	if strings.HasPrefix(c.Request.URL.Path, "/v1/chat/completions") {
-		relayMode = RelayModeChatCompletions
-	} else if strings.HasPrefix(c.Request.URL.Path, "/v1/completions") {
-		relayMode = RelayModeCompletions
-	} else if strings.HasPrefix(c.Request.URL.Path, "/v1/embeddings") {
-		relayMode = RelayModeEmbeddings
-	} else if strings.HasSuffix(c.Request.URL.Path, "embeddings") {
-		relayMode = RelayModeEmbeddings
-	} else if strings.HasPrefix(c.Request.URL.Path, "/v1/moderations") {
-		relayMode = RelayModeModerations
-	} else if strings.HasPrefix(c.Request.URL.Path, "/v1/images/generations") {
-		relayMode = RelayModeImagesGenerations
-	} else if strings.HasPrefix(c.Request.URL.Path, "/v1/edits") {
-		relayMode = RelayModeEdits
-	} else if strings.HasPrefix(c.Request.URL.Path, "/v1/audio/speech") {
-		relayMode = RelayModeAudioSpeech
-	} else if strings.HasPrefix(c.Request.URL.Path, "/v1/audio/transcriptions") {
-		relayMode = RelayModeAudioTranscription
-	} else if strings.HasPrefix(c.Request.URL.Path, "/v1/audio/translations") {
-		relayMode = RelayModeAudioTranslation
+	c.Request = c.Request.WithContext(ctx)
+
+	relayMode := constant.Path2RelayMode(c.Request.URL.Path)
+	group := c.GetString("group")
+	requestModel := c.GetString("request_model")
+	// the probe taken by the selection of a channel is given back if the
+	// request ends before the outcome of the channel is recorded
+	probeChannelId := 0
+	if !isChannelPinned(c) {
+		probeChannelId = c.GetInt("channel_id")
 	}
-	var err *OpenAIErrorWithStatusCode
-	switch relayMode {
-	case RelayModeImagesGenerations:
-		err = relayImageHelper(c, relayMode)
-	case RelayModeAudioSpeech:
-		fallthrough
-	case RelayModeAudioTranslation:
-		fallthrough
-	case RelayModeAudioTranscription:
-		err = relayAudioHelper(c, relayMode)
-	default:
-		err = relayTextHelper(c, relayMode)
+	defer func() {
+		if probeChannelId != 0 {
+			model.ReleaseCircuitProbe(probeChannelId, requestModel)
+		}
+	}()
+	if relayMode == constant.RelayModeClaudeMessages {
+		if _, err := setupClaudeMessagesRelay(c); err != nil {
+			claudeMessagesError(c, err)
+			return
+		}
+	}
+	var failedChannelIds []int
+	var err *relaymodel.OpenAIErrorWithStatusCode
+	for attempt := 0; ; attempt++ {
+		channelId := c.GetInt("channel_id")
+		c.Set("first_token_latency", time.Duration(0))
+		c.Set("response_cached", false)
+		startTime := time.Now()
+		err = relayHelper(c, relayMode)
+		recordRelayAttempt(span, attempt, channelId, err)
+		recordChannelOutcome(ctx, c, channelId, startTime, err)
+		probeChannelId = 0
+		if err == nil {
+			return
+		}
+		processChannelRelayError(ctx, c, err)
+		if !shouldRetry(c, err) {
+			break
+		}
+		isRateLimited := err.StatusCode == http.StatusTooManyRequests
+		if attempt >= common.RetryTimes && !(isRateLimited && attempt < maxRateLimitedRetryTimes) {
+			break
+		}
+		if !isRateLimited || c.GetInt("channel_key_id") == 0 {
+			// the other keys of a channel whose key is rate limited may still serve
+			failedChannelIds = append(failedChannelIds, channelId)
+		}
+		channel, selectErr := model.CacheGetRandomSatisfiedChannel(ctx, group, requestModel, c.GetString("session_key"), failedChannelIds)
+		if selectErr == nil {
+			selectErr = middleware.SetupContextForSelectedChannel(c, channel)
+			if selectErr != nil {
+				model.ReleaseCircuitProbe(channel.Id, requestModel)
+			}
+		}
+		if selectErr != nil {
+			common.LogError(ctx, fmt.Sprintf("no other channel available for retry: %s", selectErr.Error()))
+			break
+		}
+		probeChannelId = channel.Id
+		common.LogInfo(ctx, fmt.Sprintf("retrying with channel #%d, remaining retry times: %d", channel.Id, common.RetryTimes-attempt-1))
+		requestBody, _ := c.Get(common.KeyRequestBody)
+		c.Request.Body = io.NopCloser(bytes.NewBuffer(requestBody.([]byte)))
 	}
 
-	if err != nil {
-		requestId := c.GetString(common.RequestIdKey)
-		retryTimesStr := c.Query("retry")
-		retryTimes, _ := strconv.Atoi(retryTimesStr)
-		if retryTimesStr == "" {
-			retryTimes = common.RetryTimes
+	requestId := c.GetString(common.RequestIdKey)
+	if err.StatusCode == http.StatusTooManyRequests {
+		err.OpenAIError.Message = "当前分组上游负载已饱和，请稍后再试"
+		if err.RetryAfter > 0 {
+			c.Header("Retry-After", strconv.Itoa(int(math.Ceil(err.RetryAfter.Seconds()))))
 		}
-		if retryTimes > 0 {
-			c.Redirect(http.StatusTemporaryRedirect, fmt.Sprintf("%s?retry=%d", c.Request.URL.Path, retryTimes-1))
+	}
+	err.OpenAIError.Message = common.MessageWithRequestId(err.OpenAIError.Message, requestId)
+	if relayMode == constant.RelayModeClaudeMessages {
+		claudeMessagesError(c, err)
+		return
+	}
+	c.JSON(err.StatusCode, gin.H{
+		"error": err.OpenAIError,
+	})
+}
+
+// maxRateLimitedRetryTimes bounds the retries of requests that were rate
+// limited, which are retried on the channels that are not cooling down even if
+// RetryTimes is lower
+const maxRateLimitedRetryTimes = 10
+
+// shouldRetry reports whether a failed attempt may be sent to another channel,
+// only the 5xx, 429 and 408 of the upstream, the failures to reach it and the
+// first token timeout are.
+func shouldRetry(c *gin.Context, err *relaymodel.OpenAIErrorWithStatusCode) bool {
+	if isChannelPinned(c) {
+		return false
+	}
+	if c.Writer.Written() {
+		// part of the response has already reached the client
+		return false
+	}
+	if _, ok := c.Get(common.KeyRequestBody); !ok {
+		return false
+	}
+	if !err.Upstream {
+		// an error of the gateway, such as a failed database query, would
+		// happen again on the other channels
+		return false
+	}
+	if err.StatusCode == http.StatusTooManyRequests || err.StatusCode == http.StatusRequestTimeout {
+		return true
+	}
+	return err.StatusCode >= http.StatusInternalServerError
+}
+
+func processChannelRelayError(ctx context.Context, c *gin.Context, err *relaymodel.OpenAIErrorWithStatusCode) {
+	channelId := c.GetInt("channel_id")
+	channelName := c.GetString("channel_name")
+	common.LogError(ctx, fmt.Sprintf("relay error (channel #%d): http.status_code %d openai.message %s openai.type %s openai.param %s openai.code %v",
+		channelId, err.StatusCode, err.Message, err.Type, err.Param, err.Code))
+	if !err.Upstream {
+		// the errors of the gateway, such as a user without quota, say
+		// nothing of the channel
+		return
+	}
+	channelKeyId := c.GetInt("channel_key_id")
+	// errors caused by the request itself do not count against the key
+	if channelKeyId != 0 && isChannelFailure(err) {
+		model.RecordChannelKeyError(ctx, channelKeyId, err.Message)
+	}
+	if err.StatusCode == http.StatusTooManyRequests {
+		if channelKeyId != 0 {
+			model.CoolDownChannelKey(ctx, channelId, channelKeyId, err.RetryAfter)
 		} else {
-			if err.StatusCode == http.StatusTooManyRequests {
-				err.OpenAIError.Message = "当前分组上游负载已饱和，请稍后再试"
-			}
-			err.OpenAIError.Message = common.MessageWithRequestId(err.OpenAIError.Message, requestId)
-			c.JSON(err.StatusCode, gin.H{
-				"error": err.OpenAIError,
-			})
+			model.CoolDownChannel(ctx, channelId, err.RetryAfter)
 		}
-		channelId := c.GetInt("channel_id")
-		common.LogError(c.Request.Context(), fmt.Sprintf("relay error (channel #%d): http.status_code %d openai.message %s openai.type %s openai.param %s openai.code %v",
-			channelId, err.StatusCode, err.Message, err.Type, err.Param, err.Code))
-		// https://platform.openai.com/docs/guides/error-codes/api-errors
-		if shouldDisableChannel(&err.OpenAIError, err.StatusCode) {
-			channelId := c.GetInt("channel_id")
-			channelName := c.GetString("channel_name")
+	}
+	// https://platform.openai.com/docs/guides/error-codes/api-errors
+	if shouldDisableChannel(&err.OpenAIError, err.StatusCode) {
+		if channelKeyId != 0 {
+			disableChannelKey(ctx, channelId, channelKeyId, channelName, err.Message)
+		} else {
 			disableChannel(ctx, channelId, channelName, err.Message)
 		}
 	}
 }
 
+// isChannelPinned reports whether the channel is specified by the user or by
+// the object the request is about, rather than selected. No circuit probe is
+// taken for such a channel.
+func isChannelPinned(c *gin.Context) bool {
+	_, ok := c.Get("channelId")
+	return ok
+}
+
+// recordChannelOutcome feeds the outcome of an attempt into the health and the
+// circuits of the channel. Errors caused by the request itself or produced by
+// the gateway say nothing of the channel and are left out, as are responses
+// from the cache.
+func recordChannelOutcome(ctx context.Context, c *gin.Context, channelId int, startTime time.Time, err *relaymodel.OpenAIErrorWithStatusCode) {
+	requestModel := c.GetString("request_model")
+	if c.GetBool("response_cached") || (err != nil && !isChannelFailure(err)) {
+		if !isChannelPinned(c) {
+			model.ReleaseCircuitProbe(channelId, requestModel)
+		}
+		return
+	}
+	outcome := model.ChannelOutcome{}
+	if err != nil {
+		outcome.Failed = true
+	} else if firstTokenLatency := c.GetDuration("first_token_latency"); firstTokenLatency > 0 {
+		// the duration of a stream depends on the length of the completion
+		outcome.FirstToken = firstTokenLatency
+	} else {
+		outcome.Latency = time.Since(startTime)
+	}
+	model.RecordChannelOutcome(ctx, channelId, requestModel, outcome)
+	if err != nil && err.StatusCode == http.StatusTooManyRequests {
+		// rate limits are waited out rather than opening the circuit
+		if !isChannelPinned(c) {
+			model.ReleaseCircuitProbe(channelId, requestModel)
+		}
+	} else {
+		model.RecordCircuitOutcome(channelId, requestModel, outcome.Failed, err != nil && isChannelWideFailure(err))
+	}
+}
+
+// isChannelWideFailure reports whether a failure concerns the channel rather
+// than the model, as when the upstream cannot be reached or refuses the key
+func isChannelWideFailure(err *relaymodel.OpenAIErrorWithStatusCode) bool {
+	if !err.Upstream {
+		return false
+	}
+	switch err.StatusCode {
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusRequestTimeout, http.StatusGatewayTimeout:
+		return true
+	}
+	return err.Code == "do_request_failed"
+}
+
+// isChannelFailure reports whether an error counts against the channel: an
+// error of the upstream or of the way to it, that is not caused by the request
+func isChannelFailure(err *relaymodel.OpenAIErrorWithStatusCode) bool {
+	if !err.Upstream {
+		return false
+	}
+	switch err.StatusCode {
+	case http.StatusTooManyRequests, http.StatusRequestTimeout, http.StatusUnauthorized, http.StatusForbidden:
+		return true
+	}
+	return err.StatusCode >= http.StatusInternalServerError
+}
+
+func recordRelayAttempt(span trace.Span, attempt int, channelId int, err *relaymodel.OpenAIErrorWithStatusCode) {
+	attributes := []attribute.KeyValue{
+		attribute.Int("attempt", attempt),
+		attribute.Int("channel_id", channelId),
+	}
+	if err != nil {
+		attributes = append(attributes,
+			attribute.Int("status_code", err.StatusCode),
+			attribute.String("error.message", err.Message),
+			attribute.String("error.type", err.Type),
+		)
+	}
+	span.AddEvent("relay attempt", trace.WithAttributes(attributes...))
+	span.SetAttributes(attribute.Int("relay.attempts", attempt+1))
+}
+
 func RelayNotImplemented(c *gin.Context) {
-	err := OpenAIError{
+	err := relaymodel.OpenAIError{
 		Message: "API not implemented",
 		Type:    "one_api_error",
 		Param:   "",
@@ -340,7 +344,7 @@ func RelayNotImplemented(c *gin.Context) {
 }
 
 func RelayNotFound(c *gin.Context) {
-	err := OpenAIError{
+	err := relaymodel.OpenAIError{
 		Message: fmt.Sprintf("Invalid URL (%s %s)", c.Request.Method, c.Request.URL.Path),
 		Type:    "invalid_request_error",
 		Param:   "",
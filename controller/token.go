@@ -130,6 +130,8 @@ func AddToken(c *gin.Context) {
 		ExpiredTime:    token.ExpiredTime,
 		RemainQuota:    token.RemainQuota,
 		UnlimitedQuota: token.UnlimitedQuota,
+		ResponseCache:  token.ResponseCache,
+		Transcript:     token.Transcript,
 	}
 	err = cleanToken.Insert(ctx)
 	if err != nil {
@@ -217,6 +219,8 @@ func UpdateToken(c *gin.Context) {
 		cleanToken.ExpiredTime = token.ExpiredTime
 		cleanToken.RemainQuota = token.RemainQuota
 		cleanToken.UnlimitedQuota = token.UnlimitedQuota
+		cleanToken.ResponseCache = token.ResponseCache
+		cleanToken.Transcript = token.Transcript
 	}
 	err = cleanToken.Update(ctx)
 	if err != nil {
@@ -0,0 +1,97 @@
+package controller
+
+import (
+	"net/http"
+	"one-api/common"
+	"one-api/model"
+	"one-api/relay/util"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// recordTranscript keeps the request body and the response of a request made
+// with a token that has transcripts enabled, each cut to TranscriptMaxSize
+func recordTranscript(c *gin.Context, meta *util.RelayMeta, response []byte) {
+	ctx := common.Detach(c.Request.Context())
+	requestBody, err := common.GetRequestBody(c)
+	if err != nil {
+		common.LogError(ctx, "failed to get request body for transcript: "+err.Error())
+		return
+	}
+	request, requestTruncated := truncateTranscript(requestBody)
+	responseText, responseTruncated := truncateTranscript(response)
+	transcript := model.Transcript{
+		RequestId: c.GetString(common.RequestIdKey),
+		UserId:    meta.UserId,
+		TokenId:   meta.TokenId,
+		ChannelId: meta.ChannelId,
+		ModelName: meta.OriginModelName,
+		Request:   request,
+		Response:  responseText,
+		Truncated: requestTruncated || responseTruncated,
+		CreatedAt: common.GetTimestamp(),
+	}
+	err = transcript.Insert(ctx)
+	if err != nil {
+		common.LogError(ctx, "failed to record transcript: "+err.Error())
+	}
+}
+
+func truncateTranscript(data []byte) (string, bool) {
+	maxSize := common.TranscriptMaxSize
+	if maxSize < 0 {
+		maxSize = 0
+	}
+	if len(data) <= maxSize {
+		return string(data), false
+	}
+	return strings.ToValidUTF8(string(data[:maxSize]), ""), true
+}
+
+func GetAllTranscripts(c *gin.Context) {
+	p, _ := strconv.Atoi(c.Query("p"))
+	if p < 0 {
+		p = 0
+	}
+	userId, _ := strconv.Atoi(c.Query("user_id"))
+	tokenId, _ := strconv.Atoi(c.Query("token_id"))
+	transcripts, err := model.GetAllTranscripts(c.Request.Context(), c.Query("request_id"), userId, tokenId, p*common.ItemsPerPage, common.ItemsPerPage)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "",
+		"data":    transcripts,
+	})
+}
+
+func GetTranscript(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	transcript, err := model.GetTranscriptById(c.Request.Context(), id)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "",
+		"data":    transcript,
+	})
+}
@@ -19,6 +19,18 @@ import (
 	"one-api/controller"
 	"one-api/middleware"
 	"one-api/model"
+	_ "one-api/relay/channel/aiproxy"
+	_ "one-api/relay/channel/ali"
+	_ "one-api/relay/channel/anthropic"
+	_ "one-api/relay/channel/baidu"
+	_ "one-api/relay/channel/gemini"
+	_ "one-api/relay/channel/ollama"
+	_ "one-api/relay/channel/openai"
+	_ "one-api/relay/channel/palm"
+	_ "one-api/relay/channel/tencent"
+	_ "one-api/relay/channel/xunfei"
+	_ "one-api/relay/channel/zhipu"
+	"one-api/relay/util"
 	"one-api/router"
 	"os"
 	"runtime"
@@ -62,6 +74,7 @@ func newTraceProvider(exp sdktrace.SpanExporter) *sdktrace.TracerProvider {
 	)
 }
 func main() {
+	common.Init()
 	ctx := context.Background()
 	traceEndPoint := os.Getenv("TRACE_ENDPOINT")
 
@@ -123,6 +136,9 @@ func main() {
 		go model.SyncOptions(ctx, common.SyncFrequency)
 		go model.SyncChannelCache(ctx, common.SyncFrequency)
 	}
+	if common.RedisEnabled {
+		go model.SyncChannelHealth(ctx, common.ChannelHealthSyncFrequency)
+	}
 	if os.Getenv("CHANNEL_UPDATE_FREQUENCY") != "" {
 		frequency, err := strconv.Atoi(os.Getenv("CHANNEL_UPDATE_FREQUENCY"))
 		if err != nil {
@@ -137,12 +153,18 @@ func main() {
 		}
 		go controller.AutomaticallyTestChannels(ctx, frequency)
 	}
+	if common.IsMasterNode {
+		go controller.AutomaticallyUpdateBatches(ctx, common.GetOrDefault("BATCH_POLL_FREQUENCY", 1))
+		go controller.AutomaticallyUpdateFineTuningJobs(ctx, common.GetOrDefault("FINE_TUNING_POLL_FREQUENCY", 1))
+		go controller.AutomaticallyUpdateRuns(ctx, common.GetOrDefault("ASSISTANT_RUN_POLL_FREQUENCY", 1))
+		go model.CleanTranscripts(ctx, 60*60)
+	}
 	if os.Getenv("BATCH_UPDATE_ENABLED") == "true" {
 		common.BatchUpdateEnabled = true
 		common.SysLog("batch update enabled with interval " + strconv.Itoa(common.BatchUpdateInterval) + "s")
 		model.InitBatchUpdater(ctx)
 	}
-	controller.InitTokenEncoders()
+	util.InitTokenEncoders()
 
 	if common.AsyncWriteConsumeLogEnable {
 		common.SysLog("AsyncWriteConsumeLogEnable with interval " + strconv.Itoa(common.AsyncWriteConsumeLogFrequency) + "s")
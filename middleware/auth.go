@@ -92,6 +92,10 @@ func TokenAuth() func(c *gin.Context) {
 		ctx, span := tracer.Start(ctx, "TokenAuth")
 		defer span.End()
 		key := c.Request.Header.Get("Authorization")
+		if key == "" {
+			// clients of the Messages API authenticate with x-api-key
+			key = c.Request.Header.Get("x-api-key")
+		}
 		key = strings.TrimPrefix(key, "Bearer ")
 		key = strings.TrimPrefix(key, "sk-")
 		parts := strings.Split(key, "-")
@@ -113,6 +117,8 @@ func TokenAuth() func(c *gin.Context) {
 		c.Set("id", token.UserId)
 		c.Set("token_id", token.Id)
 		c.Set("token_name", token.Name)
+		c.Set("token_response_cache", token.ResponseCache)
+		c.Set("token_transcript", token.Transcript)
 		if len(parts) > 1 {
 			if model.IsAdmin(ctx, token.UserId) {
 				c.Set("channelId", parts[1])
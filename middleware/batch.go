@@ -0,0 +1,50 @@
+package middleware
+
+import (
+	"net/http"
+	"one-api/common"
+	"one-api/model"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+type batchRequest struct {
+	InputFileId string `json:"input_file_id"`
+}
+
+// BatchChannel pins requests for a batch to the channel and the key running it,
+// a new batch goes to the ones holding its input file. Batches and files of other users
+// are reported as missing.
+func BatchChannel() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		ctx := c.Request.Context()
+		userId := c.GetInt("id")
+		if batchId := c.Param("id"); batchId != "" {
+			batch, err := model.GetUserBatchByBatchId(ctx, batchId, userId)
+			if err != nil {
+				abortWithMessage(c, http.StatusNotFound, "批处理任务不存在")
+				return
+			}
+			c.Set("batch", batch)
+			c.Set("channelId", strconv.Itoa(batch.ChannelId))
+			c.Set("channelKeyId", batch.ChannelKeyId)
+			c.Next()
+			return
+		}
+		var request batchRequest
+		err := common.UnmarshalBodyReusable(c, &request)
+		if err != nil {
+			abortWithMessage(c, http.StatusBadRequest, "无效的请求")
+			return
+		}
+		file, err := model.GetUserFileByFileId(ctx, request.InputFileId, userId)
+		if err != nil {
+			abortWithMessage(c, http.StatusNotFound, "文件不存在")
+			return
+		}
+		c.Set("channelId", strconv.Itoa(file.ChannelId))
+		c.Set("channelKeyId", file.ChannelKeyId)
+		c.Next()
+	}
+}
@@ -14,6 +14,7 @@ import (
 
 type ModelRequest struct {
 	Model string `json:"model"`
+	User  string `json:"user"`
 }
 
 func Distribute() func(c *gin.Context) {
@@ -43,6 +44,11 @@ func Distribute() func(c *gin.Context) {
 				abortWithMessage(c, http.StatusForbidden, "该渠道已被禁用")
 				return
 			}
+			// the model is only known if the request has a body, it is
+			// needed to record the health of the channel
+			var modelRequest ModelRequest
+			_ = common.UnmarshalBodyReusable(c, &modelRequest)
+			c.Set("request_model", modelRequest.Model)
 		} else {
 			// Select a channel for the user
 			var modelRequest ModelRequest
@@ -61,7 +67,7 @@ func Distribute() func(c *gin.Context) {
 					modelRequest.Model = c.Param("model")
 				}
 			}
-			if strings.HasPrefix(c.Request.URL.Path, "/v1/images/generations") {
+			if strings.HasPrefix(c.Request.URL.Path, "/v1/images/") {
 				if modelRequest.Model == "" {
 					modelRequest.Model = "dall-e-2"
 				}
@@ -71,7 +77,16 @@ func Distribute() func(c *gin.Context) {
 					modelRequest.Model = "whisper-1"
 				}
 			}
-			channel, err = model.CacheGetRandomSatisfiedChannel(ctx, userGroup, modelRequest.Model)
+			if strings.HasPrefix(c.Request.URL.Path, "/v1/files") || strings.HasPrefix(c.Request.URL.Path, "/v1/threads") {
+				// files and threads are not bound to a model, the optional model field chooses the channel
+				if modelRequest.Model == "" {
+					modelRequest.Model = "gpt-3.5-turbo"
+				}
+			}
+			c.Set("request_model", modelRequest.Model)
+			sessionKey := getSessionKey(c, &modelRequest)
+			c.Set("session_key", sessionKey)
+			channel, err = model.CacheGetRandomSatisfiedChannel(ctx, userGroup, modelRequest.Model, sessionKey, nil)
 			if err != nil {
 				message := fmt.Sprintf("当前分组 %s 下对于模型 %s 无可用渠道", userGroup, modelRequest.Model)
 				if channel != nil {
@@ -82,22 +97,85 @@ func Distribute() func(c *gin.Context) {
 				return
 			}
 		}
-		c.Set("channel", channel.Type)
-		c.Set("channel_id", channel.Id)
-		c.Set("channel_name", channel.Name)
-		c.Set("model_mapping", channel.GetModelMapping())
-		c.Request.Header.Set("Authorization", fmt.Sprintf("Bearer %s", channel.Key))
-		c.Set("base_url", channel.GetBaseURL())
-		switch channel.Type {
-		case common.ChannelTypeAzure:
-			c.Set("api_version", channel.Other)
-		case common.ChannelTypeXunfei:
-			c.Set("api_version", channel.Other)
-		case common.ChannelTypeAIProxyLibrary:
-			c.Set("library_id", channel.Other)
-		case common.ChannelTypeAli:
-			c.Set("plugin", channel.Other)
+		var err error
+		if keyId, ok := c.Get("channelKeyId"); ok {
+			err = SetupContextForPinnedChannel(c, channel, keyId.(int))
+		} else {
+			err = SetupContextForSelectedChannel(c, channel)
+		}
+		if err != nil {
+			if !ok {
+				model.ReleaseCircuitProbe(channel.Id, c.GetString("request_model"))
+			}
+			common.LogError(ctx, fmt.Sprintf("failed to select a key of channel #%d: %s", channel.Id, err.Error()))
+			abortWithMessage(c, http.StatusServiceUnavailable, "该渠道没有可用的密钥")
+			return
 		}
 		c.Next()
 	}
 }
+
+// getSessionKey returns the key that binds the requests of a session to a
+// channel in groups routed by session: the X-Session-Id header, else the user
+// field of the request, else the token
+func getSessionKey(c *gin.Context, modelRequest *ModelRequest) string {
+	tokenId := strconv.Itoa(c.GetInt("token_id"))
+	if sessionId := c.GetHeader("X-Session-Id"); sessionId != "" {
+		return "session:" + tokenId + ":" + sessionId
+	}
+	if modelRequest.User != "" {
+		return "user:" + tokenId + ":" + modelRequest.User
+	}
+	return "token:" + tokenId
+}
+
+// SetupContextForSelectedChannel stores everything the relay helpers need to
+// know about the channel the request is sent to. A channel with several keys
+// fails if none of them can be selected.
+func SetupContextForSelectedChannel(c *gin.Context, channel *model.Channel) error {
+	channelKey, err := model.SelectChannelKey(c.Request.Context(), channel)
+	if err != nil {
+		return err
+	}
+	if channelKey != nil {
+		setupContextForChannel(c, channel, channelKey.Id, channelKey.Key)
+	} else {
+		setupContextForChannel(c, channel, 0, channel.Key)
+	}
+	return nil
+}
+
+// SetupContextForPinnedChannel stores what SetupContextForSelectedChannel does
+// for a request about an object, such as a file, that only exists on the
+// upstream account of the key that created it
+func SetupContextForPinnedChannel(c *gin.Context, channel *model.Channel, keyId int) error {
+	key, err := channel.GetKeyById(c.Request.Context(), keyId)
+	if err != nil {
+		return err
+	}
+	setupContextForChannel(c, channel, keyId, key)
+	return nil
+}
+
+func setupContextForChannel(c *gin.Context, channel *model.Channel, keyId int, key string) {
+	c.Set("channel", channel.Type)
+	c.Set("channel_id", channel.Id)
+	c.Set("channel_name", channel.Name)
+	c.Set("model_mapping", channel.GetModelMapping())
+	c.Set("channel_key_id", keyId)
+	c.Request.Header.Set("Authorization", fmt.Sprintf("Bearer %s", key))
+	c.Set("base_url", channel.GetBaseURL())
+	c.Set("channel_config", channel.GetConfig())
+	switch channel.Type {
+	case common.ChannelTypeAzure:
+		c.Set("api_version", channel.Other)
+	case common.ChannelTypeXunfei:
+		c.Set("api_version", channel.Other)
+	case common.ChannelTypeGemini:
+		c.Set("api_version", channel.Other)
+	case common.ChannelTypeAIProxyLibrary:
+		c.Set("library_id", channel.Other)
+	case common.ChannelTypeAli:
+		c.Set("plugin", channel.Other)
+	}
+}
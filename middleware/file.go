@@ -0,0 +1,25 @@
+package middleware
+
+import (
+	"net/http"
+	"one-api/model"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// FileChannel pins requests for an uploaded file to the channel and the key
+// holding it, files of other users are reported as missing.
+func FileChannel() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		file, err := model.GetUserFileByFileId(c.Request.Context(), c.Param("id"), c.GetInt("id"))
+		if err != nil {
+			abortWithMessage(c, http.StatusNotFound, "文件不存在")
+			return
+		}
+		c.Set("file", file)
+		c.Set("channelId", strconv.Itoa(file.ChannelId))
+		c.Set("channelKeyId", file.ChannelKeyId)
+		c.Next()
+	}
+}
@@ -0,0 +1,62 @@
+package middleware
+
+import (
+	"net/http"
+	"one-api/common"
+	"one-api/model"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+type fineTuningJobRequest struct {
+	TrainingFile   string `json:"training_file"`
+	ValidationFile string `json:"validation_file"`
+}
+
+// FineTuningJobChannel pins requests for a fine-tuning job to the channel and
+// the key running it, a new job goes to the ones holding its training file. Jobs
+// and files of other users are reported as missing.
+func FineTuningJobChannel() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		ctx := c.Request.Context()
+		userId := c.GetInt("id")
+		if jobId := c.Param("id"); jobId != "" {
+			job, err := model.GetUserFineTuningJobByJobId(ctx, jobId, userId)
+			if err != nil {
+				abortWithMessage(c, http.StatusNotFound, "微调任务不存在")
+				return
+			}
+			c.Set("fine_tuning_job", job)
+			c.Set("channelId", strconv.Itoa(job.ChannelId))
+			c.Set("channelKeyId", job.ChannelKeyId)
+			c.Next()
+			return
+		}
+		var request fineTuningJobRequest
+		err := common.UnmarshalBodyReusable(c, &request)
+		if err != nil {
+			abortWithMessage(c, http.StatusBadRequest, "无效的请求")
+			return
+		}
+		file, err := model.GetUserFileByFileId(ctx, request.TrainingFile, userId)
+		if err != nil {
+			abortWithMessage(c, http.StatusNotFound, "文件不存在")
+			return
+		}
+		if request.ValidationFile != "" {
+			validationFile, err := model.GetUserFileByFileId(ctx, request.ValidationFile, userId)
+			if err != nil {
+				abortWithMessage(c, http.StatusNotFound, "文件不存在")
+				return
+			}
+			if validationFile.ChannelId != file.ChannelId || validationFile.ChannelKeyId != file.ChannelKeyId {
+				abortWithMessage(c, http.StatusBadRequest, "训练文件与验证文件不在同一渠道上")
+				return
+			}
+		}
+		c.Set("channelId", strconv.Itoa(file.ChannelId))
+		c.Set("channelKeyId", file.ChannelKeyId)
+		c.Next()
+	}
+}
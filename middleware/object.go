@@ -0,0 +1,65 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"one-api/common"
+	"one-api/model"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+type runRequest struct {
+	AssistantId string `json:"assistant_id"`
+}
+
+// ObjectChannel pins requests for assistants, threads and their runs to the
+// channel and the key that created them, objects of other users are reported
+// as missing.
+// A new thread goes to the channel of the user's latest assistant, so that
+// the assistant can run on it.
+func ObjectChannel(objectType string) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		ctx := c.Request.Context()
+		userId := c.GetInt("id")
+		channelId, keyId := 0, 0
+		if objectId := c.Param("id"); objectId != "" {
+			object, err := model.GetUserObject(ctx, objectId, objectType, userId)
+			if err != nil {
+				abortWithMessage(c, http.StatusNotFound, fmt.Sprintf("%s 不存在", objectId))
+				return
+			}
+			channelId, keyId = object.ChannelId, object.ChannelKeyId
+		}
+		if c.Request.Method == http.MethodPost && strings.HasSuffix(c.Request.URL.Path, "/runs") {
+			var request runRequest
+			err := common.UnmarshalBodyReusable(c, &request)
+			if err != nil {
+				abortWithMessage(c, http.StatusBadRequest, "无效的请求")
+				return
+			}
+			assistant, err := model.GetUserObject(ctx, request.AssistantId, model.ObjectTypeAssistant, userId)
+			if err != nil {
+				abortWithMessage(c, http.StatusNotFound, fmt.Sprintf("%s 不存在", request.AssistantId))
+				return
+			}
+			if channelId != 0 && (channelId != assistant.ChannelId || keyId != assistant.ChannelKeyId) {
+				abortWithMessage(c, http.StatusBadRequest, "助手与线程不在同一渠道上，无法运行")
+				return
+			}
+			channelId, keyId = assistant.ChannelId, assistant.ChannelKeyId
+		}
+		if channelId == 0 && objectType == model.ObjectTypeThread {
+			if assistant, err := model.GetLatestUserObject(ctx, userId, model.ObjectTypeAssistant); err == nil {
+				channelId, keyId = assistant.ChannelId, assistant.ChannelKeyId
+			}
+		}
+		if channelId != 0 {
+			c.Set("channelId", strconv.Itoa(channelId))
+			c.Set("channelKeyId", keyId)
+		}
+		c.Next()
+	}
+}
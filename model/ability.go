@@ -2,7 +2,13 @@ package model
 
 import (
 	"context"
+	"gorm.io/gorm"
+	"hash/fnv"
+	"math"
+	"math/rand"
 	"one-api/common"
+	"sort"
+	"strconv"
 	"strings"
 )
 
@@ -12,9 +18,12 @@ type Ability struct {
 	ChannelId int    `json:"channel_id" gorm:"primaryKey;autoIncrement:false;index"`
 	Enabled   bool   `json:"enabled"`
 	Priority  *int64 `json:"priority" gorm:"bigint;default:0;index"`
+	Weight    *uint  `json:"weight" gorm:"default:0"`
 }
 
-func GetRandomSatisfiedChannel(ctx context.Context, group string, model string) (*Channel, error) {
+// GetRandomSatisfiedChannel chooses a channel for the model in the group, the
+// session key is only used by groups routed by session
+func GetRandomSatisfiedChannel(ctx context.Context, group string, model string, sessionKey string, excludedChannelIds []int) (*Channel, error) {
 	ability := Ability{}
 	groupCol := "`group`"
 	trueVal := "1"
@@ -24,16 +33,38 @@ func GetRandomSatisfiedChannel(ctx context.Context, group string, model string)
 	}
 
 	var err error = nil
-	maxPrioritySubQuery := DB.WithContext(ctx).Model(&Ability{}).Select("MAX(priority)").Where(groupCol+" = ? and model = ? and enabled = "+trueVal, group, model)
-	channelQuery := DB.WithContext(ctx).Where(groupCol+" = ? and model = ? and enabled = "+trueVal+" and priority = (?)", group, model, maxPrioritySubQuery)
-	if common.UsingSQLite || common.UsingPostgreSQL {
-		err = channelQuery.Order("RANDOM()").First(&ability).Error
-	} else {
-		err = channelQuery.Order("RAND()").First(&ability).Error
+	isHealthRouted := common.GetGroupRoutingStrategy(group) == common.RoutingStrategyHealth
+	channelQuery := DB.WithContext(ctx).Where(groupCol+" = ? and model = ? and enabled = "+trueVal, group, model)
+	if !isHealthRouted {
+		maxPrioritySubQuery := DB.WithContext(ctx).Model(&Ability{}).Select("MAX(priority)").Where(groupCol+" = ? and model = ? and enabled = "+trueVal, group, model)
+		if len(excludedChannelIds) > 0 {
+			maxPrioritySubQuery = maxPrioritySubQuery.Where("channel_id NOT IN ?", excludedChannelIds)
+		}
+		channelQuery = channelQuery.Where("priority = (?)", maxPrioritySubQuery)
 	}
+	if len(excludedChannelIds) > 0 {
+		channelQuery = channelQuery.Where("channel_id NOT IN ?", excludedChannelIds)
+	}
+	// the candidate channels are few, so they are weighed here rather than
+	// in SQL
+	var abilities []*Ability
+	err = channelQuery.Find(&abilities).Error
 	if err != nil {
 		return nil, err
 	}
+	if len(abilities) == 0 {
+		return nil, gorm.ErrRecordNotFound
+	}
+	weights := make([]uint, len(abilities))
+	channelIds := make([]int, len(abilities))
+	for i, ability_ := range abilities {
+		weights[i] = getSelectionWeight(ability_.Weight)
+		channelIds[i] = ability_.ChannelId
+	}
+	if isHealthRouted {
+		weights = getHealthWeights(channelIds, model, weights)
+	}
+	ability = *abilities[pickChannel(group, sessionKey, channelIds, weights)]
 	channel := Channel{}
 	channel.Id = ability.ChannelId
 	err = DB.WithContext(ctx).First(&channel, "id = ?", ability.ChannelId).Error
@@ -44,6 +75,7 @@ func (channel *Channel) AddAbilities(ctx context.Context) error {
 	models_ := strings.Split(channel.Models, ",")
 	groups_ := strings.Split(channel.Group, ",")
 	abilities := make([]Ability, 0, len(models_))
+	added := make(map[string]bool)
 	for _, model := range models_ {
 		for _, group := range groups_ {
 			ability := Ability{
@@ -52,9 +84,30 @@ func (channel *Channel) AddAbilities(ctx context.Context) error {
 				ChannelId: channel.Id,
 				Enabled:   channel.Status == common.ChannelStatusEnabled,
 				Priority:  channel.Priority,
+				Weight:    channel.Weight,
 			}
 			abilities = append(abilities, ability)
+			added[group+"/"+model] = true
+		}
+	}
+	// the models fine-tuned on this channel are kept across updates
+	jobs, err := GetChannelFineTunedJobs(ctx, channel.Id)
+	if err != nil {
+		return err
+	}
+	for _, job := range jobs {
+		if added[job.Group+"/"+job.FineTunedModel] {
+			continue
 		}
+		abilities = append(abilities, Ability{
+			Group:     job.Group,
+			Model:     job.FineTunedModel,
+			ChannelId: channel.Id,
+			Enabled:   channel.Status == common.ChannelStatusEnabled,
+			Priority:  channel.Priority,
+			Weight:    channel.Weight,
+		})
+		added[job.Group+"/"+job.FineTunedModel] = true
 	}
 	return DB.WithContext(ctx).Create(&abilities).Error
 }
@@ -80,6 +133,219 @@ func (channel *Channel) UpdateAbilities(ctx context.Context) error {
 	return nil
 }
 
+// HasChannelAbility reports whether the group may use the model on the channel
+func HasChannelAbility(ctx context.Context, group string, model string, channelId int) (bool, error) {
+	groupCol := "`group`"
+	if common.UsingPostgreSQL {
+		groupCol = `"group"`
+	}
+	var count int64
+	err := DB.WithContext(ctx).Model(&Ability{}).Where(groupCol+" = ? and model = ? and channel_id = ?", group, model, channelId).Count(&count).Error
+	return count > 0, err
+}
+
 func UpdateAbilityStatus(ctx context.Context, channelId int, status bool) error {
 	return DB.WithContext(ctx).Model(&Ability{}).Where("channel_id = ?", channelId).Select("enabled").Update("enabled", status).Error
 }
+
+// getSelectionWeight returns the weight a channel is chosen by among the
+// channels of the same priority, a weight of 0 counts as 1
+func getSelectionWeight(weight *uint) uint {
+	if weight == nil || *weight == 0 {
+		return 1
+	}
+	return *weight
+}
+
+// pickWeighted returns an index chosen at random in proportion to the weights
+func pickWeighted(weights []uint) int {
+	var sum uint64
+	for _, weight := range weights {
+		sum += uint64(weight)
+	}
+	target := uint64(rand.Int63n(int64(sum)))
+	for i, weight := range weights {
+		if target < uint64(weight) {
+			return i
+		}
+		target -= uint64(weight)
+	}
+	return len(weights) - 1
+}
+
+// pickChannel returns the index of the channel chosen among the candidates,
+// at random or by session
+func pickChannel(group string, sessionKey string, channelIds []int, weights []uint) int {
+	if sessionKey != "" && common.GetGroupRoutingStrategy(group) == common.RoutingStrategySticky {
+		return pickSticky(sessionKey, channelIds, weights)
+	}
+	return pickWeighted(weights)
+}
+
+// pickSticky returns the index of the channel a session is bound to, by
+// weighted rendezvous hashing. The session stays on its channel until that
+// channel is no longer a candidate, and only the sessions of a channel that is
+// added or removed move.
+func pickSticky(sessionKey string, channelIds []int, weights []uint) int {
+	selected := 0
+	selectedScore := math.Inf(-1)
+	for i, channelId := range channelIds {
+		hash := fnv.New64a()
+		_, _ = hash.Write([]byte(sessionKey + "#" + strconv.Itoa(channelId)))
+		// a uniform number in (0, 1), the bits of FNV are mixed by the
+		// finalizer of splitmix64 as the keys only differ at the end
+		sum := hash.Sum64()
+		sum = (sum ^ (sum >> 30)) * 0xbf58476d1ce4e5b9
+		sum = (sum ^ (sum >> 27)) * 0x94d049bb133111eb
+		sum ^= sum >> 31
+		u := (float64(sum>>11) + 0.5) / (1 << 53)
+		score := float64(weights[i]) / -math.Log(u)
+		if score > selectedScore {
+			selected, selectedScore = i, score
+		}
+	}
+	return selected
+}
+
+// ChannelShare is the part of the requests for a model in a group that a
+// channel receives, channels below the top priority only serve retries unless
+// the group is routed by health. Channels that are skipped by the selection at
+// the moment get no share and say why.
+type ChannelShare struct {
+	ChannelId   int     `json:"channel_id"`
+	ChannelName string  `json:"channel_name"`
+	Priority    int64   `json:"priority"`
+	Weight      uint    `json:"weight"`
+	HealthScore float64 `json:"health_score,omitempty"`
+	Share       float64 `json:"share"`
+	Skipped     string  `json:"skipped,omitempty"`
+}
+
+const (
+	ChannelSkippedCircuitOpen = "circuit_open"
+	ChannelSkippedCooling     = "cooling"
+	ChannelSkippedNoKey       = "no_enabled_key"
+)
+
+// GetChannelDistribution previews how the requests for the model in the group
+// are spread over the enabled channels, in the way they are selected: the
+// channels whose circuits are open, that are rate limited or that have no
+// enabled key are skipped before the candidates are chosen among the others
+func GetChannelDistribution(ctx context.Context, group string, model string) ([]*ChannelShare, error) {
+	var channels []*Channel
+	if common.MemoryCacheEnabled {
+		channelSyncLock.RLock()
+		channels = group2model2channels[group][model]
+		channelSyncLock.RUnlock()
+	} else {
+		groupCol := "`group`"
+		trueVal := "1"
+		if common.UsingPostgreSQL {
+			groupCol = `"group"`
+			trueVal = "true"
+		}
+		var abilities []*Ability
+		err := DB.WithContext(ctx).Where(groupCol+" = ? and model = ? and enabled = "+trueVal, group, model).Find(&abilities).Error
+		if err != nil {
+			return nil, err
+		}
+		channelIds := make([]int, 0, len(abilities))
+		for _, ability := range abilities {
+			channelIds = append(channelIds, ability.ChannelId)
+		}
+		if len(channelIds) > 0 {
+			err = DB.WithContext(ctx).Omit("key").Where("id IN ?", channelIds).Find(&channels).Error
+			if err != nil {
+				return nil, err
+			}
+		}
+		sort.SliceStable(channels, func(i, j int) bool {
+			return channels[i].GetPriority() > channels[j].GetPriority()
+		})
+	}
+	skipped := make(map[int]string)
+	for _, channelId := range getOpenCircuitChannelIds(model) {
+		skipped[channelId] = ChannelSkippedCircuitOpen
+	}
+	for _, channelId := range getCoolingChannelIds(ctx) {
+		skipped[channelId] = ChannelSkippedCooling
+	}
+	var available []*Channel
+	for _, channel := range channels {
+		if _, ok := skipped[channel.Id]; ok {
+			continue
+		}
+		if !hasEnabledChannelKey(ctx, channel) {
+			skipped[channel.Id] = ChannelSkippedNoKey
+			continue
+		}
+		available = append(available, channel)
+	}
+	isHealthRouted := common.GetGroupRoutingStrategy(group) == common.RoutingStrategyHealth
+	candidateCount := len(available)
+	if !isHealthRouted {
+		if common.MemoryCacheEnabled {
+			candidateCount = getTopPriorityEnd(available)
+		} else {
+			candidateCount = getMaxPriorityEnd(available)
+		}
+	}
+	weights := make([]uint, len(available))
+	channelIds := make([]int, len(available))
+	for i, channel := range available {
+		weights[i] = getSelectionWeight(channel.Weight)
+		channelIds[i] = channel.Id
+	}
+	selectionWeights := weights
+	var scores []float64
+	if isHealthRouted {
+		selectionWeights = getHealthWeights(channelIds, model, weights)
+		scores = getHealthScores(channelIds, model)
+	}
+	var weightSum uint64
+	for _, weight := range selectionWeights[:candidateCount] {
+		weightSum += uint64(weight)
+	}
+	shares := make([]*ChannelShare, 0, len(channels))
+	for i, channel := range available {
+		share := &ChannelShare{
+			ChannelId:   channel.Id,
+			ChannelName: channel.Name,
+			Priority:    channel.GetPriority(),
+			Weight:      weights[i],
+		}
+		if isHealthRouted {
+			share.HealthScore = scores[i]
+		}
+		if i < candidateCount {
+			share.Share = float64(selectionWeights[i]) / float64(weightSum)
+		}
+		shares = append(shares, share)
+	}
+	for _, channel := range channels {
+		reason, ok := skipped[channel.Id]
+		if !ok {
+			continue
+		}
+		shares = append(shares, &ChannelShare{
+			ChannelId:   channel.Id,
+			ChannelName: channel.Name,
+			Priority:    channel.GetPriority(),
+			Weight:      getSelectionWeight(channel.Weight),
+			Skipped:     reason,
+		})
+	}
+	return shares, nil
+}
+
+// getMaxPriorityEnd returns the end of the channels of the top priority in
+// channels sorted by priority. Unlike getTopPriorityEnd for the memory cache,
+// it keeps to the top priority whatever its sign, as the MAX(priority) query
+// of GetRandomSatisfiedChannel does.
+func getMaxPriorityEnd(channels []*Channel) int {
+	endIdx := 0
+	for endIdx < len(channels) && channels[endIdx].GetPriority() == channels[0].GetPriority() {
+		endIdx++
+	}
+	return endIdx
+}
@@ -0,0 +1,192 @@
+package model
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"one-api/common"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPickWeighted(t *testing.T) {
+	cases := []struct {
+		name    string
+		weights []uint
+	}{
+		{"single", []uint{1}},
+		{"equal", []uint{1, 1, 1, 1}},
+		{"proportional", []uint{1, 2, 7}},
+		{"health scaled", []uint{20, 1000, 980}},
+		{"zero weight", []uint{0, 3, 1}},
+	}
+	const draws = 100000
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var sum uint
+			for _, weight := range c.weights {
+				sum += weight
+			}
+			counts := make([]int, len(c.weights))
+			for i := 0; i < draws; i++ {
+				counts[pickWeighted(c.weights)]++
+			}
+			for i, weight := range c.weights {
+				want := float64(weight) / float64(sum)
+				assert.InDelta(t, want, float64(counts[i])/draws, 0.01, "index %d", i)
+				if weight == 0 {
+					assert.Zero(t, counts[i], "index %d", i)
+				}
+			}
+		})
+	}
+}
+
+func TestPickSticky(t *testing.T) {
+	cases := []struct {
+		name       string
+		channelIds []int
+		weights    []uint
+		// the candidates after a channel is removed or added
+		newChannelIds []int
+		newWeights    []uint
+	}{
+		{
+			name:          "channel removed",
+			channelIds:    []int{1, 2, 3, 4},
+			weights:       []uint{1, 1, 1, 1},
+			newChannelIds: []int{1, 2, 4},
+			newWeights:    []uint{1, 1, 1},
+		},
+		{
+			name:          "channel added",
+			channelIds:    []int{1, 2, 3},
+			weights:       []uint{1, 1, 1},
+			newChannelIds: []int{1, 2, 3, 4},
+			newWeights:    []uint{1, 1, 1, 1},
+		},
+		{
+			name:          "weighted channel removed",
+			channelIds:    []int{10, 20, 30},
+			weights:       []uint{1, 2, 7},
+			newChannelIds: []int{10, 30},
+			newWeights:    []uint{1, 7},
+		},
+	}
+	const sessions = 20000
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var sum uint
+			for _, weight := range c.weights {
+				sum += weight
+			}
+			counts := make(map[int]int)
+			reversedChannelIds := make([]int, len(c.channelIds))
+			reversedWeights := make([]uint, len(c.weights))
+			for i := range c.channelIds {
+				reversedChannelIds[len(c.channelIds)-1-i] = c.channelIds[i]
+				reversedWeights[len(c.weights)-1-i] = c.weights[i]
+			}
+			for i := 0; i < sessions; i++ {
+				sessionKey := "session:1:" + strconv.Itoa(i)
+				channelId := c.channelIds[pickSticky(sessionKey, c.channelIds, c.weights)]
+				counts[channelId]++
+				// the channel does not depend on the order of the candidates
+				assert.Equal(t, channelId, reversedChannelIds[pickSticky(sessionKey, reversedChannelIds, reversedWeights)])
+				// only the sessions of a removed channel move, and only to an
+				// added channel
+				newChannelId := c.newChannelIds[pickSticky(sessionKey, c.newChannelIds, c.newWeights)]
+				if newChannelId != channelId {
+					assert.True(t, !containsChannel(c.newChannelIds, channelId) || !containsChannel(c.channelIds, newChannelId),
+						"session %d moved from channel #%d to #%d", i, channelId, newChannelId)
+				}
+			}
+			for i, channelId := range c.channelIds {
+				want := float64(c.weights[i]) / float64(sum)
+				assert.InDelta(t, want, float64(counts[channelId])/sessions, 0.02, "channel #%d", channelId)
+			}
+		})
+	}
+}
+
+func containsChannel(channelIds []int, channelId int) bool {
+	for _, id := range channelIds {
+		if id == channelId {
+			return true
+		}
+	}
+	return false
+}
+
+func TestGetChannelDistribution(t *testing.T) {
+	priority := func(value int64) *int64 {
+		return &value
+	}
+	channels := []*Channel{
+		{Id: 1, Name: "a", Priority: priority(10)},
+		{Id: 2, Name: "b", Priority: priority(10)},
+		{Id: 3, Name: "c", Priority: priority(5)},
+	}
+	cases := []struct {
+		name     string
+		open     []int // channels whose circuits are open
+		cooling  []int // channels that are rate limited
+		want     map[int]float64
+		wantSkip map[int]string
+	}{
+		{
+			name: "top priority",
+			want: map[int]float64{1: 0.5, 2: 0.5, 3: 0},
+		},
+		{
+			name:     "open circuit",
+			open:     []int{1},
+			want:     map[int]float64{2: 1, 3: 0},
+			wantSkip: map[int]string{1: ChannelSkippedCircuitOpen},
+		},
+		{
+			name:     "lower priority once the top is skipped",
+			open:     []int{1},
+			cooling:  []int{2},
+			want:     map[int]float64{3: 1},
+			wantSkip: map[int]string{1: ChannelSkippedCircuitOpen, 2: ChannelSkippedCooling},
+		},
+	}
+	savedMemoryCacheEnabled, savedRedisEnabled := common.MemoryCacheEnabled, common.RedisEnabled
+	common.MemoryCacheEnabled, common.RedisEnabled = true, false
+	group2model2channels = map[string]map[string][]*Channel{"default": {"gpt-4": channels}}
+	t.Cleanup(func() {
+		common.MemoryCacheEnabled, common.RedisEnabled = savedMemoryCacheEnabled, savedRedisEnabled
+		group2model2channels = nil
+	})
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			setupCircuitBreaker(t, 1, 60, 1)
+			channelCooldowns = make(map[string]int64)
+			t.Cleanup(func() {
+				channelCooldowns = make(map[string]int64)
+			})
+			for _, channelId := range c.open {
+				RecordCircuitOutcome(channelId, "gpt-4", true, false)
+			}
+			for _, channelId := range c.cooling {
+				CoolDownChannel(context.Background(), channelId, time.Minute)
+			}
+			shares, err := GetChannelDistribution(context.Background(), "default", "gpt-4")
+			require.NoError(t, err)
+			require.Len(t, shares, len(channels))
+			for _, share := range shares {
+				if reason, ok := c.wantSkip[share.ChannelId]; ok {
+					assert.Equal(t, reason, share.Skipped, "channel #%d", share.ChannelId)
+					assert.Zero(t, share.Share, "channel #%d", share.ChannelId)
+					continue
+				}
+				assert.Empty(t, share.Skipped, "channel #%d", share.ChannelId)
+				assert.InDelta(t, c.want[share.ChannelId], share.Share, 1e-9, "channel #%d", share.ChannelId)
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package model
+
+import (
+	"context"
+	"errors"
+)
+
+// Batch records a batch created through the gateway. The batch runs on the
+// upstream of the channel holding its input file, where it is polled until it
+// finishes and its output is billed.
+type Batch struct {
+	Id           int    `json:"id"`
+	BatchId      string `json:"batch_id" gorm:"type:varchar(128);uniqueIndex"`
+	UserId       int    `json:"user_id" gorm:"index"`
+	TokenId      int    `json:"token_id"`
+	ChannelId    int    `json:"channel_id"`
+	ChannelKeyId int    `json:"channel_key_id"` // the key of the channel the batch was created with
+	Endpoint     string `json:"endpoint"`
+	InputFileId  string `json:"input_file_id"`
+	OutputFileId string `json:"output_file_id"`
+	ErrorFileId  string `json:"error_file_id"`
+	Status       string `json:"status" gorm:"type:varchar(32)"`
+	Settled      bool   `json:"settled" gorm:"index"`
+	Data         string `json:"data" gorm:"type:text"` // the batch object last seen upstream
+	CreatedTime  int64  `json:"created_time" gorm:"bigint"`
+	UpdatedTime  int64  `json:"updated_time" gorm:"bigint"`
+}
+
+func (batch *Batch) Insert(ctx context.Context) error {
+	return DB.WithContext(ctx).Create(batch).Error
+}
+
+func (batch *Batch) Update(ctx context.Context) error {
+	return DB.WithContext(ctx).Model(batch).Select("output_file_id", "error_file_id", "status", "data", "updated_time").Updates(batch).Error
+}
+
+// GetUserBatchByBatchId returns the batch only if it is owned by the user
+func GetUserBatchByBatchId(ctx context.Context, batchId string, userId int) (*Batch, error) {
+	if batchId == "" {
+		return nil, errors.New("batch id 为空！")
+	}
+	batch := Batch{}
+	err := DB.WithContext(ctx).Where("batch_id = ? and user_id = ?", batchId, userId).First(&batch).Error
+	return &batch, err
+}
+
+// GetUserBatches returns the batches of the user from the newest, starting
+// after the given batch if any
+func GetUserBatches(ctx context.Context, userId int, after string, limit int) ([]*Batch, error) {
+	var batches []*Batch
+	tx := DB.WithContext(ctx).Where("user_id = ?", userId)
+	if after != "" {
+		batch, err := GetUserBatchByBatchId(ctx, after, userId)
+		if err != nil {
+			return nil, err
+		}
+		tx = tx.Where("id < ?", batch.Id)
+	}
+	err := tx.Order("id desc").Limit(limit).Find(&batches).Error
+	return batches, err
+}
+
+func GetUnsettledBatches(ctx context.Context) ([]*Batch, error) {
+	var batches []*Batch
+	err := DB.WithContext(ctx).Where("settled = ?", false).Find(&batches).Error
+	return batches, err
+}
+
+// MarkBatchSettled reports whether the batch was marked by this call, so that
+// a batch seen by several nodes is billed only once.
+func MarkBatchSettled(ctx context.Context, batchId string) (bool, error) {
+	result := DB.WithContext(ctx).Model(&Batch{}).Where("batch_id = ? and settled = ?", batchId, false).Update("settled", true)
+	return result.RowsAffected == 1, result.Error
+}
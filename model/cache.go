@@ -5,11 +5,9 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"math/rand"
 	"one-api/common"
 	"sort"
 	"strconv"
-	"strings"
 	"sync"
 	"time"
 )
@@ -153,17 +151,17 @@ func InitChannelCache(ctx context.Context) {
 	for group := range groups {
 		newGroup2model2channels[group] = make(map[string][]*Channel)
 	}
-	for _, channel := range channels {
-		groups := strings.Split(channel.Group, ",")
-		for _, group := range groups {
-			models := strings.Split(channel.Models, ",")
-			for _, model := range models {
-				if _, ok := newGroup2model2channels[group][model]; !ok {
-					newGroup2model2channels[group][model] = make([]*Channel, 0)
-				}
-				newGroup2model2channels[group][model] = append(newGroup2model2channels[group][model], channel)
-			}
+	// abilities rather than channel models, so that fine-tuned models are included
+	for _, ability := range abilities {
+		channel, ok := newChannelId2channel[ability.ChannelId]
+		if !ok || !ability.Enabled {
+			continue
+		}
+		group, model := ability.Group, ability.Model
+		if _, ok := newGroup2model2channels[group][model]; !ok {
+			newGroup2model2channels[group][model] = make([]*Channel, 0)
 		}
+		newGroup2model2channels[group][model] = append(newGroup2model2channels[group][model], channel)
 	}
 
 	// sort by priority
@@ -179,6 +177,7 @@ func InitChannelCache(ctx context.Context) {
 	channelSyncLock.Lock()
 	group2model2channels = newGroup2model2channels
 	channelSyncLock.Unlock()
+	resetChannelKeysCache()
 	common.SysLog("channels synced from database")
 }
 
@@ -190,27 +189,83 @@ func SyncChannelCache(ctx context.Context, frequency int) {
 	}
 }
 
-func CacheGetRandomSatisfiedChannel(ctx context.Context, group string, model string) (*Channel, error) {
+func CacheGetRandomSatisfiedChannel(ctx context.Context, group string, model string, sessionKey string, excludedChannelIds []int) (*Channel, error) {
+	// channels whose circuits are open or that are rate limited are skipped
+	excludedChannelIds = append(getOpenCircuitChannelIds(model), excludedChannelIds...)
+	excludedChannelIds = append(getCoolingChannelIds(ctx), excludedChannelIds...)
+	for {
+		channel, err := cacheGetRandomSatisfiedChannel(ctx, group, model, sessionKey, excludedChannelIds)
+		if err != nil {
+			return channel, err
+		}
+		// so are the channels whose keys are all disabled or rate limited, and
+		// those whose probes were taken by concurrent requests meanwhile
+		if !hasEnabledChannelKey(ctx, channel) || !acquireCircuitProbe(channel.Id, model) {
+			excludedChannelIds = append(excludedChannelIds, channel.Id)
+			continue
+		}
+		return channel, nil
+	}
+}
+
+func cacheGetRandomSatisfiedChannel(ctx context.Context, group string, model string, sessionKey string, excludedChannelIds []int) (*Channel, error) {
 	if !common.MemoryCacheEnabled {
-		return GetRandomSatisfiedChannel(ctx, group, model)
+		return GetRandomSatisfiedChannel(ctx, group, model, sessionKey, excludedChannelIds)
 	}
 	channelSyncLock.RLock()
 	defer channelSyncLock.RUnlock()
-	channels := group2model2channels[group][model]
+	channels := filterExcludedChannels(group2model2channels[group][model], excludedChannelIds)
 	if len(channels) == 0 {
 		return nil, errors.New("channel not found")
 	}
+	// choose by priority, then by weight, unless the group is routed by health
+	isHealthRouted := common.GetGroupRoutingStrategy(group) == common.RoutingStrategyHealth
+	if !isHealthRouted {
+		channels = channels[:getTopPriorityEnd(channels)]
+	}
+	weights := make([]uint, len(channels))
+	channelIds := make([]int, len(channels))
+	for i, channel := range channels {
+		weights[i] = getSelectionWeight(channel.Weight)
+		channelIds[i] = channel.Id
+	}
+	if isHealthRouted {
+		weights = getHealthWeights(channelIds, model, weights)
+	}
+	return channels[pickChannel(group, sessionKey, channelIds, weights)], nil
+}
+
+// getTopPriorityEnd returns the end of the channels of the top priority in
+// channels sorted by priority, all channels are candidates if it is not positive
+func getTopPriorityEnd(channels []*Channel) int {
 	endIdx := len(channels)
-	// choose by priority
-	firstChannel := channels[0]
-	if firstChannel.GetPriority() > 0 {
+	if len(channels) > 0 && channels[0].GetPriority() > 0 {
 		for i := range channels {
-			if channels[i].GetPriority() != firstChannel.GetPriority() {
+			if channels[i].GetPriority() != channels[0].GetPriority() {
 				endIdx = i
 				break
 			}
 		}
 	}
-	idx := rand.Intn(endIdx)
-	return channels[idx], nil
+	return endIdx
+}
+
+func filterExcludedChannels(channels []*Channel, excludedChannelIds []int) []*Channel {
+	if len(excludedChannelIds) == 0 {
+		return channels
+	}
+	filtered := make([]*Channel, 0, len(channels))
+	for _, channel := range channels {
+		excluded := false
+		for _, id := range excludedChannelIds {
+			if channel.Id == id {
+				excluded = true
+				break
+			}
+		}
+		if !excluded {
+			filtered = append(filtered, channel)
+		}
+	}
+	return filtered
 }
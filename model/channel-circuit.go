@@ -0,0 +1,194 @@
+package model
+
+import (
+	"fmt"
+	"one-api/common"
+	"sort"
+	"sync"
+)
+
+const (
+	CircuitStateClosed   = "closed"
+	CircuitStateOpen     = "open"
+	CircuitStateHalfOpen = "half_open"
+)
+
+// ChannelCircuit is the circuit breaker of a channel, or of a model of a
+// channel. It opens after consecutive failures, so that the channel is skipped
+// for a cooldown, then lets a few probe requests through and closes once one
+// of them succeeds. The circuits live in the memory of each node only.
+type ChannelCircuit struct {
+	ChannelId           int    `json:"channel_id"`
+	Model               string `json:"model"` // empty for the circuit of the whole channel
+	State               string `json:"state"`
+	ConsecutiveFailures int    `json:"consecutive_failures"`
+	OpenedTime          int64  `json:"opened_time"`
+	Probes              int    `json:"probes"` // probe requests in flight while half open
+}
+
+type channelCircuitKey struct {
+	channelId int
+	model     string
+}
+
+// closed circuits without failures are not kept
+var channelCircuits = make(map[channelCircuitKey]*ChannelCircuit)
+var channelCircuitLock sync.Mutex
+
+func isCircuitBreakerEnabled() bool {
+	return common.CircuitBreakerThreshold > 0
+}
+
+func getChannelCircuitKeys(channelId int, model string) []channelCircuitKey {
+	keys := []channelCircuitKey{{channelId: channelId}}
+	if model != "" {
+		keys = append(keys, channelCircuitKey{channelId: channelId, model: model})
+	}
+	return keys
+}
+
+// allows reports whether a request may be sent through the circuit, an open
+// circuit turns half open once its cooldown is over
+func (circuit *ChannelCircuit) allows(now int64) bool {
+	if circuit.State == CircuitStateOpen && now-circuit.OpenedTime >= int64(common.CircuitBreakerCooldown) {
+		circuit.State = CircuitStateHalfOpen
+		circuit.Probes = 0
+	}
+	switch circuit.State {
+	case CircuitStateOpen:
+		return false
+	case CircuitStateHalfOpen:
+		return circuit.Probes < common.CircuitBreakerProbeRequests
+	}
+	return true
+}
+
+// getOpenCircuitChannelIds returns the channels that may not serve the model
+// now, to be excluded from the selection
+func getOpenCircuitChannelIds(model string) []int {
+	if !isCircuitBreakerEnabled() {
+		return nil
+	}
+	now := common.GetTimestamp()
+	channelCircuitLock.Lock()
+	defer channelCircuitLock.Unlock()
+	var channelIds []int
+	for key, circuit := range channelCircuits {
+		if key.model != "" && key.model != model {
+			continue
+		}
+		if !circuit.allows(now) {
+			channelIds = append(channelIds, key.channelId)
+		}
+	}
+	return channelIds
+}
+
+// acquireCircuitProbe reports whether the circuits of a selected channel let the
+// request through and, if so, counts it as a probe of those that are half open.
+// Both happen under one lock, so that concurrent requests do not send more
+// probes than allowed.
+func acquireCircuitProbe(channelId int, model string) bool {
+	if !isCircuitBreakerEnabled() {
+		return true
+	}
+	now := common.GetTimestamp()
+	channelCircuitLock.Lock()
+	defer channelCircuitLock.Unlock()
+	keys := getChannelCircuitKeys(channelId, model)
+	for _, key := range keys {
+		circuit, ok := channelCircuits[key]
+		if ok && !circuit.allows(now) {
+			return false
+		}
+	}
+	for _, key := range keys {
+		circuit, ok := channelCircuits[key]
+		if ok && circuit.State == CircuitStateHalfOpen {
+			circuit.Probes++
+		}
+	}
+	return true
+}
+
+// ReleaseCircuitProbe ends a probe whose outcome says nothing of the channel,
+// such as an invalid request, so that another probe may be sent
+func ReleaseCircuitProbe(channelId int, model string) {
+	channelCircuitLock.Lock()
+	defer channelCircuitLock.Unlock()
+	for _, key := range getChannelCircuitKeys(channelId, model) {
+		circuit, ok := channelCircuits[key]
+		if ok && circuit.State == CircuitStateHalfOpen && circuit.Probes > 0 {
+			circuit.Probes--
+		}
+	}
+}
+
+// RecordCircuitOutcome feeds the outcome of a request relayed to a channel into
+// its circuits. A success closes the circuits of the channel and of the model,
+// a failure counts for the circuit of the model and, if it concerns the whole
+// channel, for that of the channel too.
+func RecordCircuitOutcome(channelId int, model string, failed bool, channelWide bool) {
+	if !isCircuitBreakerEnabled() || channelId == 0 {
+		return
+	}
+	now := common.GetTimestamp()
+	channelCircuitLock.Lock()
+	defer channelCircuitLock.Unlock()
+	for _, key := range getChannelCircuitKeys(channelId, model) {
+		circuit, ok := channelCircuits[key]
+		if !failed {
+			delete(channelCircuits, key)
+			continue
+		}
+		if key.model == "" && model != "" && !channelWide {
+			continue
+		}
+		if !ok {
+			circuit = &ChannelCircuit{ChannelId: channelId, Model: key.model, State: CircuitStateClosed}
+			channelCircuits[key] = circuit
+		}
+		circuit.ConsecutiveFailures++
+		if circuit.State == CircuitStateHalfOpen || circuit.ConsecutiveFailures >= common.CircuitBreakerThreshold {
+			if circuit.State != CircuitStateOpen {
+				common.SysLog(fmt.Sprintf("circuit of channel #%d (model %q) opened after %d consecutive failures", channelId, key.model, circuit.ConsecutiveFailures))
+			}
+			circuit.State = CircuitStateOpen
+			circuit.OpenedTime = now
+			circuit.Probes = 0
+		}
+	}
+}
+
+// GetChannelCircuits returns the circuits that are open, half open or closed
+// with recent failures
+func GetChannelCircuits() []*ChannelCircuit {
+	now := common.GetTimestamp()
+	channelCircuitLock.Lock()
+	defer channelCircuitLock.Unlock()
+	circuits := make([]*ChannelCircuit, 0, len(channelCircuits))
+	for _, circuit := range channelCircuits {
+		circuit.allows(now)
+		circuitCopy := *circuit
+		circuits = append(circuits, &circuitCopy)
+	}
+	sort.Slice(circuits, func(i, j int) bool {
+		if circuits[i].ChannelId != circuits[j].ChannelId {
+			return circuits[i].ChannelId < circuits[j].ChannelId
+		}
+		return circuits[i].Model < circuits[j].Model
+	})
+	return circuits
+}
+
+// ResetChannelCircuits closes the circuits of a channel, those of all its
+// models as well if the model is empty
+func ResetChannelCircuits(channelId int, model string) {
+	channelCircuitLock.Lock()
+	defer channelCircuitLock.Unlock()
+	for key := range channelCircuits {
+		if key.channelId == channelId && (model == "" || key.model == model) {
+			delete(channelCircuits, key)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package model
+
+import (
+	"testing"
+
+	"one-api/common"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func setupCircuitBreaker(t *testing.T, threshold int, cooldown int, probeRequests int) {
+	savedThreshold, savedCooldown, savedProbeRequests := common.CircuitBreakerThreshold, common.CircuitBreakerCooldown, common.CircuitBreakerProbeRequests
+	common.CircuitBreakerThreshold, common.CircuitBreakerCooldown, common.CircuitBreakerProbeRequests = threshold, cooldown, probeRequests
+	channelCircuits = make(map[channelCircuitKey]*ChannelCircuit)
+	t.Cleanup(func() {
+		common.CircuitBreakerThreshold, common.CircuitBreakerCooldown, common.CircuitBreakerProbeRequests = savedThreshold, savedCooldown, savedProbeRequests
+		channelCircuits = make(map[channelCircuitKey]*ChannelCircuit)
+	})
+}
+
+// getCircuitState returns the state of a circuit as GetChannelCircuits shows
+// it, empty if the circuit is not kept
+func getCircuitState(channelId int, model string) string {
+	circuit, ok := channelCircuits[channelCircuitKey{channelId: channelId, model: model}]
+	if !ok {
+		return ""
+	}
+	circuit.allows(common.GetTimestamp())
+	return circuit.State
+}
+
+// expireCircuitCooldowns moves the circuits that are open to the end of their
+// cooldown
+func expireCircuitCooldowns() {
+	for _, circuit := range channelCircuits {
+		circuit.OpenedTime -= int64(common.CircuitBreakerCooldown)
+	}
+}
+
+func TestCircuitTransitions(t *testing.T) {
+	const (
+		fail    = "fail"
+		succeed = "succeed"
+		acquire = "acquire"
+		release = "release"
+		expire  = "expire"
+	)
+	type step struct {
+		action string
+		want   string // the state of the circuit of the model after the step
+		// whether the request is let through, for acquire
+		acquired bool
+	}
+	cases := []struct {
+		name  string
+		steps []step
+	}{
+		{
+			name: "opens after consecutive failures",
+			steps: []step{
+				{action: acquire, want: "", acquired: true},
+				{action: fail, want: CircuitStateClosed},
+				{action: fail, want: CircuitStateOpen},
+				{action: acquire, want: CircuitStateOpen, acquired: false},
+			},
+		},
+		{
+			name: "a success forgets the failures",
+			steps: []step{
+				{action: fail, want: CircuitStateClosed},
+				{action: succeed, want: ""},
+				{action: fail, want: CircuitStateClosed},
+			},
+		},
+		{
+			name: "half open lets a probe through and closes on its success",
+			steps: []step{
+				{action: fail, want: CircuitStateClosed},
+				{action: fail, want: CircuitStateOpen},
+				{action: expire, want: CircuitStateHalfOpen},
+				{action: acquire, want: CircuitStateHalfOpen, acquired: true},
+				{action: acquire, want: CircuitStateHalfOpen, acquired: false},
+				{action: succeed, want: ""},
+				{action: acquire, want: "", acquired: true},
+			},
+		},
+		{
+			name: "a failed probe opens the circuit again",
+			steps: []step{
+				{action: fail, want: CircuitStateClosed},
+				{action: fail, want: CircuitStateOpen},
+				{action: expire, want: CircuitStateHalfOpen},
+				{action: acquire, want: CircuitStateHalfOpen, acquired: true},
+				{action: fail, want: CircuitStateOpen},
+				{action: acquire, want: CircuitStateOpen, acquired: false},
+			},
+		},
+		{
+			name: "a released probe lets another through",
+			steps: []step{
+				{action: fail, want: CircuitStateClosed},
+				{action: fail, want: CircuitStateOpen},
+				{action: expire, want: CircuitStateHalfOpen},
+				{action: acquire, want: CircuitStateHalfOpen, acquired: true},
+				{action: release, want: CircuitStateHalfOpen},
+				{action: acquire, want: CircuitStateHalfOpen, acquired: true},
+			},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			setupCircuitBreaker(t, 2, 60, 1)
+			for i, s := range c.steps {
+				switch s.action {
+				case fail:
+					RecordCircuitOutcome(1, "gpt-4", true, false)
+				case succeed:
+					RecordCircuitOutcome(1, "gpt-4", false, false)
+				case acquire:
+					assert.Equal(t, s.acquired, acquireCircuitProbe(1, "gpt-4"), "step %d", i)
+				case release:
+					ReleaseCircuitProbe(1, "gpt-4")
+				case expire:
+					expireCircuitCooldowns()
+				}
+				assert.Equal(t, s.want, getCircuitState(1, "gpt-4"), "step %d", i)
+			}
+		})
+	}
+}
+
+func TestCircuitScopes(t *testing.T) {
+	setupCircuitBreaker(t, 2, 60, 1)
+	// failures of a model leave the other models of the channel alone
+	RecordCircuitOutcome(1, "gpt-4", true, false)
+	RecordCircuitOutcome(1, "gpt-4", true, false)
+	assert.Equal(t, []int{1}, getOpenCircuitChannelIds("gpt-4"))
+	assert.Empty(t, getOpenCircuitChannelIds("gpt-3.5-turbo"))
+	assert.Equal(t, "", getCircuitState(1, ""))
+
+	// failures of the whole channel open its circuit for all models
+	RecordCircuitOutcome(2, "gpt-4", true, true)
+	RecordCircuitOutcome(2, "gpt-4", true, true)
+	assert.Equal(t, CircuitStateOpen, getCircuitState(2, ""))
+	assert.Contains(t, getOpenCircuitChannelIds("gpt-3.5-turbo"), 2)
+	assert.False(t, acquireCircuitProbe(2, "gpt-3.5-turbo"))
+
+	// a success on any model closes the circuit of the channel
+	RecordCircuitOutcome(2, "gpt-3.5-turbo", false, false)
+	assert.Equal(t, "", getCircuitState(2, ""))
+	assert.Equal(t, CircuitStateOpen, getCircuitState(2, "gpt-4"))
+
+	ResetChannelCircuits(1, "")
+	ResetChannelCircuits(2, "gpt-4")
+	assert.Empty(t, GetChannelCircuits())
+}
+
+func TestCircuitBreakerDisabled(t *testing.T) {
+	setupCircuitBreaker(t, 0, 60, 1)
+	for i := 0; i < 5; i++ {
+		RecordCircuitOutcome(1, "gpt-4", true, true)
+	}
+	assert.Empty(t, GetChannelCircuits())
+	assert.Empty(t, getOpenCircuitChannelIds("gpt-4"))
+	assert.True(t, acquireCircuitProbe(1, "gpt-4"))
+}
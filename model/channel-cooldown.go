@@ -0,0 +1,195 @@
+package model
+
+import (
+	"context"
+	"fmt"
+	"one-api/common"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	maxChannelCooldown = time.Hour
+	// cooldowns shared through Redis are loaded at most this often
+	channelCooldownRefreshInterval = time.Second
+	channelCooldownRedisKey        = "channel_cooldowns"
+)
+
+// the cooldowns of rate limited channels and keys, by member as in Redis, to
+// the Unix time in milliseconds they end at
+var channelCooldowns = make(map[string]int64)
+var channelCooldownsLoadedTime time.Time
+var channelCooldownLock sync.Mutex
+
+func getChannelCooldownMember(channelId int) string {
+	return "channel:" + strconv.Itoa(channelId)
+}
+
+func getChannelKeyCooldownMember(channelId int, keyId int) string {
+	return "key:" + strconv.Itoa(channelId) + ":" + strconv.Itoa(keyId)
+}
+
+func getCooldownDuration(retryAfter time.Duration) time.Duration {
+	if retryAfter <= 0 {
+		retryAfter = time.Duration(common.ChannelRateLimitCooldown) * time.Second
+	}
+	if retryAfter > maxChannelCooldown {
+		retryAfter = maxChannelCooldown
+	}
+	return retryAfter
+}
+
+func setCooldown(ctx context.Context, member string, duration time.Duration) {
+	until := time.Now().Add(duration).UnixMilli()
+	channelCooldownLock.Lock()
+	if until > channelCooldowns[member] {
+		channelCooldowns[member] = until
+	}
+	channelCooldownLock.Unlock()
+	if !common.RedisEnabled {
+		return
+	}
+	pipe := common.RDB.TxPipeline()
+	pipe.ZRemRangeByScore(ctx, channelCooldownRedisKey, "-inf", strconv.FormatInt(time.Now().UnixMilli(), 10))
+	pipe.ZAdd(ctx, channelCooldownRedisKey, &redis.Z{Score: float64(until), Member: member})
+	_, err := pipe.Exec(ctx)
+	if err != nil {
+		common.LogError(ctx, fmt.Sprintf("failed to save the cooldown of %s in Redis: %s", member, err.Error()))
+	}
+}
+
+// getCooldowns returns the cooldowns that have not ended yet. Those shared
+// through Redis are loaded outside the lock, so that a slow Redis does not
+// hold up the selections on this node.
+func getCooldowns(ctx context.Context) map[string]int64 {
+	now := time.Now()
+	channelCooldownLock.Lock()
+	shouldLoad := common.RedisEnabled && now.Sub(channelCooldownsLoadedTime) >= channelCooldownRefreshInterval
+	if shouldLoad {
+		// the other callers meanwhile use the cooldowns loaded before
+		channelCooldownsLoadedTime = now
+	}
+	channelCooldownLock.Unlock()
+	var members []redis.Z
+	if shouldLoad {
+		var err error
+		members, err = common.RDB.ZRangeByScoreWithScores(ctx, channelCooldownRedisKey, &redis.ZRangeBy{
+			Min: strconv.FormatInt(now.UnixMilli(), 10),
+			Max: "+inf",
+		}).Result()
+		if err != nil {
+			common.LogError(ctx, "failed to load channel cooldowns from Redis: "+err.Error())
+		}
+	}
+	channelCooldownLock.Lock()
+	defer channelCooldownLock.Unlock()
+	for _, member := range members {
+		name, _ := member.Member.(string)
+		if until := int64(member.Score); until > channelCooldowns[name] {
+			channelCooldowns[name] = until
+		}
+	}
+	cooldowns := make(map[string]int64, len(channelCooldowns))
+	for member, until := range channelCooldowns {
+		if until <= now.UnixMilli() {
+			delete(channelCooldowns, member)
+			continue
+		}
+		cooldowns[member] = until
+	}
+	return cooldowns
+}
+
+// CoolDownChannel removes a rate limited channel from the selection until the
+// upstream is ready again, a default cooldown is used if that is not known
+func CoolDownChannel(ctx context.Context, channelId int, retryAfter time.Duration) {
+	duration := getCooldownDuration(retryAfter)
+	common.LogInfo(ctx, fmt.Sprintf("channel #%d is rate limited, cooling down for %s", channelId, duration))
+	setCooldown(ctx, getChannelCooldownMember(channelId), duration)
+}
+
+// CoolDownChannelKey removes a rate limited key of a channel from the
+// selection, the channel itself cools down once all its keys do
+func CoolDownChannelKey(ctx context.Context, channelId int, keyId int, retryAfter time.Duration) {
+	duration := getCooldownDuration(retryAfter)
+	common.LogInfo(ctx, fmt.Sprintf("key #%d of channel #%d is rate limited, cooling down for %s", keyId, channelId, duration))
+	setCooldown(ctx, getChannelKeyCooldownMember(channelId, keyId), duration)
+	keys, err := CacheGetChannelKeys(ctx, channelId)
+	if err != nil {
+		return
+	}
+	cooldowns := getCooldowns(ctx)
+	var earliestUntil int64
+	for _, key := range keys {
+		if key.Status != common.ChannelStatusEnabled {
+			continue
+		}
+		until, ok := cooldowns[getChannelKeyCooldownMember(channelId, key.Id)]
+		if !ok {
+			return
+		}
+		if earliestUntil == 0 || until < earliestUntil {
+			earliestUntil = until
+		}
+	}
+	if earliestUntil > 0 {
+		CoolDownChannel(ctx, channelId, time.Until(time.UnixMilli(earliestUntil)))
+	}
+}
+
+// getCoolingChannelIds returns the channels that cool down, to be excluded
+// from the selection
+func getCoolingChannelIds(ctx context.Context) []int {
+	var channelIds []int
+	for member := range getCooldowns(ctx) {
+		if !strings.HasPrefix(member, "channel:") {
+			continue
+		}
+		channelId, err := strconv.Atoi(strings.TrimPrefix(member, "channel:"))
+		if err == nil {
+			channelIds = append(channelIds, channelId)
+		}
+	}
+	return channelIds
+}
+
+// isChannelKeyCooling reports whether a key of a channel is rate limited
+func isChannelKeyCooling(cooldowns map[string]int64, key *ChannelKey) bool {
+	_, ok := cooldowns[getChannelKeyCooldownMember(key.ChannelId, key.Id)]
+	return ok
+}
+
+// ChannelCooldown is the time a rate limited channel or key is selected again
+type ChannelCooldown struct {
+	ChannelId int   `json:"channel_id"`
+	KeyId     int   `json:"key_id,omitempty"` // zero for the whole channel
+	Until     int64 `json:"until"`            // Unix time in milliseconds
+}
+
+// GetChannelCooldowns lists the channels and the keys that cool down
+func GetChannelCooldowns(ctx context.Context) []*ChannelCooldown {
+	cooldowns := getCooldowns(ctx)
+	cooldownList := make([]*ChannelCooldown, 0, len(cooldowns))
+	for member, until := range cooldowns {
+		fields := strings.Split(member, ":")
+		cooldown := &ChannelCooldown{Until: until}
+		cooldown.ChannelId, _ = strconv.Atoi(fields[len(fields)-1])
+		if fields[0] == "key" && len(fields) == 3 {
+			cooldown.ChannelId, _ = strconv.Atoi(fields[1])
+			cooldown.KeyId, _ = strconv.Atoi(fields[2])
+		}
+		cooldownList = append(cooldownList, cooldown)
+	}
+	sort.Slice(cooldownList, func(i, j int) bool {
+		if cooldownList[i].ChannelId != cooldownList[j].ChannelId {
+			return cooldownList[i].ChannelId < cooldownList[j].ChannelId
+		}
+		return cooldownList[i].KeyId < cooldownList[j].KeyId
+	})
+	return cooldownList
+}
@@ -0,0 +1,302 @@
+package model
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"one-api/common"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	channelHealthAlpha = 0.2 // the weight of the latest outcome in the moving averages
+	// the error rate of a channel that no longer receives requests halves
+	// every half life, so that a channel that recovered gets traffic again
+	channelHealthErrorHalfLife = 2 * time.Minute
+	// the lowest score, a channel keeps some traffic so that its recovery is seen
+	channelHealthMinScore = 0.02
+	// scores are turned into integer weights at this precision
+	channelHealthScoreScale = 1000
+	channelHealthRedisKey   = "channel_health"
+)
+
+// ChannelHealth is the recent health of a model of a channel, fed by the
+// outcome of every request for the model relayed to the channel. The models
+// are kept apart since their latencies differ by far. The averages are
+// exponentially weighted.
+type ChannelHealth struct {
+	ChannelId   int     `json:"channel_id"`
+	Model       string  `json:"model"`
+	Latency     float64 `json:"latency"`     // milliseconds to complete a request that is not streamed
+	FirstToken  float64 `json:"first_token"` // milliseconds to the first token of a stream
+	ErrorRate   float64 `json:"error_rate"`
+	Requests    int64   `json:"requests"`
+	UpdatedTime int64   `json:"updated_time"`
+}
+
+// ChannelOutcome is the outcome of a request relayed to a channel, durations
+// that were not measured are zero
+type ChannelOutcome struct {
+	Failed     bool
+	Latency    time.Duration
+	FirstToken time.Duration
+}
+
+type channelHealthKey struct {
+	channelId int
+	model     string
+}
+
+var channelHealths = make(map[channelHealthKey]*ChannelHealth)
+var channelHealthLock sync.RWMutex
+
+// getChannelHealthField returns the field of the health in the Redis hash,
+// model names may hold colons but channel ids do not
+func getChannelHealthField(channelId int, model string) string {
+	return strconv.Itoa(channelId) + ":" + model
+}
+
+// updateChannelHealthScript does what updateChannelHealth does in Redis, so
+// that the nodes sharing the scores do not overwrite each other's outcomes
+var updateChannelHealthScript = redis.NewScript(`
+local value = redis.call('HGET', KEYS[1], ARGV[1])
+local health = {latency = 0, first_token = 0, error_rate = 0, requests = 0}
+if value then
+	health = cjson.decode(value)
+end
+local alpha = tonumber(ARGV[2])
+local function average(current, sample)
+	if health.requests == 0 or current == 0 then
+		return sample
+	end
+	return current + alpha * (sample - current)
+end
+local latency = tonumber(ARGV[4])
+local first_token = tonumber(ARGV[5])
+if latency > 0 then
+	health.latency = average(health.latency, latency)
+end
+if first_token > 0 then
+	health.first_token = average(health.first_token, first_token)
+end
+health.error_rate = health.error_rate + alpha * (tonumber(ARGV[3]) - health.error_rate)
+health.requests = health.requests + 1
+health.updated_time = tonumber(ARGV[6])
+redis.call('HSET', KEYS[1], ARGV[1], cjson.encode(health))
+return 1
+`)
+
+func isChannelHealthShared() bool {
+	return common.RedisEnabled && common.ChannelHealthRedisEnabled
+}
+
+// RecordChannelOutcome feeds the outcome of a relayed request into the health
+// of the model of the channel
+func RecordChannelOutcome(ctx context.Context, channelId int, model string, outcome ChannelOutcome) {
+	if channelId == 0 {
+		return
+	}
+	now := common.GetTimestamp()
+	key := channelHealthKey{channelId: channelId, model: model}
+	channelHealthLock.Lock()
+	health, ok := channelHealths[key]
+	if !ok {
+		health = &ChannelHealth{ChannelId: channelId, Model: model}
+		channelHealths[key] = health
+	}
+	updateChannelHealth(health, outcome, now)
+	channelHealthLock.Unlock()
+	if !isChannelHealthShared() {
+		return
+	}
+	failed := 0
+	if outcome.Failed {
+		failed = 1
+	}
+	err := updateChannelHealthScript.Run(ctx, common.RDB, []string{channelHealthRedisKey},
+		getChannelHealthField(channelId, model), channelHealthAlpha, failed, outcome.Latency.Milliseconds(), outcome.FirstToken.Milliseconds(), now).Err()
+	if err != nil {
+		common.LogError(ctx, fmt.Sprintf("failed to update health of channel #%d in Redis: %s", channelId, err.Error()))
+	}
+}
+
+func updateChannelHealth(health *ChannelHealth, outcome ChannelOutcome, now int64) {
+	average := func(current float64, sample time.Duration) float64 {
+		if health.Requests == 0 || current == 0 {
+			return float64(sample.Milliseconds())
+		}
+		return current + channelHealthAlpha*(float64(sample.Milliseconds())-current)
+	}
+	if outcome.Latency > 0 {
+		health.Latency = average(health.Latency, outcome.Latency)
+	}
+	if outcome.FirstToken > 0 {
+		health.FirstToken = average(health.FirstToken, outcome.FirstToken)
+	}
+	// the error rate starts at 0, so that a single failure does not starve a
+	// channel
+	failed := 0.0
+	if outcome.Failed {
+		failed = 1
+	}
+	health.ErrorRate += channelHealthAlpha * (failed - health.ErrorRate)
+	health.Requests++
+	health.UpdatedTime = now
+}
+
+// SyncChannelHealth loads the health shared by all nodes from Redis
+func SyncChannelHealth(ctx context.Context, frequency int) {
+	for {
+		time.Sleep(time.Duration(frequency) * time.Second)
+		if !isChannelHealthShared() {
+			continue
+		}
+		values, err := common.RDB.HGetAll(ctx, channelHealthRedisKey).Result()
+		if err != nil {
+			common.SysError("failed to load channel health from Redis: " + err.Error())
+			continue
+		}
+		newChannelHealths := make(map[channelHealthKey]*ChannelHealth, len(values))
+		for field, value := range values {
+			id, model, ok := strings.Cut(field, ":")
+			if !ok {
+				continue
+			}
+			channelId, err := strconv.Atoi(id)
+			if err != nil {
+				continue
+			}
+			health := &ChannelHealth{}
+			err = json.Unmarshal([]byte(value), health)
+			if err != nil {
+				common.SysError(fmt.Sprintf("failed to parse health of channel #%d: %s", channelId, err.Error()))
+				continue
+			}
+			health.ChannelId = channelId
+			health.Model = model
+			newChannelHealths[channelHealthKey{channelId: channelId, model: model}] = health
+		}
+		channelHealthLock.Lock()
+		channelHealths = newChannelHealths
+		channelHealthLock.Unlock()
+	}
+}
+
+// ResetChannelHealth forgets the health of all models of a channel, on this
+// node and in Redis
+func ResetChannelHealth(ctx context.Context, channelId int) {
+	channelHealthLock.Lock()
+	for key := range channelHealths {
+		if key.channelId == channelId {
+			delete(channelHealths, key)
+		}
+	}
+	channelHealthLock.Unlock()
+	if !isChannelHealthShared() {
+		return
+	}
+	fields, err := common.RDB.HKeys(ctx, channelHealthRedisKey).Result()
+	if err == nil {
+		prefix := getChannelHealthField(channelId, "")
+		var channelFields []string
+		for _, field := range fields {
+			if strings.HasPrefix(field, prefix) {
+				channelFields = append(channelFields, field)
+			}
+		}
+		if len(channelFields) > 0 {
+			err = common.RDB.HDel(ctx, channelHealthRedisKey, channelFields...).Err()
+		}
+	}
+	if err != nil {
+		common.LogError(ctx, fmt.Sprintf("failed to reset health of channel #%d in Redis: %s", channelId, err.Error()))
+	}
+}
+
+// GetAllChannelHealth returns the health of the models of the channels that
+// have outcomes, the scores depend on the candidates and are previewed by
+// GetChannelDistribution
+func GetAllChannelHealth() []*ChannelHealth {
+	channelHealthLock.RLock()
+	defer channelHealthLock.RUnlock()
+	healths := make([]*ChannelHealth, 0, len(channelHealths))
+	for _, health := range channelHealths {
+		healthCopy := *health
+		healthCopy.ErrorRate = getDecayedErrorRate(health)
+		healths = append(healths, &healthCopy)
+	}
+	sort.Slice(healths, func(i, j int) bool {
+		if healths[i].ChannelId != healths[j].ChannelId {
+			return healths[i].ChannelId < healths[j].ChannelId
+		}
+		return healths[i].Model < healths[j].Model
+	})
+	return healths
+}
+
+func getDecayedErrorRate(health *ChannelHealth) float64 {
+	idle := time.Duration(common.GetTimestamp()-health.UpdatedTime) * time.Second
+	if idle <= 0 {
+		return health.ErrorRate
+	}
+	return health.ErrorRate * math.Pow(0.5, idle.Seconds()/channelHealthErrorHalfLife.Seconds())
+}
+
+// getHealthScores scores the candidate channels for the model between
+// channelHealthMinScore and 1. The error rate lowers the score of a channel on
+// its own, the latencies lower it in proportion to those of the fastest
+// candidate. A channel without outcomes for the model yet scores 1, so that it
+// is tried.
+func getHealthScores(channelIds []int, model string) []float64 {
+	channelHealthLock.RLock()
+	defer channelHealthLock.RUnlock()
+	var bestLatency, bestFirstToken float64
+	for _, channelId := range channelIds {
+		health, ok := channelHealths[channelHealthKey{channelId: channelId, model: model}]
+		if !ok {
+			continue
+		}
+		if health.Latency > 0 && (bestLatency == 0 || health.Latency < bestLatency) {
+			bestLatency = health.Latency
+		}
+		if health.FirstToken > 0 && (bestFirstToken == 0 || health.FirstToken < bestFirstToken) {
+			bestFirstToken = health.FirstToken
+		}
+	}
+	scores := make([]float64, len(channelIds))
+	for i, channelId := range channelIds {
+		health, ok := channelHealths[channelHealthKey{channelId: channelId, model: model}]
+		if !ok {
+			scores[i] = 1
+			continue
+		}
+		successRate := 1 - getDecayedErrorRate(health)
+		score := successRate * successRate
+		if health.Latency > 0 {
+			score *= bestLatency / health.Latency
+		}
+		if health.FirstToken > 0 {
+			score *= bestFirstToken / health.FirstToken
+		}
+		scores[i] = math.Max(score, channelHealthMinScore)
+	}
+	return scores
+}
+
+// getHealthWeights scales the selection weights of the channels by their
+// health scores for the model
+func getHealthWeights(channelIds []int, model string, weights []uint) []uint {
+	scores := getHealthScores(channelIds, model)
+	healthWeights := make([]uint, len(weights))
+	for i, weight := range weights {
+		healthWeights[i] = uint(math.Max(1, math.Round(float64(weight)*scores[i]*channelHealthScoreScale)))
+	}
+	return healthWeights
+}
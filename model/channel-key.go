@@ -0,0 +1,277 @@
+package model
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gorm.io/gorm"
+	"math/rand"
+	"one-api/common"
+	"sync"
+	"sync/atomic"
+)
+
+// ChannelKey is a key of a channel with several keys, the status, used quota
+// and test results of each key are kept apart from the ones of the channel.
+type ChannelKey struct {
+	Id            int    `json:"id"`
+	ChannelId     int    `json:"channel_id" gorm:"index"`
+	Key           string `json:"key" gorm:"type:text;not null"`
+	Status        int    `json:"status" gorm:"default:1"`
+	UsedQuota     int64  `json:"used_quota" gorm:"bigint;default:0"`
+	TestTime      int64  `json:"test_time" gorm:"bigint"`
+	ResponseTime  int    `json:"response_time"` // in milliseconds
+	LastErrorTime int64  `json:"last_error_time" gorm:"bigint"`
+	LastError     string `json:"last_error" gorm:"type:text"`
+	CreatedTime   int64  `json:"created_time" gorm:"bigint"`
+}
+
+var ErrNoEnabledChannelKey = errors.New("no enabled key")
+
+// GetChannelKeys returns the keys of the channel in the order they were added
+func GetChannelKeys(ctx context.Context, channelId int) ([]*ChannelKey, error) {
+	var keys []*ChannelKey
+	err := DB.WithContext(ctx).Where("channel_id = ?", channelId).Order("id").Find(&keys).Error
+	return keys, err
+}
+
+func GetChannelKeyById(ctx context.Context, channelId int, id int) (*ChannelKey, error) {
+	key := ChannelKey{}
+	err := DB.WithContext(ctx).First(&key, "id = ? and channel_id = ?", id, channelId).Error
+	return &key, err
+}
+
+// SetChannelKeys replaces the keys of the channel, the keys that are kept keep
+// their status, used quota and test results
+func SetChannelKeys(ctx context.Context, channelId int, keys []string) error {
+	defer invalidateChannelKeys(channelId)
+	return DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var existingKeys []*ChannelKey
+		err := tx.Where("channel_id = ?", channelId).Find(&existingKeys).Error
+		if err != nil {
+			return err
+		}
+		kept := make(map[string]bool)
+		for _, key := range keys {
+			kept[key] = true
+		}
+		existing := make(map[string]bool)
+		for _, key := range existingKeys {
+			if !kept[key.Key] || existing[key.Key] {
+				err = tx.Delete(key).Error
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			existing[key.Key] = true
+		}
+		for _, key := range keys {
+			if existing[key] {
+				continue
+			}
+			existing[key] = true
+			err = tx.Create(&ChannelKey{
+				ChannelId:   channelId,
+				Key:         key,
+				Status:      common.ChannelStatusEnabled,
+				CreatedTime: common.GetTimestamp(),
+			}).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func DeleteChannelKeys(ctx context.Context, channelId int) error {
+	defer invalidateChannelKeys(channelId)
+	return DB.WithContext(ctx).Where("channel_id = ?", channelId).Delete(&ChannelKey{}).Error
+}
+
+func UpdateChannelKeyStatus(ctx context.Context, channelId int, id int, status int) {
+	defer invalidateChannelKeys(channelId)
+	err := DB.WithContext(ctx).Model(&ChannelKey{}).Where("id = ?", id).Update("status", status).Error
+	if err != nil {
+		common.SysError("failed to update channel key status: " + err.Error())
+	}
+}
+
+func (key *ChannelKey) UpdateResponseTime(ctx context.Context, responseTime int64) {
+	err := DB.WithContext(ctx).Model(key).Select("response_time", "test_time").Updates(ChannelKey{
+		TestTime:     common.GetTimestamp(),
+		ResponseTime: int(responseTime),
+	}).Error
+	if err != nil {
+		common.SysError("failed to update channel key response time: " + err.Error())
+	}
+}
+
+// RecordChannelKeyError remembers when the key failed last, which the
+// least_recently_errored strategy chooses by
+func RecordChannelKeyError(ctx context.Context, id int, message string) {
+	now := common.GetTimestamp()
+	channelKeyErrorTimesLock.Lock()
+	channelKeyErrorTimes[id] = now
+	channelKeyErrorTimesLock.Unlock()
+	err := DB.WithContext(ctx).Model(&ChannelKey{}).Where("id = ?", id).Updates(map[string]any{
+		"last_error_time": now,
+		"last_error":      message,
+	}).Error
+	if err != nil {
+		common.SysError("failed to record channel key error: " + err.Error())
+	}
+}
+
+func updateChannelKeyUsedQuota(ctx context.Context, id int, quota int) {
+	err := DB.WithContext(ctx).Model(&ChannelKey{}).Where("id = ?", id).Update("used_quota", gorm.Expr("used_quota + ?", quota)).Error
+	if err != nil {
+		common.SysError("failed to update channel key used quota: " + err.Error())
+	}
+}
+
+var channelId2keys = make(map[int][]*ChannelKey)
+var channelKeysLock sync.RWMutex
+
+// the time a key failed last on this node, it is ahead of the one in the
+// cache of keys
+var channelKeyErrorTimes = make(map[int]int64)
+var channelKeyErrorTimesLock sync.Mutex
+
+// cursors of the round_robin strategy by channel id
+var channelKeyCursors sync.Map
+
+// CacheGetChannelKeys returns the keys of the channel, they are cached in
+// memory until the channels are synced from the database or the keys change
+func CacheGetChannelKeys(ctx context.Context, channelId int) ([]*ChannelKey, error) {
+	if !common.MemoryCacheEnabled {
+		return GetChannelKeys(ctx, channelId)
+	}
+	channelKeysLock.RLock()
+	keys, ok := channelId2keys[channelId]
+	channelKeysLock.RUnlock()
+	if ok {
+		return keys, nil
+	}
+	keys, err := GetChannelKeys(ctx, channelId)
+	if err != nil {
+		return nil, err
+	}
+	channelKeysLock.Lock()
+	channelId2keys[channelId] = keys
+	channelKeysLock.Unlock()
+	return keys, nil
+}
+
+// GetKeyById returns the key of the channel with the id, or the key of the
+// channel itself if the id is zero. Objects such as files and batches only
+// exist on the upstream account of the key that created them.
+func (channel *Channel) GetKeyById(ctx context.Context, id int) (string, error) {
+	if id == 0 {
+		return channel.Key, nil
+	}
+	keys, err := CacheGetChannelKeys(ctx, channel.Id)
+	if err != nil {
+		return "", err
+	}
+	for _, key := range keys {
+		if key.Id == id {
+			return key.Key, nil
+		}
+	}
+	return "", fmt.Errorf("key #%d of channel #%d not found", id, channel.Id)
+}
+
+func invalidateChannelKeys(channelId int) {
+	channelKeysLock.Lock()
+	delete(channelId2keys, channelId)
+	channelKeysLock.Unlock()
+}
+
+func resetChannelKeysCache() {
+	channelKeysLock.Lock()
+	channelId2keys = make(map[int][]*ChannelKey)
+	channelKeysLock.Unlock()
+}
+
+// SelectChannelKey chooses an enabled key of the channel by its strategy, it
+// returns nil for a channel with a single key
+func SelectChannelKey(ctx context.Context, channel *Channel) (*ChannelKey, error) {
+	strategy := channel.GetKeyStrategy()
+	if strategy == "" {
+		return nil, nil
+	}
+	enabledKeys, err := getEnabledChannelKeys(ctx, channel)
+	if err != nil {
+		return nil, err
+	}
+	if len(enabledKeys) == 0 {
+		return nil, ErrNoEnabledChannelKey
+	}
+	switch strategy {
+	case common.ChannelKeyStrategyRandom:
+		return enabledKeys[rand.Intn(len(enabledKeys))], nil
+	case common.ChannelKeyStrategyLeastRecentlyErrored:
+		// ties are broken in turn, so that keys that never failed share the load
+		start := nextChannelKeyCursor(channel.Id)
+		var selected *ChannelKey
+		var selectedErrorTime int64
+		for i := range enabledKeys {
+			key := enabledKeys[(start+i)%len(enabledKeys)]
+			errorTime := getChannelKeyErrorTime(key)
+			if selected == nil || errorTime < selectedErrorTime {
+				selected, selectedErrorTime = key, errorTime
+			}
+		}
+		return selected, nil
+	default:
+		return enabledKeys[nextChannelKeyCursor(channel.Id)%len(enabledKeys)], nil
+	}
+}
+
+// getEnabledChannelKeys returns the keys of the channel that are enabled and
+// not rate limited
+func getEnabledChannelKeys(ctx context.Context, channel *Channel) ([]*ChannelKey, error) {
+	keys, err := CacheGetChannelKeys(ctx, channel.Id)
+	if err != nil {
+		return nil, err
+	}
+	cooldowns := getCooldowns(ctx)
+	enabledKeys := make([]*ChannelKey, 0, len(keys))
+	for _, key := range keys {
+		if key.Status == common.ChannelStatusEnabled && !isChannelKeyCooling(cooldowns, key) {
+			enabledKeys = append(enabledKeys, key)
+		}
+	}
+	return enabledKeys, nil
+}
+
+// hasEnabledChannelKey reports whether a key can be selected for the channel,
+// a channel with several keys cannot serve once all of them are disabled or
+// rate limited
+func hasEnabledChannelKey(ctx context.Context, channel *Channel) bool {
+	if channel.GetKeyStrategy() == "" {
+		return true
+	}
+	enabledKeys, err := getEnabledChannelKeys(ctx, channel)
+	if err != nil {
+		// the selection of the key reports the error
+		return true
+	}
+	return len(enabledKeys) > 0
+}
+
+func nextChannelKeyCursor(channelId int) int {
+	cursor, _ := channelKeyCursors.LoadOrStore(channelId, new(uint64))
+	return int(atomic.AddUint64(cursor.(*uint64), 1) % (1 << 31))
+}
+
+func getChannelKeyErrorTime(key *ChannelKey) int64 {
+	channelKeyErrorTimesLock.Lock()
+	defer channelKeyErrorTimesLock.Unlock()
+	if errorTime, ok := channelKeyErrorTimes[key.Id]; ok && errorTime > key.LastErrorTime {
+		return errorTime
+	}
+	return key.LastErrorTime
+}
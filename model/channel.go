@@ -2,6 +2,7 @@ package model
 
 import (
 	"context"
+	"fmt"
 	"go.opentelemetry.io/otel"
 	"gorm.io/gorm"
 	"one-api/common"
@@ -26,6 +27,10 @@ type Channel struct {
 	UsedQuota          int64   `json:"used_quota" gorm:"bigint;default:0"`
 	ModelMapping       *string `json:"model_mapping" gorm:"type:varchar(1024);default:''"`
 	Priority           *int64  `json:"priority" gorm:"bigint;default:0"`
+	Config             *string `json:"config" gorm:"type:text"`
+	// KeyStrategy chooses among the keys of a channel with several keys, which
+	// are kept in ChannelKey, Key is then the first of them
+	KeyStrategy *string `json:"key_strategy" gorm:"type:varchar(32);default:''"`
 }
 
 func GetAllChannels(ctx context.Context, startIdx int, num int, selectAll bool) ([]*Channel, error) {
@@ -95,6 +100,26 @@ func (channel *Channel) GetModelMapping() string {
 	return *channel.ModelMapping
 }
 
+func (channel *Channel) GetKeyStrategy() string {
+	if channel.KeyStrategy == nil {
+		return ""
+	}
+	return *channel.KeyStrategy
+}
+
+// GetConfig returns the structured settings of the channel, they are checked
+// when the channel is saved
+func (channel *Channel) GetConfig() *common.ChannelConfig {
+	if channel.Config == nil {
+		return &common.ChannelConfig{}
+	}
+	config, err := common.ParseChannelConfig(*channel.Config)
+	if err != nil {
+		common.SysError(fmt.Sprintf("failed to parse config of channel #%d: %s", channel.Id, err.Error()))
+	}
+	return config
+}
+
 func (channel *Channel) Insert(ctx context.Context) error {
 	var err error
 	err = DB.WithContext(ctx).Create(channel).Error
@@ -143,6 +168,10 @@ func (channel *Channel) Delete(ctx context.Context) error {
 		return err
 	}
 	err = channel.DeleteAbilities(ctx)
+	if err != nil {
+		return err
+	}
+	err = DeleteChannelKeys(ctx, channel.Id)
 	return err
 }
 
@@ -157,15 +186,23 @@ func UpdateChannelStatusById(ctx context.Context, id int, status int) {
 	}
 }
 
-func UpdateChannelUsedQuota(ctx context.Context, id int, quota int) {
+// UpdateChannelUsedQuota adds the quota to the channel, and to the key the
+// request was sent with if the channel has several keys
+func UpdateChannelUsedQuota(ctx context.Context, id int, keyId int, quota int) {
 	tracer := otel.Tracer("one-api/model/channel")
 	ctx, span := tracer.Start(ctx, "UpdateChannelUsedQuota")
 	defer span.End()
 	if common.BatchUpdateEnabled {
 		addNewRecord(BatchUpdateTypeChannelUsedQuota, id, quota)
+		if keyId != 0 {
+			addNewRecord(BatchUpdateTypeChannelKeyUsedQuota, keyId, quota)
+		}
 		return
 	}
 	updateChannelUsedQuota(ctx, id, quota)
+	if keyId != 0 {
+		updateChannelKeyUsedQuota(ctx, keyId, quota)
+	}
 }
 
 func updateChannelUsedQuota(ctx context.Context, id int, quota int) {
@@ -177,10 +214,20 @@ func updateChannelUsedQuota(ctx context.Context, id int, quota int) {
 
 func DeleteChannelByStatus(ctx context.Context, status int64) (int64, error) {
 	result := DB.WithContext(ctx).Where("status = ?", status).Delete(&Channel{})
+	deleteOrphanChannelKeys(ctx)
 	return result.RowsAffected, result.Error
 }
 
 func DeleteDisabledChannel(ctx context.Context) (int64, error) {
 	result := DB.WithContext(ctx).Where("status = ? or status = ?", common.ChannelStatusAutoDisabled, common.ChannelStatusManuallyDisabled).Delete(&Channel{})
+	deleteOrphanChannelKeys(ctx)
 	return result.RowsAffected, result.Error
 }
+
+func deleteOrphanChannelKeys(ctx context.Context) {
+	err := DB.WithContext(ctx).Where("channel_id NOT IN (?)", DB.Model(&Channel{}).Select("id")).Delete(&ChannelKey{}).Error
+	if err != nil {
+		common.SysError("failed to delete keys of deleted channels: " + err.Error())
+	}
+	resetChannelKeysCache()
+}
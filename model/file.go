@@ -0,0 +1,55 @@
+package model
+
+import (
+	"context"
+	"errors"
+)
+
+// File records a file uploaded through the gateway, the file itself lives on the
+// upstream of the channel it was uploaded to.
+type File struct {
+	Id           int    `json:"id"`
+	FileId       string `json:"file_id" gorm:"type:varchar(128);uniqueIndex"`
+	UserId       int    `json:"user_id" gorm:"index"`
+	TokenId      int    `json:"token_id"`
+	ChannelId    int    `json:"channel_id" gorm:"index"`
+	ChannelKeyId int    `json:"channel_key_id"` // the key of the channel the file was uploaded with
+	Filename     string `json:"filename"`
+	Purpose      string `json:"purpose" gorm:"type:varchar(32)"`
+	Bytes        int64  `json:"bytes"`
+	CreatedTime  int64  `json:"created_time" gorm:"bigint"`
+}
+
+func (file *File) Insert(ctx context.Context) error {
+	return DB.WithContext(ctx).Create(file).Error
+}
+
+// Record inserts the file unless it has been recorded already, it is used for
+// files created by the upstream, such as the output of a batch.
+func (file *File) Record(ctx context.Context) error {
+	return DB.WithContext(ctx).Where("file_id = ?", file.FileId).FirstOrCreate(file).Error
+}
+
+func (file *File) Delete(ctx context.Context) error {
+	return DB.WithContext(ctx).Delete(file).Error
+}
+
+// GetUserFileByFileId returns the file only if it is owned by the user
+func GetUserFileByFileId(ctx context.Context, fileId string, userId int) (*File, error) {
+	if fileId == "" {
+		return nil, errors.New("file id 为空！")
+	}
+	file := File{}
+	err := DB.WithContext(ctx).Where("file_id = ? and user_id = ?", fileId, userId).First(&file).Error
+	return &file, err
+}
+
+func GetUserFiles(ctx context.Context, userId int, purpose string) ([]*File, error) {
+	var files []*File
+	tx := DB.WithContext(ctx).Where("user_id = ?", userId)
+	if purpose != "" {
+		tx = tx.Where("purpose = ?", purpose)
+	}
+	err := tx.Order("id desc").Find(&files).Error
+	return files, err
+}
@@ -0,0 +1,111 @@
+package model
+
+import (
+	"context"
+	"errors"
+	"one-api/common"
+)
+
+// FineTuningJob records a fine-tuning job created through the gateway. The
+// fine-tuned model only exists on the upstream account of the channel that
+// trained it, so once the job succeeds the model becomes an ability of that
+// channel for the group of the user who created the job.
+type FineTuningJob struct {
+	Id             int    `json:"id"`
+	JobId          string `json:"job_id" gorm:"type:varchar(128);uniqueIndex"`
+	UserId         int    `json:"user_id" gorm:"index"`
+	TokenId        int    `json:"token_id"`
+	ChannelId      int    `json:"channel_id" gorm:"index"`
+	ChannelKeyId   int    `json:"channel_key_id"` // the key of the channel the job was created with
+	Group          string `json:"group" gorm:"type:varchar(32)"`
+	Model          string `json:"model"`
+	FineTunedModel string `json:"fine_tuned_model"`
+	Status         string `json:"status" gorm:"type:varchar(32)"`
+	Settled        bool   `json:"settled" gorm:"index"`
+	Data           string `json:"data" gorm:"type:text"` // the job object last seen upstream
+	CreatedTime    int64  `json:"created_time" gorm:"bigint"`
+	UpdatedTime    int64  `json:"updated_time" gorm:"bigint"`
+}
+
+func (job *FineTuningJob) Insert(ctx context.Context) error {
+	return DB.WithContext(ctx).Create(job).Error
+}
+
+func (job *FineTuningJob) Update(ctx context.Context) error {
+	return DB.WithContext(ctx).Model(job).Select("fine_tuned_model", "status", "data", "updated_time").Updates(job).Error
+}
+
+// AddAbility makes the fine-tuned model available on the channel that
+// trained it, to the group of the user who created the job only. The channel
+// cache of this node is reloaded so that the model is served at once, the
+// other nodes pick it up on their next sync.
+func (job *FineTuningJob) AddAbility(ctx context.Context) error {
+	channel, err := GetChannelById(ctx, job.ChannelId, false)
+	if err != nil {
+		return err
+	}
+	ability := Ability{
+		Group:     job.Group,
+		Model:     job.FineTunedModel,
+		ChannelId: job.ChannelId,
+	}
+	err = DB.WithContext(ctx).Where(&ability).Attrs(Ability{
+		Enabled:  channel.Status == common.ChannelStatusEnabled,
+		Priority: channel.Priority,
+		Weight:   channel.Weight,
+	}).FirstOrCreate(&ability).Error
+	if err != nil {
+		return err
+	}
+	if common.MemoryCacheEnabled {
+		InitChannelCache(ctx)
+	}
+	return nil
+}
+
+// GetUserFineTuningJobByJobId returns the job only if it is owned by the user
+func GetUserFineTuningJobByJobId(ctx context.Context, jobId string, userId int) (*FineTuningJob, error) {
+	if jobId == "" {
+		return nil, errors.New("job id 为空！")
+	}
+	job := FineTuningJob{}
+	err := DB.WithContext(ctx).Where("job_id = ? and user_id = ?", jobId, userId).First(&job).Error
+	return &job, err
+}
+
+// GetUserFineTuningJobs returns the jobs of the user from the newest, starting
+// after the given job if any
+func GetUserFineTuningJobs(ctx context.Context, userId int, after string, limit int) ([]*FineTuningJob, error) {
+	var jobs []*FineTuningJob
+	tx := DB.WithContext(ctx).Where("user_id = ?", userId)
+	if after != "" {
+		job, err := GetUserFineTuningJobByJobId(ctx, after, userId)
+		if err != nil {
+			return nil, err
+		}
+		tx = tx.Where("id < ?", job.Id)
+	}
+	err := tx.Order("id desc").Limit(limit).Find(&jobs).Error
+	return jobs, err
+}
+
+func GetUnsettledFineTuningJobs(ctx context.Context) ([]*FineTuningJob, error) {
+	var jobs []*FineTuningJob
+	err := DB.WithContext(ctx).Where("settled = ?", false).Find(&jobs).Error
+	return jobs, err
+}
+
+// GetChannelFineTunedJobs returns the jobs whose fine-tuned models are
+// abilities of the channel
+func GetChannelFineTunedJobs(ctx context.Context, channelId int) ([]*FineTuningJob, error) {
+	var jobs []*FineTuningJob
+	err := DB.WithContext(ctx).Where("channel_id = ? and settled = ? and fine_tuned_model <> ?", channelId, true, "").Find(&jobs).Error
+	return jobs, err
+}
+
+// MarkFineTuningJobSettled reports whether the job was marked by this call, so
+// that a job seen by concurrent requests is settled only once.
+func MarkFineTuningJobSettled(ctx context.Context, jobId string) (bool, error) {
+	result := DB.WithContext(ctx).Model(&FineTuningJob{}).Where("job_id = ? and settled = ?", jobId, false).Update("settled", true)
+	return result.RowsAffected == 1, result.Error
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/trace"
 	"gorm.io/gorm"
 	"one-api/common"
 	"sync"
@@ -69,6 +70,7 @@ type Log struct {
 	PromptTokens     int    `json:"prompt_tokens" gorm:"default:0"`
 	CompletionTokens int    `json:"completion_tokens" gorm:"default:0"`
 	ChannelId        int    `json:"channel" gorm:"index"`
+	RequestId        string `json:"request_id" gorm:"type:varchar(64);default:''"`
 }
 
 const (
@@ -77,6 +79,7 @@ const (
 	LogTypeConsume
 	LogTypeManage
 	LogTypeSystem
+	LogTypeCacheHit
 )
 
 func RecordLog(ctx context.Context, userId int, logType int, content string) {
@@ -100,6 +103,20 @@ func RecordConsumeLog(ctx context.Context, userId int, channelId int, promptToke
 	tracer := otel.Tracer("one-api/model/log")
 	ctx, span := tracer.Start(ctx, "RecordConsumeLog")
 	defer span.End()
+	recordConsumeLog(ctx, LogTypeConsume, userId, channelId, promptTokens, completionTokens, modelName, tokenName, quota, content)
+}
+
+// RecordCacheHitLog records a request answered from the response cache, which
+// consumes quota without reaching any channel
+func RecordCacheHitLog(ctx context.Context, userId int, promptTokens int, completionTokens int, modelName string, tokenName string, quota int, content string) {
+	tracer := otel.Tracer("one-api/model/log")
+	ctx, span := tracer.Start(ctx, "RecordCacheHitLog")
+	defer span.End()
+	recordConsumeLog(ctx, LogTypeCacheHit, userId, 0, promptTokens, completionTokens, modelName, tokenName, quota, content)
+}
+
+func recordConsumeLog(ctx context.Context, logType int, userId int, channelId int, promptTokens int, completionTokens int, modelName string, tokenName string, quota int, content string) {
+	span := trace.SpanFromContext(ctx)
 
 	span.AddEvent("start log file")
 	common.LogInfo(ctx, fmt.Sprintf("record consume log: userId=%d, channelId=%d, promptTokens=%d, completionTokens=%d, modelName=%s, tokenName=%s, quota=%d, content=%s", userId, channelId, promptTokens, completionTokens, modelName, tokenName, quota, content))
@@ -112,7 +129,7 @@ func RecordConsumeLog(ctx context.Context, userId int, channelId int, promptToke
 		UserId:           userId,
 		Username:         GetUsernameById(ctx, userId),
 		CreatedAt:        common.GetTimestamp(),
-		Type:             LogTypeConsume,
+		Type:             logType,
 		Content:          content,
 		PromptTokens:     promptTokens,
 		CompletionTokens: completionTokens,
@@ -121,6 +138,9 @@ func RecordConsumeLog(ctx context.Context, userId int, channelId int, promptToke
 		Quota:            quota,
 		ChannelId:        channelId,
 	}
+	if requestId, ok := ctx.Value(common.RequestIdKey).(string); ok {
+		log.RequestId = requestId
+	}
 
 	if common.AsyncWriteConsumeLogEnable {
 		asyncWriteConsumeLogMutex.Lock()
@@ -217,7 +237,7 @@ func SumUsedQuota(ctx context.Context, logType int, startTimestamp int64, endTim
 	if channel != 0 {
 		tx = tx.Where("channel_id = ?", channel)
 	}
-	tx.Where("type = ?", LogTypeConsume).Scan(&quota)
+	tx.Where("type in ?", []int{LogTypeConsume, LogTypeCacheHit}).Scan(&quota)
 	return quota
 }
 
@@ -115,10 +115,41 @@ func InitDB(ctx context.Context) (err error) {
 		if err != nil {
 			return err
 		}
+		// the weights of abilities mirror the ones of their channels, the
+		// weights set on channels before abilities had theirs are copied over
+		err = db.Exec("UPDATE abilities SET weight = (SELECT COALESCE(weight, 0) FROM channels WHERE channels.id = abilities.channel_id) " +
+			"WHERE EXISTS (SELECT 1 FROM channels WHERE channels.id = abilities.channel_id AND COALESCE(channels.weight, 0) <> COALESCE(abilities.weight, 0))").Error
+		if err != nil {
+			return err
+		}
+		err = db.AutoMigrate(&ChannelKey{})
+		if err != nil {
+			return err
+		}
 		err = db.AutoMigrate(&Log{})
 		if err != nil {
 			return err
 		}
+		err = db.AutoMigrate(&File{})
+		if err != nil {
+			return err
+		}
+		err = db.AutoMigrate(&UpstreamObject{})
+		if err != nil {
+			return err
+		}
+		err = db.AutoMigrate(&Batch{})
+		if err != nil {
+			return err
+		}
+		err = db.AutoMigrate(&FineTuningJob{})
+		if err != nil {
+			return err
+		}
+		err = db.AutoMigrate(&Transcript{})
+		if err != nil {
+			return err
+		}
 		common.SysLog("database migrated")
 		err = createRootAccountIfNeed(ctx)
 		if err != nil {
@@ -0,0 +1,82 @@
+package model
+
+import (
+	"context"
+	"errors"
+)
+
+const (
+	ObjectTypeAssistant = "assistant"
+	ObjectTypeThread    = "thread"
+	ObjectTypeRun       = "thread.run"
+)
+
+// UpstreamObject records a stateful object, such as an assistant or a thread,
+// created through the gateway. The object only exists on the upstream account
+// of the channel that created it, so later calls must go to the same channel.
+type UpstreamObject struct {
+	Id        int    `json:"id"`
+	ObjectId  string `json:"object_id" gorm:"type:varchar(128);uniqueIndex"`
+	Type      string `json:"type" gorm:"type:varchar(32);index"`
+	UserId    int    `json:"user_id" gorm:"index"`
+	TokenId   int    `json:"token_id"`
+	ChannelId int    `json:"channel_id"`
+	// the key of the channel the object was created with, zero for the key of
+	// the channel itself
+	ChannelKeyId int `json:"channel_key_id"`
+	// the thread of a run, which the run is fetched from
+	ThreadId    string `json:"thread_id,omitempty" gorm:"type:varchar(128)"`
+	Billed      bool   `json:"billed"`
+	CreatedTime int64  `json:"created_time" gorm:"bigint"`
+}
+
+// Record inserts the object unless it has been recorded already
+func (object *UpstreamObject) Record(ctx context.Context) error {
+	return DB.WithContext(ctx).Where("object_id = ?", object.ObjectId).FirstOrCreate(object).Error
+}
+
+func GetUserObject(ctx context.Context, objectId string, objectType string, userId int) (*UpstreamObject, error) {
+	if objectId == "" {
+		return nil, errors.New("object id 为空！")
+	}
+	object := UpstreamObject{}
+	err := DB.WithContext(ctx).Where("object_id = ? and type = ? and user_id = ?", objectId, objectType, userId).First(&object).Error
+	return &object, err
+}
+
+func GetObjectByObjectId(ctx context.Context, objectId string) (*UpstreamObject, error) {
+	object := UpstreamObject{}
+	err := DB.WithContext(ctx).Where("object_id = ?", objectId).First(&object).Error
+	return &object, err
+}
+
+func GetUserObjects(ctx context.Context, userId int, objectType string) ([]*UpstreamObject, error) {
+	var objects []*UpstreamObject
+	err := DB.WithContext(ctx).Where("user_id = ? and type = ?", userId, objectType).Order("id desc").Find(&objects).Error
+	return objects, err
+}
+
+func GetLatestUserObject(ctx context.Context, userId int, objectType string) (*UpstreamObject, error) {
+	object := UpstreamObject{}
+	err := DB.WithContext(ctx).Where("user_id = ? and type = ?", userId, objectType).Order("id desc").First(&object).Error
+	return &object, err
+}
+
+func DeleteObjectByObjectId(ctx context.Context, objectId string) error {
+	return DB.WithContext(ctx).Where("object_id = ?", objectId).Delete(&UpstreamObject{}).Error
+}
+
+// GetUnbilledRuns returns the runs created through the gateway that have not
+// been billed yet
+func GetUnbilledRuns(ctx context.Context) ([]*UpstreamObject, error) {
+	var runs []*UpstreamObject
+	err := DB.WithContext(ctx).Where("type = ? and billed = ? and thread_id <> ?", ObjectTypeRun, false, "").Find(&runs).Error
+	return runs, err
+}
+
+// MarkObjectBilled reports whether the object was marked by this call, so that
+// an object seen by concurrent requests is billed only once.
+func MarkObjectBilled(ctx context.Context, objectId string) (bool, error) {
+	result := DB.WithContext(ctx).Model(&UpstreamObject{}).Where("object_id = ? and billed = ?", objectId, false).Update("billed", true)
+	return result.RowsAffected == 1, result.Error
+}
@@ -69,10 +69,26 @@ func InitOptionMap(ctx context.Context) {
 	common.OptionMap["PreConsumedQuota"] = strconv.Itoa(common.PreConsumedQuota)
 	common.OptionMap["ModelRatio"] = common.ModelRatio2JSONString()
 	common.OptionMap["GroupRatio"] = common.GroupRatio2JSONString()
+	common.OptionMap["GroupRoutingStrategy"] = common.GroupRoutingStrategy2JSONString()
+	common.OptionMap["ChannelHealthRedisEnabled"] = strconv.FormatBool(common.ChannelHealthRedisEnabled)
+	common.OptionMap["CircuitBreakerThreshold"] = strconv.Itoa(common.CircuitBreakerThreshold)
+	common.OptionMap["CircuitBreakerCooldown"] = strconv.Itoa(common.CircuitBreakerCooldown)
+	common.OptionMap["CircuitBreakerProbeRequests"] = strconv.Itoa(common.CircuitBreakerProbeRequests)
+	common.OptionMap["ChannelRateLimitCooldown"] = strconv.Itoa(common.ChannelRateLimitCooldown)
+	common.OptionMap["BatchRatio"] = common.BatchRatio2JSONString()
+	common.OptionMap["FineTunedRatio"] = common.FineTunedRatio2JSONString()
+	common.OptionMap["TrainingRatio"] = common.TrainingRatio2JSONString()
 	common.OptionMap["TopUpLink"] = common.TopUpLink
 	common.OptionMap["ChatLink"] = common.ChatLink
 	common.OptionMap["QuotaPerUnit"] = strconv.FormatFloat(common.QuotaPerUnit, 'f', -1, 64)
 	common.OptionMap["RetryTimes"] = strconv.Itoa(common.RetryTimes)
+	common.OptionMap["StreamHeartbeatInterval"] = strconv.Itoa(common.StreamHeartbeatInterval)
+	common.OptionMap["StreamFirstTokenTimeout"] = strconv.Itoa(common.StreamFirstTokenTimeout)
+	common.OptionMap["ResponseCacheEnabled"] = strconv.FormatBool(common.ResponseCacheEnabled)
+	common.OptionMap["ResponseCacheTTL"] = strconv.Itoa(common.ResponseCacheTTL)
+	common.OptionMap["ResponseCacheHitRatio"] = strconv.FormatFloat(common.ResponseCacheHitRatio, 'f', -1, 64)
+	common.OptionMap["TranscriptMaxSize"] = strconv.Itoa(common.TranscriptMaxSize)
+	common.OptionMap["TranscriptRetentionDays"] = strconv.Itoa(common.TranscriptRetentionDays)
 	common.OptionMapRWMutex.Unlock()
 	loadOptionsFromDatabase(ctx)
 }
@@ -159,6 +175,10 @@ func updateOptionMap(key string, value string) (err error) {
 			common.DisplayInCurrencyEnabled = boolValue
 		case "DisplayTokenStatEnabled":
 			common.DisplayTokenStatEnabled = boolValue
+		case "ResponseCacheEnabled":
+			common.ResponseCacheEnabled = boolValue
+		case "ChannelHealthRedisEnabled":
+			common.ChannelHealthRedisEnabled = boolValue
 		}
 	}
 	switch key {
@@ -209,10 +229,38 @@ func updateOptionMap(key string, value string) (err error) {
 		common.PreConsumedQuota, _ = strconv.Atoi(value)
 	case "RetryTimes":
 		common.RetryTimes, _ = strconv.Atoi(value)
+	case "StreamHeartbeatInterval":
+		common.StreamHeartbeatInterval, _ = strconv.Atoi(value)
+	case "StreamFirstTokenTimeout":
+		common.StreamFirstTokenTimeout, _ = strconv.Atoi(value)
+	case "CircuitBreakerThreshold":
+		common.CircuitBreakerThreshold, _ = strconv.Atoi(value)
+	case "CircuitBreakerCooldown":
+		common.CircuitBreakerCooldown, _ = strconv.Atoi(value)
+	case "CircuitBreakerProbeRequests":
+		common.CircuitBreakerProbeRequests, _ = strconv.Atoi(value)
+	case "ChannelRateLimitCooldown":
+		common.ChannelRateLimitCooldown, _ = strconv.Atoi(value)
+	case "ResponseCacheTTL":
+		common.ResponseCacheTTL, _ = strconv.Atoi(value)
+	case "ResponseCacheHitRatio":
+		common.ResponseCacheHitRatio, _ = strconv.ParseFloat(value, 64)
+	case "TranscriptMaxSize":
+		common.TranscriptMaxSize, _ = strconv.Atoi(value)
+	case "TranscriptRetentionDays":
+		common.TranscriptRetentionDays, _ = strconv.Atoi(value)
 	case "ModelRatio":
 		err = common.UpdateModelRatioByJSONString(value)
 	case "GroupRatio":
 		err = common.UpdateGroupRatioByJSONString(value)
+	case "GroupRoutingStrategy":
+		err = common.UpdateGroupRoutingStrategyByJSONString(value)
+	case "BatchRatio":
+		err = common.UpdateBatchRatioByJSONString(value)
+	case "FineTunedRatio":
+		err = common.UpdateFineTunedRatioByJSONString(value)
+	case "TrainingRatio":
+		err = common.UpdateTrainingRatioByJSONString(value)
 	case "TopUpLink":
 		common.TopUpLink = value
 	case "ChatLink":
@@ -0,0 +1,95 @@
+package model
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"errors"
+	"one-api/common"
+	"sync"
+	"time"
+)
+
+// ResponseCacheEntry is a response kept by the response cache, along with the
+// usage of the request that produced it
+type ResponseCacheEntry struct {
+	Body             []byte `json:"body"`
+	PromptTokens     int    `json:"prompt_tokens"`
+	CompletionTokens int    `json:"completion_tokens"`
+}
+
+type responseCacheItem struct {
+	key       string
+	entry     *ResponseCacheEntry
+	expiresAt time.Time
+}
+
+// the memory cache is only used without Redis, it is bounded by the size of
+// the cached bodies so that a burst of distinct requests cannot exhaust the
+// memory, the least recently used entries are evicted first
+var responseCacheMemory = make(map[string]*list.Element)
+var responseCacheMemoryOrder = list.New() // the most recently used first
+var responseCacheMemorySize int64
+var responseCacheMemoryLock sync.Mutex
+
+var errResponseCacheMiss = errors.New("response cache miss")
+
+func CacheGetResponse(ctx context.Context, key string) (*ResponseCacheEntry, error) {
+	if common.RedisEnabled {
+		data, err := common.RedisGet(ctx, "response_cache:"+key)
+		if err != nil {
+			return nil, err
+		}
+		var entry ResponseCacheEntry
+		err = json.Unmarshal([]byte(data), &entry)
+		return &entry, err
+	}
+	responseCacheMemoryLock.Lock()
+	defer responseCacheMemoryLock.Unlock()
+	element, ok := responseCacheMemory[key]
+	if !ok {
+		return nil, errResponseCacheMiss
+	}
+	item := element.Value.(*responseCacheItem)
+	if time.Now().After(item.expiresAt) {
+		removeResponseCacheElement(element)
+		return nil, errResponseCacheMiss
+	}
+	responseCacheMemoryOrder.MoveToFront(element)
+	return item.entry, nil
+}
+
+func CacheSetResponse(ctx context.Context, key string, entry *ResponseCacheEntry, ttl time.Duration) error {
+	if common.RedisEnabled {
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		return common.RedisSet(ctx, "response_cache:"+key, string(data), ttl)
+	}
+	limit := int64(common.ResponseCacheMemoryLimit) * 1024 * 1024
+	if int64(len(entry.Body)) > limit {
+		return errors.New("response is larger than the response cache")
+	}
+	responseCacheMemoryLock.Lock()
+	defer responseCacheMemoryLock.Unlock()
+	if element, ok := responseCacheMemory[key]; ok {
+		removeResponseCacheElement(element)
+	}
+	responseCacheMemory[key] = responseCacheMemoryOrder.PushFront(&responseCacheItem{
+		key:       key,
+		entry:     entry,
+		expiresAt: time.Now().Add(ttl),
+	})
+	responseCacheMemorySize += int64(len(entry.Body))
+	for responseCacheMemorySize > limit {
+		removeResponseCacheElement(responseCacheMemoryOrder.Back())
+	}
+	return nil
+}
+
+func removeResponseCacheElement(element *list.Element) {
+	item := responseCacheMemoryOrder.Remove(element).(*responseCacheItem)
+	delete(responseCacheMemory, item.key)
+	responseCacheMemorySize -= int64(len(item.entry.Body))
+}
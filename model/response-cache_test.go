@@ -0,0 +1,113 @@
+package model
+
+import (
+	"container/list"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"one-api/common"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func setupResponseCacheMemory(t *testing.T, limit int) {
+	savedLimit, savedRedisEnabled := common.ResponseCacheMemoryLimit, common.RedisEnabled
+	common.ResponseCacheMemoryLimit, common.RedisEnabled = limit, false
+	resetResponseCacheMemory := func() {
+		responseCacheMemory = make(map[string]*list.Element)
+		responseCacheMemoryOrder = list.New()
+		responseCacheMemorySize = 0
+	}
+	resetResponseCacheMemory()
+	t.Cleanup(func() {
+		common.ResponseCacheMemoryLimit, common.RedisEnabled = savedLimit, savedRedisEnabled
+		resetResponseCacheMemory()
+	})
+}
+
+func TestResponseCacheMemoryLimit(t *testing.T) {
+	const megabyte = 1024 * 1024
+	entry := func(size int) *ResponseCacheEntry {
+		return &ResponseCacheEntry{Body: []byte(strings.Repeat("x", size))}
+	}
+	cases := []struct {
+		name string
+		// the sizes of the responses cached in order, in bytes
+		sizes []int
+		// the responses read after a response is cached, by index
+		reads map[int][]int
+		want  []int // the responses left in the cache
+	}{
+		{
+			name:  "under the limit",
+			sizes: []int{megabyte, megabyte},
+			want:  []int{0, 1},
+		},
+		{
+			name:  "oldest evicted",
+			sizes: []int{megabyte, megabyte, megabyte},
+			want:  []int{1, 2},
+		},
+		{
+			name:  "least recently used evicted",
+			sizes: []int{megabyte, megabyte, megabyte},
+			reads: map[int][]int{1: {0}},
+			want:  []int{0, 2},
+		},
+		{
+			name:  "several evicted for a large response",
+			sizes: []int{megabyte / 2, megabyte / 2, megabyte / 2, megabyte * 3 / 2},
+			want:  []int{2, 3},
+		},
+		{
+			name:  "larger than the cache",
+			sizes: []int{megabyte, 3 * megabyte},
+			want:  []int{0},
+		},
+	}
+	ctx := context.Background()
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			setupResponseCacheMemory(t, 2)
+			for i, size := range c.sizes {
+				err := CacheSetResponse(ctx, strings.Repeat("k", i+1), entry(size), time.Minute)
+				if size > 2*megabyte {
+					assert.Error(t, err)
+				} else {
+					require.NoError(t, err)
+				}
+				for _, j := range c.reads[i] {
+					_, err = CacheGetResponse(ctx, strings.Repeat("k", j+1))
+					require.NoError(t, err)
+				}
+			}
+			var left []int
+			var size int64
+			for i := range c.sizes {
+				cached, ok := responseCacheMemory[strings.Repeat("k", i+1)]
+				if ok {
+					left = append(left, i)
+					size += int64(len(cached.Value.(*responseCacheItem).entry.Body))
+				}
+			}
+			assert.Equal(t, c.want, left)
+			assert.Equal(t, size, responseCacheMemorySize)
+		})
+	}
+}
+
+func TestResponseCacheMemoryExpiry(t *testing.T) {
+	setupResponseCacheMemory(t, 1)
+	ctx := context.Background()
+	require.NoError(t, CacheSetResponse(ctx, "expired", &ResponseCacheEntry{Body: []byte("x")}, -time.Second))
+	require.NoError(t, CacheSetResponse(ctx, "fresh", &ResponseCacheEntry{Body: []byte("y")}, time.Minute))
+	_, err := CacheGetResponse(ctx, "expired")
+	assert.ErrorIs(t, err, errResponseCacheMiss)
+	entry, err := CacheGetResponse(ctx, "fresh")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("y"), entry.Body)
+	assert.Equal(t, int64(1), responseCacheMemorySize)
+}
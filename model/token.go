@@ -20,6 +20,8 @@ type Token struct {
 	RemainQuota    int    `json:"remain_quota" gorm:"default:0"`
 	UnlimitedQuota bool   `json:"unlimited_quota" gorm:"default:false"`
 	UsedQuota      int    `json:"used_quota" gorm:"default:0"` // used quota
+	ResponseCache  bool   `json:"response_cache" gorm:"default:false"`
+	Transcript     bool   `json:"transcript" gorm:"default:false"`
 }
 
 func GetAllUserTokens(ctx context.Context, userId int, startIdx int, num int) ([]*Token, error) {
@@ -103,7 +105,7 @@ func (token *Token) Insert(ctx context.Context) error {
 // Update Make sure your token's fields is completed, because this will update non-zero values
 func (token *Token) Update(ctx context.Context) error {
 	var err error
-	err = DB.WithContext(ctx).Model(token).Select("name", "status", "expired_time", "remain_quota", "unlimited_quota").Updates(token).Error
+	err = DB.WithContext(ctx).Model(token).Select("name", "status", "expired_time", "remain_quota", "unlimited_quota", "response_cache", "transcript").Updates(token).Error
 	return err
 }
 
@@ -0,0 +1,76 @@
+package model
+
+import (
+	"context"
+	"one-api/common"
+	"strconv"
+	"time"
+)
+
+// Transcript keeps the request body and the response of a relayed request made
+// with a token that has transcripts enabled, it is linked to the consume log of
+// the request by the request id.
+type Transcript struct {
+	Id        int    `json:"id"`
+	RequestId string `json:"request_id" gorm:"type:varchar(64);index"`
+	UserId    int    `json:"user_id" gorm:"index"`
+	TokenId   int    `json:"token_id" gorm:"index"`
+	ChannelId int    `json:"channel_id"`
+	ModelName string `json:"model_name"`
+	Request   string `json:"request"`
+	Response  string `json:"response"`
+	Truncated bool   `json:"truncated"`
+	CreatedAt int64  `json:"created_at" gorm:"bigint;index"`
+}
+
+func (transcript *Transcript) Insert(ctx context.Context) error {
+	return DB.WithContext(ctx).Create(transcript).Error
+}
+
+// GetAllTranscripts lists the transcripts without their bodies, which are only
+// loaded one at a time
+func GetAllTranscripts(ctx context.Context, requestId string, userId int, tokenId int, startIdx int, num int) ([]*Transcript, error) {
+	var transcripts []*Transcript
+	tx := DB.WithContext(ctx).Omit("request", "response")
+	if requestId != "" {
+		tx = tx.Where("request_id = ?", requestId)
+	}
+	if userId != 0 {
+		tx = tx.Where("user_id = ?", userId)
+	}
+	if tokenId != 0 {
+		tx = tx.Where("token_id = ?", tokenId)
+	}
+	err := tx.Order("id desc").Limit(num).Offset(startIdx).Find(&transcripts).Error
+	return transcripts, err
+}
+
+func GetTranscriptById(ctx context.Context, id int) (*Transcript, error) {
+	transcript := Transcript{}
+	err := DB.WithContext(ctx).First(&transcript, "id = ?", id).Error
+	return &transcript, err
+}
+
+func DeleteOldTranscripts(ctx context.Context, targetTimestamp int64) (int64, error) {
+	result := DB.WithContext(ctx).Where("created_at < ?", targetTimestamp).Delete(&Transcript{})
+	return result.RowsAffected, result.Error
+}
+
+// CleanTranscripts deletes the transcripts older than the retention period
+func CleanTranscripts(ctx context.Context, frequency int) {
+	for {
+		time.Sleep(time.Duration(frequency) * time.Second)
+		if common.TranscriptRetentionDays <= 0 {
+			continue
+		}
+		targetTimestamp := common.GetTimestamp() - int64(common.TranscriptRetentionDays)*24*60*60
+		count, err := DeleteOldTranscripts(ctx, targetTimestamp)
+		if err != nil {
+			common.SysError("failed to delete old transcripts: " + err.Error())
+			continue
+		}
+		if count > 0 {
+			common.SysLog("old transcripts deleted: " + strconv.FormatInt(count, 10))
+		}
+	}
+}
@@ -13,6 +13,7 @@ const (
 	BatchUpdateTypeUsedQuota
 	BatchUpdateTypeChannelUsedQuota
 	BatchUpdateTypeRequestCount
+	BatchUpdateTypeChannelKeyUsedQuota
 	BatchUpdateTypeCount // if you add a new type, you need to add a new map and a new lock
 )
 
@@ -71,6 +72,8 @@ func batchUpdate(ctx context.Context) {
 				updateUserRequestCount(ctx, key, value)
 			case BatchUpdateTypeChannelUsedQuota:
 				updateChannelUsedQuota(ctx, key, value)
+			case BatchUpdateTypeChannelKeyUsedQuota:
+				updateChannelKeyUsedQuota(ctx, key, value)
 			}
 		}
 	}
@@ -0,0 +1,50 @@
+package channel
+
+import (
+	"io"
+	"net/http"
+	"one-api/relay/model"
+	"one-api/relay/util"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Adaptor translates an OpenAI-compatible request into the upstream
+// provider's protocol and translates the response back.
+type Adaptor interface {
+	Init(meta *util.RelayMeta)
+	GetRequestURL(meta *util.RelayMeta) (string, error)
+	SetupRequestHeader(c *gin.Context, req *http.Request, meta *util.RelayMeta) error
+	// ConvertRequest returns the request to be sent upstream. Returning the
+	// given request unchanged means the original body can be forwarded as is.
+	ConvertRequest(c *gin.Context, relayMode int, request *model.GeneralOpenAIRequest) (any, error)
+	DoRequest(c *gin.Context, meta *util.RelayMeta, requestBody io.Reader) (*http.Response, error)
+	DoResponse(c *gin.Context, resp *http.Response, meta *util.RelayMeta) (usage *model.Usage, err *model.OpenAIErrorWithStatusCode)
+	GetChannelName() string
+}
+
+type AdaptorFactory func() Adaptor
+
+// adaptors won't grow after initialization
+var adaptors = map[int]AdaptorFactory{}
+var defaultAdaptor AdaptorFactory
+
+// Register binds a channel type to an adaptor, it should be called in init().
+func Register(channelType int, factory AdaptorFactory) {
+	adaptors[channelType] = factory
+}
+
+// RegisterDefault sets the adaptor used by channel types without a dedicated one.
+func RegisterDefault(factory AdaptorFactory) {
+	defaultAdaptor = factory
+}
+
+func GetAdaptor(channelType int) Adaptor {
+	if factory, ok := adaptors[channelType]; ok {
+		return factory()
+	}
+	if defaultAdaptor != nil {
+		return defaultAdaptor()
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package aiproxy
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"io"
+	"net/http"
+	"one-api/common"
+	"one-api/relay/channel"
+	"one-api/relay/model"
+	"one-api/relay/util"
+)
+
+func init() {
+	channel.Register(common.ChannelTypeAIProxyLibrary, func() channel.Adaptor {
+		return &Adaptor{}
+	})
+}
+
+type Adaptor struct {
+}
+
+func (a *Adaptor) Init(meta *util.RelayMeta) {
+
+}
+
+func (a *Adaptor) GetRequestURL(meta *util.RelayMeta) (string, error) {
+	return fmt.Sprintf("%s/api/library/ask", meta.BaseURL), nil
+}
+
+func (a *Adaptor) SetupRequestHeader(c *gin.Context, req *http.Request, meta *util.RelayMeta) error {
+	channel.SetupCommonRequestHeader(c, req, meta)
+	req.Header.Set("Authorization", "Bearer "+meta.APIKey)
+	return nil
+}
+
+func (a *Adaptor) ConvertRequest(c *gin.Context, relayMode int, request *model.GeneralOpenAIRequest) (any, error) {
+	if request == nil {
+		return nil, errors.New("request is nil")
+	}
+	if err := channel.CheckToolsUnsupported(request, a.GetChannelName()); err != nil {
+		return nil, err
+	}
+	aiProxyLibraryRequest := requestOpenAI2AIProxyLibrary(*request)
+	aiProxyLibraryRequest.LibraryId = c.GetString("library_id")
+	return aiProxyLibraryRequest, nil
+}
+
+func (a *Adaptor) DoRequest(c *gin.Context, meta *util.RelayMeta, requestBody io.Reader) (*http.Response, error) {
+	return channel.DoRequestHelper(a, c, meta, requestBody)
+}
+
+func (a *Adaptor) DoResponse(c *gin.Context, resp *http.Response, meta *util.RelayMeta) (usage *model.Usage, err *model.OpenAIErrorWithStatusCode) {
+	if meta.IsStream {
+		var responseText string
+		err, usage, responseText = StreamHandler(c, resp)
+		meta.ResponseText = responseText
+	} else {
+		err, usage = Handler(c, resp)
+	}
+	return
+}
+
+func (a *Adaptor) GetChannelName() string {
+	return "aiproxy library"
+}
@@ -1,13 +1,17 @@
-package controller
+package aiproxy
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/gin-gonic/gin"
 	"io"
 	"net/http"
 	"one-api/common"
+	"one-api/relay/constant"
+	"one-api/relay/model"
+	"one-api/relay/util"
 	"strconv"
 	"strings"
 )
@@ -45,7 +49,7 @@ type AIProxyLibraryStreamResponse struct {
 	Documents []AIProxyLibraryDocument `json:"documents"`
 }
 
-func requestOpenAI2AIProxyLibrary(request GeneralOpenAIRequest) *AIProxyLibraryRequest {
+func requestOpenAI2AIProxyLibrary(request model.GeneralOpenAIRequest) *AIProxyLibraryRequest {
 	query := ""
 	if len(request.Messages) != 0 {
 		query = request.Messages[len(request.Messages)-1].StringContent()
@@ -68,52 +72,53 @@ func aiProxyDocuments2Markdown(documents []AIProxyLibraryDocument) string {
 	return content
 }
 
-func responseAIProxyLibrary2OpenAI(response *AIProxyLibraryResponse) *OpenAITextResponse {
+func responseAIProxyLibrary2OpenAI(response *AIProxyLibraryResponse) *model.OpenAITextResponse {
 	content := response.Answer + aiProxyDocuments2Markdown(response.Documents)
-	choice := OpenAITextResponseChoice{
+	choice := model.OpenAITextResponseChoice{
 		Index: 0,
-		Message: Message{
+		Message: model.Message{
 			Role:    "assistant",
 			Content: content,
 		},
 		FinishReason: "stop",
 	}
-	fullTextResponse := OpenAITextResponse{
+	fullTextResponse := model.OpenAITextResponse{
 		Id:      common.GetUUID(),
 		Object:  "chat.completion",
 		Created: common.GetTimestamp(),
-		Choices: []OpenAITextResponseChoice{choice},
+		Choices: []model.OpenAITextResponseChoice{choice},
 	}
 	return &fullTextResponse
 }
 
-func documentsAIProxyLibrary(documents []AIProxyLibraryDocument) *ChatCompletionsStreamResponse {
-	var choice ChatCompletionsStreamResponseChoice
+func documentsAIProxyLibrary(documents []AIProxyLibraryDocument) *model.ChatCompletionsStreamResponse {
+	var choice model.ChatCompletionsStreamResponseChoice
 	choice.Delta.Content = aiProxyDocuments2Markdown(documents)
-	choice.FinishReason = &stopFinishReason
-	return &ChatCompletionsStreamResponse{
+	choice.FinishReason = &constant.StopFinishReason
+	return &model.ChatCompletionsStreamResponse{
 		Id:      common.GetUUID(),
 		Object:  "chat.completion.chunk",
 		Created: common.GetTimestamp(),
 		Model:   "",
-		Choices: []ChatCompletionsStreamResponseChoice{choice},
+		Choices: []model.ChatCompletionsStreamResponseChoice{choice},
 	}
 }
 
-func streamResponseAIProxyLibrary2OpenAI(response *AIProxyLibraryStreamResponse) *ChatCompletionsStreamResponse {
-	var choice ChatCompletionsStreamResponseChoice
+func streamResponseAIProxyLibrary2OpenAI(response *AIProxyLibraryStreamResponse) *model.ChatCompletionsStreamResponse {
+	var choice model.ChatCompletionsStreamResponseChoice
 	choice.Delta.Content = response.Content
-	return &ChatCompletionsStreamResponse{
+	return &model.ChatCompletionsStreamResponse{
 		Id:      common.GetUUID(),
 		Object:  "chat.completion.chunk",
 		Created: common.GetTimestamp(),
 		Model:   response.Model,
-		Choices: []ChatCompletionsStreamResponseChoice{choice},
+		Choices: []model.ChatCompletionsStreamResponseChoice{choice},
 	}
 }
 
-func aiProxyLibraryStreamHandler(c *gin.Context, resp *http.Response) (*OpenAIErrorWithStatusCode, *Usage) {
-	var usage Usage
+func StreamHandler(c *gin.Context, resp *http.Response) (*model.OpenAIErrorWithStatusCode, *model.Usage, string) {
+	var usage model.Usage
+	responseText := ""
 	scanner := bufio.NewScanner(resp.Body)
 	scanner.Split(func(data []byte, atEOF bool) (advance int, token []byte, err error) {
 		if atEOF && len(data) == 0 {
@@ -127,9 +132,12 @@ func aiProxyLibraryStreamHandler(c *gin.Context, resp *http.Response) (*OpenAIEr
 		}
 		return 0, nil, nil
 	})
+	ctx, cancel := context.WithCancel(c.Request.Context())
+	defer cancel()
 	dataChan := make(chan string)
 	stopChan := make(chan bool)
 	go func() {
+		defer close(stopChan)
 		for scanner.Scan() {
 			data := scanner.Text()
 			if len(data) < 5 { // ignore blank line or wrong format
@@ -139,15 +147,21 @@ func aiProxyLibraryStreamHandler(c *gin.Context, resp *http.Response) (*OpenAIEr
 				continue
 			}
 			data = data[5:]
-			dataChan <- data
+			select {
+			case dataChan <- data:
+			case <-ctx.Done():
+				return
+			}
 		}
-		stopChan <- true
 	}()
-	setEventStreamHeaders(c)
+	util.SetEventStreamHeaders(c)
 	var documents []AIProxyLibraryDocument
+	heartbeat := util.NewHeartbeat()
+	defer heartbeat.Stop()
 	c.Stream(func(w io.Writer) bool {
 		select {
 		case data := <-dataChan:
+			heartbeat.Reset()
 			var AIProxyLibraryResponse AIProxyLibraryStreamResponse
 			err := json.Unmarshal([]byte(data), &AIProxyLibraryResponse)
 			if err != nil {
@@ -158,6 +172,9 @@ func aiProxyLibraryStreamHandler(c *gin.Context, resp *http.Response) (*OpenAIEr
 				documents = AIProxyLibraryResponse.Documents
 			}
 			response := streamResponseAIProxyLibrary2OpenAI(&AIProxyLibraryResponse)
+			if len(response.Choices) != 0 {
+				responseText += response.Choices[0].Delta.Content
+			}
 			jsonResponse, err := json.Marshal(response)
 			if err != nil {
 				common.SysError("error marshalling stream response: " + err.Error())
@@ -175,32 +192,37 @@ func aiProxyLibraryStreamHandler(c *gin.Context, resp *http.Response) (*OpenAIEr
 			c.Render(-1, common.CustomEvent{Data: "data: " + string(jsonResponse)})
 			c.Render(-1, common.CustomEvent{Data: "data: [DONE]"})
 			return false
+		case <-heartbeat.C():
+			heartbeat.Write(c)
+			return true
+		case <-ctx.Done():
+			return false
 		}
 	})
-	err := resp.Body.Close()
+	err := util.CloseStream(cancel, resp.Body, stopChan)
 	if err != nil {
-		return errorWrapper(err, "close_response_body_failed", http.StatusInternalServerError), nil
+		return util.ErrorWrapper(err, "close_response_body_failed", http.StatusInternalServerError), nil, ""
 	}
-	return nil, &usage
+	return nil, &usage, responseText
 }
 
-func aiProxyLibraryHandler(c *gin.Context, resp *http.Response) (*OpenAIErrorWithStatusCode, *Usage) {
+func Handler(c *gin.Context, resp *http.Response) (*model.OpenAIErrorWithStatusCode, *model.Usage) {
 	var AIProxyLibraryResponse AIProxyLibraryResponse
 	responseBody, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return errorWrapper(err, "read_response_body_failed", http.StatusInternalServerError), nil
+		return util.ErrorWrapper(err, "read_response_body_failed", http.StatusInternalServerError), nil
 	}
 	err = resp.Body.Close()
 	if err != nil {
-		return errorWrapper(err, "close_response_body_failed", http.StatusInternalServerError), nil
+		return util.ErrorWrapper(err, "close_response_body_failed", http.StatusInternalServerError), nil
 	}
 	err = json.Unmarshal(responseBody, &AIProxyLibraryResponse)
 	if err != nil {
-		return errorWrapper(err, "unmarshal_response_body_failed", http.StatusInternalServerError), nil
+		return util.ErrorWrapper(err, "unmarshal_response_body_failed", http.StatusInternalServerError), nil
 	}
 	if AIProxyLibraryResponse.ErrCode != 0 {
-		return &OpenAIErrorWithStatusCode{
-			OpenAIError: OpenAIError{
+		return &model.OpenAIErrorWithStatusCode{
+			OpenAIError: model.OpenAIError{
 				Message: AIProxyLibraryResponse.Message,
 				Type:    strconv.Itoa(AIProxyLibraryResponse.ErrCode),
 				Code:    AIProxyLibraryResponse.ErrCode,
@@ -211,7 +233,7 @@ func aiProxyLibraryHandler(c *gin.Context, resp *http.Response) (*OpenAIErrorWit
 	fullTextResponse := responseAIProxyLibrary2OpenAI(&AIProxyLibraryResponse)
 	jsonResponse, err := json.Marshal(fullTextResponse)
 	if err != nil {
-		return errorWrapper(err, "marshal_response_body_failed", http.StatusInternalServerError), nil
+		return util.ErrorWrapper(err, "marshal_response_body_failed", http.StatusInternalServerError), nil
 	}
 	c.Writer.Header().Set("Content-Type", "application/json")
 	c.Writer.WriteHeader(resp.StatusCode)
@@ -1,12 +1,15 @@
-package controller
+package ali
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
 	"github.com/gin-gonic/gin"
 	"io"
 	"net/http"
 	"one-api/common"
+	"one-api/relay/model"
+	"one-api/relay/util"
 	"strings"
 )
 
@@ -17,16 +20,26 @@ type AliMessage struct {
 	Bot  string `json:"bot"`
 }
 
+type AliChatMessage struct {
+	Role      string       `json:"role"`
+	Content   string       `json:"content"`
+	Name      string       `json:"name,omitempty"`
+	ToolCalls []model.Tool `json:"tool_calls,omitempty"`
+}
+
 type AliInput struct {
-	Prompt  string       `json:"prompt"`
-	History []AliMessage `json:"history"`
+	Prompt   string           `json:"prompt,omitempty"`
+	History  []AliMessage     `json:"history,omitempty"`
+	Messages []AliChatMessage `json:"messages,omitempty"`
 }
 
 type AliParameters struct {
-	TopP         float64 `json:"top_p,omitempty"`
-	TopK         int     `json:"top_k,omitempty"`
-	Seed         uint64  `json:"seed,omitempty"`
-	EnableSearch bool    `json:"enable_search,omitempty"`
+	TopP         float64      `json:"top_p,omitempty"`
+	TopK         int          `json:"top_k,omitempty"`
+	Seed         uint64       `json:"seed,omitempty"`
+	EnableSearch bool         `json:"enable_search,omitempty"`
+	ResultFormat string       `json:"result_format,omitempty"`
+	Tools        []model.Tool `json:"tools,omitempty"`
 }
 
 type AliChatRequest struct {
@@ -70,9 +83,30 @@ type AliUsage struct {
 	TotalTokens  int `json:"total_tokens"`
 }
 
+type AliChoice struct {
+	FinishReason string        `json:"finish_reason"`
+	Message      model.Message `json:"message"`
+}
+
 type AliOutput struct {
-	Text         string `json:"text"`
-	FinishReason string `json:"finish_reason"`
+	Text         string      `json:"text"`
+	FinishReason string      `json:"finish_reason"`
+	Choices      []AliChoice `json:"choices"`
+}
+
+// result reads the output of both the text and the message result format
+func (o AliOutput) result() (text string, finishReason string, toolCalls []model.Tool) {
+	if len(o.Choices) == 0 {
+		return o.Text, o.FinishReason, nil
+	}
+	choice := o.Choices[0]
+	toolCalls = choice.Message.ToolCalls
+	for i := range toolCalls {
+		if toolCalls[i].Type == "" {
+			toolCalls[i].Type = "function"
+		}
+	}
+	return choice.Message.StringContent(), choice.FinishReason, toolCalls
 }
 
 type AliChatResponse struct {
@@ -81,7 +115,45 @@ type AliChatResponse struct {
 	AliError
 }
 
-func requestOpenAI2Ali(request GeneralOpenAIRequest) *AliChatRequest {
+// requestOpenAI2AliWithTools uses the message format, which is required for function calling
+// https://help.aliyun.com/zh/dashscope/developer-reference/api-details
+func requestOpenAI2AliWithTools(request model.GeneralOpenAIRequest, tools []model.Tool) *AliChatRequest {
+	messages := make([]AliChatMessage, 0, len(request.Messages))
+	// tool results only carry the id of the call, so remember the names
+	toolCallNames := make(map[string]string)
+	for _, message := range request.Messages {
+		aliMessage := AliChatMessage{
+			Role:      message.Role,
+			Content:   message.StringContent(),
+			ToolCalls: message.ToolCalls,
+		}
+		for _, toolCall := range message.ToolCalls {
+			toolCallNames[toolCall.Id] = toolCall.Function.Name
+		}
+		if message.Role == "tool" {
+			aliMessage.Name = toolCallNames[message.ToolCallId]
+		}
+		if message.Name != nil {
+			aliMessage.Name = *message.Name
+		}
+		messages = append(messages, aliMessage)
+	}
+	return &AliChatRequest{
+		Model: request.Model,
+		Input: AliInput{
+			Messages: messages,
+		},
+		Parameters: AliParameters{
+			ResultFormat: "message",
+			Tools:        tools,
+		},
+	}
+}
+
+func requestOpenAI2Ali(request model.GeneralOpenAIRequest) *AliChatRequest {
+	if tools := request.GetTools(); len(tools) > 0 && request.ToolChoice != "none" {
+		return requestOpenAI2AliWithTools(request, tools)
+	}
 	messages := make([]AliMessage, 0, len(request.Messages))
 	prompt := ""
 	for i := 0; i < len(request.Messages); i++ {
@@ -119,7 +191,7 @@ func requestOpenAI2Ali(request GeneralOpenAIRequest) *AliChatRequest {
 	}
 }
 
-func embeddingRequestOpenAI2Ali(request GeneralOpenAIRequest) *AliEmbeddingRequest {
+func embeddingRequestOpenAI2Ali(request model.GeneralOpenAIRequest) *AliEmbeddingRequest {
 	return &AliEmbeddingRequest{
 		Model: "text-embedding-v1",
 		Input: struct {
@@ -130,21 +202,21 @@ func embeddingRequestOpenAI2Ali(request GeneralOpenAIRequest) *AliEmbeddingReque
 	}
 }
 
-func aliEmbeddingHandler(c *gin.Context, resp *http.Response) (*OpenAIErrorWithStatusCode, *Usage) {
+func EmbeddingHandler(c *gin.Context, resp *http.Response) (*model.OpenAIErrorWithStatusCode, *model.Usage) {
 	var aliResponse AliEmbeddingResponse
 	err := json.NewDecoder(resp.Body).Decode(&aliResponse)
 	if err != nil {
-		return errorWrapper(err, "unmarshal_response_body_failed", http.StatusInternalServerError), nil
+		return util.ErrorWrapper(err, "unmarshal_response_body_failed", http.StatusInternalServerError), nil
 	}
 
 	err = resp.Body.Close()
 	if err != nil {
-		return errorWrapper(err, "close_response_body_failed", http.StatusInternalServerError), nil
+		return util.ErrorWrapper(err, "close_response_body_failed", http.StatusInternalServerError), nil
 	}
 
 	if aliResponse.Code != "" {
-		return &OpenAIErrorWithStatusCode{
-			OpenAIError: OpenAIError{
+		return &model.OpenAIErrorWithStatusCode{
+			OpenAIError: model.OpenAIError{
 				Message: aliResponse.Message,
 				Type:    aliResponse.Code,
 				Param:   aliResponse.RequestId,
@@ -157,7 +229,7 @@ func aliEmbeddingHandler(c *gin.Context, resp *http.Response) (*OpenAIErrorWithS
 	fullTextResponse := embeddingResponseAli2OpenAI(&aliResponse)
 	jsonResponse, err := json.Marshal(fullTextResponse)
 	if err != nil {
-		return errorWrapper(err, "marshal_response_body_failed", http.StatusInternalServerError), nil
+		return util.ErrorWrapper(err, "marshal_response_body_failed", http.StatusInternalServerError), nil
 	}
 	c.Writer.Header().Set("Content-Type", "application/json")
 	c.Writer.WriteHeader(resp.StatusCode)
@@ -165,16 +237,16 @@ func aliEmbeddingHandler(c *gin.Context, resp *http.Response) (*OpenAIErrorWithS
 	return nil, &fullTextResponse.Usage
 }
 
-func embeddingResponseAli2OpenAI(response *AliEmbeddingResponse) *OpenAIEmbeddingResponse {
-	openAIEmbeddingResponse := OpenAIEmbeddingResponse{
+func embeddingResponseAli2OpenAI(response *AliEmbeddingResponse) *model.OpenAIEmbeddingResponse {
+	openAIEmbeddingResponse := model.OpenAIEmbeddingResponse{
 		Object: "list",
-		Data:   make([]OpenAIEmbeddingResponseItem, 0, len(response.Output.Embeddings)),
+		Data:   make([]model.OpenAIEmbeddingResponseItem, 0, len(response.Output.Embeddings)),
 		Model:  "text-embedding-v1",
-		Usage:  Usage{TotalTokens: response.Usage.TotalTokens},
+		Usage:  model.Usage{TotalTokens: response.Usage.TotalTokens},
 	}
 
 	for _, item := range response.Output.Embeddings {
-		openAIEmbeddingResponse.Data = append(openAIEmbeddingResponse.Data, OpenAIEmbeddingResponseItem{
+		openAIEmbeddingResponse.Data = append(openAIEmbeddingResponse.Data, model.OpenAIEmbeddingResponseItem{
 			Object:    `embedding`,
 			Index:     item.TextIndex,
 			Embedding: item.Embedding,
@@ -183,21 +255,26 @@ func embeddingResponseAli2OpenAI(response *AliEmbeddingResponse) *OpenAIEmbeddin
 	return &openAIEmbeddingResponse
 }
 
-func responseAli2OpenAI(response *AliChatResponse) *OpenAITextResponse {
-	choice := OpenAITextResponseChoice{
+func responseAli2OpenAI(response *AliChatResponse) *model.OpenAITextResponse {
+	text, finishReason, toolCalls := response.Output.result()
+	if len(toolCalls) > 0 {
+		finishReason = "tool_calls"
+	}
+	choice := model.OpenAITextResponseChoice{
 		Index: 0,
-		Message: Message{
-			Role:    "assistant",
-			Content: response.Output.Text,
+		Message: model.Message{
+			Role:      "assistant",
+			Content:   text,
+			ToolCalls: toolCalls,
 		},
-		FinishReason: response.Output.FinishReason,
+		FinishReason: finishReason,
 	}
-	fullTextResponse := OpenAITextResponse{
+	fullTextResponse := model.OpenAITextResponse{
 		Id:      response.RequestId,
 		Object:  "chat.completion",
 		Created: common.GetTimestamp(),
-		Choices: []OpenAITextResponseChoice{choice},
-		Usage: Usage{
+		Choices: []model.OpenAITextResponseChoice{choice},
+		Usage: model.Usage{
 			PromptTokens:     response.Usage.InputTokens,
 			CompletionTokens: response.Usage.OutputTokens,
 			TotalTokens:      response.Usage.InputTokens + response.Usage.OutputTokens,
@@ -206,25 +283,34 @@ func responseAli2OpenAI(response *AliChatResponse) *OpenAITextResponse {
 	return &fullTextResponse
 }
 
-func streamResponseAli2OpenAI(aliResponse *AliChatResponse) *ChatCompletionsStreamResponse {
-	var choice ChatCompletionsStreamResponseChoice
-	choice.Delta.Content = aliResponse.Output.Text
-	if aliResponse.Output.FinishReason != "null" {
-		finishReason := aliResponse.Output.FinishReason
+func streamResponseAli2OpenAI(aliResponse *AliChatResponse) *model.ChatCompletionsStreamResponse {
+	var choice model.ChatCompletionsStreamResponseChoice
+	text, finishReason, toolCalls := aliResponse.Output.result()
+	choice.Delta.Content = text
+	if finishReason != "null" && finishReason != "" {
+		// tool calls are complete only in the last response
+		if len(toolCalls) > 0 {
+			for i := range toolCalls {
+				index := i
+				toolCalls[i].Index = &index
+			}
+			choice.Delta.ToolCalls = toolCalls
+			finishReason = "tool_calls"
+		}
 		choice.FinishReason = &finishReason
 	}
-	response := ChatCompletionsStreamResponse{
+	response := model.ChatCompletionsStreamResponse{
 		Id:      aliResponse.RequestId,
 		Object:  "chat.completion.chunk",
 		Created: common.GetTimestamp(),
 		Model:   "ernie-bot",
-		Choices: []ChatCompletionsStreamResponseChoice{choice},
+		Choices: []model.ChatCompletionsStreamResponseChoice{choice},
 	}
 	return &response
 }
 
-func aliStreamHandler(c *gin.Context, resp *http.Response) (*OpenAIErrorWithStatusCode, *Usage) {
-	var usage Usage
+func StreamHandler(c *gin.Context, resp *http.Response) (*model.OpenAIErrorWithStatusCode, *model.Usage, string) {
+	var usage model.Usage
 	scanner := bufio.NewScanner(resp.Body)
 	scanner.Split(func(data []byte, atEOF bool) (advance int, token []byte, err error) {
 		if atEOF && len(data) == 0 {
@@ -238,9 +324,12 @@ func aliStreamHandler(c *gin.Context, resp *http.Response) (*OpenAIErrorWithStat
 		}
 		return 0, nil, nil
 	})
+	ctx, cancel := context.WithCancel(c.Request.Context())
+	defer cancel()
 	dataChan := make(chan string)
 	stopChan := make(chan bool)
 	go func() {
+		defer close(stopChan)
 		for scanner.Scan() {
 			data := scanner.Text()
 			if len(data) < 5 { // ignore blank line or wrong format
@@ -250,15 +339,21 @@ func aliStreamHandler(c *gin.Context, resp *http.Response) (*OpenAIErrorWithStat
 				continue
 			}
 			data = data[5:]
-			dataChan <- data
+			select {
+			case dataChan <- data:
+			case <-ctx.Done():
+				return
+			}
 		}
-		stopChan <- true
 	}()
-	setEventStreamHeaders(c)
+	util.SetEventStreamHeaders(c)
 	lastResponseText := ""
+	heartbeat := util.NewHeartbeat()
+	defer heartbeat.Stop()
 	c.Stream(func(w io.Writer) bool {
 		select {
 		case data := <-dataChan:
+			heartbeat.Reset()
 			var aliResponse AliChatResponse
 			err := json.Unmarshal([]byte(data), &aliResponse)
 			if err != nil {
@@ -271,8 +366,9 @@ func aliStreamHandler(c *gin.Context, resp *http.Response) (*OpenAIErrorWithStat
 				usage.TotalTokens = aliResponse.Usage.InputTokens + aliResponse.Usage.OutputTokens
 			}
 			response := streamResponseAli2OpenAI(&aliResponse)
+			responseText, _, _ := aliResponse.Output.result()
 			response.Choices[0].Delta.Content = strings.TrimPrefix(response.Choices[0].Delta.Content, lastResponseText)
-			lastResponseText = aliResponse.Output.Text
+			lastResponseText = responseText
 			jsonResponse, err := json.Marshal(response)
 			if err != nil {
 				common.SysError("error marshalling stream response: " + err.Error())
@@ -283,32 +379,37 @@ func aliStreamHandler(c *gin.Context, resp *http.Response) (*OpenAIErrorWithStat
 		case <-stopChan:
 			c.Render(-1, common.CustomEvent{Data: "data: [DONE]"})
 			return false
+		case <-heartbeat.C():
+			heartbeat.Write(c)
+			return true
+		case <-ctx.Done():
+			return false
 		}
 	})
-	err := resp.Body.Close()
+	err := util.CloseStream(cancel, resp.Body, stopChan)
 	if err != nil {
-		return errorWrapper(err, "close_response_body_failed", http.StatusInternalServerError), nil
+		return util.ErrorWrapper(err, "close_response_body_failed", http.StatusInternalServerError), nil, ""
 	}
-	return nil, &usage
+	return nil, &usage, lastResponseText
 }
 
-func aliHandler(c *gin.Context, resp *http.Response) (*OpenAIErrorWithStatusCode, *Usage) {
+func Handler(c *gin.Context, resp *http.Response) (*model.OpenAIErrorWithStatusCode, *model.Usage) {
 	var aliResponse AliChatResponse
 	responseBody, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return errorWrapper(err, "read_response_body_failed", http.StatusInternalServerError), nil
+		return util.ErrorWrapper(err, "read_response_body_failed", http.StatusInternalServerError), nil
 	}
 	err = resp.Body.Close()
 	if err != nil {
-		return errorWrapper(err, "close_response_body_failed", http.StatusInternalServerError), nil
+		return util.ErrorWrapper(err, "close_response_body_failed", http.StatusInternalServerError), nil
 	}
 	err = json.Unmarshal(responseBody, &aliResponse)
 	if err != nil {
-		return errorWrapper(err, "unmarshal_response_body_failed", http.StatusInternalServerError), nil
+		return util.ErrorWrapper(err, "unmarshal_response_body_failed", http.StatusInternalServerError), nil
 	}
 	if aliResponse.Code != "" {
-		return &OpenAIErrorWithStatusCode{
-			OpenAIError: OpenAIError{
+		return &model.OpenAIErrorWithStatusCode{
+			OpenAIError: model.OpenAIError{
 				Message: aliResponse.Message,
 				Type:    aliResponse.Code,
 				Param:   aliResponse.RequestId,
@@ -320,7 +421,7 @@ func aliHandler(c *gin.Context, resp *http.Response) (*OpenAIErrorWithStatusCode
 	fullTextResponse := responseAli2OpenAI(&aliResponse)
 	jsonResponse, err := json.Marshal(fullTextResponse)
 	if err != nil {
-		return errorWrapper(err, "marshal_response_body_failed", http.StatusInternalServerError), nil
+		return util.ErrorWrapper(err, "marshal_response_body_failed", http.StatusInternalServerError), nil
 	}
 	c.Writer.Header().Set("Content-Type", "application/json")
 	c.Writer.WriteHeader(resp.StatusCode)
@@ -0,0 +1,320 @@
+package anthropic
+
+import (
+	"encoding/json"
+	"fmt"
+	"one-api/common"
+	"one-api/relay/model"
+	"strings"
+)
+
+// The functions in this file serve clients that speak the Messages API,
+// their requests are converted to OpenAI's format so that they can be
+// relayed to any channel, and the responses are converted back.
+
+func stopReasonOpenAI2Claude(reason string) string {
+	switch reason {
+	case "stop":
+		return "end_turn"
+	case "length":
+		return "max_tokens"
+	case "tool_calls", "function_call":
+		return "tool_use"
+	default:
+		return reason
+	}
+}
+
+func textOfContent(content any) string {
+	switch content := content.(type) {
+	case string:
+		return content
+	case []any:
+		var text string
+		for _, item := range content {
+			if block, ok := item.(map[string]any); ok && block["type"] == "text" {
+				if subStr, ok := block["text"].(string); ok {
+					text += subStr
+				}
+			}
+		}
+		return text
+	}
+	return ""
+}
+
+func RequestClaude2OpenAI(claudeRequest *Request) *model.GeneralOpenAIRequest {
+	openaiRequest := model.GeneralOpenAIRequest{
+		Model:       claudeRequest.Model,
+		Stream:      claudeRequest.Stream,
+		MaxTokens:   claudeRequest.MaxTokens,
+		Temperature: claudeRequest.Temperature,
+		TopP:        claudeRequest.TopP,
+	}
+	if len(claudeRequest.StopSequences) > 0 {
+		openaiRequest.Stop = claudeRequest.StopSequences
+	}
+	if claudeRequest.Metadata != nil {
+		openaiRequest.User = claudeRequest.Metadata.UserId
+	}
+	if system := textOfContent(claudeRequest.System); system != "" {
+		openaiRequest.Messages = append(openaiRequest.Messages, model.Message{
+			Role:    "system",
+			Content: system,
+		})
+	}
+	for _, tool := range claudeRequest.Tools {
+		openaiRequest.Tools = append(openaiRequest.Tools, model.Tool{
+			Type: "function",
+			Function: model.Function{
+				Name:        tool.Name,
+				Description: tool.Description,
+				Parameters:  tool.InputSchema,
+			},
+		})
+	}
+	if claudeRequest.ToolChoice != nil {
+		switch claudeRequest.ToolChoice.Type {
+		case "any":
+			openaiRequest.ToolChoice = "required"
+		case "tool":
+			openaiRequest.ToolChoice = map[string]any{
+				"type":     "function",
+				"function": map[string]any{"name": claudeRequest.ToolChoice.Name},
+			}
+		default:
+			openaiRequest.ToolChoice = "auto"
+		}
+	}
+	for _, claudeMessage := range claudeRequest.Messages {
+		var parts []any
+		var toolCalls []model.Tool
+		var toolResults []model.Message
+		for _, content := range claudeMessage.Content {
+			switch content.Type {
+			case "text":
+				parts = append(parts, map[string]any{
+					"type": model.ContentTypeText,
+					"text": content.Text,
+				})
+			case "image":
+				if content.Source == nil {
+					continue
+				}
+				parts = append(parts, map[string]any{
+					"type": model.ContentTypeImageURL,
+					"image_url": map[string]any{
+						"url": fmt.Sprintf("data:%s;base64,%s", content.Source.MediaType, content.Source.Data),
+					},
+				})
+			case "tool_use":
+				arguments, _ := json.Marshal(content.Input)
+				toolCalls = append(toolCalls, model.Tool{
+					Id:   content.Id,
+					Type: "function",
+					Function: model.Function{
+						Name:      content.Name,
+						Arguments: string(arguments),
+					},
+				})
+			case "tool_result":
+				toolResults = append(toolResults, model.Message{
+					Role:       "tool",
+					Content:    textOfContent(content.Content),
+					ToolCallId: content.ToolUseId,
+				})
+			}
+		}
+		// tool results answer the previous assistant message, so they go first
+		openaiRequest.Messages = append(openaiRequest.Messages, toolResults...)
+		if len(parts) == 0 && len(toolCalls) == 0 {
+			continue
+		}
+		message := model.Message{
+			Role:      claudeMessage.Role,
+			ToolCalls: toolCalls,
+		}
+		if len(parts) == 1 && parts[0].(map[string]any)["type"] == model.ContentTypeText {
+			message.Content = parts[0].(map[string]any)["text"]
+		} else if len(parts) > 0 {
+			message.Content = parts
+		}
+		openaiRequest.Messages = append(openaiRequest.Messages, message)
+	}
+	return &openaiRequest
+}
+
+func ResponseOpenAI2Claude(response *model.OpenAITextResponse) *Response {
+	claudeResponse := Response{
+		Id:      "msg_" + strings.TrimPrefix(response.Id, "chatcmpl-"),
+		Type:    "message",
+		Role:    "assistant",
+		Content: []Content{},
+		Model:   response.Model,
+		Usage: Usage{
+			InputTokens:  response.Usage.PromptTokens,
+			OutputTokens: response.Usage.CompletionTokens,
+		},
+	}
+	if len(response.Choices) == 0 {
+		return &claudeResponse
+	}
+	choice := response.Choices[0]
+	if text := choice.StringContent(); text != "" {
+		claudeResponse.Content = append(claudeResponse.Content, Content{
+			Type: "text",
+			Text: text,
+		})
+	}
+	for _, toolCall := range choice.ToolCalls {
+		var input any = map[string]any{}
+		if arguments, ok := toolCall.Function.Arguments.(string); ok && arguments != "" {
+			_ = json.Unmarshal([]byte(arguments), &input)
+		}
+		claudeResponse.Content = append(claudeResponse.Content, Content{
+			Type:  "tool_use",
+			Id:    toolCall.Id,
+			Name:  toolCall.Function.Name,
+			Input: input,
+		})
+	}
+	stopReason := stopReasonOpenAI2Claude(choice.FinishReason)
+	claudeResponse.StopReason = &stopReason
+	return &claudeResponse
+}
+
+// StreamConverter turns OpenAI's stream chunks into the events of the Messages API.
+type StreamConverter struct {
+	Model        string
+	InputTokens  int
+	OutputTokens int
+	ResponseText string
+
+	started    bool
+	finished   bool
+	id         string
+	blockIndex int
+	blockType  string
+	stopReason string
+	toolBlocks map[int]int
+}
+
+func event(eventType string, data map[string]any) string {
+	data["type"] = eventType
+	jsonData, _ := json.Marshal(data)
+	return fmt.Sprintf("event: %s\ndata: %s\n\n", eventType, jsonData)
+}
+
+func (s *StreamConverter) start() string {
+	if s.started {
+		return ""
+	}
+	s.started = true
+	s.blockIndex = -1
+	s.toolBlocks = make(map[int]int)
+	if s.id == "" {
+		s.id = "msg_" + common.GetUUID()
+	}
+	return event("message_start", map[string]any{
+		"message": map[string]any{
+			"id":            s.id,
+			"type":          "message",
+			"role":          "assistant",
+			"content":       []any{},
+			"model":         s.Model,
+			"stop_reason":   nil,
+			"stop_sequence": nil,
+			"usage": map[string]any{
+				"input_tokens":  s.InputTokens,
+				"output_tokens": 0,
+			},
+		},
+	})
+}
+
+func (s *StreamConverter) stopBlock() string {
+	if s.blockType == "" {
+		return ""
+	}
+	s.blockType = ""
+	return event("content_block_stop", map[string]any{"index": s.blockIndex})
+}
+
+func (s *StreamConverter) startBlock(contentBlock map[string]any) string {
+	events := s.stopBlock()
+	s.blockIndex++
+	s.blockType = contentBlock["type"].(string)
+	return events + event("content_block_start", map[string]any{
+		"index":         s.blockIndex,
+		"content_block": contentBlock,
+	})
+}
+
+// Convert returns the events for a chunk
+func (s *StreamConverter) Convert(response *model.ChatCompletionsStreamResponse) string {
+	if s.id == "" && response.Id != "" {
+		s.id = "msg_" + strings.TrimPrefix(response.Id, "chatcmpl-")
+	}
+	if s.Model == "" {
+		s.Model = response.Model
+	}
+	events := s.start()
+	for _, choice := range response.Choices {
+		if choice.Delta.Content != "" {
+			if s.blockType != "text" {
+				events += s.startBlock(map[string]any{"type": "text", "text": ""})
+			}
+			s.ResponseText += choice.Delta.Content
+			events += event("content_block_delta", map[string]any{
+				"index": s.blockIndex,
+				"delta": map[string]any{"type": "text_delta", "text": choice.Delta.Content},
+			})
+		}
+		for i, toolCall := range choice.Delta.ToolCalls {
+			toolCallIndex := i
+			if toolCall.Index != nil {
+				toolCallIndex = *toolCall.Index
+			}
+			blockIndex, ok := s.toolBlocks[toolCallIndex]
+			if !ok {
+				events += s.startBlock(map[string]any{
+					"type":  "tool_use",
+					"id":    toolCall.Id,
+					"name":  toolCall.Function.Name,
+					"input": map[string]any{},
+				})
+				blockIndex = s.blockIndex
+				s.toolBlocks[toolCallIndex] = blockIndex
+			}
+			if arguments, ok := toolCall.Function.Arguments.(string); ok && arguments != "" {
+				s.ResponseText += arguments
+				events += event("content_block_delta", map[string]any{
+					"index": blockIndex,
+					"delta": map[string]any{"type": "input_json_delta", "partial_json": arguments},
+				})
+			}
+		}
+		if choice.FinishReason != nil && *choice.FinishReason != "" {
+			s.stopReason = stopReasonOpenAI2Claude(*choice.FinishReason)
+		}
+	}
+	return events
+}
+
+// Finish returns the closing events, OutputTokens should be set beforehand
+func (s *StreamConverter) Finish() string {
+	if s.finished {
+		return ""
+	}
+	s.finished = true
+	events := s.start() + s.stopBlock()
+	if s.stopReason == "" {
+		s.stopReason = "end_turn"
+	}
+	events += event("message_delta", map[string]any{
+		"delta": map[string]any{"stop_reason": s.stopReason, "stop_sequence": nil},
+		"usage": map[string]any{"output_tokens": s.OutputTokens},
+	})
+	events += event("message_stop", map[string]any{})
+	return events
+}
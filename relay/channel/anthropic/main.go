@@ -0,0 +1,458 @@
+package anthropic
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"io"
+	"net/http"
+	"one-api/common"
+	"one-api/common/image"
+	"one-api/relay/model"
+	"one-api/relay/util"
+	"strings"
+)
+
+const defaultMaxTokens = 4096
+
+func stopReasonClaude2OpenAI(reason *string) string {
+	if reason == nil {
+		return ""
+	}
+	switch *reason {
+	case "end_turn", "stop_sequence":
+		return "stop"
+	case "max_tokens":
+		return "length"
+	case "tool_use":
+		return "tool_calls"
+	default:
+		return *reason
+	}
+}
+
+func convertStopSequences(stop any) []string {
+	switch stop := stop.(type) {
+	case string:
+		return []string{stop}
+	case []any:
+		stopSequences := make([]string, 0, len(stop))
+		for _, item := range stop {
+			if str, ok := item.(string); ok {
+				stopSequences = append(stopSequences, str)
+			}
+		}
+		return stopSequences
+	}
+	return nil
+}
+
+func convertToolChoice(toolChoice any) (*ToolChoice, bool) {
+	switch toolChoice := toolChoice.(type) {
+	case string:
+		switch toolChoice {
+		case "none":
+			return nil, false
+		case "required":
+			return &ToolChoice{Type: "any"}, true
+		}
+		return &ToolChoice{Type: "auto"}, true
+	case map[string]any:
+		if function, ok := toolChoice["function"].(map[string]any); ok {
+			name, _ := function["name"].(string)
+			return &ToolChoice{Type: "tool", Name: name}, true
+		}
+	}
+	return nil, true
+}
+
+func convertContent(message model.Message) ([]Content, error) {
+	var content []Content
+	for _, part := range message.ParseContent() {
+		switch part.Type {
+		case model.ContentTypeText:
+			if part.Text == "" {
+				continue
+			}
+			content = append(content, Content{
+				Type: "text",
+				Text: part.Text,
+			})
+		case model.ContentTypeImageURL:
+			mimeType, data, err := image.GetImageFromUrl(part.ImageURL.Url)
+			if err != nil {
+				return nil, err
+			}
+			content = append(content, Content{
+				Type: "image",
+				Source: &ImageSource{
+					Type:      "base64",
+					MediaType: mimeType,
+					Data:      data,
+				},
+			})
+		}
+	}
+	return content, nil
+}
+
+func ConvertRequest(textRequest model.GeneralOpenAIRequest) (*Request, error) {
+	claudeRequest := Request{
+		Model:         textRequest.Model,
+		MaxTokens:     textRequest.MaxTokens,
+		StopSequences: convertStopSequences(textRequest.Stop),
+		Temperature:   textRequest.Temperature,
+		TopP:          textRequest.TopP,
+		Stream:        textRequest.Stream,
+	}
+	if claudeRequest.MaxTokens == 0 {
+		claudeRequest.MaxTokens = defaultMaxTokens
+	}
+	if textRequest.User != "" {
+		claudeRequest.Metadata = &Metadata{UserId: textRequest.User}
+	}
+	for _, tool := range textRequest.GetTools() {
+		if tool.Type != "function" {
+			continue
+		}
+		inputSchema := tool.Function.Parameters
+		if inputSchema == nil {
+			inputSchema = map[string]any{"type": "object", "properties": map[string]any{}}
+		}
+		claudeRequest.Tools = append(claudeRequest.Tools, Tool{
+			Name:        tool.Function.Name,
+			Description: tool.Function.Description,
+			InputSchema: inputSchema,
+		})
+	}
+	if len(claudeRequest.Tools) > 0 && textRequest.ToolChoice != nil {
+		toolChoice, keepTools := convertToolChoice(textRequest.ToolChoice)
+		if !keepTools {
+			claudeRequest.Tools = nil
+		}
+		claudeRequest.ToolChoice = toolChoice
+	}
+	var systemPrompts []string
+	for _, message := range textRequest.Messages {
+		if message.Role == "system" {
+			systemPrompts = append(systemPrompts, message.StringContent())
+			continue
+		}
+		claudeMessage := Message{
+			Role: message.Role,
+		}
+		switch message.Role {
+		case "tool":
+			claudeMessage.Role = "user"
+			claudeMessage.Content = []Content{{
+				Type:      "tool_result",
+				ToolUseId: message.ToolCallId,
+				Content:   message.StringContent(),
+			}}
+		default:
+			content, err := convertContent(message)
+			if err != nil {
+				return nil, err
+			}
+			claudeMessage.Content = content
+			for _, toolCall := range message.ToolCalls {
+				var input any = map[string]any{}
+				if arguments, ok := toolCall.Function.Arguments.(string); ok && arguments != "" {
+					if err := json.Unmarshal([]byte(arguments), &input); err != nil {
+						return nil, fmt.Errorf("invalid arguments of tool call %s: %s", toolCall.Id, err.Error())
+					}
+				}
+				claudeMessage.Content = append(claudeMessage.Content, Content{
+					Type:  "tool_use",
+					Id:    toolCall.Id,
+					Name:  toolCall.Function.Name,
+					Input: input,
+				})
+			}
+		}
+		if len(claudeMessage.Content) == 0 {
+			continue
+		}
+		// Claude requires the roles to alternate, merge consecutive messages of the same role
+		if n := len(claudeRequest.Messages); n > 0 && claudeRequest.Messages[n-1].Role == claudeMessage.Role {
+			claudeRequest.Messages[n-1].Content = append(claudeRequest.Messages[n-1].Content, claudeMessage.Content...)
+			continue
+		}
+		claudeRequest.Messages = append(claudeRequest.Messages, claudeMessage)
+	}
+	if len(systemPrompts) > 0 {
+		claudeRequest.System = strings.Join(systemPrompts, "\n")
+	}
+	return &claudeRequest, nil
+}
+
+func toolCallFromContent(content *Content, index int) model.Tool {
+	arguments := "{}"
+	if content.Input != nil {
+		if jsonInput, err := json.Marshal(content.Input); err == nil {
+			arguments = string(jsonInput)
+		}
+	}
+	return model.Tool{
+		Index: &index,
+		Id:    content.Id,
+		Type:  "function",
+		Function: model.Function{
+			Name:      content.Name,
+			Arguments: arguments,
+		},
+	}
+}
+
+func responseClaude2OpenAI(claudeResponse *Response) *model.OpenAITextResponse {
+	var responseText string
+	var toolCalls []model.Tool
+	for i := range claudeResponse.Content {
+		content := &claudeResponse.Content[i]
+		switch content.Type {
+		case "text":
+			responseText += content.Text
+		case "tool_use":
+			toolCall := toolCallFromContent(content, len(toolCalls))
+			toolCall.Index = nil
+			toolCalls = append(toolCalls, toolCall)
+		}
+	}
+	choice := model.OpenAITextResponseChoice{
+		Index: 0,
+		Message: model.Message{
+			Role:      "assistant",
+			Content:   responseText,
+			Name:      nil,
+			ToolCalls: toolCalls,
+		},
+		FinishReason: stopReasonClaude2OpenAI(claudeResponse.StopReason),
+	}
+	fullTextResponse := model.OpenAITextResponse{
+		Id:      fmt.Sprintf("chatcmpl-%s", claudeResponse.Id),
+		Object:  "chat.completion",
+		Created: common.GetTimestamp(),
+		Choices: []model.OpenAITextResponseChoice{choice},
+	}
+	return &fullTextResponse
+}
+
+// streamResponseClaude2OpenAI converts a single stream event, nil is returned for
+// events that carry nothing for the client
+func streamResponseClaude2OpenAI(claudeResponse *StreamResponse, toolCallIndex *int) *model.ChatCompletionsStreamResponse {
+	var choice model.ChatCompletionsStreamResponseChoice
+	switch claudeResponse.Type {
+	case "message_start":
+		choice.Delta.Role = "assistant"
+	case "content_block_start":
+		if claudeResponse.ContentBlock == nil {
+			return nil
+		}
+		switch claudeResponse.ContentBlock.Type {
+		case "text":
+			if claudeResponse.ContentBlock.Text == "" {
+				return nil
+			}
+			choice.Delta.Content = claudeResponse.ContentBlock.Text
+		case "tool_use":
+			*toolCallIndex++
+			claudeResponse.ContentBlock.Input = nil
+			toolCall := toolCallFromContent(claudeResponse.ContentBlock, *toolCallIndex)
+			toolCall.Function.Arguments = ""
+			choice.Delta.ToolCalls = []model.Tool{toolCall}
+		default:
+			return nil
+		}
+	case "content_block_delta":
+		if claudeResponse.Delta == nil {
+			return nil
+		}
+		switch claudeResponse.Delta.Type {
+		case "text_delta":
+			choice.Delta.Content = claudeResponse.Delta.Text
+		case "input_json_delta":
+			index := *toolCallIndex
+			choice.Delta.ToolCalls = []model.Tool{{
+				Index: &index,
+				Function: model.Function{
+					Arguments: claudeResponse.Delta.PartialJson,
+				},
+			}}
+		default:
+			return nil
+		}
+	case "message_delta":
+		if claudeResponse.Delta == nil || claudeResponse.Delta.StopReason == nil {
+			return nil
+		}
+		finishReason := stopReasonClaude2OpenAI(claudeResponse.Delta.StopReason)
+		choice.FinishReason = &finishReason
+	default:
+		return nil
+	}
+	var response model.ChatCompletionsStreamResponse
+	response.Object = "chat.completion.chunk"
+	response.Choices = []model.ChatCompletionsStreamResponseChoice{choice}
+	return &response
+}
+
+func StreamHandler(c *gin.Context, resp *http.Response) (*model.OpenAIErrorWithStatusCode, *model.Usage, string) {
+	responseText := ""
+	responseId := fmt.Sprintf("chatcmpl-%s", common.GetUUID())
+	createdTime := common.GetTimestamp()
+	var modelName string
+	var usage model.Usage
+	toolCallIndex := -1
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Split(bufio.ScanLines)
+	ctx, cancel := context.WithCancel(c.Request.Context())
+	defer cancel()
+	dataChan := make(chan string)
+	stopChan := make(chan bool)
+	go func() {
+		defer close(stopChan)
+		for scanner.Scan() {
+			data := scanner.Text()
+			if !strings.HasPrefix(data, "data: ") {
+				continue
+			}
+			select {
+			case dataChan <- strings.TrimPrefix(data, "data: "):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	util.SetEventStreamHeaders(c)
+	heartbeat := util.NewHeartbeat()
+	defer heartbeat.Stop()
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case data := <-dataChan:
+			heartbeat.Reset()
+			// some implementations may add \r at the end of data
+			data = strings.TrimSuffix(data, "\r")
+			var claudeResponse StreamResponse
+			err := json.Unmarshal([]byte(data), &claudeResponse)
+			if err != nil {
+				common.SysError("error unmarshalling stream response: " + err.Error())
+				return true
+			}
+			switch claudeResponse.Type {
+			case "message_start":
+				if claudeResponse.Message != nil {
+					responseId = fmt.Sprintf("chatcmpl-%s", claudeResponse.Message.Id)
+					modelName = claudeResponse.Message.Model
+					usage.PromptTokens = claudeResponse.Message.Usage.InputTokens
+					usage.CompletionTokens = claudeResponse.Message.Usage.OutputTokens
+				}
+			case "message_delta":
+				if claudeResponse.Usage != nil {
+					usage.CompletionTokens = claudeResponse.Usage.OutputTokens
+				}
+			case "error":
+				if claudeResponse.Error == nil {
+					return true
+				}
+				common.LogError(c.Request.Context(), fmt.Sprintf("claude stream error: type %s, message %s", claudeResponse.Error.Type, claudeResponse.Error.Message))
+				// the stream has started, the error is sent as a chunk the way
+				// OpenAI does so that clients do not take the reply as complete
+				jsonStr, err := json.Marshal(gin.H{
+					"error": model.OpenAIError{
+						Message: claudeResponse.Error.Message,
+						Type:    claudeResponse.Error.Type,
+						Code:    claudeResponse.Error.Type,
+					},
+				})
+				if err != nil {
+					common.SysError("error marshalling stream error: " + err.Error())
+					return true
+				}
+				c.Render(-1, common.CustomEvent{Data: "data: " + string(jsonStr)})
+				return true
+			}
+			response := streamResponseClaude2OpenAI(&claudeResponse, &toolCallIndex)
+			if response == nil {
+				return true
+			}
+			responseText += response.Choices[0].Delta.Content
+			response.Id = responseId
+			response.Created = createdTime
+			response.Model = modelName
+			jsonStr, err := json.Marshal(response)
+			if err != nil {
+				common.SysError("error marshalling stream response: " + err.Error())
+				return true
+			}
+			c.Render(-1, common.CustomEvent{Data: "data: " + string(jsonStr)})
+			return true
+		case <-stopChan:
+			c.Render(-1, common.CustomEvent{Data: "data: [DONE]"})
+			return false
+		case <-heartbeat.C():
+			heartbeat.Write(c)
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	})
+	err := util.CloseStream(cancel, resp.Body, stopChan)
+	if err != nil {
+		return util.ErrorWrapper(err, "close_response_body_failed", http.StatusInternalServerError), nil, ""
+	}
+	if usage.PromptTokens == 0 && usage.CompletionTokens == 0 {
+		return nil, nil, responseText
+	}
+	usage.TotalTokens = usage.PromptTokens + usage.CompletionTokens
+	return nil, &usage, responseText
+}
+
+func Handler(c *gin.Context, resp *http.Response, promptTokens int, modelName string) (*model.OpenAIErrorWithStatusCode, *model.Usage) {
+	responseBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return util.ErrorWrapper(err, "read_response_body_failed", http.StatusInternalServerError), nil
+	}
+	err = resp.Body.Close()
+	if err != nil {
+		return util.ErrorWrapper(err, "close_response_body_failed", http.StatusInternalServerError), nil
+	}
+	var claudeResponse Response
+	err = json.Unmarshal(responseBody, &claudeResponse)
+	if err != nil {
+		return util.ErrorWrapper(err, "unmarshal_response_body_failed", http.StatusInternalServerError), nil
+	}
+	if claudeResponse.Error != nil && claudeResponse.Error.Type != "" {
+		return &model.OpenAIErrorWithStatusCode{
+			OpenAIError: model.OpenAIError{
+				Message: claudeResponse.Error.Message,
+				Type:    claudeResponse.Error.Type,
+				Param:   "",
+				Code:    claudeResponse.Error.Type,
+			},
+			StatusCode: resp.StatusCode,
+		}, nil
+	}
+	fullTextResponse := responseClaude2OpenAI(&claudeResponse)
+	fullTextResponse.Model = modelName
+	usage := model.Usage{
+		PromptTokens:     claudeResponse.Usage.InputTokens,
+		CompletionTokens: claudeResponse.Usage.OutputTokens,
+	}
+	if usage.PromptTokens == 0 && usage.CompletionTokens == 0 {
+		// some compatible upstreams do not report usage
+		usage.PromptTokens = promptTokens
+		usage.CompletionTokens = util.CountTokenText(fullTextResponse.Choices[0].StringContent(), modelName)
+	}
+	usage.TotalTokens = usage.PromptTokens + usage.CompletionTokens
+	fullTextResponse.Usage = usage
+	jsonResponse, err := json.Marshal(fullTextResponse)
+	if err != nil {
+		return util.ErrorWrapper(err, "marshal_response_body_failed", http.StatusInternalServerError), nil
+	}
+	c.Writer.Header().Set("Content-Type", "application/json")
+	c.Writer.WriteHeader(resp.StatusCode)
+	_, err = c.Writer.Write(jsonResponse)
+	return nil, &usage
+}
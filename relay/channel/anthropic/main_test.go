@@ -0,0 +1,242 @@
+package anthropic
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"one-api/relay/model"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConvertRequest(t *testing.T) {
+	cases := []struct {
+		name    string
+		request string
+		want    string
+	}{
+		{
+			name:    "defaults",
+			request: `{"model":"claude-3-haiku-20240307","messages":[{"role":"user","content":"hi"}]}`,
+			want:    `{"model":"claude-3-haiku-20240307","max_tokens":4096,"messages":[{"role":"user","content":[{"type":"text","text":"hi"}]}]}`,
+		},
+		{
+			name: "system prompts and stop",
+			request: `{"model":"claude-3-haiku-20240307","max_tokens":10,"stop":"END","user":"u1","messages":[
+				{"role":"system","content":"be brief"},
+				{"role":"system","content":[{"type":"text","text":"be kind"}]},
+				{"role":"user","content":"hi"}]}`,
+			want: `{"model":"claude-3-haiku-20240307","max_tokens":10,"system":"be brief\nbe kind","stop_sequences":["END"],"metadata":{"user_id":"u1"},
+				"messages":[{"role":"user","content":[{"type":"text","text":"hi"}]}]}`,
+		},
+		{
+			name: "consecutive messages of a role are merged",
+			request: `{"model":"claude-3-haiku-20240307","stop":["a","b"],"messages":[
+				{"role":"user","content":"one"},
+				{"role":"user","content":[{"type":"text","text":"two"},{"type":"image_url","image_url":{"url":"data:image/png;base64,AAAA"}}]},
+				{"role":"assistant","content":""}]}`,
+			want: `{"model":"claude-3-haiku-20240307","max_tokens":4096,"stop_sequences":["a","b"],"messages":[{"role":"user","content":[
+				{"type":"text","text":"one"},
+				{"type":"text","text":"two"},
+				{"type":"image","source":{"type":"base64","media_type":"image/png","data":"AAAA"}}]}]}`,
+		},
+		{
+			name: "tools",
+			request: `{"model":"claude-3-haiku-20240307","tool_choice":{"type":"function","function":{"name":"get_weather"}},
+				"tools":[{"type":"function","function":{"name":"get_weather","description":"weather","parameters":{"type":"object"}}},{"type":"function","function":{"name":"now"}}],
+				"messages":[
+				{"role":"user","content":"weather?"},
+				{"role":"assistant","content":null,"tool_calls":[{"id":"call_1","type":"function","function":{"name":"get_weather","arguments":"{\"city\":\"Paris\"}"}}]},
+				{"role":"tool","tool_call_id":"call_1","content":"sunny"}]}`,
+			want: `{"model":"claude-3-haiku-20240307","max_tokens":4096,
+				"tools":[{"name":"get_weather","description":"weather","input_schema":{"type":"object"}},{"name":"now","input_schema":{"type":"object","properties":{}}}],
+				"tool_choice":{"type":"tool","name":"get_weather"},
+				"messages":[
+				{"role":"user","content":[{"type":"text","text":"weather?"}]},
+				{"role":"assistant","content":[{"type":"tool_use","id":"call_1","name":"get_weather","input":{"city":"Paris"}}]},
+				{"role":"user","content":[{"type":"tool_result","tool_use_id":"call_1","content":"sunny"}]}]}`,
+		},
+		{
+			name: "tool choice none drops the tools",
+			request: `{"model":"claude-3-haiku-20240307","tool_choice":"none","tools":[{"type":"function","function":{"name":"now"}}],
+				"messages":[{"role":"user","content":"hi"}]}`,
+			want: `{"model":"claude-3-haiku-20240307","max_tokens":4096,"messages":[{"role":"user","content":[{"type":"text","text":"hi"}]}]}`,
+		},
+		{
+			name: "tool choice required",
+			request: `{"model":"claude-3-haiku-20240307","tool_choice":"required","tools":[{"type":"function","function":{"name":"now"}}],
+				"messages":[{"role":"user","content":"hi"}]}`,
+			want: `{"model":"claude-3-haiku-20240307","max_tokens":4096,"tools":[{"name":"now","input_schema":{"type":"object","properties":{}}}],
+				"tool_choice":{"type":"any"},"messages":[{"role":"user","content":[{"type":"text","text":"hi"}]}]}`,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var textRequest model.GeneralOpenAIRequest
+			require.NoError(t, json.Unmarshal([]byte(c.request), &textRequest))
+			claudeRequest, err := ConvertRequest(textRequest)
+			require.NoError(t, err)
+			got, err := json.Marshal(claudeRequest)
+			require.NoError(t, err)
+			assert.JSONEq(t, c.want, string(got))
+		})
+	}
+}
+
+func TestConvertRequestInvalidToolArguments(t *testing.T) {
+	textRequest := model.GeneralOpenAIRequest{
+		Model: "claude-3-haiku-20240307",
+		Messages: []model.Message{{
+			Role: "assistant",
+			ToolCalls: []model.Tool{{
+				Id:       "call_1",
+				Type:     "function",
+				Function: model.Function{Name: "now", Arguments: "{"},
+			}},
+		}},
+	}
+	_, err := ConvertRequest(textRequest)
+	assert.Error(t, err)
+}
+
+func TestResponseClaude2OpenAI(t *testing.T) {
+	cases := []struct {
+		name     string
+		response string
+		want     string
+	}{
+		{
+			name:     "text",
+			response: `{"id":"msg_1","type":"message","role":"assistant","content":[{"type":"text","text":"Hello"},{"type":"text","text":" world"}],"stop_reason":"end_turn"}`,
+			want:     `{"role":"assistant","content":"Hello world"}`,
+		},
+		{
+			name: "tool use",
+			response: `{"id":"msg_1","type":"message","role":"assistant","content":[
+				{"type":"text","text":"Checking"},
+				{"type":"tool_use","id":"toolu_1","name":"get_weather","input":{"city":"Paris"}}],"stop_reason":"tool_use"}`,
+			want: `{"role":"assistant","content":"Checking","tool_calls":[{"id":"toolu_1","type":"function","function":{"name":"get_weather","arguments":"{\"city\":\"Paris\"}"}}]}`,
+		},
+	}
+	finishReasons := map[string]string{"text": "stop", "tool use": "tool_calls"}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var claudeResponse Response
+			require.NoError(t, json.Unmarshal([]byte(c.response), &claudeResponse))
+			response := responseClaude2OpenAI(&claudeResponse)
+			assert.Equal(t, "chatcmpl-msg_1", response.Id)
+			require.Len(t, response.Choices, 1)
+			assert.Equal(t, finishReasons[c.name], response.Choices[0].FinishReason)
+			got, err := json.Marshal(response.Choices[0].Message)
+			require.NoError(t, err)
+			assert.JSONEq(t, c.want, string(got))
+		})
+	}
+}
+
+func TestStopReasonClaude2OpenAI(t *testing.T) {
+	cases := []struct {
+		reason string
+		want   string
+	}{
+		{"end_turn", "stop"},
+		{"stop_sequence", "stop"},
+		{"max_tokens", "length"},
+		{"tool_use", "tool_calls"},
+		{"unknown", "unknown"},
+	}
+	for _, c := range cases {
+		reason := c.reason
+		assert.Equal(t, c.want, stopReasonClaude2OpenAI(&reason), c.reason)
+	}
+	assert.Equal(t, "", stopReasonClaude2OpenAI(nil))
+}
+
+func TestStreamResponseClaude2OpenAI(t *testing.T) {
+	// the events of a stream in which a text is followed by two tool calls,
+	// with the delta each is converted to or an empty string if it is dropped
+	events := []struct {
+		event string
+		want  string
+	}{
+		{`{"type":"message_start","message":{"id":"msg_1","model":"claude-3-haiku-20240307","usage":{"input_tokens":10,"output_tokens":1}}}`,
+			`{"role":"assistant","content":""}`},
+		{`{"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`, ""},
+		{`{"type":"ping"}`, ""},
+		{`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Hi"}}`,
+			`{"content":"Hi"}`},
+		{`{"type":"content_block_stop","index":0}`, ""},
+		{`{"type":"content_block_start","index":1,"content_block":{"type":"tool_use","id":"toolu_1","name":"get_weather","input":{}}}`,
+			`{"content":"","tool_calls":[{"index":0,"id":"toolu_1","type":"function","function":{"name":"get_weather","arguments":""}}]}`},
+		{`{"type":"content_block_delta","index":1,"delta":{"type":"input_json_delta","partial_json":"{\"city\":"}}`,
+			`{"content":"","tool_calls":[{"index":0,"function":{"arguments":"{\"city\":"}}]}`},
+		{`{"type":"content_block_start","index":2,"content_block":{"type":"tool_use","id":"toolu_2","name":"now","input":{}}}`,
+			`{"content":"","tool_calls":[{"index":1,"id":"toolu_2","type":"function","function":{"name":"now","arguments":""}}]}`},
+		{`{"type":"content_block_delta","index":2,"delta":{"type":"input_json_delta","partial_json":"{}"}}`,
+			`{"content":"","tool_calls":[{"index":1,"function":{"arguments":"{}"}}]}`},
+		{`{"type":"message_delta","delta":{"stop_reason":"tool_use"},"usage":{"output_tokens":20}}`,
+			`{"content":""}`},
+		{`{"type":"message_stop"}`, ""},
+	}
+	toolCallIndex := -1
+	for _, e := range events {
+		var claudeResponse StreamResponse
+		require.NoError(t, json.Unmarshal([]byte(e.event), &claudeResponse))
+		response := streamResponseClaude2OpenAI(&claudeResponse, &toolCallIndex)
+		if e.want == "" {
+			assert.Nil(t, response, e.event)
+			continue
+		}
+		require.NotNil(t, response, e.event)
+		require.Len(t, response.Choices, 1)
+		got, err := json.Marshal(response.Choices[0].Delta)
+		require.NoError(t, err)
+		assert.JSONEq(t, e.want, string(got), e.event)
+		if claudeResponse.Type == "message_delta" {
+			require.NotNil(t, response.Choices[0].FinishReason)
+			assert.Equal(t, "tool_calls", *response.Choices[0].FinishReason)
+		}
+	}
+}
+
+// streamRecorder records a stream, gin streams only to writers that notify
+// it of the client going away
+type streamRecorder struct {
+	*httptest.ResponseRecorder
+}
+
+func (r *streamRecorder) CloseNotify() <-chan bool {
+	return make(chan bool)
+}
+
+func TestStreamHandlerError(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	recorder := &streamRecorder{httptest.NewRecorder()}
+	c, _ := gin.CreateTestContext(recorder)
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+	body := "event: message_start\n" +
+		`data: {"type":"message_start","message":{"id":"msg_1","model":"claude-3-haiku-20240307","usage":{"input_tokens":10,"output_tokens":1}}}` + "\n\n" +
+		"event: error\n" +
+		`data: {"type":"error","error":{"type":"overloaded_error","message":"Overloaded"}}` + "\n\n"
+	resp := &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(body))}
+	respErr, usage, _ := StreamHandler(c, resp)
+	require.Nil(t, respErr)
+	require.NotNil(t, usage)
+	assert.Equal(t, 10, usage.PromptTokens)
+
+	var chunks []string
+	for _, line := range strings.Split(recorder.Body.String(), "\n") {
+		if strings.HasPrefix(line, "data: ") {
+			chunks = append(chunks, strings.TrimPrefix(line, "data: "))
+		}
+	}
+	require.Len(t, chunks, 3)
+	assert.JSONEq(t, `{"error":{"message":"Overloaded","type":"overloaded_error","param":"","code":"overloaded_error"}}`, chunks[1])
+	assert.Equal(t, "[DONE]", chunks[2])
+}
@@ -0,0 +1,119 @@
+package anthropic
+
+import "encoding/json"
+
+// https://docs.anthropic.com/claude/reference/messages_post
+
+type Metadata struct {
+	UserId string `json:"user_id"`
+}
+
+type ImageSource struct {
+	Type      string `json:"type"`
+	MediaType string `json:"media_type"`
+	Data      string `json:"data"`
+}
+
+type Content struct {
+	Type   string       `json:"type"`
+	Text   string       `json:"text,omitempty"`
+	Source *ImageSource `json:"source,omitempty"`
+	// tool_use
+	Id    string `json:"id,omitempty"`
+	Name  string `json:"name,omitempty"`
+	Input any    `json:"input,omitempty"`
+	// tool_result
+	ToolUseId string `json:"tool_use_id,omitempty"`
+	Content   any    `json:"content,omitempty"`
+	IsError   bool   `json:"is_error,omitempty"`
+}
+
+type Message struct {
+	Role    string    `json:"role"`
+	Content []Content `json:"content"`
+}
+
+// UnmarshalJSON accepts the shorthand form in which content is a plain string.
+func (m *Message) UnmarshalJSON(data []byte) error {
+	var message struct {
+		Role    string          `json:"role"`
+		Content json.RawMessage `json:"content"`
+	}
+	if err := json.Unmarshal(data, &message); err != nil {
+		return err
+	}
+	m.Role = message.Role
+	m.Content = nil
+	var text string
+	if err := json.Unmarshal(message.Content, &text); err == nil {
+		m.Content = []Content{{Type: "text", Text: text}}
+		return nil
+	}
+	return json.Unmarshal(message.Content, &m.Content)
+}
+
+type Tool struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	InputSchema any    `json:"input_schema"`
+}
+
+type ToolChoice struct {
+	Type string `json:"type"`
+	Name string `json:"name,omitempty"`
+}
+
+type Request struct {
+	Model         string      `json:"model"`
+	Messages      []Message   `json:"messages"`
+	System        any         `json:"system,omitempty"`
+	MaxTokens     int         `json:"max_tokens"`
+	StopSequences []string    `json:"stop_sequences,omitempty"`
+	Stream        bool        `json:"stream,omitempty"`
+	Temperature   float64     `json:"temperature,omitempty"`
+	TopP          float64     `json:"top_p,omitempty"`
+	TopK          int         `json:"top_k,omitempty"`
+	Tools         []Tool      `json:"tools,omitempty"`
+	ToolChoice    *ToolChoice `json:"tool_choice,omitempty"`
+	Metadata      *Metadata   `json:"metadata,omitempty"`
+}
+
+type Usage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
+
+type Error struct {
+	Type    string `json:"type"`
+	Message string `json:"message"`
+}
+
+type Response struct {
+	Id           string    `json:"id"`
+	Type         string    `json:"type"`
+	Role         string    `json:"role"`
+	Content      []Content `json:"content"`
+	Model        string    `json:"model"`
+	StopReason   *string   `json:"stop_reason"`
+	StopSequence *string   `json:"stop_sequence"`
+	Usage        Usage     `json:"usage"`
+	Error        *Error    `json:"error,omitempty"`
+}
+
+type Delta struct {
+	Type         string  `json:"type"`
+	Text         string  `json:"text,omitempty"`
+	PartialJson  string  `json:"partial_json,omitempty"`
+	StopReason   *string `json:"stop_reason,omitempty"`
+	StopSequence *string `json:"stop_sequence,omitempty"`
+}
+
+type StreamResponse struct {
+	Type         string    `json:"type"`
+	Message      *Response `json:"message,omitempty"`
+	Index        int       `json:"index"`
+	ContentBlock *Content  `json:"content_block,omitempty"`
+	Delta        *Delta    `json:"delta,omitempty"`
+	Usage        *Usage    `json:"usage,omitempty"`
+	Error        *Error    `json:"error,omitempty"`
+}
@@ -0,0 +1,98 @@
+package baidu
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"io"
+	"net/http"
+	"one-api/common"
+	"one-api/relay/channel"
+	"one-api/relay/constant"
+	"one-api/relay/model"
+	"one-api/relay/util"
+)
+
+func init() {
+	channel.Register(common.ChannelTypeBaidu, func() channel.Adaptor {
+		return &Adaptor{}
+	})
+}
+
+type Adaptor struct {
+}
+
+func (a *Adaptor) Init(meta *util.RelayMeta) {
+
+}
+
+func (a *Adaptor) GetRequestURL(meta *util.RelayMeta) (string, error) {
+	fullRequestURL := util.GetFullRequestURL(meta.BaseURL, meta.RequestURLPath, meta.ChannelType)
+	switch meta.ActualModelName {
+	case "ERNIE-Bot":
+		fullRequestURL = "https://aip.baidubce.com/rpc/2.0/ai_custom/v1/wenxinworkshop/chat/completions"
+	case "ERNIE-Bot-turbo":
+		fullRequestURL = "https://aip.baidubce.com/rpc/2.0/ai_custom/v1/wenxinworkshop/chat/eb-instant"
+	case "ERNIE-Bot-4":
+		fullRequestURL = "https://aip.baidubce.com/rpc/2.0/ai_custom/v1/wenxinworkshop/chat/completions_pro"
+	case "BLOOMZ-7B":
+		fullRequestURL = "https://aip.baidubce.com/rpc/2.0/ai_custom/v1/wenxinworkshop/chat/bloomz_7b1"
+	case "Embedding-V1":
+		fullRequestURL = "https://aip.baidubce.com/rpc/2.0/ai_custom/v1/wenxinworkshop/embeddings/embedding-v1"
+	}
+	// the token is requested through the transport of the channel
+	client, err := util.GetChannelImpatientHTTPClient(meta.ChannelId, meta.Config)
+	if err != nil {
+		return "", err
+	}
+	accessToken, err := getBaiduAccessToken(client, meta.APIKey)
+	if err != nil {
+		return "", err
+	}
+	fullRequestURL += "?access_token=" + accessToken
+	return fullRequestURL, nil
+}
+
+func (a *Adaptor) SetupRequestHeader(c *gin.Context, req *http.Request, meta *util.RelayMeta) error {
+	channel.SetupCommonRequestHeader(c, req, meta)
+	req.Header.Set("Authorization", "Bearer "+meta.APIKey)
+	return nil
+}
+
+func (a *Adaptor) ConvertRequest(c *gin.Context, relayMode int, request *model.GeneralOpenAIRequest) (any, error) {
+	if request == nil {
+		return nil, errors.New("request is nil")
+	}
+	switch relayMode {
+	case constant.RelayModeEmbeddings:
+		return embeddingRequestOpenAI2Baidu(*request), nil
+	default:
+		if err := channel.CheckMultipleToolCallsUnsupported(request, a.GetChannelName()); err != nil {
+			return nil, err
+		}
+		return requestOpenAI2Baidu(*request), nil
+	}
+}
+
+func (a *Adaptor) DoRequest(c *gin.Context, meta *util.RelayMeta, requestBody io.Reader) (*http.Response, error) {
+	return channel.DoRequestHelper(a, c, meta, requestBody)
+}
+
+func (a *Adaptor) DoResponse(c *gin.Context, resp *http.Response, meta *util.RelayMeta) (usage *model.Usage, err *model.OpenAIErrorWithStatusCode) {
+	if meta.IsStream {
+		var responseText string
+		err, usage, responseText = StreamHandler(c, resp)
+		meta.ResponseText = responseText
+	} else {
+		switch meta.Mode {
+		case constant.RelayModeEmbeddings:
+			err, usage = EmbeddingHandler(c, resp)
+		default:
+			err, usage = Handler(c, resp)
+		}
+	}
+	return
+}
+
+func (a *Adaptor) GetChannelName() string {
+	return "baidu"
+}
@@ -1,7 +1,8 @@
-package controller
+package baidu
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -9,6 +10,9 @@ import (
 	"io"
 	"net/http"
 	"one-api/common"
+	"one-api/relay/constant"
+	"one-api/relay/model"
+	"one-api/relay/util"
 	"strings"
 	"sync"
 	"time"
@@ -21,15 +25,38 @@ type BaiduTokenResponse struct {
 	AccessToken string `json:"access_token"`
 }
 
+type BaiduFunctionCall struct {
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"`
+	Thoughts  string `json:"thoughts,omitempty"`
+}
+
 type BaiduMessage struct {
-	Role    string `json:"role"`
-	Content string `json:"content"`
+	Role         string             `json:"role"`
+	Content      string             `json:"content"`
+	Name         string             `json:"name,omitempty"`
+	FunctionCall *BaiduFunctionCall `json:"function_call,omitempty"`
+}
+
+type BaiduFunction struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Parameters  any    `json:"parameters"`
+}
+
+type BaiduToolChoice struct {
+	Type     string `json:"type"`
+	Function struct {
+		Name string `json:"name"`
+	} `json:"function"`
 }
 
 type BaiduChatRequest struct {
-	Messages []BaiduMessage `json:"messages"`
-	Stream   bool           `json:"stream"`
-	UserId   string         `json:"user_id,omitempty"`
+	Messages   []BaiduMessage   `json:"messages"`
+	Stream     bool             `json:"stream"`
+	UserId     string           `json:"user_id,omitempty"`
+	Functions  []BaiduFunction  `json:"functions,omitempty"`
+	ToolChoice *BaiduToolChoice `json:"tool_choice,omitempty"`
 }
 
 type BaiduError struct {
@@ -38,13 +65,15 @@ type BaiduError struct {
 }
 
 type BaiduChatResponse struct {
-	Id               string `json:"id"`
-	Object           string `json:"object"`
-	Created          int64  `json:"created"`
-	Result           string `json:"result"`
-	IsTruncated      bool   `json:"is_truncated"`
-	NeedClearHistory bool   `json:"need_clear_history"`
-	Usage            Usage  `json:"usage"`
+	Id               string             `json:"id"`
+	Object           string             `json:"object"`
+	Created          int64              `json:"created"`
+	Result           string             `json:"result"`
+	FunctionCall     *BaiduFunctionCall `json:"function_call,omitempty"`
+	FinishReason     string             `json:"finish_reason"`
+	IsTruncated      bool               `json:"is_truncated"`
+	NeedClearHistory bool               `json:"need_clear_history"`
+	Usage            model.Usage        `json:"usage"`
 	BaiduError
 }
 
@@ -69,7 +98,7 @@ type BaiduEmbeddingResponse struct {
 	Object  string               `json:"object"`
 	Created int64                `json:"created"`
 	Data    []BaiduEmbeddingData `json:"data"`
-	Usage   Usage                `json:"usage"`
+	Usage   model.Usage          `json:"usage"`
 	BaiduError
 }
 
@@ -83,10 +112,13 @@ type BaiduAccessToken struct {
 
 var baiduTokenStore sync.Map
 
-func requestOpenAI2Baidu(request GeneralOpenAIRequest) *BaiduChatRequest {
+func requestOpenAI2Baidu(request model.GeneralOpenAIRequest) *BaiduChatRequest {
 	messages := make([]BaiduMessage, 0, len(request.Messages))
+	// function results only carry the id of the call, so remember the names
+	toolCallNames := make(map[string]string)
 	for _, message := range request.Messages {
-		if message.Role == "system" {
+		switch message.Role {
+		case "system":
 			messages = append(messages, BaiduMessage{
 				Role:    "user",
 				Content: message.StringContent(),
@@ -95,69 +127,139 @@ func requestOpenAI2Baidu(request GeneralOpenAIRequest) *BaiduChatRequest {
 				Role:    "assistant",
 				Content: "Okay",
 			})
-		} else {
-			messages = append(messages, BaiduMessage{
+		case "tool", "function":
+			baiduMessage := BaiduMessage{
+				Role:    "function",
+				Name:    toolCallNames[message.ToolCallId],
+				Content: message.StringContent(),
+			}
+			if message.Name != nil {
+				baiduMessage.Name = *message.Name
+			}
+			messages = append(messages, baiduMessage)
+		default:
+			baiduMessage := BaiduMessage{
 				Role:    message.Role,
 				Content: message.StringContent(),
-			})
+			}
+			// ERNIE Bot makes one function call per turn, requests with more
+			// are rejected by the adaptor
+			if len(message.ToolCalls) > 0 {
+				toolCall := message.ToolCalls[0]
+				arguments, _ := toolCall.Function.Arguments.(string)
+				baiduMessage.FunctionCall = &BaiduFunctionCall{
+					Name:      toolCall.Function.Name,
+					Arguments: arguments,
+				}
+				toolCallNames[toolCall.Id] = toolCall.Function.Name
+			}
+			messages = append(messages, baiduMessage)
 		}
 	}
-	return &BaiduChatRequest{
+	baiduRequest := BaiduChatRequest{
 		Messages: messages,
 		Stream:   request.Stream,
+		UserId:   request.User,
+	}
+	for _, tool := range request.GetTools() {
+		baiduRequest.Functions = append(baiduRequest.Functions, BaiduFunction{
+			Name:        tool.Function.Name,
+			Description: tool.Function.Description,
+			Parameters:  tool.Function.Parameters,
+		})
 	}
+	switch toolChoice := request.ToolChoice.(type) {
+	case string:
+		if toolChoice == "none" {
+			baiduRequest.Functions = nil
+		}
+	case map[string]any:
+		if function, ok := toolChoice["function"].(map[string]any); ok {
+			baiduRequest.ToolChoice = &BaiduToolChoice{Type: "function"}
+			baiduRequest.ToolChoice.Function.Name, _ = function["name"].(string)
+		}
+	}
+	return &baiduRequest
+}
+
+func toolCallsBaidu2OpenAI(functionCall *BaiduFunctionCall) []model.Tool {
+	if functionCall == nil {
+		return nil
+	}
+	return []model.Tool{{
+		Id:   fmt.Sprintf("call_%s", common.GetUUID()),
+		Type: "function",
+		Function: model.Function{
+			Name:      functionCall.Name,
+			Arguments: functionCall.Arguments,
+		},
+	}}
 }
 
-func responseBaidu2OpenAI(response *BaiduChatResponse) *OpenAITextResponse {
-	choice := OpenAITextResponseChoice{
+func responseBaidu2OpenAI(response *BaiduChatResponse) *model.OpenAITextResponse {
+	choice := model.OpenAITextResponseChoice{
 		Index: 0,
-		Message: Message{
-			Role:    "assistant",
-			Content: response.Result,
+		Message: model.Message{
+			Role:      "assistant",
+			Content:   response.Result,
+			ToolCalls: toolCallsBaidu2OpenAI(response.FunctionCall),
 		},
 		FinishReason: "stop",
 	}
-	fullTextResponse := OpenAITextResponse{
+	if response.FunctionCall != nil {
+		choice.FinishReason = "tool_calls"
+	}
+	fullTextResponse := model.OpenAITextResponse{
 		Id:      response.Id,
 		Object:  "chat.completion",
 		Created: response.Created,
-		Choices: []OpenAITextResponseChoice{choice},
+		Choices: []model.OpenAITextResponseChoice{choice},
 		Usage:   response.Usage,
 	}
 	return &fullTextResponse
 }
 
-func streamResponseBaidu2OpenAI(baiduResponse *BaiduChatStreamResponse) *ChatCompletionsStreamResponse {
-	var choice ChatCompletionsStreamResponseChoice
+func streamResponseBaidu2OpenAI(baiduResponse *BaiduChatStreamResponse, hasToolCalls *bool) *model.ChatCompletionsStreamResponse {
+	var choice model.ChatCompletionsStreamResponseChoice
 	choice.Delta.Content = baiduResponse.Result
+	if toolCalls := toolCallsBaidu2OpenAI(baiduResponse.FunctionCall); toolCalls != nil {
+		index := 0
+		toolCalls[0].Index = &index
+		choice.Delta.ToolCalls = toolCalls
+		*hasToolCalls = true
+	}
 	if baiduResponse.IsEnd {
-		choice.FinishReason = &stopFinishReason
+		finishReason := constant.StopFinishReason
+		if *hasToolCalls {
+			finishReason = "tool_calls"
+		}
+		choice.FinishReason = &finishReason
 	}
-	response := ChatCompletionsStreamResponse{
+	response := model.ChatCompletionsStreamResponse{
 		Id:      baiduResponse.Id,
 		Object:  "chat.completion.chunk",
 		Created: baiduResponse.Created,
 		Model:   "ernie-bot",
-		Choices: []ChatCompletionsStreamResponseChoice{choice},
+		Choices: []model.ChatCompletionsStreamResponseChoice{choice},
 	}
 	return &response
 }
 
-func embeddingRequestOpenAI2Baidu(request GeneralOpenAIRequest) *BaiduEmbeddingRequest {
+func embeddingRequestOpenAI2Baidu(request model.GeneralOpenAIRequest) *BaiduEmbeddingRequest {
 	return &BaiduEmbeddingRequest{
 		Input: request.ParseInput(),
 	}
 }
 
-func embeddingResponseBaidu2OpenAI(response *BaiduEmbeddingResponse) *OpenAIEmbeddingResponse {
-	openAIEmbeddingResponse := OpenAIEmbeddingResponse{
+func embeddingResponseBaidu2OpenAI(response *BaiduEmbeddingResponse) *model.OpenAIEmbeddingResponse {
+	openAIEmbeddingResponse := model.OpenAIEmbeddingResponse{
 		Object: "list",
-		Data:   make([]OpenAIEmbeddingResponseItem, 0, len(response.Data)),
+		Data:   make([]model.OpenAIEmbeddingResponseItem, 0, len(response.Data)),
 		Model:  "baidu-embedding",
 		Usage:  response.Usage,
 	}
 	for _, item := range response.Data {
-		openAIEmbeddingResponse.Data = append(openAIEmbeddingResponse.Data, OpenAIEmbeddingResponseItem{
+		openAIEmbeddingResponse.Data = append(openAIEmbeddingResponse.Data, model.OpenAIEmbeddingResponseItem{
 			Object:    item.Object,
 			Index:     item.Index,
 			Embedding: item.Embedding,
@@ -166,8 +268,9 @@ func embeddingResponseBaidu2OpenAI(response *BaiduEmbeddingResponse) *OpenAIEmbe
 	return &openAIEmbeddingResponse
 }
 
-func baiduStreamHandler(c *gin.Context, resp *http.Response) (*OpenAIErrorWithStatusCode, *Usage) {
-	var usage Usage
+func StreamHandler(c *gin.Context, resp *http.Response) (*model.OpenAIErrorWithStatusCode, *model.Usage, string) {
+	var usage model.Usage
+	responseText := ""
 	scanner := bufio.NewScanner(resp.Body)
 	scanner.Split(func(data []byte, atEOF bool) (advance int, token []byte, err error) {
 		if atEOF && len(data) == 0 {
@@ -181,23 +284,33 @@ func baiduStreamHandler(c *gin.Context, resp *http.Response) (*OpenAIErrorWithSt
 		}
 		return 0, nil, nil
 	})
+	ctx, cancel := context.WithCancel(c.Request.Context())
+	defer cancel()
 	dataChan := make(chan string)
 	stopChan := make(chan bool)
 	go func() {
+		defer close(stopChan)
 		for scanner.Scan() {
 			data := scanner.Text()
 			if len(data) < 6 { // ignore blank line or wrong format
 				continue
 			}
 			data = data[6:]
-			dataChan <- data
+			select {
+			case dataChan <- data:
+			case <-ctx.Done():
+				return
+			}
 		}
-		stopChan <- true
 	}()
-	setEventStreamHeaders(c)
+	util.SetEventStreamHeaders(c)
+	hasToolCalls := false
+	heartbeat := util.NewHeartbeat()
+	defer heartbeat.Stop()
 	c.Stream(func(w io.Writer) bool {
 		select {
 		case data := <-dataChan:
+			heartbeat.Reset()
 			var baiduResponse BaiduChatStreamResponse
 			err := json.Unmarshal([]byte(data), &baiduResponse)
 			if err != nil {
@@ -209,7 +322,10 @@ func baiduStreamHandler(c *gin.Context, resp *http.Response) (*OpenAIErrorWithSt
 				usage.PromptTokens = baiduResponse.Usage.PromptTokens
 				usage.CompletionTokens = baiduResponse.Usage.TotalTokens - baiduResponse.Usage.PromptTokens
 			}
-			response := streamResponseBaidu2OpenAI(&baiduResponse)
+			response := streamResponseBaidu2OpenAI(&baiduResponse, &hasToolCalls)
+			if len(response.Choices) != 0 {
+				responseText += response.Choices[0].Delta.Content
+			}
 			jsonResponse, err := json.Marshal(response)
 			if err != nil {
 				common.SysError("error marshalling stream response: " + err.Error())
@@ -220,32 +336,37 @@ func baiduStreamHandler(c *gin.Context, resp *http.Response) (*OpenAIErrorWithSt
 		case <-stopChan:
 			c.Render(-1, common.CustomEvent{Data: "data: [DONE]"})
 			return false
+		case <-heartbeat.C():
+			heartbeat.Write(c)
+			return true
+		case <-ctx.Done():
+			return false
 		}
 	})
-	err := resp.Body.Close()
+	err := util.CloseStream(cancel, resp.Body, stopChan)
 	if err != nil {
-		return errorWrapper(err, "close_response_body_failed", http.StatusInternalServerError), nil
+		return util.ErrorWrapper(err, "close_response_body_failed", http.StatusInternalServerError), nil, ""
 	}
-	return nil, &usage
+	return nil, &usage, responseText
 }
 
-func baiduHandler(c *gin.Context, resp *http.Response) (*OpenAIErrorWithStatusCode, *Usage) {
+func Handler(c *gin.Context, resp *http.Response) (*model.OpenAIErrorWithStatusCode, *model.Usage) {
 	var baiduResponse BaiduChatResponse
 	responseBody, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return errorWrapper(err, "read_response_body_failed", http.StatusInternalServerError), nil
+		return util.ErrorWrapper(err, "read_response_body_failed", http.StatusInternalServerError), nil
 	}
 	err = resp.Body.Close()
 	if err != nil {
-		return errorWrapper(err, "close_response_body_failed", http.StatusInternalServerError), nil
+		return util.ErrorWrapper(err, "close_response_body_failed", http.StatusInternalServerError), nil
 	}
 	err = json.Unmarshal(responseBody, &baiduResponse)
 	if err != nil {
-		return errorWrapper(err, "unmarshal_response_body_failed", http.StatusInternalServerError), nil
+		return util.ErrorWrapper(err, "unmarshal_response_body_failed", http.StatusInternalServerError), nil
 	}
 	if baiduResponse.ErrorMsg != "" {
-		return &OpenAIErrorWithStatusCode{
-			OpenAIError: OpenAIError{
+		return &model.OpenAIErrorWithStatusCode{
+			OpenAIError: model.OpenAIError{
 				Message: baiduResponse.ErrorMsg,
 				Type:    "baidu_error",
 				Param:   "",
@@ -257,7 +378,7 @@ func baiduHandler(c *gin.Context, resp *http.Response) (*OpenAIErrorWithStatusCo
 	fullTextResponse := responseBaidu2OpenAI(&baiduResponse)
 	jsonResponse, err := json.Marshal(fullTextResponse)
 	if err != nil {
-		return errorWrapper(err, "marshal_response_body_failed", http.StatusInternalServerError), nil
+		return util.ErrorWrapper(err, "marshal_response_body_failed", http.StatusInternalServerError), nil
 	}
 	c.Writer.Header().Set("Content-Type", "application/json")
 	c.Writer.WriteHeader(resp.StatusCode)
@@ -265,23 +386,23 @@ func baiduHandler(c *gin.Context, resp *http.Response) (*OpenAIErrorWithStatusCo
 	return nil, &fullTextResponse.Usage
 }
 
-func baiduEmbeddingHandler(c *gin.Context, resp *http.Response) (*OpenAIErrorWithStatusCode, *Usage) {
+func EmbeddingHandler(c *gin.Context, resp *http.Response) (*model.OpenAIErrorWithStatusCode, *model.Usage) {
 	var baiduResponse BaiduEmbeddingResponse
 	responseBody, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return errorWrapper(err, "read_response_body_failed", http.StatusInternalServerError), nil
+		return util.ErrorWrapper(err, "read_response_body_failed", http.StatusInternalServerError), nil
 	}
 	err = resp.Body.Close()
 	if err != nil {
-		return errorWrapper(err, "close_response_body_failed", http.StatusInternalServerError), nil
+		return util.ErrorWrapper(err, "close_response_body_failed", http.StatusInternalServerError), nil
 	}
 	err = json.Unmarshal(responseBody, &baiduResponse)
 	if err != nil {
-		return errorWrapper(err, "unmarshal_response_body_failed", http.StatusInternalServerError), nil
+		return util.ErrorWrapper(err, "unmarshal_response_body_failed", http.StatusInternalServerError), nil
 	}
 	if baiduResponse.ErrorMsg != "" {
-		return &OpenAIErrorWithStatusCode{
-			OpenAIError: OpenAIError{
+		return &model.OpenAIErrorWithStatusCode{
+			OpenAIError: model.OpenAIError{
 				Message: baiduResponse.ErrorMsg,
 				Type:    "baidu_error",
 				Param:   "",
@@ -293,7 +414,7 @@ func baiduEmbeddingHandler(c *gin.Context, resp *http.Response) (*OpenAIErrorWit
 	fullTextResponse := embeddingResponseBaidu2OpenAI(&baiduResponse)
 	jsonResponse, err := json.Marshal(fullTextResponse)
 	if err != nil {
-		return errorWrapper(err, "marshal_response_body_failed", http.StatusInternalServerError), nil
+		return util.ErrorWrapper(err, "marshal_response_body_failed", http.StatusInternalServerError), nil
 	}
 	c.Writer.Header().Set("Content-Type", "application/json")
 	c.Writer.WriteHeader(resp.StatusCode)
@@ -301,20 +422,20 @@ func baiduEmbeddingHandler(c *gin.Context, resp *http.Response) (*OpenAIErrorWit
 	return nil, &fullTextResponse.Usage
 }
 
-func getBaiduAccessToken(apiKey string) (string, error) {
+func getBaiduAccessToken(client *http.Client, apiKey string) (string, error) {
 	if val, ok := baiduTokenStore.Load(apiKey); ok {
 		var accessToken BaiduAccessToken
 		if accessToken, ok = val.(BaiduAccessToken); ok {
 			// soon this will expire
 			if time.Now().Add(time.Hour).After(accessToken.ExpiresAt) {
 				go func() {
-					_, _ = getBaiduAccessTokenHelper(apiKey)
+					_, _ = getBaiduAccessTokenHelper(client, apiKey)
 				}()
 			}
 			return accessToken.AccessToken, nil
 		}
 	}
-	accessToken, err := getBaiduAccessTokenHelper(apiKey)
+	accessToken, err := getBaiduAccessTokenHelper(client, apiKey)
 	if err != nil {
 		return "", err
 	}
@@ -324,7 +445,7 @@ func getBaiduAccessToken(apiKey string) (string, error) {
 	return (*accessToken).AccessToken, nil
 }
 
-func getBaiduAccessTokenHelper(apiKey string) (*BaiduAccessToken, error) {
+func getBaiduAccessTokenHelper(client *http.Client, apiKey string) (*BaiduAccessToken, error) {
 	parts := strings.Split(apiKey, "|")
 	if len(parts) != 2 {
 		return nil, errors.New("invalid baidu apikey")
@@ -336,7 +457,7 @@ func getBaiduAccessTokenHelper(apiKey string) (*BaiduAccessToken, error) {
 	}
 	req.Header.Add("Content-Type", "application/json")
 	req.Header.Add("Accept", "application/json")
-	res, err := impatientHTTPClient.Do(req)
+	res, err := client.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,108 @@
+package channel
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"one-api/relay/model"
+	"one-api/relay/util"
+
+	"github.com/gin-gonic/gin"
+)
+
+// UnsupportedParameterError is returned by ConvertRequest when the upstream
+// cannot honor a parameter of the request.
+type UnsupportedParameterError struct {
+	Param   string
+	Channel string
+}
+
+func (e *UnsupportedParameterError) Error() string {
+	return fmt.Sprintf("parameter %s is not supported by %s channels", e.Param, e.Channel)
+}
+
+// UnsupportedRelayModeError is returned by ConvertRequest when the upstream
+// does not serve the endpoint of the request at all.
+type UnsupportedRelayModeError struct {
+	Path    string
+	Channel string
+}
+
+func (e *UnsupportedRelayModeError) Error() string {
+	return fmt.Sprintf("%s is not supported by %s channels", e.Path, e.Channel)
+}
+
+// CheckToolsUnsupported returns an UnsupportedParameterError if the request asks for tools.
+func CheckToolsUnsupported(request *model.GeneralOpenAIRequest, channelName string) error {
+	if request.ToolChoice == "none" {
+		return nil
+	}
+	if len(request.Tools) > 0 {
+		return &UnsupportedParameterError{Param: "tools", Channel: channelName}
+	}
+	if request.Functions != nil {
+		return &UnsupportedParameterError{Param: "functions", Channel: channelName}
+	}
+	return nil
+}
+
+// CheckMultipleToolCallsUnsupported returns an UnsupportedParameterError if an
+// assistant message of the request makes more than one tool call, for the
+// upstreams that make a single function call per turn.
+func CheckMultipleToolCallsUnsupported(request *model.GeneralOpenAIRequest, channelName string) error {
+	for _, message := range request.Messages {
+		if len(message.ToolCalls) > 1 {
+			return &UnsupportedParameterError{Param: "messages with multiple tool calls", Channel: channelName}
+		}
+	}
+	return nil
+}
+
+func SetupCommonRequestHeader(c *gin.Context, req *http.Request, meta *util.RelayMeta) {
+	req.Header.Set("Content-Type", c.Request.Header.Get("Content-Type"))
+	req.Header.Set("Accept", c.Request.Header.Get("Accept"))
+	if meta.IsStream && c.Request.Header.Get("Accept") == "" {
+		req.Header.Set("Accept", "text/event-stream")
+	}
+}
+
+func DoRequestHelper(a Adaptor, c *gin.Context, meta *util.RelayMeta, requestBody io.Reader) (*http.Response, error) {
+	fullRequestURL, err := a.GetRequestURL(meta)
+	if err != nil {
+		return nil, fmt.Errorf("get request url failed: %w", err)
+	}
+	req, err := http.NewRequestWithContext(c.Request.Context(), c.Request.Method, fullRequestURL, requestBody)
+	if err != nil {
+		return nil, fmt.Errorf("new request failed: %w", err)
+	}
+	err = a.SetupRequestHeader(c, req, meta)
+	if err != nil {
+		return nil, fmt.Errorf("setup request header failed: %w", err)
+	}
+	util.SetupHeaderOverrides(req, meta.ChannelType, meta.Config)
+	resp, err := DoRequest(c, req)
+	if err != nil {
+		return nil, fmt.Errorf("do request failed: %w", err)
+	}
+	return resp, nil
+}
+
+func DoRequest(c *gin.Context, req *http.Request) (*http.Response, error) {
+	client, err := util.GetHTTPClient(c)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp == nil {
+		return nil, errors.New("resp is nil")
+	}
+	if req.Body != nil {
+		_ = req.Body.Close()
+	}
+	_ = c.Request.Body.Close()
+	return resp, nil
+}
@@ -0,0 +1,79 @@
+package gemini
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"io"
+	"net/http"
+	"one-api/common"
+	"one-api/relay/channel"
+	"one-api/relay/constant"
+	"one-api/relay/model"
+	"one-api/relay/util"
+)
+
+func init() {
+	channel.Register(common.ChannelTypeGemini, func() channel.Adaptor {
+		return &Adaptor{}
+	})
+}
+
+const defaultAPIVersion = "v1beta"
+
+type Adaptor struct {
+}
+
+func (a *Adaptor) Init(meta *util.RelayMeta) {
+
+}
+
+func (a *Adaptor) GetRequestURL(meta *util.RelayMeta) (string, error) {
+	version := meta.APIVersion
+	if version == "" {
+		version = defaultAPIVersion
+	}
+	action := "generateContent"
+	if meta.IsStream {
+		action = "streamGenerateContent?alt=sse"
+	}
+	return fmt.Sprintf("%s/%s/models/%s:%s", meta.BaseURL, version, meta.ActualModelName, action), nil
+}
+
+func (a *Adaptor) SetupRequestHeader(c *gin.Context, req *http.Request, meta *util.RelayMeta) error {
+	channel.SetupCommonRequestHeader(c, req, meta)
+	req.Header.Set("x-goog-api-key", meta.APIKey)
+	return nil
+}
+
+func (a *Adaptor) ConvertRequest(c *gin.Context, relayMode int, request *model.GeneralOpenAIRequest) (any, error) {
+	if request == nil {
+		return nil, errors.New("request is nil")
+	}
+	if relayMode != constant.RelayModeChatCompletions {
+		return nil, &channel.UnsupportedRelayModeError{Path: c.Request.URL.Path, Channel: a.GetChannelName()}
+	}
+	return ConvertRequest(*request)
+}
+
+func (a *Adaptor) DoRequest(c *gin.Context, meta *util.RelayMeta, requestBody io.Reader) (*http.Response, error) {
+	return channel.DoRequestHelper(a, c, meta, requestBody)
+}
+
+func (a *Adaptor) DoResponse(c *gin.Context, resp *http.Response, meta *util.RelayMeta) (usage *model.Usage, err *model.OpenAIErrorWithStatusCode) {
+	if meta.IsStream {
+		var responseText string
+		err, usage, responseText = StreamHandler(c, resp, meta.ActualModelName)
+		meta.ResponseText = responseText
+		if usage == nil {
+			usage = util.ResponseText2Usage(responseText, meta.ActualModelName, meta.PromptTokens)
+		}
+	} else {
+		err, usage = Handler(c, resp, meta.PromptTokens, meta.ActualModelName)
+	}
+	return
+}
+
+func (a *Adaptor) GetChannelName() string {
+	return "google gemini"
+}
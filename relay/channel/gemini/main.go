@@ -0,0 +1,438 @@
+package gemini
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"io"
+	"net/http"
+	"one-api/common"
+	"one-api/common/image"
+	"one-api/relay/model"
+	"one-api/relay/util"
+	"strings"
+)
+
+var safetyCategories = []string{
+	"HARM_CATEGORY_HARASSMENT",
+	"HARM_CATEGORY_HATE_SPEECH",
+	"HARM_CATEGORY_SEXUALLY_EXPLICIT",
+	"HARM_CATEGORY_DANGEROUS_CONTENT",
+}
+
+func finishReasonGemini2OpenAI(reason string) string {
+	switch reason {
+	case "STOP":
+		return "stop"
+	case "MAX_TOKENS":
+		return "length"
+	case "SAFETY", "RECITATION":
+		return "content_filter"
+	default:
+		return strings.ToLower(reason)
+	}
+}
+
+func convertStopSequences(stop any) []string {
+	switch stop := stop.(type) {
+	case string:
+		return []string{stop}
+	case []any:
+		stopSequences := make([]string, 0, len(stop))
+		for _, item := range stop {
+			if str, ok := item.(string); ok {
+				stopSequences = append(stopSequences, str)
+			}
+		}
+		return stopSequences
+	}
+	return nil
+}
+
+func convertToolChoice(toolChoice any) *ToolConfig {
+	var config FunctionCallingConfig
+	switch toolChoice := toolChoice.(type) {
+	case string:
+		switch toolChoice {
+		case "none":
+			config.Mode = "NONE"
+		case "required":
+			config.Mode = "ANY"
+		default:
+			config.Mode = "AUTO"
+		}
+	case map[string]any:
+		function, ok := toolChoice["function"].(map[string]any)
+		if !ok {
+			return nil
+		}
+		name, _ := function["name"].(string)
+		config.Mode = "ANY"
+		config.AllowedFunctionNames = []string{name}
+	default:
+		return nil
+	}
+	return &ToolConfig{FunctionCallingConfig: config}
+}
+
+func convertParts(message model.Message) ([]Part, error) {
+	var parts []Part
+	for _, content := range message.ParseContent() {
+		switch content.Type {
+		case model.ContentTypeText:
+			if content.Text == "" {
+				continue
+			}
+			parts = append(parts, Part{Text: content.Text})
+		case model.ContentTypeImageURL:
+			mimeType, data, err := image.GetImageFromUrl(content.ImageURL.Url)
+			if err != nil {
+				return nil, err
+			}
+			parts = append(parts, Part{
+				InlineData: &InlineData{
+					MimeType: mimeType,
+					Data:     data,
+				},
+			})
+		}
+	}
+	return parts, nil
+}
+
+// functionResponse wraps the result of a tool call, Gemini requires it to be an object
+func functionResponse(name string, content string) *FunctionResponse {
+	var response any
+	if err := json.Unmarshal([]byte(content), &response); err != nil {
+		response = nil
+	}
+	if _, ok := response.(map[string]any); !ok {
+		response = map[string]any{"content": content}
+	}
+	return &FunctionResponse{
+		Name:     name,
+		Response: response,
+	}
+}
+
+func ConvertRequest(textRequest model.GeneralOpenAIRequest) (*ChatRequest, error) {
+	geminiRequest := ChatRequest{
+		GenerationConfig: GenerationConfig{
+			Temperature:     textRequest.Temperature,
+			TopP:            textRequest.TopP,
+			MaxOutputTokens: textRequest.MaxTokens,
+			StopSequences:   convertStopSequences(textRequest.Stop),
+		},
+	}
+	for _, category := range safetyCategories {
+		geminiRequest.SafetySettings = append(geminiRequest.SafetySettings, SafetySetting{
+			Category:  category,
+			Threshold: common.GeminiSafetySetting,
+		})
+	}
+	var functionDeclarations []FunctionDeclaration
+	for _, tool := range textRequest.GetTools() {
+		if tool.Type != "function" {
+			continue
+		}
+		functionDeclarations = append(functionDeclarations, FunctionDeclaration{
+			Name:        tool.Function.Name,
+			Description: tool.Function.Description,
+			Parameters:  tool.Function.Parameters,
+		})
+	}
+	if len(functionDeclarations) > 0 {
+		geminiRequest.Tools = []Tool{{FunctionDeclarations: functionDeclarations}}
+		if textRequest.ToolChoice != nil {
+			geminiRequest.ToolConfig = convertToolChoice(textRequest.ToolChoice)
+		}
+	}
+	// tool results only carry the id of the call, the function name is looked up here
+	toolCallNames := make(map[string]string)
+	var systemParts []Part
+	for _, message := range textRequest.Messages {
+		content := Content{
+			Role: "user",
+		}
+		switch message.Role {
+		case "system":
+			parts, err := convertParts(message)
+			if err != nil {
+				return nil, err
+			}
+			systemParts = append(systemParts, parts...)
+			continue
+		case "tool", "function":
+			name := toolCallNames[message.ToolCallId]
+			if name == "" && message.Name != nil {
+				name = *message.Name
+			}
+			content.Role = "function"
+			content.Parts = []Part{{FunctionResponse: functionResponse(name, message.StringContent())}}
+		default:
+			if message.Role == "assistant" {
+				content.Role = "model"
+			}
+			parts, err := convertParts(message)
+			if err != nil {
+				return nil, err
+			}
+			content.Parts = parts
+			for _, toolCall := range message.ToolCalls {
+				var args any = map[string]any{}
+				if arguments, ok := toolCall.Function.Arguments.(string); ok && arguments != "" {
+					if err := json.Unmarshal([]byte(arguments), &args); err != nil {
+						return nil, fmt.Errorf("invalid arguments of tool call %s: %s", toolCall.Id, err.Error())
+					}
+				}
+				toolCallNames[toolCall.Id] = toolCall.Function.Name
+				content.Parts = append(content.Parts, Part{
+					FunctionCall: &FunctionCall{
+						Name: toolCall.Function.Name,
+						Args: args,
+					},
+				})
+			}
+		}
+		if len(content.Parts) == 0 {
+			continue
+		}
+		// merge consecutive messages of the same role, parallel tool results must share one content
+		if n := len(geminiRequest.Contents); n > 0 && geminiRequest.Contents[n-1].Role == content.Role {
+			geminiRequest.Contents[n-1].Parts = append(geminiRequest.Contents[n-1].Parts, content.Parts...)
+			continue
+		}
+		geminiRequest.Contents = append(geminiRequest.Contents, content)
+	}
+	if len(systemParts) > 0 {
+		geminiRequest.SystemInstruction = &Content{Parts: systemParts}
+	}
+	return &geminiRequest, nil
+}
+
+// convertCandidate returns the text and the tool calls of a candidate
+func convertCandidate(candidate *Candidate) (string, []model.Tool) {
+	var text string
+	var toolCalls []model.Tool
+	for _, part := range candidate.Content.Parts {
+		if part.FunctionCall != nil {
+			arguments := "{}"
+			if part.FunctionCall.Args != nil {
+				if jsonArgs, err := json.Marshal(part.FunctionCall.Args); err == nil {
+					arguments = string(jsonArgs)
+				}
+			}
+			toolCalls = append(toolCalls, model.Tool{
+				Id:   "call_" + common.GetUUID(),
+				Type: "function",
+				Function: model.Function{
+					Name:      part.FunctionCall.Name,
+					Arguments: arguments,
+				},
+			})
+			continue
+		}
+		text += part.Text
+	}
+	return text, toolCalls
+}
+
+func finishReasonOfCandidate(candidate *Candidate, toolCalls []model.Tool) string {
+	if len(toolCalls) > 0 {
+		return "tool_calls"
+	}
+	return finishReasonGemini2OpenAI(candidate.FinishReason)
+}
+
+func responseGemini2OpenAI(response *ChatResponse) *model.OpenAITextResponse {
+	fullTextResponse := model.OpenAITextResponse{
+		Id:      fmt.Sprintf("chatcmpl-%s", common.GetUUID()),
+		Object:  "chat.completion",
+		Created: common.GetTimestamp(),
+		Choices: make([]model.OpenAITextResponseChoice, 0, len(response.Candidates)),
+	}
+	for i := range response.Candidates {
+		candidate := &response.Candidates[i]
+		text, toolCalls := convertCandidate(candidate)
+		fullTextResponse.Choices = append(fullTextResponse.Choices, model.OpenAITextResponseChoice{
+			Index: candidate.Index,
+			Message: model.Message{
+				Role:      "assistant",
+				Content:   text,
+				ToolCalls: toolCalls,
+			},
+			FinishReason: finishReasonOfCandidate(candidate, toolCalls),
+		})
+	}
+	return &fullTextResponse
+}
+
+func streamResponseGemini2OpenAI(response *ChatResponse) *model.ChatCompletionsStreamResponse {
+	var streamResponse model.ChatCompletionsStreamResponse
+	streamResponse.Object = "chat.completion.chunk"
+	for i := range response.Candidates {
+		candidate := &response.Candidates[i]
+		text, toolCalls := convertCandidate(candidate)
+		for j := range toolCalls {
+			index := j
+			toolCalls[j].Index = &index
+		}
+		choice := model.ChatCompletionsStreamResponseChoice{
+			Index: candidate.Index,
+		}
+		choice.Delta.Content = text
+		choice.Delta.ToolCalls = toolCalls
+		if candidate.FinishReason != "" {
+			finishReason := finishReasonOfCandidate(candidate, toolCalls)
+			choice.FinishReason = &finishReason
+		}
+		streamResponse.Choices = append(streamResponse.Choices, choice)
+	}
+	return &streamResponse
+}
+
+func StreamHandler(c *gin.Context, resp *http.Response, modelName string) (*model.OpenAIErrorWithStatusCode, *model.Usage, string) {
+	responseText := ""
+	responseId := fmt.Sprintf("chatcmpl-%s", common.GetUUID())
+	createdTime := common.GetTimestamp()
+	var usage *model.Usage
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Split(bufio.ScanLines)
+	ctx, cancel := context.WithCancel(c.Request.Context())
+	defer cancel()
+	dataChan := make(chan string)
+	stopChan := make(chan bool)
+	go func() {
+		defer close(stopChan)
+		for scanner.Scan() {
+			data := scanner.Text()
+			if !strings.HasPrefix(data, "data: ") {
+				continue
+			}
+			select {
+			case dataChan <- strings.TrimPrefix(data, "data: "):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	util.SetEventStreamHeaders(c)
+	heartbeat := util.NewHeartbeat()
+	defer heartbeat.Stop()
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case data := <-dataChan:
+			heartbeat.Reset()
+			data = strings.TrimSuffix(data, "\r")
+			var geminiResponse ChatResponse
+			err := json.Unmarshal([]byte(data), &geminiResponse)
+			if err != nil {
+				common.SysError("error unmarshalling stream response: " + err.Error())
+				return true
+			}
+			if geminiResponse.Error != nil {
+				common.LogError(c.Request.Context(), fmt.Sprintf("gemini stream error: status %s, message %s", geminiResponse.Error.Status, geminiResponse.Error.Message))
+				return true
+			}
+			if geminiResponse.UsageMetadata != nil {
+				// every chunk reports the usage so far, the last one holds the total
+				usage = &model.Usage{
+					PromptTokens:     geminiResponse.UsageMetadata.PromptTokenCount,
+					CompletionTokens: geminiResponse.UsageMetadata.CandidatesTokenCount,
+				}
+			}
+			if len(geminiResponse.Candidates) == 0 {
+				return true
+			}
+			response := streamResponseGemini2OpenAI(&geminiResponse)
+			responseText += response.Choices[0].Delta.Content
+			response.Id = responseId
+			response.Created = createdTime
+			response.Model = modelName
+			jsonStr, err := json.Marshal(response)
+			if err != nil {
+				common.SysError("error marshalling stream response: " + err.Error())
+				return true
+			}
+			c.Render(-1, common.CustomEvent{Data: "data: " + string(jsonStr)})
+			return true
+		case <-stopChan:
+			c.Render(-1, common.CustomEvent{Data: "data: [DONE]"})
+			return false
+		case <-heartbeat.C():
+			heartbeat.Write(c)
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	})
+	err := util.CloseStream(cancel, resp.Body, stopChan)
+	if err != nil {
+		return util.ErrorWrapper(err, "close_response_body_failed", http.StatusInternalServerError), nil, ""
+	}
+	if usage != nil {
+		usage.TotalTokens = usage.PromptTokens + usage.CompletionTokens
+	}
+	return nil, usage, responseText
+}
+
+func Handler(c *gin.Context, resp *http.Response, promptTokens int, modelName string) (*model.OpenAIErrorWithStatusCode, *model.Usage) {
+	responseBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return util.ErrorWrapper(err, "read_response_body_failed", http.StatusInternalServerError), nil
+	}
+	err = resp.Body.Close()
+	if err != nil {
+		return util.ErrorWrapper(err, "close_response_body_failed", http.StatusInternalServerError), nil
+	}
+	var geminiResponse ChatResponse
+	err = json.Unmarshal(responseBody, &geminiResponse)
+	if err != nil {
+		return util.ErrorWrapper(err, "unmarshal_response_body_failed", http.StatusInternalServerError), nil
+	}
+	if geminiResponse.Error != nil {
+		return &model.OpenAIErrorWithStatusCode{
+			OpenAIError: model.OpenAIError{
+				Message: geminiResponse.Error.Message,
+				Type:    geminiResponse.Error.Status,
+				Param:   "",
+				Code:    geminiResponse.Error.Code,
+			},
+			StatusCode: resp.StatusCode,
+		}, nil
+	}
+	if len(geminiResponse.Candidates) == 0 {
+		return &model.OpenAIErrorWithStatusCode{
+			OpenAIError: model.OpenAIError{
+				Message: "No candidates returned",
+				Type:    "server_error",
+				Param:   "",
+				Code:    500,
+			},
+			StatusCode: resp.StatusCode,
+		}, nil
+	}
+	fullTextResponse := responseGemini2OpenAI(&geminiResponse)
+	fullTextResponse.Model = modelName
+	var usage model.Usage
+	if geminiResponse.UsageMetadata != nil {
+		usage.PromptTokens = geminiResponse.UsageMetadata.PromptTokenCount
+		usage.CompletionTokens = geminiResponse.UsageMetadata.CandidatesTokenCount
+	}
+	if usage.PromptTokens == 0 && usage.CompletionTokens == 0 {
+		usage.PromptTokens = promptTokens
+		usage.CompletionTokens = util.CountTokenText(fullTextResponse.Choices[0].StringContent(), modelName)
+	}
+	usage.TotalTokens = usage.PromptTokens + usage.CompletionTokens
+	fullTextResponse.Usage = usage
+	jsonResponse, err := json.Marshal(fullTextResponse)
+	if err != nil {
+		return util.ErrorWrapper(err, "marshal_response_body_failed", http.StatusInternalServerError), nil
+	}
+	c.Writer.Header().Set("Content-Type", "application/json")
+	c.Writer.WriteHeader(resp.StatusCode)
+	_, err = c.Writer.Write(jsonResponse)
+	return nil, &usage
+}
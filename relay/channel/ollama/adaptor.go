@@ -0,0 +1,99 @@
+package ollama
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"io"
+	"net/http"
+	"one-api/common"
+	"one-api/relay/channel"
+	"one-api/relay/constant"
+	"one-api/relay/model"
+	"one-api/relay/util"
+)
+
+func init() {
+	channel.Register(common.ChannelTypeOllama, func() channel.Adaptor {
+		return &Adaptor{}
+	})
+}
+
+type Adaptor struct {
+	// Ollama does not report the usage of embeddings, so the prompt is counted
+	promptTokens int
+}
+
+func (a *Adaptor) Init(meta *util.RelayMeta) {
+
+}
+
+func (a *Adaptor) GetRequestURL(meta *util.RelayMeta) (string, error) {
+	switch meta.Mode {
+	case constant.RelayModeEmbeddings:
+		return fmt.Sprintf("%s/api/embeddings", meta.BaseURL), nil
+	case constant.RelayModeChatCompletions:
+		return fmt.Sprintf("%s/api/chat", meta.BaseURL), nil
+	}
+	return "", fmt.Errorf("relay mode %d is not supported by ollama channels", meta.Mode)
+}
+
+func (a *Adaptor) SetupRequestHeader(c *gin.Context, req *http.Request, meta *util.RelayMeta) error {
+	channel.SetupCommonRequestHeader(c, req, meta)
+	// Ollama itself has no authentication, the key is for the proxies in front of it
+	if meta.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+meta.APIKey)
+	}
+	return nil
+}
+
+func (a *Adaptor) ConvertRequest(c *gin.Context, relayMode int, request *model.GeneralOpenAIRequest) (any, error) {
+	if request == nil {
+		return nil, errors.New("request is nil")
+	}
+	switch relayMode {
+	case constant.RelayModeEmbeddings:
+		input := request.ParseInput()
+		if len(input) != 1 {
+			return nil, &channel.UnsupportedParameterError{Param: "input with multiple items", Channel: a.GetChannelName()}
+		}
+		a.promptTokens = util.CountTokenInput(input[0], request.Model)
+		return &EmbeddingRequest{
+			Model:  request.Model,
+			Prompt: input[0],
+		}, nil
+	case constant.RelayModeChatCompletions:
+		if err := channel.CheckToolsUnsupported(request, a.GetChannelName()); err != nil {
+			return nil, err
+		}
+		return ConvertRequest(*request)
+	}
+	return nil, &channel.UnsupportedRelayModeError{Path: c.Request.URL.Path, Channel: a.GetChannelName()}
+}
+
+func (a *Adaptor) DoRequest(c *gin.Context, meta *util.RelayMeta, requestBody io.Reader) (*http.Response, error) {
+	return channel.DoRequestHelper(a, c, meta, requestBody)
+}
+
+func (a *Adaptor) DoResponse(c *gin.Context, resp *http.Response, meta *util.RelayMeta) (usage *model.Usage, err *model.OpenAIErrorWithStatusCode) {
+	if meta.IsStream {
+		var responseText string
+		err, usage, responseText = StreamHandler(c, resp)
+		meta.ResponseText = responseText
+		if usage == nil {
+			usage = util.ResponseText2Usage(responseText, meta.ActualModelName, meta.PromptTokens)
+		}
+		return
+	}
+	switch meta.Mode {
+	case constant.RelayModeEmbeddings:
+		err, usage = EmbeddingHandler(c, resp, a.promptTokens, meta.ActualModelName)
+	default:
+		err, usage = Handler(c, resp, meta.PromptTokens, meta.ActualModelName)
+	}
+	return
+}
+
+func (a *Adaptor) GetChannelName() string {
+	return "ollama"
+}
@@ -0,0 +1,304 @@
+package ollama
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"io"
+	"net/http"
+	"one-api/common"
+	"one-api/common/image"
+	"one-api/relay/model"
+	"one-api/relay/util"
+	"strings"
+)
+
+func convertStop(stop any) []string {
+	switch stop := stop.(type) {
+	case string:
+		return []string{stop}
+	case []any:
+		stopSequences := make([]string, 0, len(stop))
+		for _, item := range stop {
+			if str, ok := item.(string); ok {
+				stopSequences = append(stopSequences, str)
+			}
+		}
+		return stopSequences
+	}
+	return nil
+}
+
+func ConvertRequest(request model.GeneralOpenAIRequest) (*ChatRequest, error) {
+	ollamaRequest := ChatRequest{
+		Model:  request.Model,
+		Stream: request.Stream,
+		Options: &Options{
+			Seed:        int(request.Seed),
+			Temperature: request.Temperature,
+			TopP:        request.TopP,
+			NumPredict:  request.MaxTokens,
+			Stop:        convertStop(request.Stop),
+		},
+	}
+	for _, message := range request.Messages {
+		ollamaMessage := Message{
+			Role: message.Role,
+		}
+		var text string
+		for _, part := range message.ParseContent() {
+			switch part.Type {
+			case model.ContentTypeText:
+				text += part.Text
+			case model.ContentTypeImageURL:
+				_, data, err := image.GetImageFromUrl(part.ImageURL.Url)
+				if err != nil {
+					return nil, err
+				}
+				ollamaMessage.Images = append(ollamaMessage.Images, data)
+			}
+		}
+		ollamaMessage.Content = text
+		ollamaRequest.Messages = append(ollamaRequest.Messages, ollamaMessage)
+	}
+	return &ollamaRequest, nil
+}
+
+func finishReason(response *ChatResponse) string {
+	if response.DoneReason != "" {
+		return response.DoneReason
+	}
+	return "stop"
+}
+
+func responseOllama2OpenAI(response *ChatResponse) *model.OpenAITextResponse {
+	choice := model.OpenAITextResponseChoice{
+		Index: 0,
+		Message: model.Message{
+			Role:    "assistant",
+			Content: response.Message.Content,
+		},
+		FinishReason: finishReason(response),
+	}
+	fullTextResponse := model.OpenAITextResponse{
+		Id:      fmt.Sprintf("chatcmpl-%s", common.GetUUID()),
+		Model:   response.Model,
+		Object:  "chat.completion",
+		Created: common.GetTimestamp(),
+		Choices: []model.OpenAITextResponseChoice{choice},
+	}
+	return &fullTextResponse
+}
+
+func streamResponseOllama2OpenAI(response *ChatResponse) *model.ChatCompletionsStreamResponse {
+	var choice model.ChatCompletionsStreamResponseChoice
+	choice.Delta.Role = response.Message.Role
+	choice.Delta.Content = response.Message.Content
+	if response.Done {
+		reason := finishReason(response)
+		choice.FinishReason = &reason
+	}
+	return &model.ChatCompletionsStreamResponse{
+		Object:  "chat.completion.chunk",
+		Model:   response.Model,
+		Choices: []model.ChatCompletionsStreamResponseChoice{choice},
+	}
+}
+
+// StreamHandler relays Ollama's NDJSON stream as server-sent events
+func StreamHandler(c *gin.Context, resp *http.Response) (*model.OpenAIErrorWithStatusCode, *model.Usage, string) {
+	responseText := ""
+	responseId := fmt.Sprintf("chatcmpl-%s", common.GetUUID())
+	createdTime := common.GetTimestamp()
+	var usage *model.Usage
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Split(bufio.ScanLines)
+	ctx, cancel := context.WithCancel(c.Request.Context())
+	defer cancel()
+	dataChan := make(chan string)
+	stopChan := make(chan bool)
+	go func() {
+		defer close(stopChan)
+		for scanner.Scan() {
+			data := strings.TrimSpace(scanner.Text())
+			if data == "" {
+				continue
+			}
+			select {
+			case dataChan <- data:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	util.SetEventStreamHeaders(c)
+	heartbeat := util.NewHeartbeat()
+	defer heartbeat.Stop()
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case data := <-dataChan:
+			heartbeat.Reset()
+			var ollamaResponse ChatResponse
+			err := json.Unmarshal([]byte(data), &ollamaResponse)
+			if err != nil {
+				common.SysError("error unmarshalling stream response: " + err.Error())
+				return true
+			}
+			if ollamaResponse.Error != "" {
+				common.LogError(c.Request.Context(), "ollama stream error: "+ollamaResponse.Error)
+				return true
+			}
+			if ollamaResponse.Done {
+				usage = &model.Usage{
+					PromptTokens:     ollamaResponse.PromptEvalCount,
+					CompletionTokens: ollamaResponse.EvalCount,
+					TotalTokens:      ollamaResponse.PromptEvalCount + ollamaResponse.EvalCount,
+				}
+			}
+			responseText += ollamaResponse.Message.Content
+			response := streamResponseOllama2OpenAI(&ollamaResponse)
+			response.Id = responseId
+			response.Created = createdTime
+			jsonStr, err := json.Marshal(response)
+			if err != nil {
+				common.SysError("error marshalling stream response: " + err.Error())
+				return true
+			}
+			c.Render(-1, common.CustomEvent{Data: "data: " + string(jsonStr)})
+			return true
+		case <-stopChan:
+			c.Render(-1, common.CustomEvent{Data: "data: [DONE]"})
+			return false
+		case <-heartbeat.C():
+			heartbeat.Write(c)
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	})
+	err := util.CloseStream(cancel, resp.Body, stopChan)
+	if err != nil {
+		return util.ErrorWrapper(err, "close_response_body_failed", http.StatusInternalServerError), nil, ""
+	}
+	return nil, usage, responseText
+}
+
+func Handler(c *gin.Context, resp *http.Response, promptTokens int, modelName string) (*model.OpenAIErrorWithStatusCode, *model.Usage) {
+	var ollamaResponse ChatResponse
+	err := json.NewDecoder(resp.Body).Decode(&ollamaResponse)
+	if err != nil {
+		return util.ErrorWrapper(err, "unmarshal_response_body_failed", http.StatusInternalServerError), nil
+	}
+	err = resp.Body.Close()
+	if err != nil {
+		return util.ErrorWrapper(err, "close_response_body_failed", http.StatusInternalServerError), nil
+	}
+	if ollamaResponse.Error != "" {
+		return &model.OpenAIErrorWithStatusCode{
+			OpenAIError: model.OpenAIError{
+				Message: ollamaResponse.Error,
+				Type:    "ollama_error",
+				Param:   "",
+				Code:    "ollama_error",
+			},
+			StatusCode: resp.StatusCode,
+		}, nil
+	}
+	fullTextResponse := responseOllama2OpenAI(&ollamaResponse)
+	usage := model.Usage{
+		PromptTokens:     ollamaResponse.PromptEvalCount,
+		CompletionTokens: ollamaResponse.EvalCount,
+	}
+	if usage.PromptTokens == 0 && usage.CompletionTokens == 0 {
+		// llama.cpp and older Ollama servers may omit the counts
+		usage.PromptTokens = promptTokens
+		usage.CompletionTokens = util.CountTokenText(ollamaResponse.Message.Content, modelName)
+	}
+	usage.TotalTokens = usage.PromptTokens + usage.CompletionTokens
+	fullTextResponse.Usage = usage
+	jsonResponse, err := json.Marshal(fullTextResponse)
+	if err != nil {
+		return util.ErrorWrapper(err, "marshal_response_body_failed", http.StatusInternalServerError), nil
+	}
+	c.Writer.Header().Set("Content-Type", "application/json")
+	c.Writer.WriteHeader(resp.StatusCode)
+	_, err = c.Writer.Write(jsonResponse)
+	return nil, &usage
+}
+
+func EmbeddingHandler(c *gin.Context, resp *http.Response, promptTokens int, modelName string) (*model.OpenAIErrorWithStatusCode, *model.Usage) {
+	var ollamaResponse EmbeddingResponse
+	err := json.NewDecoder(resp.Body).Decode(&ollamaResponse)
+	if err != nil {
+		return util.ErrorWrapper(err, "unmarshal_response_body_failed", http.StatusInternalServerError), nil
+	}
+	err = resp.Body.Close()
+	if err != nil {
+		return util.ErrorWrapper(err, "close_response_body_failed", http.StatusInternalServerError), nil
+	}
+	if ollamaResponse.Error != "" {
+		return &model.OpenAIErrorWithStatusCode{
+			OpenAIError: model.OpenAIError{
+				Message: ollamaResponse.Error,
+				Type:    "ollama_error",
+				Param:   "",
+				Code:    "ollama_error",
+			},
+			StatusCode: resp.StatusCode,
+		}, nil
+	}
+	// the embeddings API reports no usage, the prompt is billed as counted locally
+	usage := model.Usage{
+		PromptTokens: promptTokens,
+		TotalTokens:  promptTokens,
+	}
+	fullTextResponse := model.OpenAIEmbeddingResponse{
+		Object: "list",
+		Data: []model.OpenAIEmbeddingResponseItem{{
+			Object:    "embedding",
+			Index:     0,
+			Embedding: ollamaResponse.Embedding,
+		}},
+		Model: modelName,
+		Usage: usage,
+	}
+	jsonResponse, err := json.Marshal(fullTextResponse)
+	if err != nil {
+		return util.ErrorWrapper(err, "marshal_response_body_failed", http.StatusInternalServerError), nil
+	}
+	c.Writer.Header().Set("Content-Type", "application/json")
+	c.Writer.WriteHeader(resp.StatusCode)
+	_, err = c.Writer.Write(jsonResponse)
+	return nil, &usage
+}
+
+// ListModels returns the names of the models pulled on the server
+func ListModels(client *http.Client, baseURL string, key string) ([]string, error) {
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s/api/tags", baseURL), nil)
+	if err != nil {
+		return nil, err
+	}
+	if key != "" {
+		req.Header.Set("Authorization", "Bearer "+key)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("bad response status code %d", resp.StatusCode)
+	}
+	var tagsResponse TagsResponse
+	err = json.NewDecoder(resp.Body).Decode(&tagsResponse)
+	if err != nil {
+		return nil, err
+	}
+	models := make([]string, 0, len(tagsResponse.Models))
+	for _, tagModel := range tagsResponse.Models {
+		models = append(models, tagModel.Name)
+	}
+	return models, nil
+}
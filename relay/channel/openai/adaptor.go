@@ -0,0 +1,77 @@
+package openai
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"io"
+	"net/http"
+	"one-api/common"
+	"one-api/relay/channel"
+	"one-api/relay/model"
+	"one-api/relay/util"
+	"strings"
+)
+
+func init() {
+	channel.RegisterDefault(func() channel.Adaptor {
+		return &Adaptor{}
+	})
+}
+
+type Adaptor struct {
+	ChannelType int
+}
+
+func (a *Adaptor) Init(meta *util.RelayMeta) {
+	a.ChannelType = meta.ChannelType
+}
+
+func (a *Adaptor) GetRequestURL(meta *util.RelayMeta) (string, error) {
+	if meta.ChannelType == common.ChannelTypeAzure {
+		// https://learn.microsoft.com/en-us/azure/cognitive-services/openai/chatgpt-quickstart?pivots=rest-api&tabs=command-line#rest-api
+		requestURL := strings.Split(meta.RequestURLPath, "?")[0]
+		requestURL = fmt.Sprintf("%s?api-version=%s", requestURL, meta.APIVersion)
+		task := strings.TrimPrefix(requestURL, "/v1/")
+		deployment := meta.Config.Azure.GetDeployment(meta.ActualModelName)
+		requestURL = fmt.Sprintf("/openai/deployments/%s/%s", deployment, task)
+		return util.GetFullRequestURL(meta.BaseURL, requestURL, meta.ChannelType), nil
+	}
+	return util.GetFullRequestURL(meta.BaseURL, meta.RequestURLPath, meta.ChannelType), nil
+}
+
+func (a *Adaptor) SetupRequestHeader(c *gin.Context, req *http.Request, meta *util.RelayMeta) error {
+	channel.SetupCommonRequestHeader(c, req, meta)
+	if meta.ChannelType == common.ChannelTypeAzure {
+		return util.SetupAzureAuthorization(c.Request.Context(), req, meta.ChannelId, meta.Config, meta.APIKey)
+	}
+	req.Header.Set("Authorization", "Bearer "+meta.APIKey)
+	return nil
+}
+
+func (a *Adaptor) ConvertRequest(c *gin.Context, relayMode int, request *model.GeneralOpenAIRequest) (any, error) {
+	if request == nil {
+		return nil, errors.New("request is nil")
+	}
+	return request, nil
+}
+
+func (a *Adaptor) DoRequest(c *gin.Context, meta *util.RelayMeta, requestBody io.Reader) (*http.Response, error) {
+	return channel.DoRequestHelper(a, c, meta, requestBody)
+}
+
+func (a *Adaptor) DoResponse(c *gin.Context, resp *http.Response, meta *util.RelayMeta) (usage *model.Usage, err *model.OpenAIErrorWithStatusCode) {
+	if meta.IsStream {
+		var responseText string
+		err, responseText = StreamHandler(c, resp, meta.Mode)
+		meta.ResponseText = responseText
+		usage = util.ResponseText2Usage(responseText, meta.ActualModelName, meta.PromptTokens)
+	} else {
+		err, usage = Handler(c, resp, meta.PromptTokens, meta.ActualModelName)
+	}
+	return
+}
+
+func (a *Adaptor) GetChannelName() string {
+	return "openai"
+}
@@ -1,17 +1,21 @@
-package controller
+package openai
 
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
 	"github.com/gin-gonic/gin"
 	"io"
 	"net/http"
 	"one-api/common"
+	"one-api/relay/constant"
+	"one-api/relay/model"
+	"one-api/relay/util"
 	"strings"
 )
 
-func openaiStreamHandler(c *gin.Context, resp *http.Response, relayMode int) (*OpenAIErrorWithStatusCode, string) {
+func StreamHandler(c *gin.Context, resp *http.Response, relayMode int) (*model.OpenAIErrorWithStatusCode, string) {
 	responseText := ""
 	scanner := bufio.NewScanner(resp.Body)
 	scanner.Split(func(data []byte, atEOF bool) (advance int, token []byte, err error) {
@@ -26,9 +30,12 @@ func openaiStreamHandler(c *gin.Context, resp *http.Response, relayMode int) (*O
 		}
 		return 0, nil, nil
 	})
+	ctx, cancel := context.WithCancel(c.Request.Context())
+	defer cancel()
 	dataChan := make(chan string)
 	stopChan := make(chan bool)
 	go func() {
+		defer close(stopChan)
 		for scanner.Scan() {
 			data := scanner.Text()
 			if len(data) < 6 { // ignore blank line or wrong format
@@ -37,12 +44,16 @@ func openaiStreamHandler(c *gin.Context, resp *http.Response, relayMode int) (*O
 			if data[:6] != "data: " && data[:6] != "[DONE]" {
 				continue
 			}
-			dataChan <- data
+			select {
+			case dataChan <- data:
+			case <-ctx.Done():
+				return
+			}
 			data = data[6:]
 			if !strings.HasPrefix(data, "[DONE]") {
 				switch relayMode {
-				case RelayModeChatCompletions:
-					var streamResponse ChatCompletionsStreamResponse
+				case constant.RelayModeChatCompletions:
+					var streamResponse model.ChatCompletionsStreamResponse
 					err := json.Unmarshal([]byte(data), &streamResponse)
 					if err != nil {
 						common.SysError("error unmarshalling stream response: " + err.Error())
@@ -51,8 +62,8 @@ func openaiStreamHandler(c *gin.Context, resp *http.Response, relayMode int) (*O
 					for _, choice := range streamResponse.Choices {
 						responseText += choice.Delta.Content
 					}
-				case RelayModeCompletions:
-					var streamResponse CompletionsStreamResponse
+				case constant.RelayModeCompletions:
+					var streamResponse model.CompletionsStreamResponse
 					err := json.Unmarshal([]byte(data), &streamResponse)
 					if err != nil {
 						common.SysError("error unmarshalling stream response: " + err.Error())
@@ -64,12 +75,14 @@ func openaiStreamHandler(c *gin.Context, resp *http.Response, relayMode int) (*O
 				}
 			}
 		}
-		stopChan <- true
 	}()
-	setEventStreamHeaders(c)
+	util.SetEventStreamHeaders(c)
+	heartbeat := util.NewHeartbeat()
+	defer heartbeat.Stop()
 	c.Stream(func(w io.Writer) bool {
 		select {
 		case data := <-dataChan:
+			heartbeat.Reset()
 			if strings.HasPrefix(data, "data: [DONE]") {
 				data = data[:12]
 			}
@@ -79,31 +92,36 @@ func openaiStreamHandler(c *gin.Context, resp *http.Response, relayMode int) (*O
 			return true
 		case <-stopChan:
 			return false
+		case <-heartbeat.C():
+			heartbeat.Write(c)
+			return true
+		case <-ctx.Done():
+			return false
 		}
 	})
-	err := resp.Body.Close()
+	err := util.CloseStream(cancel, resp.Body, stopChan)
 	if err != nil {
-		return errorWrapper(err, "close_response_body_failed", http.StatusInternalServerError), ""
+		return util.ErrorWrapper(err, "close_response_body_failed", http.StatusInternalServerError), ""
 	}
 	return nil, responseText
 }
 
-func openaiHandler(c *gin.Context, resp *http.Response, promptTokens int, model string) (*OpenAIErrorWithStatusCode, *Usage) {
-	var textResponse TextResponse
+func Handler(c *gin.Context, resp *http.Response, promptTokens int, modelName string) (*model.OpenAIErrorWithStatusCode, *model.Usage) {
+	var textResponse model.TextResponse
 	responseBody, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return errorWrapper(err, "read_response_body_failed", http.StatusInternalServerError), nil
+		return util.ErrorWrapper(err, "read_response_body_failed", http.StatusInternalServerError), nil
 	}
 	err = resp.Body.Close()
 	if err != nil {
-		return errorWrapper(err, "close_response_body_failed", http.StatusInternalServerError), nil
+		return util.ErrorWrapper(err, "close_response_body_failed", http.StatusInternalServerError), nil
 	}
 	err = json.Unmarshal(responseBody, &textResponse)
 	if err != nil {
-		return errorWrapper(err, "unmarshal_response_body_failed", http.StatusInternalServerError), nil
+		return util.ErrorWrapper(err, "unmarshal_response_body_failed", http.StatusInternalServerError), nil
 	}
 	if textResponse.Error.Type != "" {
-		return &OpenAIErrorWithStatusCode{
+		return &model.OpenAIErrorWithStatusCode{
 			OpenAIError: textResponse.Error,
 			StatusCode:  resp.StatusCode,
 		}, nil
@@ -121,19 +139,19 @@ func openaiHandler(c *gin.Context, resp *http.Response, promptTokens int, model
 	c.Writer.WriteHeader(resp.StatusCode)
 	_, err = io.Copy(c.Writer, resp.Body)
 	if err != nil {
-		return errorWrapper(err, "copy_response_body_failed", http.StatusInternalServerError), nil
+		return util.ErrorWrapper(err, "copy_response_body_failed", http.StatusInternalServerError), nil
 	}
 	err = resp.Body.Close()
 	if err != nil {
-		return errorWrapper(err, "close_response_body_failed", http.StatusInternalServerError), nil
+		return util.ErrorWrapper(err, "close_response_body_failed", http.StatusInternalServerError), nil
 	}
 
 	if textResponse.Usage.TotalTokens == 0 {
 		completionTokens := 0
 		for _, choice := range textResponse.Choices {
-			completionTokens += countTokenText(choice.Message.StringContent(), model)
+			completionTokens += util.CountTokenText(choice.Message.StringContent(), modelName)
 		}
-		textResponse.Usage = Usage{
+		textResponse.Usage = model.Usage{
 			PromptTokens:     promptTokens,
 			CompletionTokens: completionTokens,
 			TotalTokens:      promptTokens + completionTokens,
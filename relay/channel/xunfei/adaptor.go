@@ -0,0 +1,89 @@
+package xunfei
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"io"
+	"net/http"
+	"one-api/common"
+	"one-api/relay/channel"
+	"one-api/relay/model"
+	"one-api/relay/util"
+	"strings"
+)
+
+func init() {
+	channel.Register(common.ChannelTypeXunfei, func() channel.Adaptor {
+		return &Adaptor{}
+	})
+}
+
+type Adaptor struct {
+	request *model.GeneralOpenAIRequest
+}
+
+func (a *Adaptor) Init(meta *util.RelayMeta) {
+
+}
+
+func (a *Adaptor) GetRequestURL(meta *util.RelayMeta) (string, error) {
+	return "", nil
+}
+
+func (a *Adaptor) SetupRequestHeader(c *gin.Context, req *http.Request, meta *util.RelayMeta) error {
+	channel.SetupCommonRequestHeader(c, req, meta)
+	// check DoResponse for auth part
+	return nil
+}
+
+func (a *Adaptor) ConvertRequest(c *gin.Context, relayMode int, request *model.GeneralOpenAIRequest) (any, error) {
+	if request == nil {
+		return nil, errors.New("request is nil")
+	}
+	if !supportsFunctionCall(getAPIVersion(c)) {
+		if err := channel.CheckToolsUnsupported(request, a.GetChannelName()); err != nil {
+			return nil, err
+		}
+	}
+	if err := channel.CheckMultipleToolCallsUnsupported(request, a.GetChannelName()); err != nil {
+		return nil, err
+	}
+	// Spark decides on its own whether to call a function
+	if request.ToolChoice == "required" {
+		return nil, &channel.UnsupportedParameterError{Param: "tool_choice required", Channel: a.GetChannelName()}
+	}
+	if _, ok := request.ToolChoice.(map[string]any); ok {
+		return nil, &channel.UnsupportedParameterError{Param: "tool_choice function", Channel: a.GetChannelName()}
+	}
+	a.request = request
+	return nil, nil
+}
+
+func (a *Adaptor) DoRequest(c *gin.Context, meta *util.RelayMeta, requestBody io.Reader) (*http.Response, error) {
+	// xunfei's request is not http request, so we don't need to do anything here
+	dummyResp := &http.Response{}
+	dummyResp.StatusCode = http.StatusOK
+	return dummyResp, nil
+}
+
+func (a *Adaptor) DoResponse(c *gin.Context, resp *http.Response, meta *util.RelayMeta) (usage *model.Usage, err *model.OpenAIErrorWithStatusCode) {
+	splits := strings.Split(meta.APIKey, "|")
+	if len(splits) != 3 {
+		return nil, util.ErrorWrapper(errors.New("invalid auth"), "invalid_auth", http.StatusBadRequest)
+	}
+	if a.request == nil {
+		return nil, util.ErrorWrapper(errors.New("request is nil"), "request_is_nil", http.StatusBadRequest)
+	}
+	if meta.IsStream {
+		var responseText string
+		err, usage, responseText = StreamHandler(c, *a.request, splits[0], splits[1], splits[2])
+		meta.ResponseText = responseText
+	} else {
+		err, usage = Handler(c, *a.request, splits[0], splits[1], splits[2])
+	}
+	return
+}
+
+func (a *Adaptor) GetChannelName() string {
+	return "xunfei"
+}
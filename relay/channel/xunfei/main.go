@@ -1,6 +1,7 @@
-package controller
+package xunfei
 
 import (
+	"context"
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/base64"
@@ -12,6 +13,9 @@ import (
 	"net/http"
 	"net/url"
 	"one-api/common"
+	"one-api/relay/constant"
+	"one-api/relay/model"
+	"one-api/relay/util"
 	"strings"
 	"time"
 )
@@ -24,6 +28,17 @@ type XunfeiMessage struct {
 	Content string `json:"content"`
 }
 
+type XunfeiFunctionCall struct {
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"`
+}
+
+type XunfeiFunction struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Parameters  any    `json:"parameters"`
+}
+
 type XunfeiChatRequest struct {
 	Header struct {
 		AppId string `json:"app_id"`
@@ -41,13 +56,17 @@ type XunfeiChatRequest struct {
 		Message struct {
 			Text []XunfeiMessage `json:"text"`
 		} `json:"message"`
+		Functions *struct {
+			Text []XunfeiFunction `json:"text"`
+		} `json:"functions,omitempty"`
 	} `json:"payload"`
 }
 
 type XunfeiChatResponseTextItem struct {
-	Content string `json:"content"`
-	Role    string `json:"role"`
-	Index   int    `json:"index"`
+	Content      string              `json:"content"`
+	Role         string              `json:"role"`
+	Index        int                 `json:"index"`
+	FunctionCall *XunfeiFunctionCall `json:"function_call,omitempty"`
 }
 
 type XunfeiChatResponse struct {
@@ -70,12 +89,12 @@ type XunfeiChatResponse struct {
 			//	CompletionTokens string `json:"completion_tokens"`
 			//	TotalTokens      string `json:"total_tokens"`
 			//} `json:"text"`
-			Text Usage `json:"text"`
+			Text model.Usage `json:"text"`
 		} `json:"usage"`
 	} `json:"payload"`
 }
 
-func requestOpenAI2Xunfei(request GeneralOpenAIRequest, xunfeiAppId string, domain string) *XunfeiChatRequest {
+func requestOpenAI2Xunfei(request model.GeneralOpenAIRequest, xunfeiAppId string, domain string) *XunfeiChatRequest {
 	messages := make([]XunfeiMessage, 0, len(request.Messages))
 	for _, message := range request.Messages {
 		if message.Role == "system" {
@@ -87,14 +106,43 @@ func requestOpenAI2Xunfei(request GeneralOpenAIRequest, xunfeiAppId string, doma
 				Role:    "assistant",
 				Content: "Okay",
 			})
+		} else if message.Role == "tool" || message.Role == "function" {
+			// Spark has no role for function results, they are sent as user input
+			messages = append(messages, XunfeiMessage{
+				Role:    "user",
+				Content: message.StringContent(),
+			})
 		} else {
+			content := message.StringContent()
+			// Spark makes one function call per turn, requests with more are
+			// rejected by the adaptor
+			if content == "" && len(message.ToolCalls) > 0 {
+				arguments, _ := message.ToolCalls[0].Function.Arguments.(string)
+				jsonFunctionCall, _ := json.Marshal(XunfeiFunctionCall{
+					Name:      message.ToolCalls[0].Function.Name,
+					Arguments: arguments,
+				})
+				content = string(jsonFunctionCall)
+			}
 			messages = append(messages, XunfeiMessage{
 				Role:    message.Role,
-				Content: message.StringContent(),
+				Content: content,
 			})
 		}
 	}
 	xunfeiRequest := XunfeiChatRequest{}
+	if tools := request.GetTools(); len(tools) > 0 && request.ToolChoice != "none" {
+		xunfeiRequest.Payload.Functions = &struct {
+			Text []XunfeiFunction `json:"text"`
+		}{}
+		for _, tool := range tools {
+			xunfeiRequest.Payload.Functions.Text = append(xunfeiRequest.Payload.Functions.Text, XunfeiFunction{
+				Name:        tool.Function.Name,
+				Description: tool.Function.Description,
+				Parameters:  tool.Function.Parameters,
+			})
+		}
+	}
 	xunfeiRequest.Header.AppId = xunfeiAppId
 	xunfeiRequest.Parameter.Chat.Domain = domain
 	xunfeiRequest.Parameter.Chat.Temperature = request.Temperature
@@ -104,7 +152,21 @@ func requestOpenAI2Xunfei(request GeneralOpenAIRequest, xunfeiAppId string, doma
 	return &xunfeiRequest
 }
 
-func responseXunfei2OpenAI(response *XunfeiChatResponse) *OpenAITextResponse {
+func toolCallsXunfei2OpenAI(functionCall *XunfeiFunctionCall) []model.Tool {
+	if functionCall == nil {
+		return nil
+	}
+	return []model.Tool{{
+		Id:   fmt.Sprintf("call_%s", common.GetUUID()),
+		Type: "function",
+		Function: model.Function{
+			Name:      functionCall.Name,
+			Arguments: functionCall.Arguments,
+		},
+	}}
+}
+
+func responseXunfei2OpenAI(response *XunfeiChatResponse) *model.OpenAITextResponse {
 	if len(response.Payload.Choices.Text) == 0 {
 		response.Payload.Choices.Text = []XunfeiChatResponseTextItem{
 			{
@@ -112,24 +174,28 @@ func responseXunfei2OpenAI(response *XunfeiChatResponse) *OpenAITextResponse {
 			},
 		}
 	}
-	choice := OpenAITextResponseChoice{
+	choice := model.OpenAITextResponseChoice{
 		Index: 0,
-		Message: Message{
-			Role:    "assistant",
-			Content: response.Payload.Choices.Text[0].Content,
+		Message: model.Message{
+			Role:      "assistant",
+			Content:   response.Payload.Choices.Text[0].Content,
+			ToolCalls: toolCallsXunfei2OpenAI(response.Payload.Choices.Text[0].FunctionCall),
 		},
-		FinishReason: stopFinishReason,
+		FinishReason: constant.StopFinishReason,
+	}
+	if choice.ToolCalls != nil {
+		choice.FinishReason = "tool_calls"
 	}
-	fullTextResponse := OpenAITextResponse{
+	fullTextResponse := model.OpenAITextResponse{
 		Object:  "chat.completion",
 		Created: common.GetTimestamp(),
-		Choices: []OpenAITextResponseChoice{choice},
+		Choices: []model.OpenAITextResponseChoice{choice},
 		Usage:   response.Payload.Usage.Text,
 	}
 	return &fullTextResponse
 }
 
-func streamResponseXunfei2OpenAI(xunfeiResponse *XunfeiChatResponse) *ChatCompletionsStreamResponse {
+func streamResponseXunfei2OpenAI(xunfeiResponse *XunfeiChatResponse, hasToolCalls *bool) *model.ChatCompletionsStreamResponse {
 	if len(xunfeiResponse.Payload.Choices.Text) == 0 {
 		xunfeiResponse.Payload.Choices.Text = []XunfeiChatResponseTextItem{
 			{
@@ -137,16 +203,26 @@ func streamResponseXunfei2OpenAI(xunfeiResponse *XunfeiChatResponse) *ChatComple
 			},
 		}
 	}
-	var choice ChatCompletionsStreamResponseChoice
+	var choice model.ChatCompletionsStreamResponseChoice
 	choice.Delta.Content = xunfeiResponse.Payload.Choices.Text[0].Content
+	if toolCalls := toolCallsXunfei2OpenAI(xunfeiResponse.Payload.Choices.Text[0].FunctionCall); toolCalls != nil {
+		index := 0
+		toolCalls[0].Index = &index
+		choice.Delta.ToolCalls = toolCalls
+		*hasToolCalls = true
+	}
 	if xunfeiResponse.Payload.Choices.Status == 2 {
-		choice.FinishReason = &stopFinishReason
+		finishReason := constant.StopFinishReason
+		if *hasToolCalls {
+			finishReason = "tool_calls"
+		}
+		choice.FinishReason = &finishReason
 	}
-	response := ChatCompletionsStreamResponse{
+	response := model.ChatCompletionsStreamResponse{
 		Object:  "chat.completion.chunk",
 		Created: common.GetTimestamp(),
 		Model:   "SparkDesk",
-		Choices: []ChatCompletionsStreamResponseChoice{choice},
+		Choices: []model.ChatCompletionsStreamResponseChoice{choice},
 	}
 	return &response
 }
@@ -177,21 +253,35 @@ func buildXunfeiAuthUrl(hostUrl string, apiKey, apiSecret string) string {
 	return callUrl
 }
 
-func xunfeiStreamHandler(c *gin.Context, textRequest GeneralOpenAIRequest, appId string, apiSecret string, apiKey string) (*OpenAIErrorWithStatusCode, *Usage) {
+func StreamHandler(c *gin.Context, textRequest model.GeneralOpenAIRequest, appId string, apiSecret string, apiKey string) (*model.OpenAIErrorWithStatusCode, *model.Usage, string) {
 	domain, authUrl := getXunfeiAuthUrl(c, apiKey, apiSecret)
-	dataChan, stopChan, err := xunfeiMakeRequest(textRequest, domain, authUrl, appId)
+	ctx, cancel := context.WithCancel(c.Request.Context())
+	defer cancel()
+	transport, err := util.GetChannelTransport(c.GetInt("channel_id"), util.GetChannelConfig(c))
 	if err != nil {
-		return errorWrapper(err, "make xunfei request err", http.StatusInternalServerError), nil
+		return util.ErrorWrapper(err, "get_channel_transport_failed", http.StatusInternalServerError), nil, ""
 	}
-	setEventStreamHeaders(c)
-	var usage Usage
+	dataChan, stopChan, err := xunfeiMakeRequest(ctx, transport, textRequest, domain, authUrl, appId)
+	if err != nil {
+		return util.ErrorWrapper(err, "make xunfei request err", http.StatusInternalServerError), nil, ""
+	}
+	util.SetEventStreamHeaders(c)
+	responseText := ""
+	var usage model.Usage
+	hasToolCalls := false
+	heartbeat := util.NewHeartbeat()
+	defer heartbeat.Stop()
 	c.Stream(func(w io.Writer) bool {
 		select {
 		case xunfeiResponse := <-dataChan:
+			heartbeat.Reset()
 			usage.PromptTokens += xunfeiResponse.Payload.Usage.Text.PromptTokens
 			usage.CompletionTokens += xunfeiResponse.Payload.Usage.Text.CompletionTokens
 			usage.TotalTokens += xunfeiResponse.Payload.Usage.Text.TotalTokens
-			response := streamResponseXunfei2OpenAI(&xunfeiResponse)
+			response := streamResponseXunfei2OpenAI(&xunfeiResponse, &hasToolCalls)
+			if len(response.Choices) != 0 {
+				responseText += response.Choices[0].Delta.Content
+			}
 			jsonResponse, err := json.Marshal(response)
 			if err != nil {
 				common.SysError("error marshalling stream response: " + err.Error())
@@ -202,19 +292,32 @@ func xunfeiStreamHandler(c *gin.Context, textRequest GeneralOpenAIRequest, appId
 		case <-stopChan:
 			c.Render(-1, common.CustomEvent{Data: "data: [DONE]"})
 			return false
+		case <-heartbeat.C():
+			heartbeat.Write(c)
+			return true
+		case <-ctx.Done():
+			return false
 		}
 	})
-	return nil, &usage
+	// the connection is closed once ctx is canceled, which ends the reader
+	cancel()
+	<-stopChan
+	return nil, &usage, responseText
 }
 
-func xunfeiHandler(c *gin.Context, textRequest GeneralOpenAIRequest, appId string, apiSecret string, apiKey string) (*OpenAIErrorWithStatusCode, *Usage) {
+func Handler(c *gin.Context, textRequest model.GeneralOpenAIRequest, appId string, apiSecret string, apiKey string) (*model.OpenAIErrorWithStatusCode, *model.Usage) {
 	domain, authUrl := getXunfeiAuthUrl(c, apiKey, apiSecret)
-	dataChan, stopChan, err := xunfeiMakeRequest(textRequest, domain, authUrl, appId)
+	transport, err := util.GetChannelTransport(c.GetInt("channel_id"), util.GetChannelConfig(c))
 	if err != nil {
-		return errorWrapper(err, "make xunfei request err", http.StatusInternalServerError), nil
+		return util.ErrorWrapper(err, "get_channel_transport_failed", http.StatusInternalServerError), nil
 	}
-	var usage Usage
+	dataChan, stopChan, err := xunfeiMakeRequest(c.Request.Context(), transport, textRequest, domain, authUrl, appId)
+	if err != nil {
+		return util.ErrorWrapper(err, "make xunfei request err", http.StatusInternalServerError), nil
+	}
+	var usage model.Usage
 	var content string
+	var functionCall *XunfeiFunctionCall
 	var xunfeiResponse XunfeiChatResponse
 	stop := false
 	for !stop {
@@ -224,29 +327,43 @@ func xunfeiHandler(c *gin.Context, textRequest GeneralOpenAIRequest, appId strin
 				continue
 			}
 			content += xunfeiResponse.Payload.Choices.Text[0].Content
+			if xunfeiResponse.Payload.Choices.Text[0].FunctionCall != nil {
+				functionCall = xunfeiResponse.Payload.Choices.Text[0].FunctionCall
+			}
 			usage.PromptTokens += xunfeiResponse.Payload.Usage.Text.PromptTokens
 			usage.CompletionTokens += xunfeiResponse.Payload.Usage.Text.CompletionTokens
 			usage.TotalTokens += xunfeiResponse.Payload.Usage.Text.TotalTokens
-		case stop = <-stopChan:
+		case <-stopChan:
+			stop = true
 		}
 	}
 
+	if len(xunfeiResponse.Payload.Choices.Text) == 0 {
+		xunfeiResponse.Payload.Choices.Text = []XunfeiChatResponseTextItem{{}}
+	}
 	xunfeiResponse.Payload.Choices.Text[0].Content = content
+	xunfeiResponse.Payload.Choices.Text[0].FunctionCall = functionCall
 
 	response := responseXunfei2OpenAI(&xunfeiResponse)
 	jsonResponse, err := json.Marshal(response)
 	if err != nil {
-		return errorWrapper(err, "marshal_response_body_failed", http.StatusInternalServerError), nil
+		return util.ErrorWrapper(err, "marshal_response_body_failed", http.StatusInternalServerError), nil
 	}
 	c.Writer.Header().Set("Content-Type", "application/json")
 	_, _ = c.Writer.Write(jsonResponse)
 	return nil, &usage
 }
 
-func xunfeiMakeRequest(textRequest GeneralOpenAIRequest, domain, authUrl, appId string) (chan XunfeiChatResponse, chan bool, error) {
+func xunfeiMakeRequest(ctx context.Context, transport *http.Transport, textRequest model.GeneralOpenAIRequest, domain, authUrl, appId string) (chan XunfeiChatResponse, chan bool, error) {
 	d := websocket.Dialer{
 		HandshakeTimeout: 5 * time.Second,
 	}
+	// connect through the proxy and with the TLS settings of the channel
+	if transport != nil {
+		d.Proxy = transport.Proxy
+		d.TLSClientConfig = transport.TLSClientConfig
+		d.NetDialContext = transport.DialContext
+	}
 	conn, resp, err := d.Dial(authUrl, nil)
 	if err != nil || resp.StatusCode != 101 {
 		return nil, nil, err
@@ -260,6 +377,11 @@ func xunfeiMakeRequest(textRequest GeneralOpenAIRequest, domain, authUrl, appId
 	dataChan := make(chan XunfeiChatResponse)
 	stopChan := make(chan bool)
 	go func() {
+		<-ctx.Done()
+		_ = conn.Close()
+	}()
+	go func() {
+		defer close(stopChan)
 		for {
 			_, msg, err := conn.ReadMessage()
 			if err != nil {
@@ -272,7 +394,11 @@ func xunfeiMakeRequest(textRequest GeneralOpenAIRequest, domain, authUrl, appId
 				common.SysError("error unmarshalling stream response: " + err.Error())
 				break
 			}
-			dataChan <- response
+			select {
+			case dataChan <- response:
+			case <-ctx.Done():
+				return
+			}
 			if response.Payload.Choices.Status == 2 {
 				err := conn.Close()
 				if err != nil {
@@ -281,13 +407,12 @@ func xunfeiMakeRequest(textRequest GeneralOpenAIRequest, domain, authUrl, appId
 				break
 			}
 		}
-		stopChan <- true
 	}()
 
 	return dataChan, stopChan, nil
 }
 
-func getXunfeiAuthUrl(c *gin.Context, apiKey string, apiSecret string) (string, string) {
+func getAPIVersion(c *gin.Context) string {
 	query := c.Request.URL.Query()
 	apiVersion := query.Get("api-version")
 	if apiVersion == "" {
@@ -297,6 +422,16 @@ func getXunfeiAuthUrl(c *gin.Context, apiKey string, apiSecret string) (string,
 		apiVersion = "v1.1"
 		common.SysLog("api_version not found, use default: " + apiVersion)
 	}
+	return apiVersion
+}
+
+// functions are supported since Spark v3.0
+func supportsFunctionCall(apiVersion string) bool {
+	return apiVersion != "v1.1" && apiVersion != "v2.1"
+}
+
+func getXunfeiAuthUrl(c *gin.Context, apiKey string, apiSecret string) (string, string) {
+	apiVersion := getAPIVersion(c)
 	domain := "general"
 	if apiVersion != "v1.1" {
 		domain += strings.Split(apiVersion, ".")[0]
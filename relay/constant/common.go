@@ -0,0 +1,3 @@
+package constant
+
+var StopFinishReason = "stop"
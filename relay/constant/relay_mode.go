@@ -0,0 +1,63 @@
+package constant
+
+import "strings"
+
+const (
+	RelayModeUnknown = iota
+	RelayModeChatCompletions
+	RelayModeCompletions
+	RelayModeEmbeddings
+	RelayModeModerations
+	RelayModeImagesGenerations
+	RelayModeEdits
+	RelayModeAudioSpeech
+	RelayModeAudioTranscription
+	RelayModeAudioTranslation
+	RelayModeClaudeMessages
+	RelayModeImagesEdits
+	RelayModeImagesVariations
+	RelayModeFiles
+	RelayModeAssistants
+	RelayModeBatches
+	RelayModeFineTuning
+)
+
+func Path2RelayMode(path string) int {
+	relayMode := RelayModeUnknown
+	if strings.HasPrefix(path, "/v1/chat/completions") {
+		relayMode = RelayModeChatCompletions
+	} else if strings.HasPrefix(path, "/v1/completions") {
+		relayMode = RelayModeCompletions
+	} else if strings.HasPrefix(path, "/v1/embeddings") {
+		relayMode = RelayModeEmbeddings
+	} else if strings.HasSuffix(path, "embeddings") {
+		relayMode = RelayModeEmbeddings
+	} else if strings.HasPrefix(path, "/v1/moderations") {
+		relayMode = RelayModeModerations
+	} else if strings.HasPrefix(path, "/v1/images/generations") {
+		relayMode = RelayModeImagesGenerations
+	} else if strings.HasPrefix(path, "/v1/images/edits") {
+		relayMode = RelayModeImagesEdits
+	} else if strings.HasPrefix(path, "/v1/images/variations") {
+		relayMode = RelayModeImagesVariations
+	} else if strings.HasPrefix(path, "/v1/files") {
+		relayMode = RelayModeFiles
+	} else if strings.HasPrefix(path, "/v1/assistants") || strings.HasPrefix(path, "/v1/threads") {
+		relayMode = RelayModeAssistants
+	} else if strings.HasPrefix(path, "/v1/batches") {
+		relayMode = RelayModeBatches
+	} else if strings.HasPrefix(path, "/v1/fine_tuning") {
+		relayMode = RelayModeFineTuning
+	} else if strings.HasPrefix(path, "/v1/edits") {
+		relayMode = RelayModeEdits
+	} else if strings.HasPrefix(path, "/v1/audio/speech") {
+		relayMode = RelayModeAudioSpeech
+	} else if strings.HasPrefix(path, "/v1/audio/transcriptions") {
+		relayMode = RelayModeAudioTranscription
+	} else if strings.HasPrefix(path, "/v1/audio/translations") {
+		relayMode = RelayModeAudioTranslation
+	} else if strings.HasPrefix(path, "/v1/messages") {
+		relayMode = RelayModeClaudeMessages
+	}
+	return relayMode
+}
@@ -0,0 +1,30 @@
+package model
+
+import "encoding/json"
+
+// AssistantObject holds the fields of the objects of the Assistants API that the
+// gateway tracks, https://platform.openai.com/docs/api-reference/assistants
+type AssistantObject struct {
+	Id       string            `json:"id"`
+	Object   string            `json:"object"`
+	ThreadId string            `json:"thread_id,omitempty"`
+	Status   string            `json:"status,omitempty"`
+	Model    string            `json:"model,omitempty"`
+	Usage    *Usage            `json:"usage,omitempty"`
+	Deleted  bool              `json:"deleted,omitempty"`
+	Data     []json.RawMessage `json:"data,omitempty"`
+	LastId   string            `json:"last_id,omitempty"`
+	HasMore  bool              `json:"has_more,omitempty"`
+}
+
+// IsTerminalRun reports whether the object is a run that will not change anymore
+func (o *AssistantObject) IsTerminalRun() bool {
+	if o.Object != "thread.run" {
+		return false
+	}
+	switch o.Status {
+	case "completed", "failed", "cancelled", "expired", "incomplete":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,54 @@
+package model
+
+import "encoding/json"
+
+// Batch holds the fields of a batch that the gateway tracks,
+// https://platform.openai.com/docs/api-reference/batch/object
+type Batch struct {
+	Id           string `json:"id"`
+	Object       string `json:"object"`
+	Endpoint     string `json:"endpoint"`
+	InputFileId  string `json:"input_file_id"`
+	OutputFileId string `json:"output_file_id"`
+	ErrorFileId  string `json:"error_file_id"`
+	Status       string `json:"status"`
+}
+
+// IsTerminal reports whether the batch will not change anymore
+func (b *Batch) IsTerminal() bool {
+	switch b.Status {
+	case "completed", "failed", "cancelled", "expired":
+		return true
+	}
+	return false
+}
+
+type BatchList struct {
+	Object  string            `json:"object"`
+	Data    []json.RawMessage `json:"data"`
+	FirstId any               `json:"first_id"`
+	LastId  any               `json:"last_id"`
+	HasMore bool              `json:"has_more"`
+}
+
+// BatchInputLine is a line of the input file of a batch,
+// https://platform.openai.com/docs/api-reference/batch/request-input
+type BatchInputLine struct {
+	CustomId string `json:"custom_id"`
+	Body     struct {
+		Model string `json:"model"`
+	} `json:"body"`
+}
+
+// BatchOutputLine is a line of the output file of a batch,
+// https://platform.openai.com/docs/api-reference/batch/request-output
+type BatchOutputLine struct {
+	CustomId string `json:"custom_id"`
+	Response *struct {
+		StatusCode int `json:"status_code"`
+		Body       struct {
+			Model string `json:"model"`
+			Usage *Usage `json:"usage"`
+		} `json:"body"`
+	} `json:"response"`
+}
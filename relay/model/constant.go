@@ -0,0 +1,6 @@
+package model
+
+const (
+	ContentTypeText     = "text"
+	ContentTypeImageURL = "image_url"
+)
@@ -0,0 +1,17 @@
+package model
+
+// https://platform.openai.com/docs/api-reference/files/object
+
+type File struct {
+	Id        string `json:"id"`
+	Object    string `json:"object"`
+	Bytes     int64  `json:"bytes"`
+	CreatedAt int64  `json:"created_at"`
+	Filename  string `json:"filename"`
+	Purpose   string `json:"purpose"`
+}
+
+type FileList struct {
+	Object string `json:"object"`
+	Data   []File `json:"data"`
+}
@@ -0,0 +1,29 @@
+package model
+
+import "encoding/json"
+
+// FineTuningJob holds the fields of a fine-tuning job that the gateway tracks,
+// https://platform.openai.com/docs/api-reference/fine-tuning/object
+type FineTuningJob struct {
+	Id             string `json:"id"`
+	Object         string `json:"object"`
+	Model          string `json:"model"`
+	FineTunedModel string `json:"fine_tuned_model"`
+	Status         string `json:"status"`
+	TrainedTokens  int    `json:"trained_tokens"`
+}
+
+// IsTerminal reports whether the job will not change anymore
+func (j *FineTuningJob) IsTerminal() bool {
+	switch j.Status {
+	case "succeeded", "failed", "cancelled":
+		return true
+	}
+	return false
+}
+
+type FineTuningJobList struct {
+	Object  string            `json:"object"`
+	Data    []json.RawMessage `json:"data"`
+	HasMore bool              `json:"has_more"`
+}
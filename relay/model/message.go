@@ -0,0 +1,100 @@
+package model
+
+type Message struct {
+	Role       string  `json:"role"`
+	Content    any     `json:"content"`
+	Name       *string `json:"name,omitempty"`
+	ToolCalls  []Tool  `json:"tool_calls,omitempty"`
+	ToolCallId string  `json:"tool_call_id,omitempty"`
+}
+
+type ImageURL struct {
+	Url    string `json:"url,omitempty"`
+	Detail string `json:"detail,omitempty"`
+}
+
+type TextContent struct {
+	Type string `json:"type,omitempty"`
+	Text string `json:"text,omitempty"`
+}
+
+type ImageContent struct {
+	Type     string    `json:"type,omitempty"`
+	ImageURL *ImageURL `json:"image_url,omitempty"`
+}
+
+func (m Message) StringContent() string {
+	content, ok := m.Content.(string)
+	if ok {
+		return content
+	}
+	contentList, ok := m.Content.([]any)
+	if ok {
+		var contentStr string
+		for _, contentItem := range contentList {
+			contentMap, ok := contentItem.(map[string]any)
+			if !ok {
+				continue
+			}
+			if contentMap["type"] == "text" {
+				if subStr, ok := contentMap["text"].(string); ok {
+					contentStr += subStr
+				}
+			}
+		}
+		return contentStr
+	}
+	return ""
+}
+
+type MessageContent struct {
+	Type     string    `json:"type,omitempty"`
+	Text     string    `json:"text"`
+	ImageURL *ImageURL `json:"image_url,omitempty"`
+}
+
+// ParseContent returns the text and image parts of the message,
+// a plain string content is returned as a single text part.
+func (m Message) ParseContent() []MessageContent {
+	var contentList []MessageContent
+	content, ok := m.Content.(string)
+	if ok {
+		contentList = append(contentList, MessageContent{
+			Type: ContentTypeText,
+			Text: content,
+		})
+		return contentList
+	}
+	anyList, ok := m.Content.([]any)
+	if !ok {
+		return contentList
+	}
+	for _, contentItem := range anyList {
+		contentMap, ok := contentItem.(map[string]any)
+		if !ok {
+			continue
+		}
+		switch contentMap["type"] {
+		case ContentTypeText:
+			if subStr, ok := contentMap["text"].(string); ok {
+				contentList = append(contentList, MessageContent{
+					Type: ContentTypeText,
+					Text: subStr,
+				})
+			}
+		case ContentTypeImageURL:
+			if subObj, ok := contentMap["image_url"].(map[string]any); ok {
+				url, _ := subObj["url"].(string)
+				detail, _ := subObj["detail"].(string)
+				contentList = append(contentList, MessageContent{
+					Type: ContentTypeImageURL,
+					ImageURL: &ImageURL{
+						Url:    url,
+						Detail: detail,
+					},
+				})
+			}
+		}
+	}
+	return contentList
+}
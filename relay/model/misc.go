@@ -0,0 +1,27 @@
+package model
+
+import "time"
+
+type Usage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+type OpenAIError struct {
+	Message string `json:"message"`
+	Type    string `json:"type"`
+	Param   string `json:"param"`
+	Code    any    `json:"code"`
+}
+
+type OpenAIErrorWithStatusCode struct {
+	OpenAIError
+	StatusCode int `json:"status_code"`
+	// RetryAfter is how long the upstream asked to wait after a 429, zero if
+	// it did not say
+	RetryAfter time.Duration `json:"-"`
+	// Upstream is set for the errors returned by the upstream or met on the
+	// way to it, only those say something about the channel
+	Upstream bool `json:"-"`
+}
@@ -0,0 +1,15 @@
+package model
+
+type Tool struct {
+	Index    *int     `json:"index,omitempty"`
+	Id       string   `json:"id,omitempty"`
+	Type     string   `json:"type,omitempty"`
+	Function Function `json:"function"`
+}
+
+type Function struct {
+	Description string `json:"description,omitempty"`
+	Name        string `json:"name,omitempty"`
+	Parameters  any    `json:"parameters,omitempty"`
+	Arguments   any    `json:"arguments,omitempty"`
+}
@@ -0,0 +1,168 @@
+package util
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"one-api/common"
+	"one-api/relay/constant"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const defaultEntraIDAuthority = "https://login.microsoftonline.com"
+
+type entraIDToken struct {
+	accessToken string
+	expiresAt   time.Time
+}
+
+// entraIDTokenCall is a request for a token in flight, the lock is not held
+// during the request
+type entraIDTokenCall struct {
+	done        chan struct{}
+	accessToken string
+	err         error
+}
+
+var entraIDTokens = make(map[string]*entraIDToken)
+var entraIDTokenCalls = make(map[string]*entraIDTokenCall)
+var entraIDTokensLock sync.Mutex
+
+// GetChannelConfig returns the config of the channel the request is sent to
+func GetChannelConfig(c *gin.Context) *common.ChannelConfig {
+	if config, ok := c.Get("channel_config"); ok {
+		return config.(*common.ChannelConfig)
+	}
+	return &common.ChannelConfig{}
+}
+
+// GetAzureEndpoint returns the endpoint whose api-version applies to the relay mode
+func GetAzureEndpoint(relayMode int) string {
+	switch relayMode {
+	case constant.RelayModeChatCompletions, constant.RelayModeCompletions:
+		return common.AzureEndpointChat
+	case constant.RelayModeEmbeddings:
+		return common.AzureEndpointEmbeddings
+	case constant.RelayModeImagesGenerations, constant.RelayModeImagesEdits, constant.RelayModeImagesVariations:
+		return common.AzureEndpointImages
+	case constant.RelayModeAudioSpeech, constant.RelayModeAudioTranscription, constant.RelayModeAudioTranslation:
+		return common.AzureEndpointAudio
+	}
+	return common.AzureEndpointDefault
+}
+
+// GetAzureAPIVersion returns the api-version of the request if it has one, then
+// the one configured for the endpoint, then the default one of the channel
+func GetAzureAPIVersion(c *gin.Context, endpoint string) string {
+	if apiVersion := c.Query("api-version"); apiVersion != "" {
+		return apiVersion
+	}
+	return GetChannelConfig(c).Azure.GetAPIVersion(endpoint, c.GetString("api_version"))
+}
+
+// SetupAzureAuthorization authenticates a request to Azure OpenAI with the
+// api-key, or with a token of Microsoft Entra ID if the channel is set up so.
+// The token is requested through the transport of the channel.
+func SetupAzureAuthorization(ctx context.Context, req *http.Request, channelId int, config *common.ChannelConfig, key string) error {
+	entraID := config.Azure.GetEntraID()
+	if entraID == nil {
+		req.Header.Set("api-key", key)
+		return nil
+	}
+	client, err := GetChannelImpatientHTTPClient(channelId, config)
+	if err != nil {
+		return err
+	}
+	accessToken, err := getEntraIDToken(ctx, client, entraID, key)
+	if err != nil {
+		return fmt.Errorf("get entra id token failed: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	return nil
+}
+
+// getEntraIDToken returns a cached token of the application, a new one is
+// requested with the client credentials once it is about to expire. The
+// requests made meanwhile for the same application wait for that one.
+func getEntraIDToken(ctx context.Context, client *http.Client, entraID *common.AzureEntraID, clientSecret string) (string, error) {
+	cacheKey := strings.Join([]string{entraID.Authority, entraID.TenantId, entraID.ClientId, clientSecret}, "|")
+	entraIDTokensLock.Lock()
+	if token, ok := entraIDTokens[cacheKey]; ok && time.Now().Add(5*time.Minute).Before(token.expiresAt) {
+		entraIDTokensLock.Unlock()
+		return token.accessToken, nil
+	}
+	call, ok := entraIDTokenCalls[cacheKey]
+	if ok {
+		entraIDTokensLock.Unlock()
+		select {
+		case <-call.done:
+			return call.accessToken, call.err
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+	call = &entraIDTokenCall{done: make(chan struct{})}
+	entraIDTokenCalls[cacheKey] = call
+	entraIDTokensLock.Unlock()
+
+	token, err := requestEntraIDToken(ctx, client, entraID, clientSecret)
+	entraIDTokensLock.Lock()
+	if err == nil {
+		entraIDTokens[cacheKey] = token
+		call.accessToken = token.accessToken
+	}
+	call.err = err
+	delete(entraIDTokenCalls, cacheKey)
+	entraIDTokensLock.Unlock()
+	close(call.done)
+	return call.accessToken, call.err
+}
+
+func requestEntraIDToken(ctx context.Context, client *http.Client, entraID *common.AzureEntraID, clientSecret string) (*entraIDToken, error) {
+	authority := entraID.Authority
+	if authority == "" {
+		authority = defaultEntraIDAuthority
+	}
+	form := url.Values{}
+	form.Set("grant_type", "client_credentials")
+	form.Set("client_id", entraID.ClientId)
+	form.Set("client_secret", clientSecret)
+	form.Set("scope", "https://cognitiveservices.azure.com/.default")
+	tokenURL := fmt.Sprintf("%s/%s/oauth2/v2.0/token", strings.TrimSuffix(authority, "/"), entraID.TenantId)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var tokenResponse struct {
+		AccessToken      string `json:"access_token"`
+		ExpiresIn        int    `json:"expires_in"`
+		ErrorDescription string `json:"error_description"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&tokenResponse)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK || tokenResponse.AccessToken == "" {
+		if tokenResponse.ErrorDescription != "" {
+			return nil, errors.New(tokenResponse.ErrorDescription)
+		}
+		return nil, fmt.Errorf("bad response status code %d", resp.StatusCode)
+	}
+	return &entraIDToken{
+		accessToken: tokenResponse.AccessToken,
+		expiresAt:   time.Now().Add(time.Duration(tokenResponse.ExpiresIn) * time.Second),
+	}, nil
+}
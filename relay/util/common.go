@@ -0,0 +1,114 @@
+package util
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"one-api/common"
+	"one-api/relay/model"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+func ErrorWrapper(err error, code string, statusCode int) *model.OpenAIErrorWithStatusCode {
+	openAIError := model.OpenAIError{
+		Message: err.Error(),
+		Type:    "one_api_error",
+		Code:    code,
+	}
+	return &model.OpenAIErrorWithStatusCode{
+		OpenAIError: openAIError,
+		StatusCode:  statusCode,
+	}
+}
+
+// UpstreamErrorWrapper wraps an error met while sending the request to the
+// upstream or reading its response, which counts against the channel
+func UpstreamErrorWrapper(err error, code string, statusCode int) *model.OpenAIErrorWithStatusCode {
+	openAIErrorWithStatusCode := ErrorWrapper(err, code, statusCode)
+	openAIErrorWithStatusCode.Upstream = true
+	return openAIErrorWithStatusCode
+}
+
+func SetEventStreamHeaders(c *gin.Context) {
+	c.Writer.Header().Set("Content-Type", "text/event-stream")
+	c.Writer.Header().Set("Cache-Control", "no-cache")
+	c.Writer.Header().Set("Connection", "keep-alive")
+	c.Writer.Header().Set("Transfer-Encoding", "chunked")
+	c.Writer.Header().Set("X-Accel-Buffering", "no")
+}
+
+// CloseStream ends a stream whose events are read by a goroutine: cancel
+// releases the goroutine if it is waiting to hand over an event, closing the
+// body stops upstream and unblocks a pending read, then the goroutine is
+// waited for so that it does not outlive the request.
+func CloseStream(cancel context.CancelFunc, body io.Closer, stopChan <-chan bool) error {
+	cancel()
+	err := body.Close()
+	<-stopChan
+	return err
+}
+
+// IsClientGone reports whether the client went away before the response was
+// complete, net/http cancels the request context once it notices.
+func IsClientGone(c *gin.Context) bool {
+	return c.Request.Context().Err() != nil
+}
+
+func RelayErrorHandler(resp *http.Response) (openAIErrorWithStatusCode *model.OpenAIErrorWithStatusCode) {
+	openAIErrorWithStatusCode = &model.OpenAIErrorWithStatusCode{
+		StatusCode: resp.StatusCode,
+		OpenAIError: model.OpenAIError{
+			Message: fmt.Sprintf("bad response status code %d", resp.StatusCode),
+			Type:    "upstream_error",
+			Code:    "bad_response_status_code",
+			Param:   strconv.Itoa(resp.StatusCode),
+		},
+		Upstream: true,
+	}
+	if resp.StatusCode == http.StatusTooManyRequests {
+		openAIErrorWithStatusCode.RetryAfter = GetRetryAfter(resp.Header)
+	}
+	responseBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return
+	}
+	err = resp.Body.Close()
+	if err != nil {
+		return
+	}
+	var textResponse model.TextResponse
+	err = json.Unmarshal(responseBody, &textResponse)
+	if err != nil {
+		return
+	}
+	openAIErrorWithStatusCode.OpenAIError = textResponse.Error
+	return
+}
+
+func GetFullRequestURL(baseURL string, requestURL string, channelType int) string {
+	fullRequestURL := fmt.Sprintf("%s%s", baseURL, requestURL)
+
+	if strings.HasPrefix(baseURL, "https://gateway.ai.cloudflare.com") {
+		switch channelType {
+		case common.ChannelTypeOpenAI:
+			fullRequestURL = fmt.Sprintf("%s%s", baseURL, strings.TrimPrefix(requestURL, "/v1"))
+		case common.ChannelTypeAzure:
+			fullRequestURL = fmt.Sprintf("%s%s", baseURL, strings.TrimPrefix(requestURL, "/openai/deployments"))
+		}
+	}
+	return fullRequestURL
+}
+
+func GetAPIVersion(c *gin.Context) string {
+	query := c.Request.URL.Query()
+	apiVersion := query.Get("api-version")
+	if apiVersion == "" {
+		apiVersion = c.GetString("api_version")
+	}
+	return apiVersion
+}
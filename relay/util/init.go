@@ -0,0 +1,64 @@
+package util
+
+import (
+	"context"
+	"fmt"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"net"
+	"net/http"
+	"one-api/common"
+	"os"
+	"runtime"
+	"strconv"
+	"time"
+)
+
+var HTTPClient *http.Client
+var ImpatientHTTPClient *http.Client
+
+// defaultTransport is the transport of HTTPClient, the transports of channels
+// with their own settings are cloned from it
+var defaultTransport *http.Transport
+
+func defaultTransportDialContext(dialer *net.Dialer) func(context.Context, string, string) (net.Conn, error) {
+	return dialer.DialContext
+}
+
+func init() {
+	maxIdleConnsPerHost := runtime.NumCPU() * 100
+
+	if os.Getenv("MaxIdleConnsPerHostPerCpu") != "" {
+		maxIdleConnsPerHostPercpuFromEnv, err := strconv.Atoi(os.Getenv("MaxIdleConnsPerHostPerCpu"))
+		if err == nil {
+			if maxIdleConnsPerHostPercpuFromEnv > 0 {
+				fmt.Printf("maxIdleConnsPerHostPercpuFromEnv = %d\n", maxIdleConnsPerHostPercpuFromEnv)
+				maxIdleConnsPerHost = runtime.NumCPU() * maxIdleConnsPerHostPercpuFromEnv
+			}
+		}
+	}
+
+	defaultTransport = &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: defaultTransportDialContext(&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}),
+		ForceAttemptHTTP2:     true,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+		MaxIdleConnsPerHost:   maxIdleConnsPerHost,
+	}
+
+	// a whole-request timeout would cut long streams, only the wait for the
+	// response to start is bounded
+	defaultTransport.ResponseHeaderTimeout = time.Duration(common.RelayTimeout) * time.Second
+	HTTPClient = &http.Client{
+		Transport: otelhttp.NewTransport(defaultTransport),
+	}
+
+	ImpatientHTTPClient = &http.Client{
+		Timeout:   5 * time.Second,
+		Transport: otelhttp.NewTransport(http.DefaultTransport),
+	}
+}
@@ -0,0 +1,250 @@
+package util
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"one-api/common"
+	"strconv"
+	"strings"
+)
+
+// defaultChannelHeaders are sent to the upstreams of a channel type unless the
+// config of the channel removes or replaces them
+var defaultChannelHeaders = map[int]map[string]string{
+	common.ChannelTypeOpenRouter: {
+		"HTTP-Referer": "https://github.com/songquanpeng/one-api",
+		"X-Title":      "One API",
+	},
+}
+
+// SetupHeaderOverrides adds and removes the headers configured for the channel
+func SetupHeaderOverrides(req *http.Request, channelType int, config *common.ChannelConfig) {
+	for key, value := range defaultChannelHeaders[channelType] {
+		req.Header.Set(key, value)
+	}
+	if config == nil || config.Headers == nil {
+		return
+	}
+	for _, key := range config.Headers.Remove {
+		req.Header.Del(key)
+	}
+	for key, value := range config.Headers.Set {
+		if strings.EqualFold(key, "Host") {
+			req.Host = value
+			continue
+		}
+		req.Header.Set(key, value)
+	}
+}
+
+// ApplyBodyOverrides patches a JSON body with the operations configured for
+// the channel, the body is returned as it is if there are none
+func ApplyBodyOverrides(body []byte, config *common.ChannelConfig) ([]byte, error) {
+	if !config.HasBodyOverrides() {
+		return body, nil
+	}
+	var document any
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	err := decoder.Decode(&document)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := document.(map[string]any); !ok {
+		return nil, errors.New("request body is not a JSON object")
+	}
+	for i := range config.Body {
+		document, err = applyBodyOperation(document, &config.Body[i])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return json.Marshal(document)
+}
+
+// ApplyFormOverrides applies the body operations of the channel to the text
+// fields of a multipart form, where only paths of one level take effect. It
+// returns the patched fields and the names of the removed ones, to be passed to
+// common.RewriteMultipartForm.
+func ApplyFormOverrides(fields map[string]string, config *common.ChannelConfig) (map[string]string, []string, error) {
+	if !config.HasBodyOverrides() {
+		return fields, nil, nil
+	}
+	document := make(map[string]any, len(fields))
+	for name, value := range fields {
+		document[name] = value
+	}
+	for i := range config.Body {
+		_, err := applyBodyOperation(document, &config.Body[i])
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	patchedFields := make(map[string]string, len(document))
+	for name, value := range document {
+		text, ok := value.(string)
+		if !ok {
+			textBytes, err := json.Marshal(value)
+			if err != nil {
+				return nil, nil, err
+			}
+			text = string(textBytes)
+		}
+		patchedFields[name] = text
+	}
+	var removedFields []string
+	for name := range fields {
+		if _, ok := document[name]; !ok {
+			removedFields = append(removedFields, name)
+		}
+	}
+	return patchedFields, removedFields, nil
+}
+
+func applyBodyOperation(document any, operation *common.BodyOperation) (any, error) {
+	tokens := strings.Split(strings.TrimPrefix(operation.Path, "/"), "/")
+	for i, token := range tokens {
+		tokens[i] = strings.NewReplacer("~1", "/", "~0", "~").Replace(token)
+	}
+	patched, err := patchNode(document, tokens, operation)
+	if err != nil {
+		return nil, fmt.Errorf("body operation %s %s failed: %w", operation.Op, operation.Path, err)
+	}
+	return patched, nil
+}
+
+// patchNode applies the operation to the path of the node, the node is
+// returned as it may be a slice that has grown
+func patchNode(node any, tokens []string, operation *common.BodyOperation) (any, error) {
+	token := tokens[0]
+	isLast := len(tokens) == 1
+	creates := operation.Op == common.BodyOperationAdd || operation.Op == common.BodyOperationDefault
+	switch container := node.(type) {
+	case map[string]any:
+		child, exists := container[token]
+		if !isLast {
+			if !exists {
+				if !creates {
+					return container, nil
+				}
+				child = make(map[string]any)
+			}
+			child, err := patchNode(child, tokens[1:], operation)
+			if err != nil {
+				return nil, err
+			}
+			container[token] = child
+			return container, nil
+		}
+		value, keep, err := applyOperation(child, exists, operation)
+		if err != nil {
+			return nil, err
+		}
+		if keep {
+			container[token] = value
+		} else {
+			delete(container, token)
+		}
+		return container, nil
+	case []any:
+		if token == "-" {
+			if !isLast || operation.Op != common.BodyOperationAdd {
+				return container, nil
+			}
+			value, _, err := applyOperation(nil, false, operation)
+			if err != nil {
+				return nil, err
+			}
+			return append(container, value), nil
+		}
+		index, err := strconv.Atoi(token)
+		if err != nil || index < 0 || index >= len(container) {
+			return container, nil
+		}
+		if !isLast {
+			container[index], err = patchNode(container[index], tokens[1:], operation)
+			return container, err
+		}
+		value, keep, err := applyOperation(container[index], true, operation)
+		if err != nil {
+			return nil, err
+		}
+		if keep {
+			container[index] = value
+			return container, nil
+		}
+		return append(container[:index], container[index+1:]...), nil
+	}
+	if creates {
+		return nil, errors.New("parent of the path is not an object or an array")
+	}
+	return node, nil
+}
+
+// applyOperation returns the new value at the path and whether the path is kept
+func applyOperation(value any, exists bool, operation *common.BodyOperation) (any, bool, error) {
+	switch operation.Op {
+	case common.BodyOperationAdd:
+		return decodeOperationValue(operation)
+	case common.BodyOperationReplace:
+		if !exists {
+			return nil, false, nil
+		}
+		return decodeOperationValue(operation)
+	case common.BodyOperationDefault:
+		if exists {
+			return value, true, nil
+		}
+		return decodeOperationValue(operation)
+	case common.BodyOperationRemove:
+		return nil, false, nil
+	case common.BodyOperationClamp:
+		if !exists {
+			return nil, false, nil
+		}
+		number, err := toFloat(value)
+		if err != nil {
+			// only numbers are clamped
+			return value, true, nil
+		}
+		clamped := number
+		if operation.Min != nil && clamped < *operation.Min {
+			clamped = *operation.Min
+		}
+		if operation.Max != nil && clamped > *operation.Max {
+			clamped = *operation.Max
+		}
+		if clamped == number {
+			return value, true, nil
+		}
+		return json.Number(strconv.FormatFloat(clamped, 'f', -1, 64)), true, nil
+	}
+	return nil, false, fmt.Errorf("unknown body operation: %q", operation.Op)
+}
+
+func decodeOperationValue(operation *common.BodyOperation) (any, bool, error) {
+	var value any
+	decoder := json.NewDecoder(bytes.NewReader(operation.Value))
+	decoder.UseNumber()
+	err := decoder.Decode(&value)
+	if err != nil {
+		return nil, false, err
+	}
+	return value, true, nil
+}
+
+func toFloat(value any) (float64, error) {
+	switch number := value.(type) {
+	case json.Number:
+		return number.Float64()
+	case float64:
+		return number, nil
+	case string:
+		// fields of multipart forms are strings
+		return strconv.ParseFloat(number, 64)
+	}
+	return 0, errors.New("not a number")
+}
@@ -0,0 +1,159 @@
+package util_test
+
+import (
+	"sort"
+	"testing"
+
+	"one-api/common"
+	"one-api/relay/util"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestApplyBodyOverrides(t *testing.T) {
+	cases := []struct {
+		name       string
+		body       string
+		operations string
+		want       string
+	}{
+		{
+			name:       "no operations",
+			body:       `{"model":"gpt-4", "temperature":1}`,
+			operations: `[]`,
+			want:       `{"model":"gpt-4", "temperature":1}`,
+		},
+		{
+			name:       "add creates the parents",
+			body:       `{"model":"gpt-4"}`,
+			operations: `[{"op":"add","path":"/stream_options/include_usage","value":true}]`,
+			want:       `{"model":"gpt-4","stream_options":{"include_usage":true}}`,
+		},
+		{
+			name:       "replace skips missing paths",
+			body:       `{"model":"gpt-4","top_p":0.5}`,
+			operations: `[{"op":"replace","path":"/top_p","value":1},{"op":"replace","path":"/temperature","value":1}]`,
+			want:       `{"model":"gpt-4","top_p":1}`,
+		},
+		{
+			name:       "default keeps existing values",
+			body:       `{"model":"gpt-4","temperature":0.2}`,
+			operations: `[{"op":"default","path":"/temperature","value":1},{"op":"default","path":"/max_tokens","value":100}]`,
+			want:       `{"model":"gpt-4","temperature":0.2,"max_tokens":100}`,
+		},
+		{
+			name:       "remove",
+			body:       `{"model":"gpt-4","user":"u1","logit_bias":{"50256":-100}}`,
+			operations: `[{"op":"remove","path":"/user"},{"op":"remove","path":"/logit_bias/50256"},{"op":"remove","path":"/missing/field"}]`,
+			want:       `{"model":"gpt-4","logit_bias":{}}`,
+		},
+		{
+			name:       "append to an array",
+			body:       `{"stop":["a"]}`,
+			operations: `[{"op":"add","path":"/stop/-","value":"b"},{"op":"replace","path":"/stop/-","value":"c"}]`,
+			want:       `{"stop":["a","b"]}`,
+		},
+		{
+			name:       "array indices",
+			body:       `{"messages":[{"role":"system","content":"x"},{"role":"user","content":"hi","name":"n"}]}`,
+			operations: `[{"op":"remove","path":"/messages/0"},{"op":"remove","path":"/messages/0/name"},{"op":"replace","path":"/messages/5/role","value":"user"}]`,
+			want:       `{"messages":[{"role":"user","content":"hi"}]}`,
+		},
+		{
+			name:       "escaped tokens",
+			body:       `{"a/b":1,"c~d":2}`,
+			operations: `[{"op":"replace","path":"/a~1b","value":10},{"op":"remove","path":"/c~0d"}]`,
+			want:       `{"a/b":10}`,
+		},
+		{
+			name: "clamp",
+			body: `{"temperature":1.5,"top_p":-1,"max_tokens":100,"n":"2"}`,
+			operations: `[{"op":"clamp","path":"/temperature","max":1},{"op":"clamp","path":"/top_p","min":0,"max":1},
+				{"op":"clamp","path":"/max_tokens","min":1,"max":4096},{"op":"clamp","path":"/n","max":1},{"op":"clamp","path":"/seed","max":1}]`,
+			want: `{"temperature":1,"top_p":0,"max_tokens":100,"n":1}`,
+		},
+		{
+			name:       "large integers are kept",
+			body:       `{"seed":12345678901234567890}`,
+			operations: `[{"op":"add","path":"/user","value":"u1"}]`,
+			want:       `{"seed":12345678901234567890,"user":"u1"}`,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			config, err := common.ParseChannelConfig(`{"body":` + c.operations + `}`)
+			require.NoError(t, err)
+			body, err := util.ApplyBodyOverrides([]byte(c.body), config)
+			require.NoError(t, err)
+			assert.JSONEq(t, c.want, string(body))
+		})
+	}
+}
+
+func TestApplyBodyOverridesErrors(t *testing.T) {
+	cases := []struct {
+		name       string
+		body       string
+		operations string
+	}{
+		{"not an object", `[1,2]`, `[{"op":"remove","path":"/0"}]`},
+		{"invalid body", `{"model":`, `[{"op":"remove","path":"/model"}]`},
+		{"add below a scalar", `{"model":"gpt-4"}`, `[{"op":"add","path":"/model/name","value":1}]`},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			config, err := common.ParseChannelConfig(`{"body":` + c.operations + `}`)
+			require.NoError(t, err)
+			_, err = util.ApplyBodyOverrides([]byte(c.body), config)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestApplyFormOverrides(t *testing.T) {
+	cases := []struct {
+		name        string
+		fields      map[string]string
+		operations  string
+		wantFields  map[string]string
+		wantRemoved []string
+	}{
+		{
+			name:       "no operations",
+			fields:     map[string]string{"model": "whisper-1"},
+			operations: `[]`,
+			wantFields: map[string]string{"model": "whisper-1"},
+		},
+		{
+			name:       "values are turned into text",
+			fields:     map[string]string{"model": "whisper-1", "temperature": "0.5"},
+			operations: `[{"op":"add","path":"/language","value":"en"},{"op":"replace","path":"/temperature","value":0},{"op":"default","path":"/timestamp_granularities","value":["word"]}]`,
+			wantFields: map[string]string{"model": "whisper-1", "temperature": "0", "language": "en", "timestamp_granularities": `["word"]`},
+		},
+		{
+			name:        "remove",
+			fields:      map[string]string{"model": "whisper-1", "prompt": "p", "response_format": "json"},
+			operations:  `[{"op":"remove","path":"/prompt"},{"op":"remove","path":"/response_format"}]`,
+			wantFields:  map[string]string{"model": "whisper-1"},
+			wantRemoved: []string{"prompt", "response_format"},
+		},
+		{
+			name:       "clamp",
+			fields:     map[string]string{"temperature": "1.5", "prompt": "p"},
+			operations: `[{"op":"clamp","path":"/temperature","max":1},{"op":"clamp","path":"/prompt","max":1}]`,
+			wantFields: map[string]string{"temperature": "1", "prompt": "p"},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			config, err := common.ParseChannelConfig(`{"body":` + c.operations + `}`)
+			require.NoError(t, err)
+			fields, removedFields, err := util.ApplyFormOverrides(c.fields, config)
+			require.NoError(t, err)
+			sort.Strings(removedFields)
+			assert.Equal(t, c.wantFields, fields)
+			assert.Equal(t, c.wantRemoved, removedFields)
+		})
+	}
+}
@@ -0,0 +1,67 @@
+package util
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// GetRetryAfter returns how long a rate limited upstream asked to wait, from
+// Retry-After or, failing that, from the x-ratelimit-reset-* headers of the
+// limits that were exhausted. It is zero if the headers do not say.
+func GetRetryAfter(header http.Header) time.Duration {
+	if value := header.Get("Retry-After-Ms"); value != "" {
+		milliseconds, err := strconv.ParseFloat(value, 64)
+		if err == nil && milliseconds > 0 {
+			return time.Duration(milliseconds * float64(time.Millisecond))
+		}
+	}
+	if value := header.Get("Retry-After"); value != "" {
+		if retryAfter := parseResetTime(value); retryAfter > 0 {
+			return retryAfter
+		}
+	}
+	var exhaustedReset, longestReset time.Duration
+	for name := range header {
+		lowerName := strings.ToLower(name)
+		if !strings.HasPrefix(lowerName, "x-ratelimit-reset") {
+			continue
+		}
+		reset := parseResetTime(header.Get(name))
+		if reset > longestReset {
+			longestReset = reset
+		}
+		// x-ratelimit-reset-tokens goes with x-ratelimit-remaining-tokens
+		limit := strings.TrimPrefix(lowerName, "x-ratelimit-reset")
+		if header.Get("x-ratelimit-remaining"+limit) == "0" && reset > exhaustedReset {
+			exhaustedReset = reset
+		}
+	}
+	if exhaustedReset > 0 {
+		return exhaustedReset
+	}
+	return longestReset
+}
+
+// parseResetTime reads a duration such as 6m0s, a number of seconds, a Unix
+// time or an HTTP date
+func parseResetTime(value string) time.Duration {
+	value = strings.TrimSpace(value)
+	if duration, err := time.ParseDuration(value); err == nil {
+		return duration
+	}
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		if seconds > 1e9 {
+			return time.Until(time.Unix(int64(seconds), 0))
+		}
+		return time.Duration(seconds * float64(time.Second))
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return time.Until(date)
+	}
+	if date, err := time.Parse(time.RFC3339, value); err == nil {
+		return time.Until(date)
+	}
+	return 0
+}
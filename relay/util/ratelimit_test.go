@@ -0,0 +1,94 @@
+package util
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseResetTime(t *testing.T) {
+	now := time.Now()
+	cases := []struct {
+		value string
+		want  time.Duration
+	}{
+		{"6m0s", 6 * time.Minute},
+		{"1.5s", 1500 * time.Millisecond},
+		{"20ms", 20 * time.Millisecond},
+		{" 30 ", 30 * time.Second},
+		{"0.5", 500 * time.Millisecond},
+		{strconv.FormatInt(now.Add(time.Minute).Unix(), 10), time.Minute},
+		{now.Add(2 * time.Minute).UTC().Format(http.TimeFormat), 2 * time.Minute},
+		{now.Add(3 * time.Minute).Format(time.RFC3339), 3 * time.Minute},
+		{"", 0},
+		{"soon", 0},
+	}
+	for _, c := range cases {
+		// times are rounded to the second by their formats
+		assert.InDelta(t, c.want, parseResetTime(c.value), float64(time.Second), c.value)
+	}
+}
+
+func TestGetRetryAfter(t *testing.T) {
+	cases := []struct {
+		name    string
+		headers map[string]string
+		want    time.Duration
+	}{
+		{
+			name: "no headers",
+			want: 0,
+		},
+		{
+			name:    "retry after",
+			headers: map[string]string{"Retry-After": "20"},
+			want:    20 * time.Second,
+		},
+		{
+			name:    "retry after in milliseconds first",
+			headers: map[string]string{"Retry-After-Ms": "1500", "Retry-After": "20"},
+			want:    1500 * time.Millisecond,
+		},
+		{
+			name:    "invalid retry after",
+			headers: map[string]string{"Retry-After-Ms": "-1", "Retry-After": "later", "X-Ratelimit-Reset-Requests": "2s"},
+			want:    2 * time.Second,
+		},
+		{
+			name: "reset of the exhausted limit",
+			headers: map[string]string{
+				"X-Ratelimit-Remaining-Requests": "0",
+				"X-Ratelimit-Reset-Requests":     "1s",
+				"X-Ratelimit-Remaining-Tokens":   "1000",
+				"X-Ratelimit-Reset-Tokens":       "6m0s",
+			},
+			want: time.Second,
+		},
+		{
+			name: "longest reset if no limit is exhausted",
+			headers: map[string]string{
+				"X-Ratelimit-Remaining-Requests": "10",
+				"X-Ratelimit-Reset-Requests":     "1s",
+				"X-Ratelimit-Reset-Tokens":       "6m0s",
+			},
+			want: 6 * time.Minute,
+		},
+		{
+			name:    "reset without a limit",
+			headers: map[string]string{"X-Ratelimit-Reset": "30"},
+			want:    30 * time.Second,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			header := make(http.Header)
+			for name, value := range c.headers {
+				header.Set(name, value)
+			}
+			assert.Equal(t, c.want, GetRetryAfter(header))
+		})
+	}
+}
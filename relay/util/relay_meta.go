@@ -0,0 +1,60 @@
+package util
+
+import (
+	"one-api/common"
+	"one-api/relay/constant"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RelayMeta carries everything an adaptor needs to know about the
+// current request and the channel it was distributed to.
+type RelayMeta struct {
+	Mode            int
+	ChannelType     int
+	ChannelId       int
+	ChannelKeyId    int // the key of a channel with several keys
+	TokenId         int
+	TokenName       string
+	UserId          int
+	Group           string
+	ModelMapping    string
+	BaseURL         string
+	APIVersion      string
+	Config          *common.ChannelConfig
+	APIKey          string
+	IsStream        bool
+	OriginModelName string
+	ActualModelName string
+	RequestURLPath  string
+	PromptTokens    int    // only for DoResponse
+	ResponseText    string // set by DoResponse of streams that assemble the text
+	ClientAborted   bool   // the client went away before the stream ended
+}
+
+func GetRelayMeta(c *gin.Context) *RelayMeta {
+	meta := RelayMeta{
+		Mode:           constant.Path2RelayMode(c.Request.URL.Path),
+		ChannelType:    c.GetInt("channel"),
+		ChannelId:      c.GetInt("channel_id"),
+		ChannelKeyId:   c.GetInt("channel_key_id"),
+		TokenId:        c.GetInt("token_id"),
+		TokenName:      c.GetString("token_name"),
+		UserId:         c.GetInt("id"),
+		Group:          c.GetString("group"),
+		ModelMapping:   c.GetString("model_mapping"),
+		BaseURL:        c.GetString("base_url"),
+		APIVersion:     GetAPIVersion(c),
+		Config:         GetChannelConfig(c),
+		APIKey:         strings.TrimPrefix(c.Request.Header.Get("Authorization"), "Bearer "),
+		RequestURLPath: c.Request.URL.String(),
+	}
+	if meta.ChannelType == common.ChannelTypeAzure {
+		meta.APIVersion = GetAzureAPIVersion(c, GetAzureEndpoint(meta.Mode))
+	}
+	if meta.BaseURL == "" {
+		meta.BaseURL = common.ChannelBaseURLs[meta.ChannelType]
+	}
+	return &meta
+}
@@ -0,0 +1,155 @@
+package util
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net/http"
+	"one-api/common"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Heartbeat ticks while a stream handler waits on upstream, the comments it
+// writes keep proxies in front of us from closing the connection as idle.
+type Heartbeat struct {
+	ticker   *time.Ticker
+	interval time.Duration
+}
+
+func NewHeartbeat() *Heartbeat {
+	if common.StreamHeartbeatInterval <= 0 {
+		return &Heartbeat{}
+	}
+	interval := time.Duration(common.StreamHeartbeatInterval) * time.Second
+	return &Heartbeat{
+		ticker:   time.NewTicker(interval),
+		interval: interval,
+	}
+}
+
+// C never fires when heartbeats are disabled
+func (h *Heartbeat) C() <-chan time.Time {
+	if h.ticker == nil {
+		return nil
+	}
+	return h.ticker.C
+}
+
+// Reset postpones the next heartbeat after an event was sent
+func (h *Heartbeat) Reset() {
+	if h.ticker != nil {
+		h.ticker.Reset(h.interval)
+	}
+}
+
+func (h *Heartbeat) Stop() {
+	if h.ticker != nil {
+		h.ticker.Stop()
+	}
+}
+
+func (h *Heartbeat) Write(c *gin.Context) {
+	_, _ = c.Writer.WriteString(": keep-alive\n\n")
+}
+
+// FirstTokenTimer bounds the wait for an upstream stream to start. Nothing has
+// reached the client by then, so a stream that does not start can still be
+// relayed by another channel.
+type FirstTokenTimer struct {
+	timer   *time.Timer
+	cancel  context.CancelFunc
+	stopped bool
+	expired bool
+}
+
+// StartFirstTokenTimer returns the context for the upstream request, which is
+// canceled once the first token timeout expires. The timer is to be released
+// once the stream is done.
+func StartFirstTokenTimer(ctx context.Context) (context.Context, *FirstTokenTimer) {
+	if common.StreamFirstTokenTimeout <= 0 {
+		return ctx, &FirstTokenTimer{}
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	timer := time.AfterFunc(time.Duration(common.StreamFirstTokenTimeout)*time.Second, cancel)
+	return ctx, &FirstTokenTimer{timer: timer, cancel: cancel}
+}
+
+func (t *FirstTokenTimer) Enabled() bool {
+	return t.timer != nil
+}
+
+// Stop reports whether the timeout expired before the timer was stopped
+func (t *FirstTokenTimer) Stop() bool {
+	if t.timer == nil {
+		return false
+	}
+	if !t.stopped {
+		t.stopped = true
+		t.expired = !t.timer.Stop()
+	}
+	return t.expired
+}
+
+// Release stops the timer and cancels the context of the upstream request, it
+// is called once the stream is done
+func (t *FirstTokenTimer) Release() {
+	t.Stop()
+	if t.cancel != nil {
+		t.cancel()
+	}
+}
+
+// WaitFirstByte blocks until the body of the response starts, read errors are
+// left to the stream handler.
+func WaitFirstByte(resp *http.Response) {
+	if resp.Body == nil {
+		return
+	}
+	reader := bufio.NewReader(resp.Body)
+	_, _ = reader.Peek(1)
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{reader, resp.Body}
+}
+
+// FirstByteClock measures the time to the first byte of the body of a
+// response, which is the time to the first token of a stream
+type FirstByteClock struct {
+	start   time.Time
+	elapsed int64
+}
+
+func StartFirstByteClock() *FirstByteClock {
+	return &FirstByteClock{start: time.Now()}
+}
+
+// Watch stops the clock once the body of the response is first read, the body
+// may be read by another goroutine
+func (clock *FirstByteClock) Watch(resp *http.Response) {
+	if resp.Body == nil {
+		return
+	}
+	resp.Body = &firstByteReader{ReadCloser: resp.Body, clock: clock}
+}
+
+// Elapsed is zero while nothing has been read
+func (clock *FirstByteClock) Elapsed() time.Duration {
+	return time.Duration(atomic.LoadInt64(&clock.elapsed))
+}
+
+type firstByteReader struct {
+	io.ReadCloser
+	clock *FirstByteClock
+}
+
+func (r *firstByteReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 && atomic.LoadInt64(&r.clock.elapsed) == 0 {
+		atomic.StoreInt64(&r.clock.elapsed, int64(time.Since(r.clock.start)))
+	}
+	return n, err
+}
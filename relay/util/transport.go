@@ -0,0 +1,165 @@
+package util
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"one-api/common"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+)
+
+type channelHTTPClient struct {
+	// settings is the serialized transport config the client was built with,
+	// the client is rebuilt once the config of the channel changes
+	settings  string
+	transport *http.Transport
+	client    *http.Client
+}
+
+var channelHTTPClients = make(map[int]*channelHTTPClient)
+var channelHTTPClientsLock sync.Mutex
+
+// unsavedChannelHTTPClient is the client of the last channel used before it was
+// saved, so that testing a form again reuses its connections rather than
+// leaving a transport behind on each test
+var unsavedChannelHTTPClient *channelHTTPClient
+
+// GetHTTPClient returns the client for the channel selected for the request
+func GetHTTPClient(c *gin.Context) (*http.Client, error) {
+	return GetChannelHTTPClient(c.GetInt("channel_id"), GetChannelConfig(c))
+}
+
+// GetChannelHTTPClient returns the client sending requests to the upstream of
+// the channel, the clients of channels with transport settings are cached by
+// channel id, a channel id of 0 stands for a channel that is not saved yet and
+// only the client of the last such channel is kept
+func GetChannelHTTPClient(channelId int, config *common.ChannelConfig) (*http.Client, error) {
+	if config == nil || config.Transport == nil {
+		return HTTPClient, nil
+	}
+	cached, err := getChannelHTTPClient(channelId, config.Transport)
+	if err != nil {
+		return nil, err
+	}
+	return cached.client, nil
+}
+
+// GetChannelImpatientHTTPClient returns a client with the transport of the
+// channel that gives up as soon as ImpatientHTTPClient does, for the requests
+// made to get access tokens
+func GetChannelImpatientHTTPClient(channelId int, config *common.ChannelConfig) (*http.Client, error) {
+	if config == nil || config.Transport == nil {
+		return ImpatientHTTPClient, nil
+	}
+	cached, err := getChannelHTTPClient(channelId, config.Transport)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{Transport: cached.client.Transport, Timeout: ImpatientHTTPClient.Timeout}, nil
+}
+
+// GetChannelTransport returns the transport of the channel, for the
+// connections made without an http.Client such as websockets. It is nil if
+// the channel has no transport settings.
+func GetChannelTransport(channelId int, config *common.ChannelConfig) (*http.Transport, error) {
+	if config == nil || config.Transport == nil {
+		return nil, nil
+	}
+	cached, err := getChannelHTTPClient(channelId, config.Transport)
+	if err != nil {
+		return nil, err
+	}
+	return cached.transport, nil
+}
+
+func getChannelHTTPClient(channelId int, config *common.TransportConfig) (*channelHTTPClient, error) {
+	settings, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+	channelHTTPClientsLock.Lock()
+	defer channelHTTPClientsLock.Unlock()
+	cached, ok := channelHTTPClients[channelId]
+	if channelId == 0 {
+		cached, ok = unsavedChannelHTTPClient, unsavedChannelHTTPClient != nil
+	}
+	if ok && cached.settings == string(settings) {
+		return cached, nil
+	}
+	transport, err := newChannelTransport(config)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		cached.transport.CloseIdleConnections()
+	}
+	cached = &channelHTTPClient{
+		settings:  string(settings),
+		transport: transport,
+		client:    &http.Client{Transport: otelhttp.NewTransport(transport)},
+	}
+	if channelId == 0 {
+		unsavedChannelHTTPClient = cached
+	} else {
+		channelHTTPClients[channelId] = cached
+	}
+	return cached, nil
+}
+
+// ResetChannelHTTPClient drops the cached client of the channel after it is
+// edited or deleted, requests in flight keep their connections
+func ResetChannelHTTPClient(channelId int) {
+	channelHTTPClientsLock.Lock()
+	defer channelHTTPClientsLock.Unlock()
+	if cached, ok := channelHTTPClients[channelId]; ok {
+		cached.transport.CloseIdleConnections()
+		delete(channelHTTPClients, channelId)
+	}
+}
+
+func newChannelTransport(config *common.TransportConfig) (*http.Transport, error) {
+	transport := defaultTransport.Clone()
+	if config.Proxy != "" {
+		proxyURL, err := url.Parse(config.Proxy)
+		if err != nil {
+			return nil, err
+		}
+		// socks5 proxies are supported by http.Transport as well
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+	if config.DialTimeout > 0 {
+		transport.DialContext = defaultTransportDialContext(&net.Dialer{
+			Timeout:   time.Duration(config.DialTimeout) * time.Second,
+			KeepAlive: 30 * time.Second,
+		})
+	}
+	if config.ResponseHeaderTimeout > 0 {
+		transport.ResponseHeaderTimeout = time.Duration(config.ResponseHeaderTimeout) * time.Second
+	}
+	if config.InsecureSkipVerify || config.TLSServerName != "" || config.CACert != "" {
+		tlsConfig := &tls.Config{
+			InsecureSkipVerify: config.InsecureSkipVerify,
+			ServerName:         config.TLSServerName,
+		}
+		if config.CACert != "" {
+			rootCAs, err := x509.SystemCertPool()
+			if err != nil {
+				rootCAs = x509.NewCertPool()
+			}
+			if !rootCAs.AppendCertsFromPEM([]byte(config.CACert)) {
+				return nil, errors.New("ca_cert contains no valid PEM certificate")
+			}
+			tlsConfig.RootCAs = rootCAs
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+	return transport, nil
+}
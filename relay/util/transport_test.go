@@ -0,0 +1,49 @@
+package util
+
+import (
+	"net/http"
+	"testing"
+
+	"one-api/common"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetChannelHTTPClientCache(t *testing.T) {
+	t.Cleanup(func() {
+		channelHTTPClients = make(map[int]*channelHTTPClient)
+		unsavedChannelHTTPClient = nil
+	})
+	config := func(dialTimeout int) *common.ChannelConfig {
+		return &common.ChannelConfig{Transport: &common.TransportConfig{DialTimeout: dialTimeout}}
+	}
+	cases := []struct {
+		name      string
+		channelId int
+		config    *common.ChannelConfig
+		// the step whose client is reused, -1 for a new client
+		reuses int
+	}{
+		{name: "unsaved", channelId: 0, config: config(5), reuses: -1},
+		{name: "unsaved with the same settings", channelId: 0, config: config(5), reuses: 0},
+		{name: "saved with the same settings", channelId: 1, config: config(5), reuses: -1},
+		{name: "saved again", channelId: 1, config: config(5), reuses: 2},
+		{name: "unsaved with other settings", channelId: 0, config: config(10), reuses: -1},
+		{name: "unsaved with the first settings", channelId: 0, config: config(5), reuses: -1},
+		{name: "saved after an unsaved one", channelId: 1, config: config(5), reuses: 2},
+	}
+	var transports []*http.Transport
+	for _, c := range cases {
+		transport, err := GetChannelTransport(c.channelId, c.config)
+		require.NoError(t, err, c.name)
+		if c.reuses >= 0 {
+			assert.Same(t, transports[c.reuses], transport, c.name)
+		} else {
+			for j, previous := range transports {
+				assert.NotSame(t, previous, transport, "%s: step %d", c.name, j)
+			}
+		}
+		transports = append(transports, transport)
+	}
+}
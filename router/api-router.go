@@ -72,15 +72,23 @@ func SetApiRouter(router *gin.Engine) {
 			channelRoute.GET("/", controller.GetAllChannels)
 			channelRoute.GET("/search", controller.SearchChannels)
 			channelRoute.GET("/models", controller.ListModels)
+			channelRoute.GET("/distribution", controller.GetChannelDistribution)
+			channelRoute.GET("/health", controller.GetChannelHealth)
+			channelRoute.GET("/circuit", controller.GetChannelCircuits)
+			channelRoute.GET("/cooldown", controller.GetChannelCooldowns)
 			channelRoute.GET("/:id", controller.GetChannel)
+			channelRoute.GET("/:id/keys", controller.GetChannelKeys)
+			channelRoute.PUT("/:id/keys", controller.UpdateChannelKeyStatus)
 			channelRoute.GET("/test", controller.TestAllChannels)
 			channelRoute.GET("/test/:id", controller.TestChannel)
 			channelRoute.GET("/update_balance", controller.UpdateAllChannelsBalance)
 			channelRoute.GET("/update_balance/:id", controller.UpdateChannelBalance)
 			channelRoute.POST("/", controller.AddChannel)
+			channelRoute.POST("/fetch_models", controller.FetchChannelModels)
 			channelRoute.PUT("/", controller.UpdateChannel)
 			channelRoute.DELETE("/disabled", controller.DeleteDisabledChannel)
 			channelRoute.DELETE("/:id", controller.DeleteChannel)
+			channelRoute.DELETE("/:id/circuit", controller.ResetChannelCircuits)
 		}
 		tokenRoute := apiRouter.Group("/token")
 		tokenRoute.Use(middleware.UserAuth())
@@ -110,6 +118,12 @@ func SetApiRouter(router *gin.Engine) {
 		logRoute.GET("/search", middleware.AdminAuth(), controller.SearchAllLogs)
 		logRoute.GET("/self", middleware.UserAuth(), controller.GetUserLogs)
 		logRoute.GET("/self/search", middleware.UserAuth(), controller.SearchUserLogs)
+		transcriptRoute := apiRouter.Group("/transcript")
+		transcriptRoute.Use(middleware.AdminAuth())
+		{
+			transcriptRoute.GET("/", controller.GetAllTranscripts)
+			transcriptRoute.GET("/:id", controller.GetTranscript)
+		}
 		groupRoute := apiRouter.Group("/group")
 		groupRoute.Use(middleware.AdminAuth())
 		{
@@ -3,6 +3,7 @@ package router
 import (
 	"one-api/controller"
 	"one-api/middleware"
+	"one-api/model"
 
 	"github.com/gin-gonic/gin"
 )
@@ -16,57 +17,90 @@ func SetRelayRouter(router *gin.Engine) {
 		modelsRouter.GET("", controller.ListModels)
 		modelsRouter.GET("/:model", controller.RetrieveModel)
 	}
+	filesRouter := router.Group("/v1/files")
+	filesRouter.Use(middleware.RelayPanicRecover(), middleware.TokenAuth())
+	{
+		filesRouter.GET("", controller.ListFiles)
+		filesRouter.POST("", middleware.Distribute(), controller.Relay)
+		filesRouter.GET("/:id", middleware.FileChannel(), middleware.Distribute(), controller.Relay)
+		filesRouter.DELETE("/:id", middleware.FileChannel(), middleware.Distribute(), controller.Relay)
+		filesRouter.GET("/:id/content", middleware.FileChannel(), middleware.Distribute(), controller.Relay)
+	}
+	assistantsRouter := router.Group("/v1/assistants")
+	assistantsRouter.Use(middleware.RelayPanicRecover(), middleware.TokenAuth())
+	{
+		assistantsRouter.GET("", controller.ListAssistants)
+		assistantsRouter.POST("", middleware.Distribute(), controller.Relay)
+		assistantRouter := assistantsRouter.Group("/:id")
+		assistantRouter.Use(middleware.ObjectChannel(model.ObjectTypeAssistant), middleware.Distribute())
+		{
+			assistantRouter.GET("", controller.Relay)
+			assistantRouter.POST("", controller.Relay)
+			assistantRouter.DELETE("", controller.Relay)
+			assistantRouter.POST("/files", controller.Relay)
+			assistantRouter.GET("/files/:fileId", controller.Relay)
+			assistantRouter.DELETE("/files/:fileId", controller.Relay)
+			assistantRouter.GET("/files", controller.Relay)
+		}
+	}
+	threadsRouter := router.Group("/v1/threads")
+	threadsRouter.Use(middleware.RelayPanicRecover(), middleware.TokenAuth(), middleware.ObjectChannel(model.ObjectTypeThread), middleware.Distribute())
+	{
+		threadsRouter.POST("", controller.Relay)
+		threadsRouter.POST("/runs", controller.Relay)
+		threadsRouter.GET("/:id", controller.Relay)
+		threadsRouter.POST("/:id", controller.Relay)
+		threadsRouter.DELETE("/:id", controller.Relay)
+		threadsRouter.POST("/:id/messages", controller.Relay)
+		threadsRouter.GET("/:id/messages", controller.Relay)
+		threadsRouter.GET("/:id/messages/:messageId", controller.Relay)
+		threadsRouter.POST("/:id/messages/:messageId", controller.Relay)
+		threadsRouter.DELETE("/:id/messages/:messageId", controller.Relay)
+		threadsRouter.GET("/:id/messages/:messageId/files/:filesId", controller.Relay)
+		threadsRouter.GET("/:id/messages/:messageId/files", controller.Relay)
+		threadsRouter.POST("/:id/runs", controller.Relay)
+		threadsRouter.GET("/:id/runs/:runsId", controller.Relay)
+		threadsRouter.POST("/:id/runs/:runsId", controller.Relay)
+		threadsRouter.GET("/:id/runs", controller.Relay)
+		threadsRouter.POST("/:id/runs/:runsId/submit_tool_outputs", controller.Relay)
+		threadsRouter.POST("/:id/runs/:runsId/cancel", controller.Relay)
+		threadsRouter.GET("/:id/runs/:runsId/steps/:stepId", controller.Relay)
+		threadsRouter.GET("/:id/runs/:runsId/steps", controller.Relay)
+	}
+	batchesRouter := router.Group("/v1/batches")
+	batchesRouter.Use(middleware.RelayPanicRecover(), middleware.TokenAuth())
+	{
+		batchesRouter.GET("", controller.ListBatches)
+		batchesRouter.POST("", middleware.BatchChannel(), middleware.Distribute(), controller.Relay)
+		batchesRouter.GET("/:id", middleware.BatchChannel(), middleware.Distribute(), controller.Relay)
+		batchesRouter.POST("/:id/cancel", middleware.BatchChannel(), middleware.Distribute(), controller.Relay)
+	}
+	fineTuningRouter := router.Group("/v1/fine_tuning/jobs")
+	fineTuningRouter.Use(middleware.RelayPanicRecover(), middleware.TokenAuth())
+	{
+		fineTuningRouter.GET("", controller.ListFineTuningJobs)
+		fineTuningRouter.POST("", middleware.FineTuningJobChannel(), middleware.Distribute(), controller.Relay)
+		fineTuningRouter.GET("/:id", middleware.FineTuningJobChannel(), middleware.Distribute(), controller.Relay)
+		fineTuningRouter.POST("/:id/cancel", middleware.FineTuningJobChannel(), middleware.Distribute(), controller.Relay)
+		fineTuningRouter.GET("/:id/events", middleware.FineTuningJobChannel(), middleware.Distribute(), controller.Relay)
+		fineTuningRouter.GET("/:id/checkpoints", middleware.FineTuningJobChannel(), middleware.Distribute(), controller.Relay)
+	}
 	relayV1Router := router.Group("/v1")
 	relayV1Router.Use(middleware.RelayPanicRecover(), middleware.TokenAuth(), middleware.Distribute())
 	{
 		relayV1Router.POST("/completions", controller.Relay)
 		relayV1Router.POST("/chat/completions", controller.Relay)
+		relayV1Router.POST("/messages", controller.Relay)
 		relayV1Router.POST("/edits", controller.Relay)
 		relayV1Router.POST("/images/generations", controller.Relay)
-		relayV1Router.POST("/images/edits", controller.RelayNotImplemented)
-		relayV1Router.POST("/images/variations", controller.RelayNotImplemented)
+		relayV1Router.POST("/images/edits", controller.Relay)
+		relayV1Router.POST("/images/variations", controller.Relay)
 		relayV1Router.POST("/embeddings", controller.Relay)
 		relayV1Router.POST("/engines/:model/embeddings", controller.Relay)
 		relayV1Router.POST("/audio/transcriptions", controller.Relay)
 		relayV1Router.POST("/audio/translations", controller.Relay)
 		relayV1Router.POST("/audio/speech", controller.Relay)
-		relayV1Router.GET("/files", controller.RelayNotImplemented)
-		relayV1Router.POST("/files", controller.RelayNotImplemented)
-		relayV1Router.DELETE("/files/:id", controller.RelayNotImplemented)
-		relayV1Router.GET("/files/:id", controller.RelayNotImplemented)
-		relayV1Router.GET("/files/:id/content", controller.RelayNotImplemented)
-		relayV1Router.POST("/fine_tuning/jobs", controller.RelayNotImplemented)
-		relayV1Router.GET("/fine_tuning/jobs", controller.RelayNotImplemented)
-		relayV1Router.GET("/fine_tuning/jobs/:id", controller.RelayNotImplemented)
-		relayV1Router.POST("/fine_tuning/jobs/:id/cancel", controller.RelayNotImplemented)
-		relayV1Router.GET("/fine_tuning/jobs/:id/events", controller.RelayNotImplemented)
 		relayV1Router.DELETE("/models/:model", controller.RelayNotImplemented)
 		relayV1Router.POST("/moderations", controller.Relay)
-		relayV1Router.POST("/assistants", controller.RelayNotImplemented)
-		relayV1Router.GET("/assistants/:id", controller.RelayNotImplemented)
-		relayV1Router.POST("/assistants/:id", controller.RelayNotImplemented)
-		relayV1Router.DELETE("/assistants/:id", controller.RelayNotImplemented)
-		relayV1Router.GET("/assistants", controller.RelayNotImplemented)
-		relayV1Router.POST("/assistants/:id/files", controller.RelayNotImplemented)
-		relayV1Router.GET("/assistants/:id/files/:fileId", controller.RelayNotImplemented)
-		relayV1Router.DELETE("/assistants/:id/files/:fileId", controller.RelayNotImplemented)
-		relayV1Router.GET("/assistants/:id/files", controller.RelayNotImplemented)
-		relayV1Router.POST("/threads", controller.RelayNotImplemented)
-		relayV1Router.GET("/threads/:id", controller.RelayNotImplemented)
-		relayV1Router.POST("/threads/:id", controller.RelayNotImplemented)
-		relayV1Router.DELETE("/threads/:id", controller.RelayNotImplemented)
-		relayV1Router.POST("/threads/:id/messages", controller.RelayNotImplemented)
-		relayV1Router.GET("/threads/:id/messages/:messageId", controller.RelayNotImplemented)
-		relayV1Router.POST("/threads/:id/messages/:messageId", controller.RelayNotImplemented)
-		relayV1Router.GET("/threads/:id/messages/:messageId/files/:filesId", controller.RelayNotImplemented)
-		relayV1Router.GET("/threads/:id/messages/:messageId/files", controller.RelayNotImplemented)
-		relayV1Router.POST("/threads/:id/runs", controller.RelayNotImplemented)
-		relayV1Router.GET("/threads/:id/runs/:runsId", controller.RelayNotImplemented)
-		relayV1Router.POST("/threads/:id/runs/:runsId", controller.RelayNotImplemented)
-		relayV1Router.GET("/threads/:id/runs", controller.RelayNotImplemented)
-		relayV1Router.POST("/threads/:id/runs/:runsId/submit_tool_outputs", controller.RelayNotImplemented)
-		relayV1Router.POST("/threads/:id/runs/:runsId/cancel", controller.RelayNotImplemented)
-		relayV1Router.GET("/threads/:id/runs/:runsId/steps/:stepId", controller.RelayNotImplemented)
-		relayV1Router.GET("/threads/:id/runs/:runsId/steps", controller.RelayNotImplemented)
 	}
 }
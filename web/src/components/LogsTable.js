@@ -23,7 +23,8 @@ const LOG_OPTIONS = [
   { key: '1', text: '充值', value: 1 },
   { key: '2', text: '消费', value: 2 },
   { key: '3', text: '管理', value: 3 },
-  { key: '4', text: '系统', value: 4 }
+  { key: '4', text: '系统', value: 4 },
+  { key: '5', text: '缓存命中', value: 5 }
 ];
 
 function renderType(type) {
@@ -36,6 +37,8 @@ function renderType(type) {
       return <Label basic color='orange'> 管理 </Label>;
     case 4:
       return <Label basic color='purple'> 系统 </Label>;
+    case 5:
+      return <Label basic color='teal'> 缓存命中 </Label>;
     default:
       return <Label basic color='black'> 未知 </Label>;
   }
@@ -12,6 +12,9 @@ const OperationSetting = () => {
     PreConsumedQuota: 0,
     ModelRatio: '',
     GroupRatio: '',
+    BatchRatio: '',
+    FineTunedRatio: '',
+    TrainingRatio: '',
     TopUpLink: '',
     ChatLink: '',
     QuotaPerUnit: 0,
@@ -22,7 +25,20 @@ const OperationSetting = () => {
     DisplayInCurrencyEnabled: '',
     DisplayTokenStatEnabled: '',
     ApproximateTokenEnabled: '',
-    RetryTimes: 0
+    RetryTimes: 0,
+    StreamHeartbeatInterval: 0,
+    StreamFirstTokenTimeout: 0,
+    ResponseCacheEnabled: '',
+    ResponseCacheTTL: 0,
+    ResponseCacheHitRatio: 0,
+    TranscriptMaxSize: 0,
+    TranscriptRetentionDays: 0,
+    GroupRoutingStrategy: '',
+    ChannelHealthRedisEnabled: '',
+    CircuitBreakerThreshold: 0,
+    CircuitBreakerCooldown: 0,
+    CircuitBreakerProbeRequests: 0,
+    ChannelRateLimitCooldown: 0
   });
   const [originInputs, setOriginInputs] = useState({});
   let [loading, setLoading] = useState(false);
@@ -34,7 +50,7 @@ const OperationSetting = () => {
     if (success) {
       let newInputs = {};
       data.forEach((item) => {
-        if (item.key === 'ModelRatio' || item.key === 'GroupRatio') {
+        if (item.key === 'ModelRatio' || item.key === 'GroupRatio' || item.key === 'BatchRatio' || item.key === 'FineTunedRatio' || item.key === 'TrainingRatio' || item.key === 'GroupRoutingStrategy') {
           item.value = JSON.stringify(JSON.parse(item.value), null, 2);
         }
         newInputs[item.key] = item.value;
@@ -101,6 +117,27 @@ const OperationSetting = () => {
           }
           await updateOption('GroupRatio', inputs.GroupRatio);
         }
+        if (originInputs['BatchRatio'] !== inputs.BatchRatio) {
+          if (!verifyJSON(inputs.BatchRatio)) {
+            showError('批处理倍率不是合法的 JSON 字符串');
+            return;
+          }
+          await updateOption('BatchRatio', inputs.BatchRatio);
+        }
+        if (originInputs['FineTunedRatio'] !== inputs.FineTunedRatio) {
+          if (!verifyJSON(inputs.FineTunedRatio)) {
+            showError('微调模型倍率不是合法的 JSON 字符串');
+            return;
+          }
+          await updateOption('FineTunedRatio', inputs.FineTunedRatio);
+        }
+        if (originInputs['TrainingRatio'] !== inputs.TrainingRatio) {
+          if (!verifyJSON(inputs.TrainingRatio)) {
+            showError('训练倍率不是合法的 JSON 字符串');
+            return;
+          }
+          await updateOption('TrainingRatio', inputs.TrainingRatio);
+        }
         break;
       case 'quota':
         if (originInputs['QuotaForNewUser'] !== inputs.QuotaForNewUser) {
@@ -129,6 +166,49 @@ const OperationSetting = () => {
         if (originInputs['RetryTimes'] !== inputs.RetryTimes) {
           await updateOption('RetryTimes', inputs.RetryTimes);
         }
+        if (originInputs['StreamHeartbeatInterval'] !== inputs.StreamHeartbeatInterval) {
+          await updateOption('StreamHeartbeatInterval', inputs.StreamHeartbeatInterval);
+        }
+        if (originInputs['StreamFirstTokenTimeout'] !== inputs.StreamFirstTokenTimeout) {
+          await updateOption('StreamFirstTokenTimeout', inputs.StreamFirstTokenTimeout);
+        }
+        break;
+      case 'log':
+        if (originInputs['TranscriptMaxSize'] !== inputs.TranscriptMaxSize) {
+          await updateOption('TranscriptMaxSize', inputs.TranscriptMaxSize);
+        }
+        if (originInputs['TranscriptRetentionDays'] !== inputs.TranscriptRetentionDays) {
+          await updateOption('TranscriptRetentionDays', inputs.TranscriptRetentionDays);
+        }
+        break;
+      case 'routing':
+        if (originInputs['GroupRoutingStrategy'] !== inputs.GroupRoutingStrategy) {
+          if (!verifyJSON(inputs.GroupRoutingStrategy)) {
+            showError('分组路由策略不是合法的 JSON 字符串');
+            return;
+          }
+          await updateOption('GroupRoutingStrategy', inputs.GroupRoutingStrategy);
+        }
+        if (originInputs['CircuitBreakerThreshold'] !== inputs.CircuitBreakerThreshold) {
+          await updateOption('CircuitBreakerThreshold', inputs.CircuitBreakerThreshold);
+        }
+        if (originInputs['CircuitBreakerCooldown'] !== inputs.CircuitBreakerCooldown) {
+          await updateOption('CircuitBreakerCooldown', inputs.CircuitBreakerCooldown);
+        }
+        if (originInputs['CircuitBreakerProbeRequests'] !== inputs.CircuitBreakerProbeRequests) {
+          await updateOption('CircuitBreakerProbeRequests', inputs.CircuitBreakerProbeRequests);
+        }
+        if (originInputs['ChannelRateLimitCooldown'] !== inputs.ChannelRateLimitCooldown) {
+          await updateOption('ChannelRateLimitCooldown', inputs.ChannelRateLimitCooldown);
+        }
+        break;
+      case 'cache':
+        if (originInputs['ResponseCacheTTL'] !== inputs.ResponseCacheTTL) {
+          await updateOption('ResponseCacheTTL', inputs.ResponseCacheTTL);
+        }
+        if (originInputs['ResponseCacheHitRatio'] !== inputs.ResponseCacheHitRatio) {
+          await updateOption('ResponseCacheHitRatio', inputs.ResponseCacheHitRatio);
+        }
         break;
     }
   };
@@ -192,6 +272,30 @@ const OperationSetting = () => {
               placeholder='失败重试次数'
             />
           </Form.Group>
+          <Form.Group widths={4}>
+            <Form.Input
+              label='流式心跳间隔（秒）'
+              name='StreamHeartbeatInterval'
+              type={'number'}
+              step='1'
+              min='0'
+              onChange={handleInputChange}
+              autoComplete='new-password'
+              value={inputs.StreamHeartbeatInterval}
+              placeholder='上游无输出时发送 keep-alive 注释的间隔，为 0 时不发送'
+            />
+            <Form.Input
+              label='首字超时（秒）'
+              name='StreamFirstTokenTimeout'
+              type={'number'}
+              step='1'
+              min='0'
+              onChange={handleInputChange}
+              autoComplete='new-password'
+              value={inputs.StreamFirstTokenTimeout}
+              placeholder='流式响应超时未开始时重试其他渠道，为 0 时不限制'
+            />
+          </Form.Group>
           <Form.Group inline>
             <Form.Checkbox
               checked={inputs.DisplayInCurrencyEnabled === 'true'}
@@ -237,6 +341,31 @@ const OperationSetting = () => {
           <Form.Button onClick={() => {
             deleteHistoryLogs().then();
           }}>清理历史日志</Form.Button>
+          <Form.Group widths={4}>
+            <Form.Input
+              label='请求记录大小上限'
+              name='TranscriptMaxSize'
+              onChange={handleInputChange}
+              autoComplete='new-password'
+              value={inputs.TranscriptMaxSize}
+              type='number'
+              min='0'
+              placeholder='单位字节，令牌开启记录请求与响应内容后，请求与响应各自超出的部分将被截断'
+            />
+            <Form.Input
+              label='请求记录保留天数'
+              name='TranscriptRetentionDays'
+              onChange={handleInputChange}
+              autoComplete='new-password'
+              value={inputs.TranscriptRetentionDays}
+              type='number'
+              min='0'
+              placeholder='为 0 时不删除'
+            />
+          </Form.Group>
+          <Form.Button onClick={() => {
+            submitConfig('log').then();
+          }}>保存请求记录设置</Form.Button>
           <Divider />
           <Header as='h3'>
             监控设置
@@ -281,6 +410,114 @@ const OperationSetting = () => {
             submitConfig('monitor').then();
           }}>保存监控设置</Form.Button>
           <Divider />
+          <Header as='h3'>
+            路由设置
+          </Header>
+          <Form.Group inline>
+            <Form.Checkbox
+              checked={inputs.ChannelHealthRedisEnabled === 'true'}
+              label='通过 Redis 在各节点间共享渠道健康度（需启用 Redis）'
+              name='ChannelHealthRedisEnabled'
+              onChange={handleInputChange}
+            />
+          </Form.Group>
+          <Form.Group widths='equal'>
+            <Form.TextArea
+              label='分组路由策略'
+              name='GroupRoutingStrategy'
+              onChange={handleInputChange}
+              style={{ minHeight: 150, fontFamily: 'JetBrains Mono, Consolas' }}
+              autoComplete='new-password'
+              value={inputs.GroupRoutingStrategy}
+              placeholder='为一个 JSON 文本，键为分组名称，值为 priority（按优先级与权重选择渠道，默认）、health（在所有渠道中按权重与延迟、错误率计算的健康度选择渠道）或 sticky（按优先级选择渠道，同一会话固定使用同一渠道以提高上游提示词缓存命中率，会话依次由请求头 X-Session-Id、请求的 user 字段或令牌确定）'
+            />
+          </Form.Group>
+          <Form.Group widths={3}>
+            <Form.Input
+              label='熔断阈值'
+              name='CircuitBreakerThreshold'
+              onChange={handleInputChange}
+              autoComplete='new-password'
+              value={inputs.CircuitBreakerThreshold}
+              type='number'
+              min='0'
+              placeholder='渠道或渠道的某个模型连续失败此次数后熔断，熔断期间不再选择，为 0 时不熔断'
+            />
+            <Form.Input
+              label='熔断时长'
+              name='CircuitBreakerCooldown'
+              onChange={handleInputChange}
+              autoComplete='new-password'
+              value={inputs.CircuitBreakerCooldown}
+              type='number'
+              min='1'
+              placeholder='单位秒，熔断结束后进入半开状态，放行少量探测请求，成功则恢复'
+            />
+            <Form.Input
+              label='半开探测请求数'
+              name='CircuitBreakerProbeRequests'
+              onChange={handleInputChange}
+              autoComplete='new-password'
+              value={inputs.CircuitBreakerProbeRequests}
+              type='number'
+              min='1'
+              placeholder='半开状态下同时放行的请求数'
+            />
+          </Form.Group>
+          <Form.Group widths={3}>
+            <Form.Input
+              label='限流冷却时长'
+              name='ChannelRateLimitCooldown'
+              onChange={handleInputChange}
+              autoComplete='new-password'
+              value={inputs.ChannelRateLimitCooldown}
+              type='number'
+              min='1'
+              placeholder='单位秒，上游返回 429 时渠道或密钥暂停使用至限流重置，上游未给出重置时间时使用此时长'
+            />
+          </Form.Group>
+          <Form.Button onClick={() => {
+            submitConfig('routing').then();
+          }}>保存路由设置</Form.Button>
+          <Divider />
+          <Header as='h3'>
+            缓存设置
+          </Header>
+          <Form.Group inline>
+            <Form.Checkbox
+              checked={inputs.ResponseCacheEnabled === 'true'}
+              label='启用响应缓存，相同的 Embedding 请求及 temperature 为 0 的对话请求将直接返回缓存的响应，令牌需单独开启'
+              name='ResponseCacheEnabled'
+              onChange={handleInputChange}
+            />
+          </Form.Group>
+          <Form.Group widths={3}>
+            <Form.Input
+              label='缓存有效期'
+              name='ResponseCacheTTL'
+              onChange={handleInputChange}
+              autoComplete='new-password'
+              value={inputs.ResponseCacheTTL}
+              type='number'
+              min='1'
+              placeholder='单位秒'
+            />
+            <Form.Input
+              label='缓存命中倍率'
+              name='ResponseCacheHitRatio'
+              onChange={handleInputChange}
+              autoComplete='new-password'
+              value={inputs.ResponseCacheHitRatio}
+              type='number'
+              step='0.01'
+              min='0'
+              placeholder='缓存命中时按原请求额度的此倍数计费，为 0 时不计费'
+            />
+          </Form.Group>
+          <Form.Button onClick={() => {
+            submitConfig('cache').then();
+          }}>保存缓存设置</Form.Button>
+          <Divider />
           <Header as='h3'>
             额度设置
           </Header>
@@ -355,6 +592,39 @@ const OperationSetting = () => {
               placeholder='为一个 JSON 文本，键为分组名称，值为倍率'
             />
           </Form.Group>
+          <Form.Group widths='equal'>
+            <Form.TextArea
+              label='批处理倍率'
+              name='BatchRatio'
+              onChange={handleInputChange}
+              style={{ minHeight: 250, fontFamily: 'JetBrains Mono, Consolas' }}
+              autoComplete='new-password'
+              value={inputs.BatchRatio}
+              placeholder='为一个 JSON 文本，键为模型名称，值为批处理请求在模型倍率之上的折扣，未设置的模型为 0.5'
+            />
+          </Form.Group>
+          <Form.Group widths='equal'>
+            <Form.TextArea
+              label='微调模型倍率'
+              name='FineTunedRatio'
+              onChange={handleInputChange}
+              style={{ minHeight: 250, fontFamily: 'JetBrains Mono, Consolas' }}
+              autoComplete='new-password'
+              value={inputs.FineTunedRatio}
+              placeholder='为一个 JSON 文本，键为基础模型名称，值为其微调模型相对基础模型倍率的倍数，未设置的模型为 1'
+            />
+          </Form.Group>
+          <Form.Group widths='equal'>
+            <Form.TextArea
+              label='训练倍率'
+              name='TrainingRatio'
+              onChange={handleInputChange}
+              style={{ minHeight: 250, fontFamily: 'JetBrains Mono, Consolas' }}
+              autoComplete='new-password'
+              value={inputs.TrainingRatio}
+              placeholder='为一个 JSON 文本，键为基础模型名称，值为微调训练每个 token 的倍率，未设置的模型按名称前缀匹配'
+            />
+          </Form.Group>
           <Form.Button onClick={() => {
             submitConfig('ratio').then();
           }}>保存倍率设置</Form.Button>
@@ -13,10 +13,12 @@ const EditToken = () => {
     name: '',
     remain_quota: isEdit ? 0 : 500000,
     expired_time: -1,
-    unlimited_quota: false
+    unlimited_quota: false,
+    response_cache: false,
+    transcript: false
   };
   const [inputs, setInputs] = useState(originInputs);
-  const { name, remain_quota, expired_time, unlimited_quota } = inputs;
+  const { name, remain_quota, expired_time, unlimited_quota, response_cache, transcript } = inputs;
   const navigate = useNavigate();
   const handleInputChange = (e, { name, value }) => {
     setInputs((inputs) => ({ ...inputs, [name]: value }));
@@ -137,6 +139,26 @@ const EditToken = () => {
               setExpiredTime(0, 0, 0, 1);
             }}>一分钟后过期</Button>
           </div>
+          <Form.Field>
+            <Form.Checkbox
+              label='使用响应缓存，相同的 Embedding 请求及 temperature 为 0 的对话请求将直接返回缓存的响应（需管理员启用响应缓存）'
+              name='response_cache'
+              checked={response_cache}
+              onChange={() => {
+                setInputs({ ...inputs, response_cache: !response_cache });
+              }}
+            />
+          </Form.Field>
+          <Form.Field>
+            <Form.Checkbox
+              label='记录请求与响应内容，便于排查问题，记录内容仅管理员可见，并在保留期限后删除'
+              name='transcript'
+              checked={transcript}
+              onChange={() => {
+                setInputs({ ...inputs, transcript: !transcript });
+              }}
+            />
+          </Form.Field>
           <Message>注意，令牌的额度仅用于限制令牌本身的最大额度使用量，实际的使用受到账户的剩余额度限制。</Message>
           <Form.Field>
             <Form.Input